@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level '%v', expected one of %v", s, strings.Join(logLevelNames, ", "))
+}
+
+// pollingRoutes are asked for over and over by idle clients, so are only
+// logged at debug level unless they fail.
+var pollingRoutes = map[string]bool{
+	"/server-info":                 true,
+	"/content-codes":               true,
+	"/update":                      true,
+	"/ctrl-int/1/playstatusupdate": true,
+}
+
+// accessLog is where requests are logged, set up from the configuration at
+// startup.
+var accessLog = &AccessLog{w: os.Stderr, format: "logfmt", level: levelInfo}
+
+// AccessLog writes a line per request in logfmt or JSON.
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  logLevel
+}
+
+// accessEntry is one line of the access log. Handlers can fill in item
+// through noteItem.
+type accessEntry struct {
+	Time       string  `json:"time"`
+	Level      string  `json:"level"`
+	Method     string  `json:"method"`
+	URI        string  `json:"uri"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	ClientIP   string  `json:"client_ip"`
+	SessionID  string  `json:"session_id,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	DAAPVer    string  `json:"daap_version,omitempty"`
+	ViewerOnly string  `json:"viewer_only,omitempty"`
+	Item       string  `json:"item,omitempty"`
+}
+
+type accessEntryKey struct{}
+
+// noteItem adds the song being streamed to a request's access log entry and
+// its session.
+func noteItem(r *http.Request, song Song) {
+	item := itemName(song)
+	if entry, ok := r.Context().Value(accessEntryKey{}).(*accessEntry); ok {
+		entry.Item = item
+	}
+	if c, ok := r.Context().Value(sessionKey{}).(sessionContext); ok {
+		c.sessions.streaming(c.session, item)
+	}
+}
+
+// doneItem clears the song a request's session is streaming, unless the
+// client has started streaming another one since.
+func doneItem(r *http.Request, song Song) {
+	if c, ok := r.Context().Value(sessionKey{}).(sessionContext); ok {
+		c.sessions.doneStreaming(c.session, itemName(song))
+	}
+}
+
+func itemName(song Song) string {
+	return song.Artist + " - " + song.Album + " - " + song.Title
+}
+
+// wrap logs each request once it has been handled.
+func (l *AccessLog) wrap(inner http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry))
+		rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		inner(rw, r)
+
+		level := levelInfo
+		switch {
+		case rw.status >= 500:
+			level = levelError
+		case rw.status >= 400:
+			level = levelWarn
+		case pollingRoutes[r.URL.Path]:
+			level = levelDebug
+		}
+		if level < l.level {
+			return
+		}
+
+		entry.Time = start.UTC().Format(time.RFC3339Nano)
+		entry.Level = level.String()
+		entry.Method = r.Method
+		entry.URI = r.RequestURI
+		entry.Status = rw.status
+		entry.Bytes = rw.written
+		entry.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+		entry.ClientIP = clientIP(r)
+		entry.SessionID = r.URL.Query().Get("session-id")
+		entry.UserAgent = r.UserAgent()
+		entry.DAAPVer = r.Header.Get("Client-DAAP-Version")
+		entry.ViewerOnly = r.Header.Get("Viewer-Only-Client")
+		l.write(entry)
+	})
+}
+
+func (l *AccessLog) write(entry *accessEntry) {
+	var line []byte
+	if l.format == "json" {
+		line, _ = json.Marshal(entry)
+	} else {
+		line = logfmt(entry)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// logfmt writes an entry as key=value pairs, leaving out empty optional
+// values as the JSON does.
+func logfmt(entry *accessEntry) []byte {
+	pairs := []struct {
+		key, value string
+		always     bool
+	}{
+		{"time", entry.Time, true},
+		{"level", entry.Level, true},
+		{"method", entry.Method, true},
+		{"uri", entry.URI, true},
+		{"status", strconv.Itoa(entry.Status), true},
+		{"bytes", strconv.FormatInt(entry.Bytes, 10), true},
+		{"duration_ms", strconv.FormatFloat(entry.DurationMS, 'f', -1, 64), true},
+		{"client_ip", entry.ClientIP, true},
+		{"session_id", entry.SessionID, false},
+		{"user_agent", entry.UserAgent, false},
+		{"daap_version", entry.DAAPVer, false},
+		{"viewer_only", entry.ViewerOnly, false},
+		{"item", entry.Item, false},
+	}
+	line := []byte{}
+	for _, pair := range pairs {
+		if pair.value == "" && !pair.always {
+			continue
+		}
+		if len(line) > 0 {
+			line = append(line, ' ')
+		}
+		line = append(line, pair.key...)
+		line = append(line, '=')
+		if pair.value == "" || strings.ContainsAny(pair.value, " \"=\\") {
+			line = strconv.AppendQuote(line, pair.value)
+		} else {
+			line = append(line, pair.value...)
+		}
+	}
+	return line
+}
+
+// rotatingFile is a log file that is renamed to path.1, path.1 to path.2 and
+// so on, once it grows past maxBytes. Only the newest backups are kept.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// Write is only called with the access log's lock held.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	os.Remove(fmt.Sprintf("%v.%d", r.path, r.backups))
+	for i := r.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%d", r.path, i), fmt.Sprintf("%v.%d", r.path, i+1))
+	}
+	if r.backups > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
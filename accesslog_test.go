@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l := &AccessLog{w: &buf, format: "logfmt", level: levelInfo}
+	handler := l.wrap(func(w http.ResponseWriter, r *http.Request) {
+		noteItem(r, Song{Title: "Airbag", Album: "OK Computer", Artist: "Radiohead"})
+		w.Write([]byte("12345"))
+	})
+	req := httptest.NewRequest("GET", "/databases/1/items/1.mp3?session-id=113", nil)
+	req.RemoteAddr = "192.168.1.20:51000"
+	req.Header.Set("User-Agent", "iTunes/12.8")
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	req.Header.Set("Viewer-Only-Client", "1")
+	handler(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	for _, want := range []string{
+		`level=info method=GET uri="/databases/1/items/1.mp3?session-id=113" status=200 bytes=5 `,
+		"client_ip=192.168.1.20 session_id=113 user_agent=iTunes/12.8 daap_version=3.0 viewer_only=1",
+		`item="Radiohead - OK Computer - Airbag"`,
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("missing %v in %v", want, line)
+		}
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := &AccessLog{w: &buf, format: "json", level: levelInfo}
+	handler := l.wrap(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/databases/9/items", nil))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %v", buf.String(), err)
+	}
+	if entry["level"] != "warn" || entry["status"] != float64(404) || entry["uri"] != "/databases/9/items" {
+		t.Errorf("wrong entry: %v", entry)
+	}
+	if _, ok := entry["item"]; ok {
+		t.Errorf("empty item should be left out: %v", entry)
+	}
+}
+
+func TestAccessLogLevels(t *testing.T) {
+	tests := []struct {
+		level  logLevel
+		path   string
+		status int
+		logged bool
+	}{
+		{levelInfo, "/update", http.StatusOK, false},
+		{levelDebug, "/update", http.StatusOK, true},
+		{levelInfo, "/databases", http.StatusOK, true},
+		{levelWarn, "/databases", http.StatusOK, false},
+		{levelWarn, "/update", http.StatusBadRequest, true},
+		{levelError, "/databases", http.StatusNotFound, false},
+		{levelError, "/databases", http.StatusServiceUnavailable, true},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		l := &AccessLog{w: &buf, format: "logfmt", level: test.level}
+		l.wrap(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+		})(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		if logged := buf.Len() > 0; logged != test.logged {
+			t.Errorf("%v %v at level %v: logged %v, want %v", test.path, test.status, test.level, logged, test.logged)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%v: got %q, want %q", file, data, want)
+		}
+	}
+	if _, err := ioutil.ReadFile(path + ".3"); err == nil {
+		t.Error("kept too many backups")
+	}
+}
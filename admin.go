@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/husobee/vestigo"
+)
+
+// Admin is what the admin API under /admin/v1 manages, besides the library
+// and sessions. It needs admin_password to be set.
+type Admin struct {
+	scanner   *Scanner
+	playlists *SmartPlaylists
+}
+
+// adminAccess checks the admin password, which is separate from the share
+// password so listeners can't manage the server.
+func adminAccess(r *http.Request, share shareSettings) *refusal {
+	if share.adminPassword == "" {
+		return &refusal{status: http.StatusForbidden, msg: "the admin API is off, set admin_password to use it"}
+	}
+	_, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(share.adminPassword)) != 1 {
+		return &refusal{status: http.StatusUnauthorized, msg: "admin password required", realm: share.name + " admin"}
+	}
+	return nil
+}
+
+func rescanStatusHandler(admin *Admin) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, admin.scanner.progress())
+	})
+}
+
+// rescanHandler starts rescanning the libraries named by library= params,
+// or all of them.
+func rescanHandler(admin *Admin) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		err := admin.scanner.start(r.Form["library"])
+		if err == errScanRunning {
+			apiError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Print(err)
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, admin.scanner.progress())
+	})
+}
+
+func sessionsHandler(sessions *Sessions) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, sessions.active())
+	})
+}
+
+// expireSessionHandler logs a client out. Its next request is refused, so
+// it has to log in again.
+func expireSessionHandler(sessions *Sessions) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionIDParam := vestigo.Param(r, "sessionId")
+		sessionID, err := strconv.Atoi(sessionIDParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", sessionIDParam)
+			log.Print(msg)
+			apiError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if !sessions.expire(sessionID) {
+			apiError(w, r.URL.Path+" not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("expired session %v", sessionID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func smartPlaylistsHandler(admin *Admin) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, admin.playlists.list())
+	})
+}
+
+// putSmartPlaylistHandler adds or replaces a smart playlist, taking the query
+// from a JSON body like {"query": "'daap.songgenre:Jazz'"}.
+func putSmartPlaylistHandler(admin *Admin, library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var playlist SmartPlaylist
+		if err := json.NewDecoder(r.Body).Decode(&playlist); err != nil {
+			msg := fmt.Sprintf("Cannot read playlist: %v", err)
+			log.Print(msg)
+			apiError(w, msg, http.StatusBadRequest)
+			return
+		}
+		playlist.Name = vestigo.Param(r, "name")
+		if err := playlist.validate(); err != nil {
+			log.Print(err)
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := admin.playlists.put(playlist); err != nil {
+			log.Print(err)
+			apiError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		library.useSmartPlaylists(admin.playlists.list())
+		writeJSON(w, playlist)
+	})
+}
+
+func deleteSmartPlaylistHandler(admin *Admin, library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		removed, err := admin.playlists.remove(vestigo.Param(r, "name"))
+		if err != nil {
+			log.Print(err)
+			apiError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			apiError(w, r.URL.Path+" not found", http.StatusNotFound)
+			return
+		}
+		library.useSmartPlaylists(admin.playlists.list())
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
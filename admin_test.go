@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func adminTestRouter(t *testing.T) (http.Handler, *Library, *Admin) {
+	t.Helper()
+	playlists, err := loadSmartPlaylists(filepath.Join(t.TempDir(), "playlists.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	writeSongs(t, root, "Radiohead/OK Computer/01 Airbag.mp3")
+	library := newLibrary([]Database{{name: "Music"}})
+	admin := &Admin{scanner: newScanner(library, []LibraryConfig{{Name: "Music", Root: root}}), playlists: playlists}
+	return routes(nil, library, nil, nil, admin), library, admin
+}
+
+func adminRequest(router http.Handler, method, uri, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	req.SetBasicAuth("", "admin")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminAuth(t *testing.T) {
+	defer setShare(currentShare())
+	router, _, _ := adminTestRouter(t)
+
+	setShare(shareSettings{name: "testdb", password: "secret"})
+	rr := adminRequest(router, "GET", "/admin/v1/sessions", "")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected the admin API to be off, got %v", rr.Code)
+	}
+
+	setShare(shareSettings{name: "testdb", password: "admin", adminPassword: "letmein"})
+	rr = adminRequest(router, "GET", "/admin/v1/sessions", "")
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected the share password to be refused, got %v", rr.Code)
+	}
+
+	setShare(shareSettings{name: "testdb", adminPassword: "admin"})
+	rr = adminRequest(router, "GET", "/admin/v1/sessions", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("wrong response %v %v", rr.Code, rr.Header())
+	}
+}
+
+func TestAdminRescan(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "testdb", adminPassword: "admin"})
+	router, library, admin := adminTestRouter(t)
+
+	rr := adminRequest(router, "POST", "/admin/v1/rescan?library=Films", "")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown library to be refused, got %v", rr.Code)
+	}
+
+	rr = adminRequest(router, "POST", "/admin/v1/rescan?library=Music", "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("wrong status %v: %v", rr.Code, rr.Body.String())
+	}
+	admin.scanner.wait()
+
+	rr = adminRequest(router, "GET", "/admin/v1/rescan", "")
+	var status ScanStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Running || status.Songs != 1 || len(status.Errors) != 0 {
+		t.Errorf("wrong status: %+v", status)
+	}
+	if database, _ := library.database(1); len(database.songs) != 1 {
+		t.Errorf("library not rescanned: %+v", database)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "testdb", sessionTimeout: 1800e9, adminPassword: "admin"})
+	router, _, _ := adminTestRouter(t)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/login", nil))
+	sessionID := int(binary.BigEndian.Uint32(rr.Body.Bytes()[28:32]))
+
+	var sessions []Session
+	if err := json.Unmarshal(adminRequest(router, "GET", "/admin/v1/sessions", "").Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != sessionID {
+		t.Fatalf("wrong sessions for %v: %+v", sessionID, sessions)
+	}
+
+	uri := "/admin/v1/sessions/" + strconv.Itoa(sessionID)
+	if rr := adminRequest(router, "DELETE", uri, ""); rr.Code != http.StatusNoContent {
+		t.Errorf("wrong status expiring session: %v", rr.Code)
+	}
+	if rr := adminRequest(router, "DELETE", uri, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status expiring session again: %v", rr.Code)
+	}
+	if rr := adminRequest(router, "DELETE", "/admin/v1/sessions/abc", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status for a bad session id: %v", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/databases?session-id="+strconv.Itoa(sessionID), nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected the expired session to be refused, got %v", rr.Code)
+	}
+	var body map[string]string
+	getJSON(t, router, "/api/v1/databases?session-id="+strconv.Itoa(sessionID), http.StatusForbidden, &body)
+	if body["error"] == "" {
+		t.Errorf("expected a JSON error, got %v", body)
+	}
+}
+
+func TestAdminPlaylists(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "testdb", adminPassword: "admin"})
+	router, library, _ := adminTestRouter(t)
+	library.setDatabase(1, Database{name: "Music", songs: []Song{{Title: "Airbag", Artist: "Radiohead"}, {Title: "So What"}}})
+
+	rr := adminRequest(router, "PUT", "/admin/v1/playlists/Radiohead", `{"query": "'daap.songartist:Radiohead'"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status %v: %v", rr.Code, rr.Body.String())
+	}
+	if rr := adminRequest(router, "PUT", "/admin/v1/playlists/Broken", `{"query": "'daap.songartist"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad query to be refused, got %v", rr.Code)
+	}
+	if rr := adminRequest(router, "PUT", "/admin/v1/playlists/Broken", `{`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected bad JSON to be refused, got %v", rr.Code)
+	}
+
+	var playlists []SmartPlaylist
+	if err := json.Unmarshal(adminRequest(router, "GET", "/admin/v1/playlists", "").Body.Bytes(), &playlists); err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists) != 1 || playlists[0] != (SmartPlaylist{Name: "Radiohead", Query: "'daap.songartist:Radiohead'"}) {
+		t.Errorf("wrong playlists: %+v", playlists)
+	}
+	database, _ := library.database(1)
+	containers := database.containers()
+	if last := containers[len(containers)-1]; last.name != "Radiohead" || len(last.ids) != 1 {
+		t.Errorf("smart playlist not in the library: %+v", containers)
+	}
+
+	if rr := adminRequest(router, "DELETE", "/admin/v1/playlists/Radiohead", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("wrong status deleting: %v", rr.Code)
+	}
+	if rr := adminRequest(router, "DELETE", "/admin/v1/playlists/Radiohead", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status deleting again: %v", rr.Code)
+	}
+	database, _ = library.database(1)
+	for _, c := range database.containers() {
+		if c.name == "Radiohead" {
+			t.Errorf("smart playlist still in the library: %+v", database.containers())
+		}
+	}
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/husobee/vestigo"
+)
+
+// variousArtists is the album artist of compilations that aren't tagged with
+// one.
+const variousArtists = "Various Artists"
+
+// Album is a set of songs released together: the songs with the same album
+// name and album artist, or the same name on a compilation whoever they're
+// by. The discs of a set are one album.
+type Album struct {
+	// id is the same for the album's songs however they're scanned, see
+	// albumID.
+	id          int64
+	name        string
+	artist      string
+	compilation bool
+	discs       int
+	// songs are the ids of the album's songs in disc and track order.
+	songs []int
+}
+
+// albumArtist is who the song's album is by: the album artist tag, various
+// artists on a compilation, or the song's artist.
+func (s Song) albumArtist() string {
+	if s.AlbumArtist != "" {
+		return s.AlbumArtist
+	}
+	if s.Compilation {
+		return variousArtists
+	}
+	return s.Artist
+}
+
+// albumName is the song's album without a disc number, so each disc of a set
+// is on the same album.
+func (s Song) albumName() string {
+	name := strings.TrimSpace(s.Album)
+	if strings.HasSuffix(name, ")") || strings.HasSuffix(name, "]") {
+		// Album (Disc 2), Album [CD 2 of 3]
+		if open := strings.LastIndexAny(name, "(["); open > 0 {
+			if _, ok := parseDiscName(name[open+1 : len(name)-1]); ok {
+				return strings.TrimSpace(name[:open])
+			}
+		}
+		return name
+	}
+	// Album - Disc 2, Album, CD2
+	words := strings.Fields(name)
+	for _, n := range []int{1, 2, 4} {
+		if n >= len(words) {
+			break
+		}
+		if _, ok := parseDiscName(strings.Join(words[len(words)-n:], " ")); ok {
+			return strings.TrimRight(strings.Join(words[:len(words)-n], " "), " -,:")
+		}
+	}
+	return name
+}
+
+// sortAlbumName is what the song's album is sorted by: its album sort tag or
+// its album name, without a disc number like albumName.
+func (s Song) sortAlbumName() string {
+	if s.SortAlbum != "" {
+		return Song{Album: s.SortAlbum}.albumName()
+	}
+	return deriveSortName(s.albumName(), currentShare().sortArticles)
+}
+
+// parseDiscName reads a disc name like "Disc 2", "CD2" or "disk 2 of 3",
+// which are how folders and album names number the discs of a set.
+func parseDiscName(s string) (int, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, prefix := range []string{"disc", "disk", "cd"} {
+		if !strings.HasPrefix(s, prefix) {
+			continue
+		}
+		number := strings.TrimSpace(s[len(prefix):])
+		if i := strings.Index(number, " of "); i >= 0 {
+			number = number[:i]
+		}
+		disc, err := strconv.Atoi(number)
+		if err != nil || disc < 1 {
+			return 0, false
+		}
+		return disc, true
+	}
+	return 0, false
+}
+
+// albumID identifies the song's album by its name and album artist, or only
+// its name on a compilation, ignoring case and accents. It's 0 for songs that
+// aren't on an album. As it only depends on the tags the id stays the same
+// across rescans, so clients can keep it.
+func (s Song) albumID() int64 {
+	name := foldText(s.albumName())
+	if name == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	io.WriteString(h, name)
+	if s.Compilation {
+		h.Write([]byte{0, 1})
+	} else {
+		h.Write([]byte{0})
+		io.WriteString(h, foldText(s.albumArtist()))
+	}
+	return nonZeroID(h.Sum64())
+}
+
+// artistID identifies an album artist the way albumID does an album.
+func artistID(name string) int64 {
+	h := fnv.New64a()
+	io.WriteString(h, foldText(name))
+	return nonZeroID(h.Sum64())
+}
+
+func nonZeroID(id uint64) int64 {
+	if id == 0 {
+		return 1
+	}
+	return int64(id)
+}
+
+// groupAlbums puts songs on their albums, in the order the albums first
+// appear.
+func groupAlbums(songs []Song) []Album {
+	albums := []Album{}
+	index := map[int64]int{}
+	for i, song := range songs {
+		id := song.albumID()
+		if id == 0 {
+			continue
+		}
+		n, ok := index[id]
+		if !ok {
+			n = len(albums)
+			index[id] = n
+			albums = append(albums, Album{id: id, name: song.albumName(), artist: song.albumArtist(), compilation: song.Compilation, discs: 1})
+		}
+		albums[n].songs = append(albums[n].songs, i+1)
+		if song.DiscNumber > albums[n].discs {
+			albums[n].discs = song.DiscNumber
+		}
+	}
+	for _, album := range albums {
+		ids := album.songs
+		sort.SliceStable(ids, func(i, j int) bool {
+			a, b := songs[ids[i]-1], songs[ids[j]-1]
+			if a.DiscNumber != b.DiscNumber {
+				return a.DiscNumber < b.DiscNumber
+			}
+			return a.TrackNumber < b.TrackNumber
+		})
+	}
+	return albums
+}
+
+// album looks up an album by its id.
+func (d Database) album(id int64) (Album, bool) {
+	for _, album := range d.albums {
+		if album.id == id {
+			return album, true
+		}
+	}
+	return Album{}, false
+}
+
+// group is an item in a groups response: an album, or an album artist and
+// their albums. songs and albums only count those matching the query.
+type group struct {
+	id           int
+	persistentID int64
+	name         string
+	artist       string
+	compilation  bool
+	songs        int
+	albums       int
+
+	// sort names, which headers list the group under, and their collation
+	// keys
+	sortName, sortArtist string
+	nameKey, artistKey   string
+}
+
+// groupItemIDs gives each persistent id an item id taken from it, so a group
+// keeps its item id across rescans and whatever the query. Ids that collide
+// move on to the next free one, as proxied songs' do.
+func groupItemIDs(persistentIDs []int64) map[int64]int {
+	items := map[int]int{}
+	ids := map[int64]int{}
+	for i, persistentID := range persistentIDs {
+		if _, ok := ids[persistentID]; ok {
+			continue
+		}
+		id := freeItemID(items, int(persistentID&0x7fffffff))
+		items[id] = i
+		ids[persistentID] = id
+	}
+	return ids
+}
+
+// albumGroups are the albums with songs matching the query.
+func albumGroups(database Database, matched []bool) []group {
+	albumIDs := make([]int64, len(database.albums))
+	for i, album := range database.albums {
+		albumIDs[i] = album.id
+	}
+	itemIDs := groupItemIDs(albumIDs)
+
+	groups := []group{}
+	for _, album := range database.albums {
+		count := 0
+		for _, id := range album.songs {
+			if matched[id] {
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		first, _ := database.song(album.songs[0])
+		groups = append(groups, group{
+			id:           itemIDs[album.id],
+			persistentID: album.id,
+			name:         album.name,
+			artist:       album.artist,
+			compilation:  album.compilation,
+			songs:        count,
+			albums:       1,
+			sortName:     first.sortAlbumName(),
+			sortArtist:   first.sortAlbumArtist(),
+			nameKey:      collationKey(first.sortAlbumName()),
+			artistKey:    collationKey(first.sortAlbumArtist()),
+		})
+	}
+	return groups
+}
+
+// artistGroups are the album artists of the albums with songs matching the
+// query.
+func artistGroups(database Database, matched []bool) []group {
+	artistIDs := make([]int64, len(database.albums))
+	for i, album := range database.albums {
+		artistIDs[i] = artistID(album.artist)
+	}
+	itemIDs := groupItemIDs(artistIDs)
+
+	groups := []group{}
+	index := map[int64]int{}
+	for i, album := range database.albums {
+		id := artistIDs[i]
+		n, ok := index[id]
+		if !ok {
+			n = len(groups)
+			index[id] = n
+			first, _ := database.song(album.songs[0])
+			sortName := first.sortAlbumArtist()
+			key := collationKey(sortName)
+			groups = append(groups, group{id: itemIDs[id], persistentID: id, name: album.artist, artist: album.artist, sortName: sortName, sortArtist: sortName, nameKey: key, artistKey: key})
+		}
+		count := 0
+		for _, id := range album.songs {
+			if matched[id] {
+				count++
+			}
+		}
+		if count > 0 {
+			groups[n].songs += count
+			groups[n].albums++
+		}
+	}
+	found := groups[:0]
+	for _, g := range groups {
+		if g.songs > 0 {
+			found = append(found, g)
+		}
+	}
+	return found
+}
+
+// groupSort is a sort= order of groups, like songSort.
+type groupSort struct {
+	name func(g group) string
+	keys func(g group) []string
+}
+
+// groupSorts are the sort= orders of groups, comparing names and then
+// artists or the other way around.
+var groupSorts = map[string]groupSort{
+	"album": {func(g group) string { return g.sortName }, func(g group) []string {
+		return []string{g.nameKey, g.name, g.artistKey, g.artist}
+	}},
+	"artist": {func(g group) string { return g.sortArtist }, func(g group) []string {
+		return []string{g.artistKey, g.artist, g.nameKey, g.name}
+	}},
+	"albumartist": {func(g group) string { return g.sortArtist }, func(g group) []string {
+		return []string{g.artistKey, g.artist, g.nameKey, g.name}
+	}},
+}
+
+// sortGroups sorts groups by one of groupSorts, returning the headers for an
+// index of them.
+func sortGroups(groups []group, by string) ([]sortHeader, error) {
+	order, ok := groupSorts[by]
+	if !ok {
+		return nil, fmt.Errorf("cannot sort groups by '%v'", by)
+	}
+	type sortable struct {
+		group
+		keys []string
+	}
+	sorted := make([]sortable, len(groups))
+	for i, g := range groups {
+		sorted[i] = sortable{g, order.keys(g)}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return lessKeys(sorted[i].keys, sorted[j].keys) })
+
+	names := make([]string, len(sorted))
+	for i, g := range sorted {
+		groups[i] = g.group
+		names[i] = order.name(g.group)
+	}
+	return sortHeaders(names), nil
+}
+
+func groupFieldSize(field string, g group) int {
+	switch field {
+	case "dmap.itemid", "dmap.itemcount", "daap.groupalbumcount":
+		return 8 + 4
+	case "dmap.persistentid", "daap.songalbumid":
+		return 8 + 8
+	case "dmap.itemname":
+		return 8 + len(g.name)
+	case "daap.songartist", "daap.songalbumartist":
+		return 8 + len(g.artist)
+	case "daap.songcompilation":
+		return 8 + 1
+	}
+	return 0
+}
+
+func writeGroupField(e *dmapWriter, field string, g group) {
+	switch field {
+	case "dmap.itemid":
+		e.intField("miid", g.id)
+	case "dmap.persistentid":
+		e.longField("mper", g.persistentID)
+	case "daap.songalbumid":
+		e.longField("asai", g.persistentID)
+	case "dmap.itemname":
+		e.stringField("minm", g.name)
+	case "daap.songartist":
+		e.stringField("asar", g.artist)
+	case "daap.songalbumartist":
+		e.stringField("asaa", g.artist)
+	case "dmap.itemcount":
+		e.intField("mimc", g.songs)
+	case "daap.groupalbumcount":
+		e.intField("agac", g.albums)
+	case "daap.songcompilation":
+		var compilation byte
+		if g.compilation {
+			compilation = 1
+		}
+		e.charField("asco", compilation)
+	}
+}
+
+func groupContentSize(fields []string, g group) int {
+	size := 0
+	for _, field := range fields {
+		size += groupFieldSize(field, g)
+	}
+	return size
+}
+
+// writeGroups writes a groups response, agal for albums or agar for artists.
+func writeGroups(w io.Writer, tag string, fields []string, groups []group, headers []sortHeader) error {
+	listingSize := 0
+	for _, g := range groups {
+		listingSize += 8 + groupContentSize(fields, g)
+	}
+
+	e := newDmapWriter(w)
+	e.tag(tag, 12+9+12+12+8+listingSize+sortHeadersSize(headers))
+	e.intField("mstt", 200)
+	e.charField("muty", 0)
+	e.intField("mtco", len(groups))
+	e.intField("mrco", len(groups))
+	e.tag("mlcl", listingSize)
+	for _, g := range groups {
+		e.tag("mlit", groupContentSize(fields, g))
+		for _, field := range fields {
+			writeGroupField(e, field, g)
+		}
+	}
+	writeSortHeaders(e, headers)
+	return e.flush()
+}
+
+// groupTypes are the group-type= values of a groups request and the tag of
+// their response.
+var groupTypes = map[string]struct {
+	tag    string
+	groups func(Database, []bool) []group
+}{
+	"albums":  {"agal", albumGroups},
+	"artists": {"agar", artistGroups},
+}
+
+// matchingSongs finds the songs matching a request's query= parameter, as a
+// lookup by song id.
+func matchingSongs(r *http.Request, database Database) ([]bool, error) {
+	query, err := parseQuery(r.Form.Get("query"))
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]bool, len(database.songs)+1)
+	for _, id := range database.find(query) {
+		matched[id] = true
+	}
+	return matched, nil
+}
+
+// groupsHandler lists the albums or album artists with songs matching the
+// query, which is how remotes browse by album.
+func groupsHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		itemIdParam := vestigo.Param(r, "itemId")
+		dbId, err := strconv.Atoi(itemIdParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", itemIdParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		groupType := r.Form.Get("group-type")
+		if groupType == "" {
+			groupType = "albums"
+		}
+		kind, ok := groupTypes[groupType]
+		if !ok {
+			msg := fmt.Sprintf("Unknown group type '%v'", groupType)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		database, ok := library.database(dbId)
+		if !ok {
+			dmapError(w, kind.tag, http.StatusNotFound)
+			return
+		}
+		matched, err := matchingSongs(r, database)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		groups := kind.groups(database, matched)
+		var headers []sortHeader
+		if by := r.Form.Get("sort"); by != "" {
+			headers, err = sortGroups(groups, by)
+			if err != nil {
+				log.Print(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if r.Form.Get("include-sort-headers") != "1" {
+				headers = nil
+			}
+		}
+
+		fields := normalizeMeta(strings.Split(r.Form.Get("meta"), ","))
+		if err := writeGroups(w, kind.tag, fields, groups, headers); err != nil {
+			log.Printf("error writing groups: %v", err)
+		}
+	})
+}
+
+// browseCategories are what can be browsed, the tag of their listing and the
+// names to list for a song with the name to sort each by.
+var browseCategories = map[string]struct {
+	tag   string
+	names func(Song) (string, string)
+}{
+	"artists":   {"abar", func(s Song) (string, string) { return s.Artist, s.sortArtist() }},
+	"albums":    {"abal", func(s Song) (string, string) { return s.albumName(), s.sortAlbumName() }},
+	"genres":    {"abgn", func(s Song) (string, string) { return s.Genre, s.Genre }},
+	"composers": {"abcp", func(s Song) (string, string) { return s.Composer, s.Composer }},
+}
+
+// browseNames are the different names in a category of the matching songs,
+// sorted. Names that only differ by case or accents are listed once.
+func browseNames(database Database, matched []bool, names func(Song) (string, string)) ([]string, []sortHeader) {
+	type browsed struct{ name, sortName, key string }
+	seen := map[string]bool{}
+	list := []browsed{}
+	for i, song := range database.songs {
+		if !matched[i+1] {
+			continue
+		}
+		name, sortName := names(song)
+		folded := foldText(name)
+		if folded == "" || seen[folded] {
+			continue
+		}
+		seen[folded] = true
+		list = append(list, browsed{name, sortName, collationKey(sortName)})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return compareKeys(list[i].key, list[j].key, list[i].name, list[j].name) < 0
+	})
+	sorted := make([]string, len(list))
+	sortNames := make([]string, len(list))
+	for i, b := range list {
+		sorted[i], sortNames[i] = b.name, b.sortName
+	}
+	return sorted, sortHeaders(sortNames)
+}
+
+// writeBrowse writes a browse response with the names listed in tag.
+func writeBrowse(w io.Writer, tag string, names []string, headers []sortHeader) error {
+	listingSize := 0
+	for _, name := range names {
+		listingSize += 8 + len(name)
+	}
+
+	e := newDmapWriter(w)
+	e.tag("abro", 12+9+12+12+8+listingSize+sortHeadersSize(headers))
+	e.intField("mstt", 200)
+	e.charField("muty", 0)
+	e.intField("mtco", len(names))
+	e.intField("mrco", len(names))
+	e.tag(tag, listingSize)
+	for _, name := range names {
+		e.stringField("mlit", name)
+	}
+	writeSortHeaders(e, headers)
+	return e.flush()
+}
+
+// browseHandler lists the artists, albums, genres or composers of the songs
+// matching the query.
+func browseHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		itemIdParam := vestigo.Param(r, "itemId")
+		dbId, err := strconv.Atoi(itemIdParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", itemIdParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		category, ok := browseCategories[vestigo.Param(r, "category")]
+		if !ok {
+			dmapError(w, "abro", http.StatusNotFound)
+			return
+		}
+		database, ok := library.database(dbId)
+		if !ok {
+			dmapError(w, "abro", http.StatusNotFound)
+			return
+		}
+		matched, err := matchingSongs(r, database)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		names, headers := browseNames(database, matched, category.names)
+		if r.Form.Get("include-sort-headers") != "1" {
+			headers = nil
+		}
+		if err := writeBrowse(w, category.tag, names, headers); err != nil {
+			log.Printf("error writing browse listing: %v", err)
+		}
+	})
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+func TestAlbumName(t *testing.T) {
+	tests := map[string]string{
+		"The White Album (Disc 2)":      "The White Album",
+		"The White Album [CD 1 of 2]":   "The White Album",
+		"The White Album - Disc 2":      "The White Album",
+		"The White Album, CD2":          "The White Album",
+		"The White Album disk 1 of 2":   "The White Album",
+		"Songs in A Minor (Remastered)": "Songs in A Minor (Remastered)",
+		"Discovery":                     "Discovery",
+		"CD 1":                          "CD 1",
+		"The Disc":                      "The Disc",
+		"  OK Computer ":                "OK Computer",
+	}
+	for album, want := range tests {
+		if got := (Song{Album: album}).albumName(); got != want {
+			t.Errorf("albumName(%q) = %q, want %q", album, got, want)
+		}
+	}
+}
+
+func TestSortAlbumName(t *testing.T) {
+	tests := []struct {
+		song Song
+		want string
+	}{
+		{Song{Album: "The White Album (Disc 2)"}, "White Album"},
+		{Song{Album: "The White Album (Disc 2)", SortAlbum: "White Album, The (Disc 2)"}, "White Album, The"},
+		{Song{Album: "Mezzanine"}, "Mezzanine"},
+	}
+	for _, test := range tests {
+		if got := test.song.sortAlbumName(); got != test.want {
+			t.Errorf("sortAlbumName(%+v) = %q, want %q", test.song, got, test.want)
+		}
+	}
+}
+
+func TestGroupItemIDs(t *testing.T) {
+	ids := groupItemIDs([]int64{7, 1<<31 | 7, 7, 9})
+	if want := map[int64]int{7: 7, 1<<31 | 7: 8, 9: 9}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("wrong item ids %v, want %v", ids, want)
+	}
+}
+
+func TestParseDiscName(t *testing.T) {
+	tests := map[string]int{"Disc 2": 2, "CD2": 2, "disk 3 of 4": 3, "cd 0": 0, "Discovery": 0, "Bonus": 0}
+	for name, want := range tests {
+		disc, ok := parseDiscName(name)
+		if disc != want || ok != (want > 0) {
+			t.Errorf("parseDiscName(%q) = %v %v, want %v", name, disc, ok, want)
+		}
+	}
+}
+
+func TestAlbumID(t *testing.T) {
+	song := Song{Album: "Mezzanine", Artist: "Massive Attack"}
+	same := []Song{
+		{Album: "MEZZANINE", Artist: "massive attack"},
+		{Album: "Mezzanine (Disc 2)", Artist: "Massive Attack"},
+		{Album: "Mezzanine", Artist: "3D", AlbumArtist: "Massive Attack"},
+	}
+	for _, other := range same {
+		if other.albumID() != song.albumID() {
+			t.Errorf("%+v not on the same album as %+v", other, song)
+		}
+	}
+	different := []Song{
+		{Album: "Mezzanine", Artist: "Someone Else"},
+		{Album: "Mezzanine", Artist: "Massive Attack", Compilation: true},
+		{Album: "Protection", Artist: "Massive Attack"},
+	}
+	for _, other := range different {
+		if other.albumID() == song.albumID() {
+			t.Errorf("%+v on the same album as %+v", other, song)
+		}
+	}
+	if id := (Song{Title: "Loose", Artist: "Someone"}).albumID(); id != 0 {
+		t.Errorf("song without an album has album id %v", id)
+	}
+
+	hits := []Song{
+		{Album: "Hits", Artist: "One", Compilation: true},
+		{Album: "Hits", Artist: "Two", Compilation: true, AlbumArtist: "Various Artists"},
+	}
+	if hits[0].albumID() != hits[1].albumID() {
+		t.Error("songs on a compilation should be on the same album")
+	}
+}
+
+var albumTestSongs = []Song{
+	{Title: "Birthday", Album: "The White Album (Disc 2)", Artist: "The Beatles", DiscNumber: 2, TrackNumber: 1},
+	{Title: "Teardrop", Album: "Mezzanine", Artist: "Massive Attack", Genre: "Trip Hop", TrackNumber: 3},
+	{Title: "Back in the U.S.S.R.", Album: "The White Album (Disc 1)", Artist: "The Beatles", DiscNumber: 1, TrackNumber: 1},
+	{Title: "Hit One", Album: "Now 42", Artist: "Abba", Compilation: true, TrackNumber: 2},
+	{Title: "Angel", Album: "Mezzanine", Artist: "Massive Attack", Genre: "trip hop", TrackNumber: 1},
+	{Title: "Hit Two", Album: "Now 42", Artist: "Blur", Compilation: true, TrackNumber: 1},
+	{Title: "Loose", Artist: "Zed"},
+}
+
+func TestGroupAlbums(t *testing.T) {
+	albums := groupAlbums(albumTestSongs)
+	want := []Album{
+		{id: albumTestSongs[0].albumID(), name: "The White Album", artist: "The Beatles", discs: 2, songs: []int{3, 1}},
+		{id: albumTestSongs[1].albumID(), name: "Mezzanine", artist: "Massive Attack", discs: 1, songs: []int{5, 2}},
+		{id: albumTestSongs[3].albumID(), name: "Now 42", artist: "Various Artists", compilation: true, discs: 1, songs: []int{6, 4}},
+	}
+	if !reflect.DeepEqual(albums, want) {
+		t.Errorf("wrong albums:\n%+v\nwant\n%+v", albums, want)
+	}
+	database := Database{songs: albumTestSongs, albums: albums}
+	if album, ok := database.album(want[1].id); !ok || album.name != "Mezzanine" {
+		t.Errorf("wrong album %+v %v", album, ok)
+	}
+	if _, ok := database.album(1); ok {
+		t.Error("found an album that doesn't exist")
+	}
+}
+
+var groupContainers = map[string]bool{"agal": true, "agar": true, "mlcl": true, "mlit": true, "mshl": true}
+
+func getGroups(t *testing.T, router http.Handler, params string, code string) daap.Tag {
+	req := httptest.NewRequest("GET", "/databases/1/groups?"+params, nil)
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("%v: wrong http status, want %v, got %v", params, http.StatusOK, resp.Code)
+	}
+	tags, err := daap.Decode(resp.Body.Bytes(), groupContainers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Code != code {
+		t.Fatalf("%v: wrong response %+v", params, tags)
+	}
+	return tags[0]
+}
+
+func TestGetGroups(t *testing.T) {
+	router := routes(nil, newLibrary([]Database{{name: "testdb", songs: albumTestSongs}}), nil, nil, nil)
+
+	meta := "meta=dmap.itemid,dmap.persistentid,dmap.itemname,daap.songalbumartist,dmap.itemcount,daap.songcompilation"
+	agal := getGroups(t, router, meta+"&type=music&group-type=albums&sort=album&include-sort-headers=1", "agal")
+	listing, _ := agal.Find("mlcl")
+	items := listing.All("mlit")
+	names := []string{}
+	for _, item := range items {
+		name, _ := item.Find("minm")
+		names = append(names, name.Text())
+	}
+	if want := []string{"Mezzanine", "Now 42", "The White Album"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("wrong albums %q, want %q", names, want)
+	}
+	if mrco, _ := agal.Find("mrco"); mrco.Int() != 3 {
+		t.Errorf("wrong mrco %v", mrco.Int())
+	}
+	now, white := items[1], items[2]
+	if id, _ := now.Find("miid"); id.Int() != albumTestSongs[3].albumID()&0x7fffffff {
+		t.Errorf("wrong item id %v", id.Int())
+	}
+	if mper, _ := now.Find("mper"); mper.Int() != albumTestSongs[3].albumID() {
+		t.Errorf("wrong persistent id %v", mper.Int())
+	}
+	if artist, _ := now.Find("asaa"); artist.Text() != "Various Artists" {
+		t.Errorf("wrong album artist %q", artist.Text())
+	}
+	if compilation, _ := now.Find("asco"); compilation.Int() != 1 {
+		t.Error("compilation not flagged")
+	}
+	if count, _ := white.Find("mimc"); count.Int() != 2 {
+		t.Errorf("wrong song count %v", count.Int())
+	}
+	mshl, ok := agal.Find("mshl")
+	if !ok || len(mshl.All("mlit")) != 3 {
+		t.Errorf("wrong sort headers %+v", mshl)
+	}
+
+	// an artist's albums, as remotes ask for them
+	query := url.QueryEscape("'daap.songartist:Blur'")
+	agal = getGroups(t, router, meta+"&group-type=albums&query="+query, "agal")
+	listing, _ = agal.Find("mlcl")
+	if items := listing.All("mlit"); len(items) != 1 {
+		t.Errorf("wrong albums for a query %+v", items)
+	} else if count, _ := items[0].Find("mimc"); count.Int() != 1 {
+		t.Errorf("wrong matching song count %v", count.Int())
+	} else if id, _ := items[0].Find("miid"); id.Int() != albumTestSongs[3].albumID()&0x7fffffff {
+		t.Errorf("item id changed with the query: %v", id.Int())
+	}
+
+	agar := getGroups(t, router, "meta=dmap.itemname,dmap.itemcount,daap.groupalbumcount&group-type=artists&sort=artist", "agar")
+	listing, _ = agar.Find("mlcl")
+	items = listing.All("mlit")
+	names = []string{}
+	for _, item := range items {
+		name, _ := item.Find("minm")
+		names = append(names, name.Text())
+	}
+	if want := []string{"The Beatles", "Massive Attack", "Various Artists"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("wrong artists %q, want %q", names, want)
+	}
+	if albums, _ := items[0].Find("agac"); albums.Int() != 1 {
+		t.Errorf("wrong album count %v", albums.Int())
+	}
+
+	for _, params := range []string{"group-type=songs", "sort=colour", "query='broken"} {
+		req := httptest.NewRequest("GET", "/databases/1/groups?"+params, nil)
+		req.Header.Set("Client-DAAP-Version", "3.0")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("%v: wrong http status, want %v, got %v", params, http.StatusBadRequest, resp.Code)
+		}
+	}
+	req := httptest.NewRequest("GET", "/databases/2/groups?group-type=albums", nil)
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("wrong http status for a missing database, want %v, got %v", http.StatusNotFound, resp.Code)
+	}
+}
+
+func TestGroupsAndBrowseOverHTTP(t *testing.T) {
+	// a real server, so the query string is parsed by net/http as a
+	// client's is
+	server := httptest.NewServer(routes(nil, newLibrary([]Database{{name: "testdb", songs: albumTestSongs}}), nil, nil, nil))
+	defer server.Close()
+
+	get := func(uri string, containers map[string]bool) daap.Tag {
+		req, _ := http.NewRequest("GET", server.URL+uri, nil)
+		req.Header.Set("Client-DAAP-Version", "3.0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		tags, err := daap.Decode(data, containers)
+		if resp.StatusCode != http.StatusOK || err != nil || len(tags) != 1 {
+			t.Fatalf("%v: bad response %v %v", uri, resp.StatusCode, err)
+		}
+		return tags[0]
+	}
+
+	query := url.QueryEscape("'daap.songartist:Massive Attack'")
+	agal := get("/databases/1/groups?group-type=albums&meta=dmap.itemname&sort=album&include-sort-headers=1&query="+query,
+		map[string]bool{"agal": true, "mlcl": true, "mlit": true, "mshl": true})
+	listing, _ := agal.Find("mlcl")
+	if items := listing.All("mlit"); len(items) != 1 {
+		t.Errorf("query not applied to groups: %+v", items)
+	} else if _, ok := items[0].Find("mimc"); ok {
+		t.Error("meta not applied to groups")
+	}
+	if _, ok := agal.Find("mshl"); !ok {
+		t.Error("include-sort-headers not applied to groups")
+	}
+
+	abro := get("/databases/1/browse/albums?query="+query, map[string]bool{"abro": true, "abal": true})
+	abal, _ := abro.Find("abal")
+	if items := abal.All("mlit"); len(items) != 1 || items[0].Text() != "Mezzanine" {
+		t.Errorf("query not applied to browse: %+v", items)
+	}
+}
+
+func TestGetBrowse(t *testing.T) {
+	router := routes(nil, newLibrary([]Database{{name: "testdb", songs: albumTestSongs}}), nil, nil, nil)
+	containers := map[string]bool{"abro": true, "abar": true, "abal": true, "abgn": true, "abcp": true, "mshl": true}
+
+	tests := []struct {
+		uri   string
+		tag   string
+		names []string
+	}{
+		{"/databases/1/browse/artists", "abar", []string{"Abba", "The Beatles", "Blur", "Massive Attack", "Zed"}},
+		{"/databases/1/browse/albums", "abal", []string{"Mezzanine", "Now 42", "The White Album"}},
+		{"/databases/1/browse/genres", "abgn", []string{"Trip Hop"}},
+		{"/databases/1/browse/composers", "abcp", []string{}},
+		{"/databases/1/browse/albums?query=" + url.QueryEscape("'daap.songartist:The Beatles'"), "abal", []string{"The White Album"}},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.uri, nil)
+		req.Header.Set("Client-DAAP-Version", "3.0")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Errorf("%v: wrong http status, want %v, got %v", test.uri, http.StatusOK, resp.Code)
+			continue
+		}
+		tags, err := daap.Decode(resp.Body.Bytes(), containers)
+		if err != nil || len(tags) != 1 || tags[0].Code != "abro" {
+			t.Errorf("%v: bad response %+v %v", test.uri, tags, err)
+			continue
+		}
+		listing, _ := tags[0].Find(test.tag)
+		names := []string{}
+		for _, item := range listing.All("mlit") {
+			names = append(names, item.Text())
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%v: wrong names %q, want %q", test.uri, names, test.names)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/databases/1/browse/artists?include-sort-headers=1", nil)
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	tags, err := daap.Decode(resp.Body.Bytes(), containers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mshl, _ := tags[0].Find("mshl")
+	if headers := mshl.All("mlit"); len(headers) != 4 {
+		t.Errorf("wrong sort headers %+v", headers)
+	}
+
+	req = httptest.NewRequest("GET", "/databases/1/browse/moods", nil)
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("wrong http status for an unknown category, want %v, got %v", http.StatusNotFound, resp.Code)
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/husobee/vestigo"
+)
+
+// The JSON API under /api/v1 serves the same library as the DAAP routes, for
+// scripts and web pages that would rather not decode DMAP.
+
+const apiDefaultLimit = 100
+const apiMaxLimit = 1000
+
+type apiDatabase struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Songs     int    `json:"songs"`
+	Playlists int    `json:"playlists"`
+}
+
+type apiSong struct {
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	Album       string     `json:"album,omitempty"`
+	Artist      string     `json:"artist,omitempty"`
+	Genre       string     `json:"genre,omitempty"`
+	Composer    string     `json:"composer,omitempty"`
+	AlbumArtist string     `json:"album_artist,omitempty"`
+	AlbumID     int64      `json:"album_id,string,omitempty"`
+	Compilation bool       `json:"compilation,omitempty"`
+	DiscNumber  int        `json:"disc_number,omitempty"`
+	TrackNumber int        `json:"track_number,omitempty"`
+	Duration    int        `json:"duration_ms,omitempty"`
+	Format      string     `json:"format"`
+	MediaKind   string     `json:"media_kind"`
+	Rating      int        `json:"rating"`
+	PlayCount   int        `json:"play_count"`
+	SkipCount   int        `json:"skip_count"`
+	LastPlayed  *time.Time `json:"last_played,omitempty"`
+	StreamURL   string     `json:"stream_url"`
+}
+
+type apiSongPage struct {
+	Total  int       `json:"total"`
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+	Songs  []apiSong `json:"songs"`
+}
+
+type apiPlaylist struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Songs int    `json:"songs"`
+}
+
+type apiArtist struct {
+	Name     string `json:"name"`
+	SortName string `json:"sort_name"`
+	Albums   int    `json:"albums"`
+	Songs    int    `json:"songs"`
+}
+
+type apiAlbum struct {
+	ID          int64  `json:"id,string"`
+	Name        string `json:"name"`
+	Artist      string `json:"artist"`
+	Compilation bool   `json:"compilation"`
+	Discs       int    `json:"discs"`
+	Songs       int    `json:"songs"`
+
+	sortName, sortArtist string
+}
+
+type apiStats struct {
+	Revision  int   `json:"revision"`
+	Databases int   `json:"databases"`
+	Songs     int   `json:"songs"`
+	Duration  int64 `json:"duration_ms"`
+	Plays     int   `json:"plays"`
+	Skips     int   `json:"skips"`
+	Rated     int   `json:"rated"`
+}
+
+func apiError(w http.ResponseWriter, msg string, status int) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("cannot write response: %v", err)
+	}
+}
+
+// apiParam gets an integer path parameter, responding with an error if it
+// isn't one.
+func apiParam(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	param := vestigo.Param(r, name)
+	i, err := strconv.Atoi(param)
+	if err != nil {
+		msg := fmt.Sprintf("Cannot convert '%v' to int", param)
+		log.Print(msg)
+		apiError(w, msg, http.StatusBadRequest)
+		return 0, false
+	}
+	return i, true
+}
+
+// apiLookupDatabase finds the database in the path, responding with an error
+// if there isn't one.
+func apiLookupDatabase(w http.ResponseWriter, r *http.Request, library *Library) (int, Database, bool) {
+	id, ok := apiParam(w, r, "databaseId")
+	if !ok {
+		return 0, Database{}, false
+	}
+	database, ok := library.database(id)
+	if !ok {
+		apiError(w, r.URL.Path+" not found", http.StatusNotFound)
+		return 0, Database{}, false
+	}
+	return id, database, true
+}
+
+func toAPISong(databaseID, id int, song Song) apiSong {
+	stats := song.stats()
+	s := apiSong{
+		ID:          song.itemIDAt(id),
+		Title:       song.Title,
+		Album:       song.Album,
+		Artist:      song.Artist,
+		Genre:       song.Genre,
+		Composer:    song.Composer,
+		AlbumArtist: song.albumArtist(),
+		AlbumID:     song.albumID(),
+		Compilation: song.Compilation,
+		DiscNumber:  song.DiscNumber,
+		TrackNumber: song.TrackNumber,
+		Duration:    song.Duration,
+		Format:      song.format(),
+		MediaKind:   mediaKindName(song.kind()),
+		Rating:      stats.Rating,
+		PlayCount:   stats.PlayCount,
+		SkipCount:   stats.SkipCount,
+		StreamURL:   fmt.Sprintf("/databases/%d/items/%d.%s", databaseID, song.itemIDAt(id), song.format()),
+	}
+	if !stats.LastPlayed.IsZero() {
+		lastPlayed := stats.LastPlayed
+		s.LastPlayed = &lastPlayed
+	}
+	return s
+}
+
+func mediaKindName(kind MediaKind) string {
+	for name, k := range mediaKindNames {
+		if k == kind {
+			return name
+		}
+	}
+	return strconv.Itoa(int(kind))
+}
+
+func apiDatabasesHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		databases := []apiDatabase{}
+		for i, database := range library.databases() {
+			kind := "library"
+			if database.kind == RadioDatabase {
+				kind = "radio"
+			}
+			databases = append(databases, apiDatabase{
+				ID:        i + 1,
+				Name:      database.name,
+				Kind:      kind,
+				Songs:     len(database.songs),
+				Playlists: len(database.containers()),
+			})
+		}
+		writeJSON(w, databases)
+	})
+}
+
+// songFilter picks songs in a database by the query string: query takes a
+// DAAP query, artist, album, genre and kind match exactly, ignoring case and
+// accents, album_id picks the songs on an album, and q looks for words
+// starting with the words given in the title, artist, album, composer or
+// genre.
+func songFilter(r *http.Request, database Database) (func(id int, song Song) bool, error) {
+	query, err := parseQuery(r.FormValue("query"))
+	if err != nil {
+		return nil, err
+	}
+	exact := map[string]string{}
+	for _, field := range []string{"artist", "album", "genre", "kind"} {
+		if value := r.FormValue(field); value != "" {
+			exact[field] = foldText(value)
+		}
+	}
+	ids := database.find(query)
+	if text := r.FormValue("q"); text != "" {
+		ids = intersectIDs(ids, database.search(text))
+	}
+	if param := r.FormValue("album_id"); param != "" {
+		albumID, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert album_id '%v' to int", param)
+		}
+		album, _ := database.album(albumID)
+		ids = keepIDs(album.songs, ids)
+	}
+	found := make([]bool, len(database.songs)+1)
+	for _, id := range ids {
+		found[id] = true
+	}
+	return func(id int, song Song) bool {
+		if id < 1 || id >= len(found) || !found[id] {
+			return false
+		}
+		for field, value := range exact {
+			var got string
+			switch field {
+			case "artist":
+				got = song.Artist
+			case "album":
+				got = song.Album
+			case "genre":
+				got = song.Genre
+			case "kind":
+				got = mediaKindName(song.kind())
+			}
+			if foldText(got) != value {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// apiSortKey is what a song is ordered by for one sort= field: a number, or
+// a name compared by its collation key.
+type apiSortKey struct {
+	n         int64
+	key, name string
+}
+
+func numberSortKey(n int) apiSortKey {
+	return apiSortKey{n: int64(n)}
+}
+
+func nameSortKey(sortName, name string) apiSortKey {
+	return apiSortKey{key: collationKey(sortName), name: name}
+}
+
+func (k apiSortKey) compare(other apiSortKey) int {
+	switch {
+	case k.n < other.n:
+		return -1
+	case k.n > other.n:
+		return 1
+	}
+	return compareKeys(k.key, other.key, k.name, other.name)
+}
+
+// apiSortKeys get a song's key for each sort= field.
+var apiSortKeys = map[string]func(id int, song Song) apiSortKey{
+	"id":           func(id int, song Song) apiSortKey { return numberSortKey(song.itemIDAt(id)) },
+	"title":        func(id int, song Song) apiSortKey { return nameSortKey(song.sortTitle(), song.Title) },
+	"artist":       func(id int, song Song) apiSortKey { return nameSortKey(song.sortArtist(), song.Artist) },
+	"album":        func(id int, song Song) apiSortKey { return nameSortKey(song.sortAlbum(), song.Album) },
+	"album_artist": func(id int, song Song) apiSortKey { return nameSortKey(song.sortAlbumArtist(), song.albumArtist()) },
+	"disc_number":  func(id int, song Song) apiSortKey { return numberSortKey(song.DiscNumber) },
+	"track_number": func(id int, song Song) apiSortKey { return numberSortKey(song.TrackNumber) },
+	"duration_ms":  func(id int, song Song) apiSortKey { return numberSortKey(song.Duration) },
+	"rating":       func(id int, song Song) apiSortKey { return numberSortKey(song.stats().Rating) },
+	"play_count":   func(id int, song Song) apiSortKey { return numberSortKey(song.stats().PlayCount) },
+	"last_played": func(id int, song Song) apiSortKey {
+		lastPlayed := song.stats().LastPlayed
+		if lastPlayed.IsZero() {
+			return apiSortKey{n: math.MinInt64}
+		}
+		return apiSortKey{n: lastPlayed.UnixNano()}
+	},
+}
+
+// sortAPISongs sorts the songs with the given ids by a comma separated list of
+// fields, each descending if it starts with a -, e.g.
+// artist,album,track_number or -play_count. Only the keys of the fields
+// asked for are worked out.
+func sortAPISongs(database Database, ids []int, spec string) error {
+	type field struct {
+		key        func(id int, song Song) apiSortKey
+		descending bool
+	}
+	fields := []field{}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		key, ok := apiSortKeys[strings.TrimPrefix(name, "-")]
+		if !ok {
+			return fmt.Errorf("cannot sort by '%v'", name)
+		}
+		fields = append(fields, field{key, strings.HasPrefix(name, "-")})
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	type sortable struct {
+		id   int
+		keys []apiSortKey
+	}
+	songs := make([]sortable, len(ids))
+	for i, id := range ids {
+		song, _ := database.song(id)
+		songs[i] = sortable{id, make([]apiSortKey, len(fields))}
+		for k, f := range fields {
+			songs[i].keys[k] = f.key(id, song)
+		}
+	}
+	sort.SliceStable(songs, func(i, j int) bool {
+		for k, f := range fields {
+			c := songs[i].keys[k].compare(songs[j].keys[k])
+			if f.descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	for i, song := range songs {
+		ids[i] = song.id
+	}
+	return nil
+}
+
+// pageParams reads offset and limit from the query string.
+func pageParams(r *http.Request) (int, int, error) {
+	offset, limit := 0, apiDefaultLimit
+	if param := r.FormValue("offset"); param != "" {
+		var err error
+		if offset, err = strconv.Atoi(param); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Cannot convert '%v' to an offset", param)
+		}
+	}
+	if param := r.FormValue("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, fmt.Errorf("Cannot convert '%v' to a limit, it must be 1 to %v", param, apiMaxLimit)
+		}
+	}
+	return offset, limit, nil
+}
+
+// writeSongPage filters, sorts and pages the songs with the given ids.
+func writeSongPage(w http.ResponseWriter, r *http.Request, databaseID int, database Database, ids []int) {
+	matches, err := songFilter(r, database)
+	if err != nil {
+		log.Print(err)
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		log.Print(err)
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	matched := []int{}
+	for _, id := range ids {
+		song, _ := database.song(id)
+		if matches(id, song) {
+			matched = append(matched, id)
+		}
+	}
+	if err := sortAPISongs(database, matched, r.FormValue("sort")); err != nil {
+		log.Print(err)
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// only the songs on the page are converted
+	page := apiSongPage{Total: len(matched), Offset: offset, Limit: limit, Songs: []apiSong{}}
+	if offset < len(matched) {
+		end := offset + limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		for _, id := range matched[offset:end] {
+			song, _ := database.song(id)
+			page.Songs = append(page.Songs, toAPISong(databaseID, id, song))
+		}
+	}
+	writeJSON(w, page)
+}
+
+func apiSongsHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		databaseID, database, ok := apiLookupDatabase(w, r, library)
+		if !ok {
+			return
+		}
+		ids := make([]int, len(database.songs))
+		for i := range ids {
+			ids[i] = i + 1
+		}
+		writeSongPage(w, r, databaseID, database, ids)
+	})
+}
+
+func apiSongHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		databaseID, database, ok := apiLookupDatabase(w, r, library)
+		if !ok {
+			return
+		}
+		songID, ok := apiParam(w, r, "songId")
+		if !ok {
+			return
+		}
+		position, song, ok := database.item(songID)
+		if !ok {
+			apiError(w, r.URL.Path+" not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, toAPISong(databaseID, position, song))
+	})
+}
+
+func apiPlaylistsHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, database, ok := apiLookupDatabase(w, r, library)
+		if !ok {
+			return
+		}
+		playlists := []apiPlaylist{}
+		for i, c := range database.containers() {
+			playlists = append(playlists, apiPlaylist{ID: i + 1, Name: c.name, Songs: len(c.ids)})
+		}
+		writeJSON(w, playlists)
+	})
+}
+
+func apiPlaylistSongsHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		databaseID, database, ok := apiLookupDatabase(w, r, library)
+		if !ok {
+			return
+		}
+		playlistID, ok := apiParam(w, r, "playlistId")
+		if !ok {
+			return
+		}
+		containers := database.containers()
+		if playlistID < 1 || playlistID > len(containers) {
+			apiError(w, r.URL.Path+" not found", http.StatusNotFound)
+			return
+		}
+		writeSongPage(w, r, databaseID, database, containers[playlistID-1].ids)
+	})
+}
+
+func apiArtistsHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, database, ok := apiLookupDatabase(w, r, library)
+		if !ok {
+			return
+		}
+		artists := map[string]*apiArtist{}
+		albums := map[string]map[int64]bool{}
+		for _, song := range database.songs {
+			artist, ok := artists[song.Artist]
+			if !ok {
+				artist = &apiArtist{Name: song.Artist, SortName: song.sortArtist()}
+				artists[song.Artist] = artist
+				albums[song.Artist] = map[int64]bool{}
+			}
+			artist.Songs++
+			// a compilation counts once for each artist on it
+			if id := song.albumID(); id != 0 && !albums[song.Artist][id] {
+				albums[song.Artist][id] = true
+				artist.Albums++
+			}
+		}
+		list := []apiArtist{}
+		for _, artist := range artists {
+			list = append(list, *artist)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return compareKeys(collationKey(list[i].SortName), collationKey(list[j].SortName), list[i].Name, list[j].Name) < 0
+		})
+		writeJSON(w, list)
+	})
+}
+
+func apiAlbumsHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, database, ok := apiLookupDatabase(w, r, library)
+		if !ok {
+			return
+		}
+		artistFilter := foldText(r.FormValue("artist"))
+		list := []apiAlbum{}
+		for _, album := range database.albums {
+			first, _ := database.song(album.songs[0])
+			if artistFilter != "" && !albumHasArtist(database, album, artistFilter) {
+				continue
+			}
+			list = append(list, apiAlbum{
+				ID:          album.id,
+				Name:        album.name,
+				Artist:      album.artist,
+				Compilation: album.compilation,
+				Discs:       album.discs,
+				Songs:       len(album.songs),
+				sortName:    collationKey(first.sortAlbumName()),
+				sortArtist:  collationKey(first.sortAlbumArtist()),
+			})
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if c := compareKeys(list[i].sortArtist, list[j].sortArtist, list[i].Artist, list[j].Artist); c != 0 {
+				return c < 0
+			}
+			return compareKeys(list[i].sortName, list[j].sortName, list[i].Name, list[j].Name) < 0
+		})
+		writeJSON(w, list)
+	})
+}
+
+// albumHasArtist is whether an album is by an artist, or has a song by them,
+// as on a compilation. artist must be folded.
+func albumHasArtist(database Database, album Album, artist string) bool {
+	if foldText(album.artist) == artist {
+		return true
+	}
+	for _, id := range album.songs {
+		if song, _ := database.song(id); foldText(song.Artist) == artist {
+			return true
+		}
+	}
+	return false
+}
+
+func apiStatsHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		databases := library.databases()
+		stats := apiStats{Revision: library.revision(), Databases: len(databases)}
+		for _, database := range databases {
+			for _, song := range database.songs {
+				stats.Songs++
+				stats.Duration += int64(song.Duration)
+				songStats := song.stats()
+				stats.Plays += songStats.PlayCount
+				stats.Skips += songStats.SkipCount
+				if songStats.Rating > 0 {
+					stats.Rated++
+				}
+			}
+		}
+		writeJSON(w, stats)
+	})
+}
+
+func apiOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(openAPIDocument))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func apiTestRouter() http.Handler {
+	var databases = []Database{
+		{
+			name: "Music",
+			songs: []Song{
+				{Title: "Airbag", Album: "OK Computer", Artist: "Radiohead", TrackNumber: 1, Path: "/m/airbag.mp3", live: &songStats{SongStats: SongStats{PlayCount: 3}}},
+				{Title: "Lucky", Album: "OK Computer", Artist: "Radiohead", TrackNumber: 11, Path: "/m/lucky.mp3", live: &songStats{SongStats: SongStats{PlayCount: 7, Rating: 80}}},
+				{Title: "Teardrop", Album: "Mezzanine", Artist: "Massive Attack", TrackNumber: 3, Path: "/m/teardrop.m4a"},
+				{Title: "Episode 1", Album: "The Show", Artist: "Host", Path: "/p/ep1.mp3", MediaKind: MediaKindPodcast},
+			},
+		},
+	}
+	return routes(nil, newLibrary(databases), nil, nil, nil)
+}
+
+func getJSON(t *testing.T, router http.Handler, uri string, status int, v interface{}) {
+	t.Helper()
+	req := httptest.NewRequest("GET", uri, nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != status {
+		t.Fatalf("%v: wrong status %v, want %v: %v", uri, rr.Code, status, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%v: wrong content type %v", uri, ct)
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+		t.Fatalf("%v: %v", uri, err)
+	}
+}
+
+func songTitles(page apiSongPage) string {
+	titles := []string{}
+	for _, song := range page.Songs {
+		titles = append(titles, song.Title)
+	}
+	return strings.Join(titles, ",")
+}
+
+func TestAPIDatabases(t *testing.T) {
+	var databases []apiDatabase
+	getJSON(t, apiTestRouter(), "/api/v1/databases", http.StatusOK, &databases)
+	if len(databases) != 1 || databases[0] != (apiDatabase{ID: 1, Name: "Music", Kind: "library", Songs: 4, Playlists: 1}) {
+		t.Errorf("wrong databases: %+v", databases)
+	}
+}
+
+func TestAPISongs(t *testing.T) {
+	router := apiTestRouter()
+	tests := []struct {
+		uri    string
+		total  int
+		titles string
+	}{
+		{"/api/v1/databases/1/songs", 4, "Airbag,Lucky,Teardrop,Episode 1"},
+		{"/api/v1/databases/1/songs?artist=radiohead", 2, "Airbag,Lucky"},
+		{"/api/v1/databases/1/songs?q=tear", 1, "Teardrop"},
+		{"/api/v1/databases/1/songs?kind=podcast", 1, "Episode 1"},
+		{"/api/v1/databases/1/songs?query='daap.songalbum:OK*'", 2, "Airbag,Lucky"},
+		{"/api/v1/databases/1/songs?sort=-play_count,title", 4, "Lucky,Airbag,Episode 1,Teardrop"},
+		{"/api/v1/databases/1/songs?sort=artist,-track_number&limit=2&offset=1", 4, "Teardrop,Lucky"},
+		{"/api/v1/databases/1/songs?offset=10", 4, ""},
+		{"/api/v1/databases/1/playlists/1/songs", 1, "Episode 1"},
+	}
+	for _, test := range tests {
+		var page apiSongPage
+		getJSON(t, router, test.uri, http.StatusOK, &page)
+		titles := songTitles(page)
+		if page.Total != test.total || titles != test.titles {
+			t.Errorf("%v: got %v %q, want %v %q", test.uri, page.Total, titles, test.total, test.titles)
+		}
+	}
+}
+
+func TestSortAPISongs(t *testing.T) {
+	database := Database{songs: []Song{
+		{Title: "Never"},
+		{Title: "Later", AlbumArtist: "Zebra", live: &songStats{SongStats: SongStats{LastPlayed: time.Unix(2000, 0)}}},
+		{Title: "Earlier", AlbumArtist: "The Album Leaf", live: &songStats{SongStats: SongStats{LastPlayed: time.Unix(1000, 0)}}},
+	}}
+	tests := []struct {
+		sort string
+		want []int
+	}{
+		{"", []int{3, 1, 2}},
+		{"last_played", []int{1, 3, 2}},
+		{"-last_played", []int{2, 3, 1}},
+		{"album_artist", []int{1, 3, 2}},
+		{"-id", []int{3, 2, 1}},
+	}
+	for _, test := range tests {
+		ids := []int{3, 1, 2}
+		if err := sortAPISongs(database, ids, test.sort); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%q: got %v, want %v", test.sort, ids, test.want)
+		}
+	}
+	if err := sortAPISongs(database, []int{1}, "title,colour"); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestAPISong(t *testing.T) {
+	var song apiSong
+	getJSON(t, apiTestRouter(), "/api/v1/databases/1/songs/3", http.StatusOK, &song)
+	mezzanine := Song{Album: "Mezzanine", Artist: "Massive Attack"}.albumID()
+	want := apiSong{ID: 3, Title: "Teardrop", Album: "Mezzanine", Artist: "Massive Attack", AlbumArtist: "Massive Attack", AlbumID: mezzanine, TrackNumber: 3, Format: "m4a", MediaKind: "music", StreamURL: "/databases/1/items/3.m4a"}
+	if song != want {
+		t.Errorf("wrong song:\n%+v\nwant:\n%+v", song, want)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	router := apiTestRouter()
+	for uri, status := range map[string]int{
+		"/api/v1/databases/2/songs":               http.StatusNotFound,
+		"/api/v1/databases/x/songs":               http.StatusBadRequest,
+		"/api/v1/databases/1/songs/5":             http.StatusNotFound,
+		"/api/v1/databases/1/playlists/2/songs":   http.StatusNotFound,
+		"/api/v1/databases/1/songs?sort=colour":   http.StatusBadRequest,
+		"/api/v1/databases/1/songs?limit=0":       http.StatusBadRequest,
+		"/api/v1/databases/1/songs?query='broken": http.StatusBadRequest,
+	} {
+		var body map[string]string
+		getJSON(t, router, uri, status, &body)
+		if body["error"] == "" {
+			t.Errorf("%v: no error message", uri)
+		}
+	}
+}
+
+func TestAPIArtistsAndAlbums(t *testing.T) {
+	router := apiTestRouter()
+	var artists []apiArtist
+	getJSON(t, router, "/api/v1/databases/1/artists", http.StatusOK, &artists)
+	if len(artists) != 3 || artists[2] != (apiArtist{Name: "Radiohead", SortName: "Radiohead", Albums: 1, Songs: 2}) {
+		t.Errorf("wrong artists: %+v", artists)
+	}
+	var albums []apiAlbum
+	getJSON(t, router, "/api/v1/databases/1/albums?artist=Massive%20Attack", http.StatusOK, &albums)
+	mezzanine := Song{Album: "Mezzanine", Artist: "Massive Attack"}.albumID()
+	if len(albums) != 1 || albums[0] != (apiAlbum{ID: mezzanine, Name: "Mezzanine", Artist: "Massive Attack", Discs: 1, Songs: 1}) {
+		t.Errorf("wrong albums: %+v", albums)
+	}
+}
+
+func TestAPICompilations(t *testing.T) {
+	router := routes(nil, newLibrary([]Database{{
+		name: "Music",
+		songs: []Song{
+			{Title: "Hit One", Album: "Now 42", Artist: "Abba", Compilation: true},
+			{Title: "Hit Two", Album: "Now 42", Artist: "Blur", Compilation: true},
+			{Title: "Song 2", Album: "Blur", Artist: "Blur", DiscNumber: 1},
+			{Title: "Bonus", Album: "Blur (Disc 2)", Artist: "Blur", DiscNumber: 2},
+		},
+	}}), nil, nil, nil)
+
+	var albums []apiAlbum
+	getJSON(t, router, "/api/v1/databases/1/albums?artist=blur", http.StatusOK, &albums)
+	if len(albums) != 2 {
+		t.Fatalf("wrong albums: %+v", albums)
+	}
+	if albums[0].Name != "Blur" || albums[0].Discs != 2 || albums[0].Songs != 2 {
+		t.Errorf("discs not one album: %+v", albums[0])
+	}
+	if albums[1].Name != "Now 42" || albums[1].Artist != "Various Artists" || !albums[1].Compilation || albums[1].Songs != 2 {
+		t.Errorf("compilation not one album: %+v", albums[1])
+	}
+
+	var page apiSongPage
+	getJSON(t, router, fmt.Sprintf("/api/v1/databases/1/songs?album_id=%d", albums[1].ID), http.StatusOK, &page)
+	if titles := songTitles(page); titles != "Hit One,Hit Two" {
+		t.Errorf("wrong songs on the compilation: %q", titles)
+	}
+	if page.Songs[0].AlbumID != albums[1].ID || page.Songs[0].AlbumArtist != "Various Artists" {
+		t.Errorf("wrong album of a song: %+v", page.Songs[0])
+	}
+
+	var artists []apiArtist
+	getJSON(t, router, "/api/v1/databases/1/artists", http.StatusOK, &artists)
+	if len(artists) != 2 || artists[1].Name != "Blur" || artists[1].Albums != 2 {
+		t.Errorf("wrong artists: %+v", artists)
+	}
+
+	var body map[string]string
+	getJSON(t, router, "/api/v1/databases/1/songs?album_id=x", http.StatusBadRequest, &body)
+}
+
+func TestAPISortNames(t *testing.T) {
+	router := routes(nil, newLibrary([]Database{{
+		name: "Music",
+		songs: []Song{
+			{Title: "Zebra", Artist: "Beach House"},
+			{Title: "Help!", Artist: "The Beatles", Album: "Help!"},
+			{Title: "Alors on danse", Artist: "Stromae"},
+			{Title: "Été", Artist: "Éric Serra"},
+			{Title: "Thriller", Artist: "Michael Jackson", SortArtist: "Jackson, Michael"},
+		},
+	}}), nil, nil, nil)
+
+	var artists []apiArtist
+	getJSON(t, router, "/api/v1/databases/1/artists", http.StatusOK, &artists)
+	names := []string{}
+	for _, artist := range artists {
+		names = append(names, artist.Name)
+	}
+	if got := strings.Join(names, ","); got != "Beach House,The Beatles,Éric Serra,Michael Jackson,Stromae" {
+		t.Errorf("wrong artist order: %v", got)
+	}
+	if artists[1].SortName != "Beatles" {
+		t.Errorf("wrong sort name: %+v", artists[1])
+	}
+
+	var page apiSongPage
+	getJSON(t, router, "/api/v1/databases/1/songs?sort=title", http.StatusOK, &page)
+	if titles := songTitles(page); titles != "Alors on danse,Été,Help!,Thriller,Zebra" {
+		t.Errorf("wrong title order: %v", titles)
+	}
+}
+
+func TestAPIStats(t *testing.T) {
+	var stats apiStats
+	getJSON(t, apiTestRouter(), "/api/v1/stats", http.StatusOK, &stats)
+	if stats != (apiStats{Revision: 1, Databases: 1, Songs: 4, Plays: 10, Rated: 1}) {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+}
+
+func TestAPIPassword(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "testdb", password: "secret"})
+
+	var body map[string]string
+	getJSON(t, apiTestRouter(), "/api/v1/databases", http.StatusUnauthorized, &body)
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	var doc struct {
+		Paths map[string]interface{} `json:"paths"`
+	}
+	getJSON(t, apiTestRouter(), "/api/v1/openapi.json", http.StatusOK, &doc)
+	for _, path := range []string{
+		"/databases",
+		"/databases/{databaseId}/songs",
+		"/databases/{databaseId}/songs/{songId}",
+		"/databases/{databaseId}/playlists",
+		"/databases/{databaseId}/playlists/{playlistId}/songs",
+		"/databases/{databaseId}/artists",
+		"/databases/{databaseId}/albums",
+		"/stats",
+		"/openapi.json",
+	} {
+		if _, ok := doc.Paths[path]; !ok {
+			t.Errorf("%v isn't documented", path)
+		}
+	}
+}
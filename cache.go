@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// responseCacheSize bounds the memory used by cached item listings.
+var responseCacheSize = 64 << 20
+
+type cacheKey struct {
+	database int
+	revision int
+	plays    int64
+	meta     string
+	query    string
+	sort     string
+	headers  bool
+	index    string
+	gzip     bool
+}
+
+// etag identifies the listing for a key. A key always gives the same listing
+// while the server runs, so it's worked out from the key rather than the
+// body, and can be sent before the listing is written. It starts with the
+// library revision, so a listing from another revision never matches.
+func (k cacheKey) etag() string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d %+v", startTime.UnixNano(), k)
+	return fmt.Sprintf(`"%d-%x"`, k.revision, h.Sum64())
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	body    []byte
+	etag    string
+	gzipped bool
+}
+
+// responseCache keeps encoded listings until the library revision changes,
+// evicting the least recently used ones when it grows past maxBytes.
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	revision int
+	order    *list.List
+	entries  map[cacheKey]*list.Element
+	hits     int
+	misses   int
+}
+
+func newResponseCache(maxBytes int) *responseCache {
+	return &responseCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[cacheKey]*list.Element{},
+	}
+}
+
+// normalizeMeta trims and de-duplicates a meta= list so trivially different
+// requests share a cache entry. Order is kept as it decides the output order.
+func normalizeMeta(fields []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || seen[field] {
+			continue
+		}
+		seen[field] = true
+		normalized = append(normalized, field)
+	}
+	return normalized
+}
+
+func (c *responseCache) get(key cacheKey) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkRevision(key.revision)
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry), true
+}
+
+// put stores a body, gzipping it first if the key asks for it and it is big
+// enough to be worth it. The entry is returned even if it was too big to keep.
+func (c *responseCache) put(key cacheKey, body []byte) *cacheEntry {
+	entry := &cacheEntry{key: key, body: body}
+	if key.gzip && len(body) >= gzipThreshold {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		entry.body = buf.Bytes()
+		entry.gzipped = true
+	}
+	entry.etag = key.etag()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkRevision(key.revision)
+	if key.revision < c.revision || len(entry.body) > c.maxBytes {
+		return entry
+	}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += len(entry.body)
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+	return entry
+}
+
+// stats returns the hit and miss counts and the bytes cached.
+func (c *responseCache) stats() (int, int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.size
+}
+
+func (c *responseCache) checkRevision(revision int) {
+	if revision <= c.revision {
+		return
+	}
+	c.revision = revision
+	c.order.Init()
+	c.entries = map[cacheKey]*list.Element{}
+	c.size = 0
+}
+
+func (c *responseCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.body)
+}
+
+func matchesETag(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
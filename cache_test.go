@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeMeta(t *testing.T) {
+	got := normalizeMeta([]string{" dmap.itemid", "dmap.itemname", "", "dmap.itemid "})
+	if strings.Join(got, ",") != "dmap.itemid,dmap.itemname" {
+		t.Errorf("wrong normalized meta: %v", got)
+	}
+}
+
+func TestResponseCacheHit(t *testing.T) {
+	cache := newResponseCache(1024)
+	key := cacheKey{database: 1, revision: 1, meta: "dmap.itemid"}
+	if _, ok := cache.get(key); ok {
+		t.Fatal("empty cache returned an entry")
+	}
+	put := cache.put(key, []byte("body"))
+	got, ok := cache.get(key)
+	if !ok {
+		t.Fatal("cache did not return stored entry")
+	}
+	if !bytes.Equal(got.body, []byte("body")) || got.etag != put.etag || got.etag == "" {
+		t.Errorf("wrong cached entry: %+v", got)
+	}
+	if cache.hits != 1 || cache.misses != 1 {
+		t.Errorf("wrong hit/miss counts: %v/%v", cache.hits, cache.misses)
+	}
+}
+
+func TestResponseCacheRevision(t *testing.T) {
+	cache := newResponseCache(1024)
+	cache.put(cacheKey{database: 1, revision: 1}, []byte("old"))
+	if _, ok := cache.get(cacheKey{database: 1, revision: 2}); ok {
+		t.Error("cache returned entry for a different revision")
+	}
+	if _, ok := cache.get(cacheKey{database: 1, revision: 1}); ok {
+		t.Error("cache kept entry for an old revision")
+	}
+	if cache.size != 0 {
+		t.Errorf("wrong cache size after invalidation: %v", cache.size)
+	}
+	cache.put(cacheKey{database: 1, revision: 1}, []byte("stale"))
+	if _, ok := cache.get(cacheKey{database: 1, revision: 1}); ok {
+		t.Error("cache stored entry for an old revision")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := newResponseCache(10)
+	a := cacheKey{database: 1, meta: "a"}
+	b := cacheKey{database: 1, meta: "b"}
+	c := cacheKey{database: 1, meta: "c"}
+	cache.put(a, []byte("aaaa"))
+	cache.put(b, []byte("bbbb"))
+	cache.get(a)
+	cache.put(c, []byte("cccc"))
+	if _, ok := cache.get(b); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if _, ok := cache.get(a); !ok {
+		t.Error("recently used entry was evicted")
+	}
+	if _, ok := cache.get(c); !ok {
+		t.Error("newest entry was evicted")
+	}
+	if cache.size != 8 {
+		t.Errorf("wrong cache size: %v", cache.size)
+	}
+
+	big := cacheKey{database: 1, meta: "big"}
+	entry := cache.put(big, bytes.Repeat([]byte("x"), 11))
+	if len(entry.body) != 11 {
+		t.Error("oversized entry not returned")
+	}
+	if _, ok := cache.get(big); ok {
+		t.Error("oversized entry was cached")
+	}
+}
+
+func TestResponseCacheGzip(t *testing.T) {
+	cache := newResponseCache(1 << 20)
+	body := bytes.Repeat([]byte("mlit"), gzipThreshold)
+	entry := cache.put(cacheKey{gzip: true}, body)
+	if !entry.gzipped {
+		t.Fatal("entry was not gzipped")
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(entry.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, body) {
+		t.Error("decompressed body doesn't match")
+	}
+
+	entry = cache.put(cacheKey{gzip: true, meta: "small"}, []byte("small"))
+	if entry.gzipped {
+		t.Error("small entry was gzipped")
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"def", "abc"`, true},
+		{`"def"`, false},
+		{"*", true},
+	}
+	for _, test := range tests {
+		if got := matchesETag(test.ifNoneMatch, `"abc"`); got != test.want {
+			t.Errorf("wrong match for '%v', want %v, got %v", test.ifNoneMatch, test.want, got)
+		}
+	}
+}
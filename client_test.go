@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+// TestClient runs the daap client against our own server.
+func TestClient(t *testing.T) {
+	f, err := ioutil.TempFile("", "song*.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not really an mp3")
+	f.Close()
+
+	var databases = []Database{
+		{name: "testdb", songs: []Song{
+			{Title: "one", Album: "an album", Artist: "an artist", Path: f.Name()},
+			{Title: "two", Album: "an album", Artist: "an artist", Path: f.Name()},
+		}},
+	}
+	library := newLibrary(databases)
+	server := httptest.NewServer(routes(contentCodes, library, nil, nil, nil))
+	defer server.Close()
+
+	ctx := context.Background()
+	client := daap.NewClient(server.URL)
+	client.Password = "secret"
+
+	info, err := client.ServerInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "daap-server" || info.DAAPVersion.Major != 3 || info.DatabasesCount != 1 {
+		t.Errorf("wrong server info: %+v", info)
+	}
+
+	codes, err := client.ContentCodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != len(contentCodes) {
+		t.Errorf("wrong number of content codes, want %v, got %v", len(contentCodes), len(codes))
+	}
+
+	if err := client.Login(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if client.SessionID() == 0 {
+		t.Error("no session id after login")
+	}
+
+	revision, err := client.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 1 {
+		t.Errorf("wrong revision: %v", revision)
+	}
+
+	dbs, err := client.Databases(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbs) != 1 || dbs[0].Name != "testdb" || dbs[0].ItemCount != 2 {
+		t.Fatalf("wrong databases: %+v", dbs)
+	}
+
+	songs, err := client.Items(ctx, dbs[0].ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 2 {
+		t.Fatalf("wrong number of songs: %+v", songs)
+	}
+	if songs[1].ID != 2 || songs[1].Title != "two" || songs[1].Artist != "an artist" || songs[1].Format != "mp3" || songs[1].Kind != 2 {
+		t.Errorf("wrong song: %+v", songs[1])
+	}
+
+	playlists, err := client.Containers(ctx, dbs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists) != 0 {
+		t.Errorf("unexpected playlists: %+v", playlists)
+	}
+
+	stream, err := client.Stream(ctx, dbs[0].ID, songs[1], 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(stream)
+	stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "really an mp3" || stream.Offset != 4 || stream.Size != 17 {
+		t.Errorf("wrong stream: %q from %v of %v", p, stream.Offset, stream.Size)
+	}
+
+	library.bumpRevision()
+	revision, err = client.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 2 {
+		t.Errorf("wrong revision after change: %v", revision)
+	}
+
+	// now that the client is up to date the next update waits for a change
+	updated := make(chan int)
+	go func() {
+		revision, err := client.Update(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		updated <- revision
+	}()
+	select {
+	case <-updated:
+		t.Fatal("update returned before the library changed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// songs are still streamed while an update is pending, as the proxy does
+	stream, err = client.Stream(ctx, dbs[0].ID, songs[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if client.Revision() != 2 {
+		t.Errorf("wrong revision while waiting: %v", client.Revision())
+	}
+	library.bumpRevision()
+	select {
+	case revision := <-updated:
+		if revision != 3 {
+			t.Errorf("wrong revision after update: %v", revision)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("update did not return")
+	}
+
+	if err := client.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
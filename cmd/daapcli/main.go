@@ -0,0 +1,234 @@
+// Command daapcli explores and mirrors remote DAAP shares.
+//
+//	daapcli [-server url] [-password pw] [-db id] command
+//
+// Commands:
+//
+//	info                 show server info
+//	ls databases         list databases
+//	ls items [--query q] list songs, optionally filtered with a DAAP query
+//	ls playlists         list playlists
+//	get [-o file] <item> download one song
+//	mirror <dir>         download every song into dir/Artist/Album/NN Title.ext
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: daapcli [flags] command
+commands:
+  info
+  ls databases
+  ls items [--query q]
+  ls playlists
+  get [-o file] <item>
+  mirror <dir>
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:3689", "DAAP server URL")
+	password := flag.String("password", "", "share password")
+	databaseID := flag.Int("db", 0, "database id, the first one if not set")
+	flag.Usage = usage
+	flag.Parse()
+	log.SetFlags(0)
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	client := daap.NewClient(*server)
+	client.Password = *password
+
+	if args[0] == "info" {
+		if err := info(ctx, client); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := client.Login(ctx); err != nil {
+		log.Fatalf("login failed: %v", err)
+	}
+	defer client.Logout(ctx)
+	if _, err := client.Update(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	var err error
+	switch {
+	case len(args) == 2 && args[0] == "ls" && args[1] == "databases":
+		err = listDatabases(ctx, client)
+	case len(args) >= 2 && args[0] == "ls" && args[1] == "items":
+		fs := flag.NewFlagSet("ls items", flag.ExitOnError)
+		query := fs.String("query", "", "DAAP query, e.g. 'daap.songartist:Some Artist'")
+		fs.Parse(args[2:])
+		err = withDatabase(ctx, client, *databaseID, func(id int) error {
+			return listItems(ctx, client, id, *query)
+		})
+	case len(args) == 2 && args[0] == "ls" && args[1] == "playlists":
+		err = withDatabase(ctx, client, *databaseID, func(id int) error {
+			return listPlaylists(ctx, client, id)
+		})
+	case args[0] == "get":
+		fs := flag.NewFlagSet("get", flag.ExitOnError)
+		output := fs.String("o", "", "output file, the song title if not set")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			usage()
+			os.Exit(2)
+		}
+		var itemID int
+		if _, err := fmt.Sscan(fs.Arg(0), &itemID); err != nil {
+			log.Fatalf("bad item id '%v'", fs.Arg(0))
+		}
+		err = withDatabase(ctx, client, *databaseID, func(id int) error {
+			return get(ctx, client, id, itemID, *output)
+		})
+	case len(args) == 2 && args[0] == "mirror":
+		err = withDatabase(ctx, client, *databaseID, func(id int) error {
+			return mirror(ctx, client, id, args[1])
+		})
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// withDatabase runs f with the chosen database id, or the first database's if
+// none was chosen.
+func withDatabase(ctx context.Context, client *daap.Client, id int, f func(int) error) error {
+	if id != 0 {
+		return f(id)
+	}
+	databases, err := client.Databases(ctx)
+	if err != nil {
+		return err
+	}
+	if len(databases) == 0 {
+		return fmt.Errorf("server has no databases")
+	}
+	return f(databases[0].ID)
+}
+
+func info(ctx context.Context, client *daap.Client) error {
+	info, err := client.ServerInfo(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "name:\t%v\n", info.Name)
+	fmt.Fprintf(w, "DAAP version:\t%v.%v.%v\n", info.DAAPVersion.Major, info.DAAPVersion.Minor, info.DAAPVersion.Patch)
+	fmt.Fprintf(w, "DMAP version:\t%v.%v.%v\n", info.DMAPVersion.Major, info.DMAPVersion.Minor, info.DMAPVersion.Patch)
+	fmt.Fprintf(w, "login required:\t%v\n", info.LoginRequired)
+	fmt.Fprintf(w, "timeout:\t%vs\n", info.TimeoutInterval)
+	fmt.Fprintf(w, "databases:\t%v\n", info.DatabasesCount)
+	return w.Flush()
+}
+
+func listDatabases(ctx context.Context, client *daap.Client) error {
+	databases, err := client.Databases(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tITEMS\tPLAYLISTS")
+	for _, database := range databases {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", database.ID, database.Name, database.ItemCount, database.ContainerCount)
+	}
+	return w.Flush()
+}
+
+func listItems(ctx context.Context, client *daap.Client, databaseID int, query string) error {
+	songs, err := client.QueryItems(ctx, databaseID, nil, query)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tARTIST\tALBUM\tTRACK\tTITLE\tFORMAT")
+	for _, song := range songs {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", song.ID, song.Artist, song.Album, song.TrackNumber, song.Title, song.Format)
+	}
+	return w.Flush()
+}
+
+func listPlaylists(ctx context.Context, client *daap.Client, databaseID int) error {
+	playlists, err := client.Containers(ctx, databaseID)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tITEMS")
+	for _, playlist := range playlists {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", playlist.ID, playlist.Name, playlist.ItemCount)
+	}
+	return w.Flush()
+}
+
+func get(ctx context.Context, client *daap.Client, databaseID, itemID int, output string) error {
+	songs, err := client.Items(ctx, databaseID, nil)
+	if err != nil {
+		return err
+	}
+	for _, song := range songs {
+		if song.ID != itemID {
+			continue
+		}
+		if output == "" {
+			output = sanitize(song.Title, "Unknown Title") + "." + songFormat(song)
+		}
+		if _, err := download(ctx, client, databaseID, song, output); err != nil {
+			return err
+		}
+		fmt.Println(output)
+		return nil
+	}
+	return fmt.Errorf("no item %v in database %v", itemID, databaseID)
+}
+
+func mirror(ctx context.Context, client *daap.Client, databaseID int, dir string) error {
+	songs, err := client.Items(ctx, databaseID, nil)
+	if err != nil {
+		return err
+	}
+	var downloaded, skipped, failed int
+	paths := mirrorPaths(songs)
+	for i, song := range songs {
+		path := filepath.Join(dir, paths[i])
+		ok, err := download(ctx, client, databaseID, song, path)
+		switch {
+		case err != nil:
+			log.Printf("%v: %v", path, err)
+			failed++
+		case ok:
+			fmt.Println(path)
+			downloaded++
+		default:
+			skipped++
+		}
+	}
+	log.Printf("%v downloaded, %v already present, %v failed", downloaded, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%v songs failed to download", failed)
+	}
+	return nil
+}
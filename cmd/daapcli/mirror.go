@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+func songFormat(song daap.Song) string {
+	if song.Format == "" {
+		return "mp3"
+	}
+	return song.Format
+}
+
+// sanitize makes a tag value safe to use as a single path element.
+func sanitize(s, fallback string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r < 32, strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.Trim(strings.TrimSpace(s), ".")
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+// mirrorPath is where a song goes relative to the mirror directory,
+// Artist/Album/NN Title.ext.
+func mirrorPath(song daap.Song) string {
+	name := sanitize(song.Title, "Unknown Title")
+	if song.TrackNumber > 0 {
+		name = fmt.Sprintf("%02d %v", song.TrackNumber, name)
+	}
+	return filepath.Join(
+		sanitize(song.Artist, "Unknown Artist"),
+		sanitize(song.Album, "Unknown Album"),
+		name+"."+songFormat(song),
+	)
+}
+
+// mirrorPaths gives each song its mirrorPath, numbering the songs after the
+// first that would share one, e.g. "01 Intro (2).mp3". Paths are compared
+// ignoring case, as the mirror may be on a case insensitive filesystem.
+func mirrorPaths(songs []daap.Song) []string {
+	paths := make([]string, len(songs))
+	taken := map[string]bool{}
+	for i, song := range songs {
+		path := mirrorPath(song)
+		ext := filepath.Ext(path)
+		for n := 2; taken[strings.ToLower(path)]; n++ {
+			path = fmt.Sprintf("%v (%d)%v", strings.TrimSuffix(mirrorPath(song), ext), n, ext)
+		}
+		taken[strings.ToLower(path)] = true
+		paths[i] = path
+	}
+	return paths
+}
+
+// download saves a song to path, returning false if it was already there. It
+// goes via a .part file so that an interrupted download can be resumed.
+func download(ctx context.Context, client *daap.Client, databaseID int, song daap.Song, path string) (bool, error) {
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+
+	partPath := path + ".part"
+	var offset int64
+	if fi, err := os.Stat(partPath); err == nil {
+		offset = fi.Size()
+	}
+
+	stream, err := client.Stream(ctx, databaseID, song, offset)
+	var rangeErr *daap.RangeError
+	if errors.As(err, &rangeErr) && offset > 0 && rangeErr.Size == offset {
+		// the part file is the whole song, the last run stopped before
+		// renaming it
+		return true, os.Rename(partPath, path)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if stream.Offset == offset && offset > 0 {
+		flags |= os.O_APPEND
+	} else {
+		// the server started from the beginning
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return false, err
+	}
+	written, err := io.Copy(f, stream)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	if stream.Size >= 0 && stream.Offset+written != stream.Size {
+		return false, fmt.Errorf("short download, got %v of %v bytes", stream.Offset+written, stream.Size)
+	}
+	return true, os.Rename(partPath, path)
+}
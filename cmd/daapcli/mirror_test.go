@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"AC/DC", "AC_DC"},
+		{"  What?  ", "What_"},
+		{"...", "fallback"},
+		{"", "fallback"},
+		{"Björk", "Björk"},
+	}
+	for _, test := range tests {
+		if got := sanitize(test.in, "fallback"); got != test.want {
+			t.Errorf("wrong result for '%v', want '%v', got '%v'", test.in, test.want, got)
+		}
+	}
+}
+
+func TestMirrorPath(t *testing.T) {
+	song := daap.Song{Title: "Track", Album: "Album", Artist: "Artist", Format: "m4a", TrackNumber: 3}
+	if got := mirrorPath(song); got != filepath.Join("Artist", "Album", "03 Track.m4a") {
+		t.Errorf("wrong path: %v", got)
+	}
+	if got := mirrorPath(daap.Song{}); got != filepath.Join("Unknown Artist", "Unknown Album", "Unknown Title.mp3") {
+		t.Errorf("wrong path for empty song: %v", got)
+	}
+}
+
+func TestMirrorPaths(t *testing.T) {
+	songs := []daap.Song{
+		{Title: "Intro", Album: "Album", Artist: "Artist", TrackNumber: 1},
+		{Title: "Intro", Album: "Album", Artist: "Artist", TrackNumber: 1},
+		{Title: "intro", Album: "album", Artist: "artist", TrackNumber: 1},
+		{Title: "Outro", Album: "Album", Artist: "Artist", TrackNumber: 2},
+	}
+	want := []string{
+		filepath.Join("Artist", "Album", "01 Intro.mp3"),
+		filepath.Join("Artist", "Album", "01 Intro (2).mp3"),
+		filepath.Join("artist", "album", "01 intro (3).mp3"),
+		filepath.Join("Artist", "Album", "02 Outro.mp3"),
+	}
+	if got := mirrorPaths(songs); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong paths:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/databases/1/items/2.mp3" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		w.Header().Set("Content-Type", "audio/mpeg")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "daapcli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	client := daap.NewClient(server.URL)
+	song := daap.Song{ID: 2, Format: "mp3"}
+	path := filepath.Join(dir, "a", "b", "song.mp3")
+
+	// pretend an earlier download got part of the way
+	os.MkdirAll(filepath.Dir(path), 0755)
+	ioutil.WriteFile(path+".part", content[:8], 0644)
+
+	ok, err := download(ctx, client, 1, song, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("song was not downloaded")
+	}
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, content) {
+		t.Errorf("wrong content: %q", p)
+	}
+	if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Error("part file left behind")
+	}
+
+	ok, err = download(ctx, client, 1, song, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || requests != 1 {
+		t.Errorf("existing song was downloaded again")
+	}
+
+	// the whole song was downloaded but not renamed, so the server can't
+	// serve the rest
+	path = filepath.Join(dir, "a", "b", "done.mp3")
+	ioutil.WriteFile(path+".part", content, 0644)
+	ok, err = download(ctx, client, 1, song, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || requests != 2 {
+		t.Errorf("wrong result for a finished part file: %v after %v requests", ok, requests)
+	}
+	if p, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(p, content) {
+		t.Errorf("wrong content: %q %v", p, err)
+	}
+}
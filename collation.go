@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultSortArticles are stripped from the start of names that have no sort
+// name, so The Beatles sort under B.
+var defaultSortArticles = []string{"the", "a", "an"}
+
+// defaultSortLanguage is the language whose collation rules names are sorted
+// by unless sort_language says otherwise.
+var defaultSortLanguage = language.English
+
+// parseSortArticles reads a comma separated list of articles, like
+// "the,a,an,le,la,les".
+func parseSortArticles(s string) ([]string, error) {
+	articles := []string{}
+	for _, article := range strings.Split(s, ",") {
+		article = strings.TrimSpace(article)
+		if article == "" {
+			continue
+		}
+		if strings.ContainsAny(article, " \t") {
+			return nil, fmt.Errorf("sort article '%v' should be a single word", article)
+		}
+		articles = append(articles, foldText(article))
+	}
+	return articles, nil
+}
+
+// deriveSortName is name without a leading article, for names without a sort
+// tag. Articles followed by an apostrophe, like l'Orchestre, are stripped too.
+// A name that is only an article is left alone.
+func deriveSortName(name string, articles []string) string {
+	end := strings.IndexAny(name, " '’")
+	if end < 0 {
+		return name
+	}
+	rest := strings.TrimSpace(name[end:])
+	if name[end] != ' ' {
+		// keep the length of ' or ’ out of the rest
+		_, size := utf8.DecodeRuneInString(name[end:])
+		rest = strings.TrimSpace(name[end+size:])
+	}
+	if rest == "" {
+		return name
+	}
+	first := foldText(name[:end])
+	for _, article := range articles {
+		if first == article {
+			return rest
+		}
+	}
+	return name
+}
+
+// sortArtist is the name the song's artist is sorted by.
+func (s Song) sortArtist() string {
+	if s.SortArtist != "" {
+		return s.SortArtist
+	}
+	return deriveSortName(s.Artist, currentShare().sortArticles)
+}
+
+func (s Song) sortAlbum() string {
+	if s.SortAlbum != "" {
+		return s.SortAlbum
+	}
+	return deriveSortName(s.Album, currentShare().sortArticles)
+}
+
+func (s Song) sortTitle() string {
+	if s.SortName != "" {
+		return s.SortName
+	}
+	return deriveSortName(s.Title, currentShare().sortArticles)
+}
+
+func (s Song) sortAlbumArtist() string {
+	if s.SortAlbumArtist != "" {
+		return s.SortAlbumArtist
+	}
+	if s.AlbumArtist == "" && !s.Compilation {
+		return s.sortArtist()
+	}
+	return deriveSortName(s.albumArtist(), currentShare().sortArticles)
+}
+
+// sortCollation sorts names by the Unicode Collation Algorithm with the
+// rules of the share's sort language, so Å sorts with A in English and after
+// Z in Swedish. Collators aren't safe for concurrent use, hence the lock.
+var sortCollation struct {
+	sync.Mutex
+	tag   language.Tag
+	key   *collate.Collator
+	loose *collate.Collator
+	buf   collate.Buffer
+}
+
+// collator locks sortCollation, making its collators for the share's sort
+// language if it changed, and returns the unlock.
+func collator() func() {
+	tag := currentShare().sortLanguage
+	sortCollation.Lock()
+	if sortCollation.key == nil || sortCollation.tag != tag {
+		sortCollation.tag = tag
+		sortCollation.key = collate.New(tag)
+		sortCollation.loose = collate.New(tag, collate.Loose)
+	}
+	return sortCollation.Unlock
+}
+
+// trimSortName leaves off leading punctuation, so "(What's the Story)" sorts
+// with the Ws.
+func trimSortName(s string) string {
+	return strings.TrimLeftFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// collationKey is what a name is sorted by: its collation key, in which case
+// and accents only break ties, without leading punctuation.
+func collationKey(s string) string {
+	defer collator()()
+	sortCollation.buf.Reset()
+	return string(sortCollation.key.KeyFromString(&sortCollation.buf, trimSortName(s)))
+}
+
+// compareKeys compares names by their collation keys. Names with the same key
+// are ordered by their exact text, so the order is always the same.
+func compareKeys(aKey, bKey, a, b string) int {
+	if c := strings.Compare(aKey, bKey); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// sortHeaderChar is the character a sort name is listed under in an index of
+// the listing: its first letter in upper case, or # for digits and symbols.
+// Accented letters are listed under their base letter when the sort language
+// sorts them together, so É is under E, but Å is under Å in Swedish.
+func sortHeaderChar(name string) rune {
+	r, _ := utf8.DecodeRuneInString(trimSortName(name))
+	if !unicode.IsLetter(r) || r > 0xffff {
+		// mshc only has room for 16 bits
+		return '#'
+	}
+	r = unicode.ToUpper(r)
+	base, _ := utf8.DecodeRuneInString(norm.NFKD.String(string(r)))
+	if base == r || !unicode.IsLetter(base) {
+		return r
+	}
+	defer collator()()
+	if sortCollation.loose.CompareString(string(r), string(base)) == 0 {
+		return base
+	}
+	return r
+}
+
+// sortHeader is an entry in the mshl index of a sorted listing: the songs
+// from index on, count of them, are listed under char.
+type sortHeader struct {
+	char  rune
+	index int
+	count int
+}
+
+// songSort is a sort= order of songs: the sort name a song is listed under
+// in the headers and the keys to compare in turn.
+type songSort struct {
+	name func(Song) string
+	keys func(Song) []string
+}
+
+// songSorts are the sort= orders DAAP clients ask for.
+var songSorts = map[string]songSort{
+	"name": {Song.sortTitle, func(s Song) []string { return []string{collationKey(s.sortTitle()), s.Title} }},
+	"artist": {Song.sortArtist, func(s Song) []string {
+		return []string{collationKey(s.sortArtist()), s.Artist, collationKey(s.sortAlbum()), s.Album, trackKey(s)}
+	}},
+	"album": {Song.sortAlbum, func(s Song) []string {
+		return []string{collationKey(s.sortAlbum()), s.Album, trackKey(s)}
+	}},
+	"albumartist": {Song.sortAlbumArtist, func(s Song) []string {
+		return []string{collationKey(s.sortAlbumArtist()), s.albumArtist(), collationKey(s.sortAlbum()), s.Album, trackKey(s)}
+	}},
+}
+
+// trackKey is a song's disc and track number as text that sorts in order.
+func trackKey(s Song) string {
+	return fmt.Sprintf("%05d%05d", s.DiscNumber, s.TrackNumber)
+}
+
+// lessKeys compares keys from songSorts or groupSorts in turn.
+func lessKeys(a, b []string) bool {
+	for k := range a {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return false
+}
+
+// sortSongIDs sorts the songs with the given ids by one of songSorts,
+// returning the sorted ids and the headers for an index of them.
+func sortSongIDs(database Database, ids []int, by string) ([]int, []sortHeader, error) {
+	order, ok := songSorts[by]
+	if !ok {
+		return nil, nil, fmt.Errorf("cannot sort by '%v'", by)
+	}
+	type sortable struct {
+		id   int
+		name string
+		keys []string
+	}
+	songs := make([]sortable, len(ids))
+	for i, id := range ids {
+		song, _ := database.song(id)
+		songs[i] = sortable{id, order.name(song), order.keys(song)}
+	}
+	sort.SliceStable(songs, func(i, j int) bool { return lessKeys(songs[i].keys, songs[j].keys) })
+
+	sorted := make([]int, len(songs))
+	names := make([]string, len(songs))
+	for i, song := range songs {
+		sorted[i] = song.id
+		names[i] = song.name
+	}
+	return sorted, sortHeaders(names), nil
+}
+
+// sortHeaders are the headers for an index of a listing, given the sort names
+// in the order listed.
+func sortHeaders(names []string) []sortHeader {
+	headers := []sortHeader{}
+	for i, name := range names {
+		char := sortHeaderChar(name)
+		if len(headers) == 0 || headers[len(headers)-1].char != char {
+			headers = append(headers, sortHeader{char: char, index: i})
+		}
+		headers[len(headers)-1].count++
+	}
+	return headers
+}
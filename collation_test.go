@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func TestDeriveSortName(t *testing.T) {
+	articles := []string{"the", "a", "an", "l"}
+	tests := map[string]string{
+		"The Beatles":          "Beatles",
+		"the the":              "the",
+		"THE  Who":             "Who",
+		"A Tribe Called Quest": "Tribe Called Quest",
+		"An Horse":             "Horse",
+		"Theatre of Tragedy":   "Theatre of Tragedy",
+		"The":                  "The",
+		"A ":                   "A ",
+		"l'Orchestre":          "Orchestre",
+		"Radiohead":            "Radiohead",
+		"":                     "",
+	}
+	for name, want := range tests {
+		if got := deriveSortName(name, articles); got != want {
+			t.Errorf("deriveSortName(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if got := deriveSortName("The Beatles", nil); got != "The Beatles" {
+		t.Errorf("stripped an article without any: %q", got)
+	}
+}
+
+func TestParseSortArticles(t *testing.T) {
+	articles, err := parseSortArticles("The, a,,LES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(articles, []string{"the", "a", "les"}) {
+		t.Errorf("wrong articles: %q", articles)
+	}
+	if _, err := parseSortArticles("the,de la"); err == nil {
+		t.Error("expected an error for an article with a space")
+	}
+}
+
+func TestSongSortNames(t *testing.T) {
+	song := Song{Title: "A Day in the Life", Artist: "The Beatles", Album: "Sgt. Pepper"}
+	if song.sortTitle() != "Day in the Life" || song.sortArtist() != "Beatles" || song.sortAlbum() != "Sgt. Pepper" || song.sortAlbumArtist() != "Beatles" {
+		t.Errorf("wrong derived sort names: %q %q %q %q", song.sortTitle(), song.sortArtist(), song.sortAlbum(), song.sortAlbumArtist())
+	}
+	song.SortArtist = "Beatles, The"
+	if song.sortArtist() != "Beatles, The" || song.sortAlbumArtist() != "Beatles, The" {
+		t.Errorf("sort tag not used: %q %q", song.sortArtist(), song.sortAlbumArtist())
+	}
+	song.AlbumArtist = "The Various Artists"
+	if song.albumArtist() != "The Various Artists" || song.sortAlbumArtist() != "Various Artists" {
+		t.Errorf("wrong album artist: %q %q", song.albumArtist(), song.sortAlbumArtist())
+	}
+}
+
+func TestCompareKeys(t *testing.T) {
+	names := []string{"Zebra", "éclair", "Eagle", "(What's the Story)", "apple", "Éclair", "10cc", "Ångström", "Émile"}
+	sort.Slice(names, func(i, j int) bool {
+		return compareKeys(collationKey(names[i]), collationKey(names[j]), names[i], names[j]) < 0
+	})
+	want := []string{"10cc", "Ångström", "apple", "Eagle", "éclair", "Éclair", "Émile", "(What's the Story)", "Zebra"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("wrong order:\n%q\nwant\n%q", names, want)
+	}
+}
+
+func TestSortLanguage(t *testing.T) {
+	defer setShare(currentShare())
+	settings := currentShare()
+	settings.sortLanguage = language.Swedish
+	setShare(settings)
+
+	names := []string{"Östen", "Zebra", "Ångström", "apple", "Éclair"}
+	sort.Slice(names, func(i, j int) bool {
+		return compareKeys(collationKey(names[i]), collationKey(names[j]), names[i], names[j]) < 0
+	})
+	if want := []string{"apple", "Éclair", "Zebra", "Ångström", "Östen"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("wrong Swedish order:\n%q\nwant\n%q", names, want)
+	}
+	if char := sortHeaderChar("ångström"); char != 'Å' {
+		t.Errorf("Å should have its own header in Swedish, got %q", char)
+	}
+	if char := sortHeaderChar("éclair"); char != 'E' {
+		t.Errorf("É should be under E in Swedish, got %q", char)
+	}
+}
+
+func TestSortHeaderChar(t *testing.T) {
+	tests := map[string]rune{
+		"apple":              'A',
+		"Ångström":           'A',
+		"Émile":              'E',
+		"(What's the Story)": 'W',
+		"10cc":               '#',
+		"":                   '#',
+	}
+	for name, want := range tests {
+		if got := sortHeaderChar(name); got != want {
+			t.Errorf("sortHeaderChar(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSortSongIDs(t *testing.T) {
+	database := Database{songs: []Song{
+		{Title: "Help!", Artist: "The Beatles", Album: "Help!", TrackNumber: 1},
+		{Title: "Zebra", Artist: "Beach House", Album: "Teen Dream", TrackNumber: 1},
+		{Title: "Yesterday", Artist: "The Beatles", Album: "Help!", TrackNumber: 13},
+		{Title: "1979", Artist: "The Smashing Pumpkins", Album: "Mellon Collie"},
+		{Title: "Été", Artist: "Éric Serra"},
+		{Title: "Ticket to Ride", Artist: "The Beatles", Album: "Help!", TrackNumber: 7},
+	}}
+	all := []int{1, 2, 3, 4, 5, 6}
+
+	ids, headers, err := sortSongIDs(database, all, "artist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{2, 1, 6, 3, 5, 4}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("wrong artist order %v, want %v", ids, want)
+	}
+	wantHeaders := []sortHeader{{'B', 0, 4}, {'E', 4, 1}, {'S', 5, 1}}
+	if !reflect.DeepEqual(headers, wantHeaders) {
+		t.Errorf("wrong headers %+v, want %+v", headers, wantHeaders)
+	}
+
+	ids, headers, _ = sortSongIDs(database, all, "name")
+	if want := []int{4, 5, 1, 6, 3, 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("wrong name order %v, want %v", ids, want)
+	}
+	if headers[0] != (sortHeader{'#', 0, 1}) {
+		t.Errorf("wrong first header %+v", headers[0])
+	}
+
+	if ids, _, _ = sortSongIDs(database, []int{6, 3, 1}, "album"); !reflect.DeepEqual(ids, []int{1, 6, 3}) {
+		t.Errorf("wrong album order %v", ids)
+	}
+	if _, _, err := sortSongIDs(database, all, "colour"); err == nil {
+		t.Error("expected an error for an unknown sort")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandPlayer plays songs on the server by running a command for each, like
+// mpv or ffplay. The command is given as words with placeholders:
+//
+//	mpv --no-video --really-quiet --start={start} --volume={volume} {file}
+//
+// {file} is the song's path or stream URL, {start} the seconds into the song
+// to start at and {volume} the volume from 0 to 100. Pausing stops the command
+// and playing starts it again where it left off, as does changing the volume,
+// so the command must be able to start part way through a song.
+type commandPlayer struct {
+	command []string
+
+	mu       sync.Mutex
+	status   PlayerStatus
+	queue    []QueueItem
+	cmd      *exec.Cmd
+	started  time.Time // when cmd started, from status.position
+	changed  func()
+	finished func(QueueItem)
+}
+
+// parsePlayerCommand splits a player command into words, adding {file} at the
+// end if it isn't there.
+func parsePlayerCommand(s string) ([]string, error) {
+	command := strings.Fields(s)
+	if len(command) == 0 {
+		return nil, fmt.Errorf("empty player command")
+	}
+	for _, word := range command {
+		if strings.Contains(word, "{file}") {
+			return command, nil
+		}
+	}
+	return append(command, "{file}"), nil
+}
+
+func newCommandPlayer(command []string) *commandPlayer {
+	return &commandPlayer{
+		command:  command,
+		status:   PlayerStatus{state: PlayStateStopped, volume: 50, current: -1},
+		changed:  func() {},
+		finished: func(QueueItem) {},
+	}
+}
+
+// args fills in the placeholders of the command for a song.
+func (p *commandPlayer) args(item QueueItem) ([]string, error) {
+	file := item.song.Path
+	if file == "" {
+		file = item.song.StreamURL
+	}
+	if file == "" {
+		return nil, fmt.Errorf("cannot play %v, it isn't a local file or a stream", item.song.Title)
+	}
+	replacer := strings.NewReplacer(
+		"{file}", file,
+		"{start}", strconv.FormatFloat(float64(p.status.position)/1000, 'f', 3, 64),
+		"{volume}", strconv.Itoa(p.status.volume),
+	)
+	args := make([]string, len(p.command))
+	for i, word := range p.command {
+		args[i] = replacer.Replace(word)
+	}
+	return args, nil
+}
+
+// startLocked runs the command for the current song from status.position.
+// Callers must hold the lock.
+func (p *commandPlayer) startLocked() error {
+	if p.status.current < 0 || p.status.current >= len(p.queue) {
+		p.status.state = PlayStateStopped
+		return nil
+	}
+	item := p.queue[p.status.current]
+	args, err := p.args(item)
+	if err != nil {
+		p.status.state = PlayStateStopped
+		return err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		p.status.state = PlayStateStopped
+		return fmt.Errorf("cannot start player: %v", err)
+	}
+	p.cmd = cmd
+	p.started = time.Now()
+	p.status.state = PlayStatePlaying
+	go p.wait(cmd, item)
+	return nil
+}
+
+// stopLocked stops the command, keeping how far into the song it got.
+// Callers must hold the lock.
+func (p *commandPlayer) stopLocked() {
+	if p.cmd == nil {
+		return
+	}
+	p.status.position += int(time.Since(p.started) / time.Millisecond)
+	p.cmd.Process.Kill()
+	p.cmd = nil
+}
+
+// wait moves on to the next song when the command for item ends by itself.
+func (p *commandPlayer) wait(cmd *exec.Cmd, item QueueItem) {
+	err := cmd.Wait()
+
+	p.mu.Lock()
+	if p.cmd != cmd {
+		// stopped on purpose
+		p.mu.Unlock()
+		return
+	}
+	p.cmd = nil
+	p.status.position = 0
+	if err != nil {
+		log.Printf("player stopped playing %v: %v", item.song.Title, err)
+		p.status.state = PlayStateStopped
+	} else {
+		switch {
+		case p.status.repeat == 1:
+		case p.status.current+1 < len(p.queue):
+			p.status.current++
+		case p.status.repeat == 2:
+			p.status.current = 0
+		default:
+			p.status.current = -1
+		}
+		if startErr := p.startLocked(); startErr != nil {
+			log.Print(startErr)
+		}
+	}
+	changed, finished := p.changed, p.finished
+	p.mu.Unlock()
+
+	if err == nil {
+		finished(item)
+	}
+	changed()
+}
+
+func (p *commandPlayer) Cue(items []QueueItem, index int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLocked()
+	p.queue = items
+	p.status.position = 0
+	if len(items) == 0 {
+		p.status.state = PlayStateStopped
+		p.status.current = -1
+		return nil
+	}
+	p.status.current = index
+	return p.startLocked()
+}
+
+func (p *commandPlayer) PlayPause() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.status.state {
+	case PlayStatePlaying:
+		p.stopLocked()
+		p.status.state = PlayStatePaused
+	case PlayStatePaused:
+		return p.startLocked()
+	case PlayStateStopped:
+		if len(p.queue) > 0 {
+			p.status.current = 0
+			p.status.position = 0
+			return p.startLocked()
+		}
+	}
+	return nil
+}
+
+func (p *commandPlayer) skip(by int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		return nil
+	}
+	playing := p.status.state == PlayStatePlaying
+	p.stopLocked()
+	p.status.current = (p.status.current + by + len(p.queue)) % len(p.queue)
+	p.status.position = 0
+	if playing {
+		return p.startLocked()
+	}
+	return nil
+}
+
+func (p *commandPlayer) Next() error     { return p.skip(1) }
+func (p *commandPlayer) Previous() error { return p.skip(-1) }
+
+func (p *commandPlayer) SetVolume(volume int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.volume = volume
+	if p.status.state != PlayStatePlaying {
+		return nil
+	}
+	// the command only takes the volume when it starts
+	p.stopLocked()
+	return p.startLocked()
+}
+
+func (p *commandPlayer) Status() PlayerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.status
+	if p.cmd != nil {
+		status.position += int(time.Since(p.started) / time.Millisecond)
+	}
+	return status
+}
+
+func (p *commandPlayer) Queue() []QueueItem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queue
+}
+
+// Artwork always returns no data, the command doesn't tell us any.
+func (p *commandPlayer) Artwork() ([]byte, string, error) {
+	return nil, "", nil
+}
+
+func (p *commandPlayer) Notify(changed func(), finished func(QueueItem)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.changed = changed
+	p.finished = finished
+}
+
+// close stops playback when the server shuts down.
+func (p *commandPlayer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLocked()
+	p.status.state = PlayStateStopped
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePlayerCommand(t *testing.T) {
+	command, err := parsePlayerCommand("mpv --start={start} {file}")
+	if err != nil || !reflect.DeepEqual(command, []string{"mpv", "--start={start}", "{file}"}) {
+		t.Errorf("wrong command %q %v", command, err)
+	}
+	command, _ = parsePlayerCommand("ffplay -nodisp -autoexit")
+	if !reflect.DeepEqual(command, []string{"ffplay", "-nodisp", "-autoexit", "{file}"}) {
+		t.Errorf("{file} not added: %q", command)
+	}
+	if _, err := parsePlayerCommand("  "); err == nil {
+		t.Error("expected an error for an empty command")
+	}
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCommandPlayer(t *testing.T) {
+	// the "player" writes its arguments to a file named after the song
+	dir := t.TempDir()
+	played := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		return string(data)
+	}
+	command := func(seconds string) []string {
+		return []string{"sh", "-c", "echo $1 $2 > $0; sleep " + seconds, "{file}", "{start}", "{volume}"}
+	}
+	queue := []QueueItem{
+		{databaseID: 1, itemID: 1, song: Song{Title: "Long", Path: filepath.Join(dir, "long")}},
+		{databaseID: 1, itemID: 2, song: Song{Title: "Short", Path: filepath.Join(dir, "short")}},
+	}
+
+	player := newCommandPlayer(command("10"))
+	defer player.close()
+	if err := player.Cue(queue, 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first song to start", func() bool { return played("long") != "" })
+	if got := played("long"); got != "0.000 50\n" {
+		t.Errorf("wrong arguments %q", got)
+	}
+	if status := player.Status(); status.state != PlayStatePlaying || status.current != 0 {
+		t.Errorf("wrong status %+v", status)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	player.PlayPause()
+	status := player.Status()
+	if status.state != PlayStatePaused || status.position < 20 {
+		t.Errorf("wrong paused status %+v", status)
+	}
+	os.Remove(filepath.Join(dir, "long"))
+	player.SetVolume(80)
+	player.PlayPause()
+	waitFor(t, "the song to resume", func() bool { return played("long") != "" })
+	if got := played("long"); got == "0.000 80\n" || got[len(got)-3:] != "80\n" {
+		t.Errorf("not resumed part way with the new volume: %q", got)
+	}
+
+	if err := player.Cue([]QueueItem{{song: Song{Title: "Remote"}}}, 0); err == nil {
+		t.Error("expected an error for a song that can't be played")
+	}
+}
+
+func TestCommandPlayerFinishes(t *testing.T) {
+	dir := t.TempDir()
+	player := newCommandPlayer([]string{"true", "{file}"})
+	defer player.close()
+	finished := make(chan QueueItem, 10)
+	player.Notify(func() {}, func(item QueueItem) { finished <- item })
+
+	// songs that end by themselves count as finished and the next one plays
+	queue := []QueueItem{
+		{databaseID: 1, itemID: 1, song: Song{Title: "One", Path: filepath.Join(dir, "one")}},
+		{databaseID: 1, itemID: 2, song: Song{Title: "Two", Path: filepath.Join(dir, "two")}},
+	}
+	if err := player.Cue(queue, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{1, 2} {
+		select {
+		case item := <-finished:
+			if item.itemID != want {
+				t.Errorf("wrong song finished %+v, want %v", item, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("song never finished")
+		}
+	}
+	waitFor(t, "the queue to end", func() bool { return player.Status().state == PlayStateStopped })
+	if status := player.Status(); status.current != -1 {
+		t.Errorf("wrong status at the end of the queue %+v", status)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", true},
+		{"deflate", false},
+		{"x-gzip", false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", test.header)
+		if got := acceptsGzip(req); got != test.want {
+			t.Errorf("wrong result for '%v', want %v, got %v", test.header, test.want, got)
+		}
+	}
+}
+
+func gzipTestRequest(t *testing.T, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	headers(nil, handler)(resp, req)
+	return resp
+}
+
+func TestGzipLargeResponse(t *testing.T) {
+	body := bytes.Repeat([]byte("mlit"), gzipThreshold)
+	resp := gzipTestRequest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body[:10])
+		w.Write(body[10:])
+	})
+	if resp.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("response was not compressed")
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, body) {
+		t.Errorf("decompressed body doesn't match")
+	}
+}
+
+func TestGzipSmallResponse(t *testing.T) {
+	resp := gzipTestRequest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("small"))
+	})
+	if resp.Header().Get("Content-Encoding") != "" {
+		t.Errorf("small response was compressed")
+	}
+	if resp.Body.String() != "small" {
+		t.Errorf("response body doesn't match: %v", resp.Body.String())
+	}
+}
+
+func TestGzipErrorStatus(t *testing.T) {
+	resp := gzipTestRequest(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	})
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("wrong http status, want %v, got %v", http.StatusBadRequest, resp.Code)
+	}
+}
+
+func TestGzipSkipsAudio(t *testing.T) {
+	body := bytes.Repeat([]byte{0}, gzipThreshold*2)
+	resp := gzipTestRequest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write(body)
+	})
+	if resp.Header().Get("Content-Encoding") != "" {
+		t.Errorf("audio response was compressed")
+	}
+	if !bytes.Equal(resp.Body.Bytes(), body) {
+		t.Errorf("response body doesn't match")
+	}
+}
+
+func TestGzipSkipsStreams(t *testing.T) {
+	// a station that doesn't say what it sends
+	body := bytes.Repeat([]byte("audio"), gzipThreshold)
+	station := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		w.Write(body)
+	}))
+	defer station.Close()
+
+	router := radioTestRouter(RelayStrip, station.URL)
+	req, err := http.NewRequest("GET", "/databases/2/items/1.mp3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Header().Get("Content-Encoding") != "" {
+		t.Errorf("relayed stream was compressed")
+	}
+	if !bytes.Equal(resp.Body.Bytes(), body) {
+		t.Errorf("relayed stream doesn't match")
+	}
+}
+
+func syntheticDatabase(songs int) Database {
+	database := Database{name: "benchdb", songs: make([]Song, songs)}
+	for i := range database.songs {
+		database.songs[i] = Song{
+			Title:  fmt.Sprintf("Track %d", i%20+1),
+			Album:  fmt.Sprintf("Album %d", i/12),
+			Artist: fmt.Sprintf("Artist %d", i/120),
+			Path:   fmt.Sprintf("/music/%d.mp3", i),
+		}
+	}
+	return database
+}
+
+func benchmarkItems(b *testing.B, acceptEncoding string) {
+	router := routes(nil, newLibrary([]Database{syntheticDatabase(50000)}), nil, nil, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var size int
+	for i := 0; i < b.N; i++ {
+		req, err := http.NewRequest("GET", "/databases/1/items?meta=dmap.itemid,dmap.itemname,dmap.itemkind,dmap.persistentid,daap.songalbum,daap.songartist", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		size = resp.Body.Len()
+	}
+	b.ReportMetric(float64(size), "bytes/response")
+}
+
+func BenchmarkItemsUncompressed(b *testing.B) {
+	benchmarkItems(b, "")
+}
+
+func BenchmarkItemsGzip(b *testing.B) {
+	benchmarkItems(b, "gzip")
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// Config is everything about the server that can be changed without
+// rebuilding it. Settings are taken from, in increasing order of precedence:
+//
+//   - the defaults in defaultConfig
+//   - the config file, given by -config or AUDIOSERVE_CONFIG
+//   - AUDIOSERVE_<SETTING> environment variables, e.g. AUDIOSERVE_PORT
+//   - command line flags, e.g. -port
+//
+// so that a Docker image can ship a config file that is tweaked with
+// environment variables, and flags always win when running by hand.
+type Config struct {
+	Name string
+	Port int
+	// AdminPort serves /metrics, if set.
+	AdminPort int
+	Password  string
+	// AdminPassword turns on the admin API.
+	AdminPassword  string
+	SessionTimeout time.Duration
+	IdleTimeout    time.Duration
+	// ShutdownTimeout is how long songs being streamed get to finish when
+	// the server is stopped.
+	ShutdownTimeout time.Duration
+	DataDir         string
+	CacheSize       int // megabytes of encoded listings to keep
+	Gzip            bool
+	RequireValid    bool
+	// DAAPVersion is the newest DAAP version spoken, see profilesUpTo.
+	DAAPVersion Version
+	// SortArticles are left off the start of names without a sort tag.
+	SortArticles []string
+	// SortLanguage gives the collation rules names are sorted by.
+	SortLanguage language.Tag
+	// WriteTags writes ratings and play counts back into MP3 and FLAC
+	// files.
+	WriteTags bool
+
+	// AccessLog is a file to log requests to instead of stderr, rotated once
+	// it's AccessLogMaxSize megabytes if that's set.
+	AccessLog        string
+	AccessLogMaxSize int
+	AccessLogBackups int
+	LogFormat        string
+	LogLevel         logLevel
+
+	Libraries  []LibraryConfig
+	Proxy      []string
+	Radio      string
+	RadioRelay RelayMode
+	// Player is the command to play songs on the server with, for DACP
+	// remotes, which can't control anything without one.
+	Player []string
+
+	// one-off pairing with a remote, only taken from flags
+	PairRemote string
+	PairCode   string
+	PIN        string
+}
+
+func defaultConfig() Config {
+	return Config{
+		Name:            "daap-server",
+		Port:            3689,
+		SessionTimeout:  1800 * time.Second,
+		IdleTimeout:     120 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		DataDir:         ".",
+		CacheSize:       64,
+		Gzip:            true,
+		DAAPVersion:     newestDAAPVersion,
+		SortArticles:    defaultSortArticles,
+		SortLanguage:    defaultSortLanguage,
+	}
+}
+
+// setting is one configuration value. key is its name in the config file;
+// the flag is the key with dashes and the environment variable is the key in
+// upper case after AUDIOSERVE_.
+type setting struct {
+	key      string
+	usage    string
+	flagOnly bool
+	set      func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{key: "name", usage: "share name shown to clients", set: func(c *Config, v string) error {
+		c.Name = v
+		return nil
+	}},
+	{key: "port", usage: "port to listen on", set: func(c *Config, v string) error {
+		return setInt(&c.Port, v)
+	}},
+	{key: "admin_port", usage: "port to serve /metrics on, 0 for none", set: func(c *Config, v string) error {
+		return setInt(&c.AdminPort, v)
+	}},
+	{key: "password", usage: "password clients must log in with, none if empty", set: func(c *Config, v string) error {
+		c.Password = v
+		return nil
+	}},
+	{key: "admin_password", usage: "password for the admin API under /admin/v1, which is off if empty", set: func(c *Config, v string) error {
+		c.AdminPassword = v
+		return nil
+	}},
+	{key: "session_timeout", usage: "seconds before an idle client is logged out", set: func(c *Config, v string) error {
+		return setSeconds(&c.SessionTimeout, v)
+	}},
+	{key: "idle_timeout", usage: "seconds to keep idle connections open", set: func(c *Config, v string) error {
+		return setSeconds(&c.IdleTimeout, v)
+	}},
+	{key: "shutdown_timeout", usage: "seconds to let streams finish when stopping", set: func(c *Config, v string) error {
+		return setSeconds(&c.ShutdownTimeout, v)
+	}},
+	{key: "data_dir", usage: "directory for paired remotes and play counts", set: func(c *Config, v string) error {
+		c.DataDir = v
+		return nil
+	}},
+	{key: "cache_size", usage: "megabytes of item listings to cache, 0 to turn the cache off", set: func(c *Config, v string) error {
+		return setInt(&c.CacheSize, v)
+	}},
+	{key: "access_log", usage: "file to log requests to, stderr if empty", set: func(c *Config, v string) error {
+		c.AccessLog = v
+		return nil
+	}},
+	{key: "access_log_max_size", usage: "megabytes the access log can grow to before it's rotated, 0 to never rotate", set: func(c *Config, v string) error {
+		return setInt(&c.AccessLogMaxSize, v)
+	}},
+	{key: "access_log_backups", usage: "rotated access logs to keep", set: func(c *Config, v string) error {
+		return setInt(&c.AccessLogBackups, v)
+	}},
+	{key: "log_format", usage: "access log format, logfmt or json", set: func(c *Config, v string) error {
+		if v != "logfmt" && v != "json" {
+			return fmt.Errorf("unknown format '%v', expected logfmt or json", v)
+		}
+		c.LogFormat = v
+		return nil
+	}},
+	{key: "log_level", usage: "least important requests to log: debug includes polling, warn only failures", set: func(c *Config, v string) error {
+		level, err := parseLogLevel(v)
+		c.LogLevel = level
+		return err
+	}},
+	{key: "gzip", usage: "compress responses for clients that accept it", set: func(c *Config, v string) error {
+		return setBool(&c.Gzip, v)
+	}},
+	{key: "require_validation", usage: "reject clients without a valid Client-DAAP-Validation header", set: func(c *Config, v string) error {
+		return setBool(&c.RequireValid, v)
+	}},
+	{key: "daap_version", usage: "newest DAAP version to speak and advertise to clients, e.g. 2.0 to hide DAAP 3 features", set: func(c *Config, v string) error {
+		version, err := parseVersion(v)
+		if err != nil {
+			return err
+		}
+		if _, err := profilesUpTo(version); err != nil {
+			return err
+		}
+		c.DAAPVersion = version
+		return nil
+	}},
+	{key: "library", usage: "databases to serve as name=root, optionally followed by ;formats=mp3,m4a and ;kind=podcast, separated by | (the flag can be repeated instead)", set: func(c *Config, v string) error {
+		c.Libraries = nil
+		for _, s := range strings.Split(v, "|") {
+			config, err := parseLibraryConfig(s)
+			if err != nil {
+				return err
+			}
+			c.Libraries = append(c.Libraries, config)
+		}
+		return nil
+	}},
+	{key: "proxy", usage: "comma separated DAAP servers to merge into one library instead of serving local files", set: func(c *Config, v string) error {
+		c.Proxy = nil
+		for _, u := range strings.Split(v, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				c.Proxy = append(c.Proxy, u)
+			}
+		}
+		return nil
+	}},
+	{key: "sort_articles", usage: "comma separated articles to ignore at the start of names when sorting", set: func(c *Config, v string) error {
+		articles, err := parseSortArticles(v)
+		if err != nil {
+			return err
+		}
+		c.SortArticles = articles
+		return nil
+	}},
+	{key: "sort_language", usage: "BCP 47 language whose rules names are sorted by, e.g. sv", set: func(c *Config, v string) error {
+		tag, err := language.Parse(v)
+		if err != nil {
+			return fmt.Errorf("'%v' is not a language: %v", v, err)
+		}
+		c.SortLanguage = tag
+		return nil
+	}},
+	{key: "write_tags", usage: "write ratings and play counts back into the POPM tag of MP3 files and RATING and PLAYCOUNT of FLAC files", set: func(c *Config, v string) error {
+		return setBool(&c.WriteTags, v)
+	}},
+	{key: "radio", usage: "PLS, M3U or JSON list of radio stations to serve as a radio database", set: func(c *Config, v string) error {
+		c.Radio = v
+		return nil
+	}},
+	{key: "radio_relay", usage: "how radio streams reach clients: off to send them to the station, strip to relay without ICY metadata, forward to relay with it", set: func(c *Config, v string) error {
+		relay, err := parseRelayMode(v)
+		c.RadioRelay = relay
+		return err
+	}},
+	{key: "player", usage: "command that plays a song on the server for remotes to control, with {file}, {start} and {volume} placeholders, e.g. mpv --no-video --start={start} --volume={volume} {file}; remote control is off if empty", set: func(c *Config, v string) error {
+		c.Player = nil
+		if strings.TrimSpace(v) == "" {
+			return nil
+		}
+		command, err := parsePlayerCommand(v)
+		c.Player = command
+		return err
+	}},
+	{key: "pair", flagOnly: true, usage: "host:port of a remote to pair with, as advertised by its _touch-remote._tcp service", set: func(c *Config, v string) error {
+		c.PairRemote = v
+		return nil
+	}},
+	{key: "pair_code", flagOnly: true, usage: "the Pair value advertised by the remote", set: func(c *Config, v string) error {
+		c.PairCode = v
+		return nil
+	}},
+	{key: "pin", flagOnly: true, usage: "the 4 digit PIN shown on the remote", set: func(c *Config, v string) error {
+		c.PIN = v
+		return nil
+	}},
+}
+
+func setInt(i *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("'%v' is not a number", v)
+	}
+	*i = n
+	return nil
+}
+
+func setSeconds(d *time.Duration, v string) error {
+	var seconds int
+	if err := setInt(&seconds, v); err != nil {
+		return err
+	}
+	*d = time.Duration(seconds) * time.Second
+	return nil
+}
+
+func setBool(b *bool, v string) error {
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("'%v' is not true or false", v)
+	}
+	*b = parsed
+	return nil
+}
+
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+func envName(key string) string {
+	return "AUDIOSERVE_" + strings.ToUpper(key)
+}
+
+// settingFlag collects every value given for a flag, as -library can be
+// repeated.
+type settingFlag struct {
+	values []string
+}
+
+func (f *settingFlag) String() string {
+	return strings.Join(f.values, "|")
+}
+
+func (f *settingFlag) Set(v string) error {
+	f.values = append(f.values, v)
+	return nil
+}
+
+// loadConfig works out the configuration from the command line arguments, the
+// environment and the config file they point to, then checks it.
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	fs := flag.NewFlagSet("daap-server", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("AUDIOSERVE_CONFIG"), "config file (AUDIOSERVE_CONFIG)")
+	flags := map[string]*settingFlag{}
+	for _, s := range settings {
+		f := &settingFlag{}
+		flags[s.key] = f
+		usage := s.usage
+		if !s.flagOnly {
+			usage += " (" + envName(s.key) + ")"
+		}
+		fs.Var(f, flagName(s.key), usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	config := defaultConfig()
+	if *configPath != "" {
+		f, err := os.Open(*configPath)
+		if err != nil {
+			return Config{}, err
+		}
+		err = readConfigFile(f, &config)
+		f.Close()
+		if err != nil {
+			return Config{}, fmt.Errorf("%v: %v", *configPath, err)
+		}
+	}
+
+	errs := []string{}
+	for _, s := range settings {
+		if s.flagOnly {
+			continue
+		}
+		if v, ok := lookupEnv(getenv, envName(s.key)); ok {
+			if err := s.set(&config, v); err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", envName(s.key), err))
+			}
+		}
+	}
+	for _, s := range settings {
+		values := flags[s.key].values
+		if len(values) == 0 {
+			continue
+		}
+		if err := s.set(&config, strings.Join(values, "|")); err != nil {
+			errs = append(errs, fmt.Sprintf("-%v: %v", flagName(s.key), err))
+		}
+	}
+	errs = append(errs, config.validate()...)
+	if len(errs) > 0 {
+		return Config{}, errors.New("invalid configuration:\n\t" + strings.Join(errs, "\n\t"))
+	}
+	return config, nil
+}
+
+// lookupEnv treats empty variables as unset, as that's what an unset
+// variable in a compose file turns into.
+func lookupEnv(getenv func(string) string, name string) (string, bool) {
+	v := getenv(name)
+	return v, v != ""
+}
+
+// validate returns everything wrong with a configuration, so it can all be
+// fixed in one go.
+func (c Config) validate() []string {
+	errs := []string{}
+	if c.Name == "" {
+		errs = append(errs, "name: must not be empty")
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port: %v is not between 1 and 65535", c.Port))
+	}
+	if c.AdminPort < 0 || c.AdminPort > 65535 {
+		errs = append(errs, fmt.Sprintf("admin_port: %v is not between 0 and 65535", c.AdminPort))
+	} else if c.AdminPort != 0 && c.AdminPort == c.Port {
+		errs = append(errs, "admin_port: must be different to port")
+	}
+	if c.AdminPassword != "" && c.AdminPassword == c.Password {
+		errs = append(errs, "admin_password: must be different to password")
+	}
+	if c.SessionTimeout <= 0 {
+		errs = append(errs, "session_timeout: must be more than 0")
+	}
+	if c.IdleTimeout < 0 {
+		errs = append(errs, "idle_timeout: must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, "shutdown_timeout: must not be negative")
+	}
+	if c.AccessLogMaxSize < 0 || c.AccessLogBackups < 0 {
+		errs = append(errs, "access_log_max_size and access_log_backups must not be negative")
+	}
+	if c.CacheSize < 0 {
+		errs = append(errs, "cache_size: must not be negative")
+	}
+	if info, err := os.Stat(c.DataDir); err != nil || !info.IsDir() {
+		errs = append(errs, fmt.Sprintf("data_dir: %v is not a directory", c.DataDir))
+	}
+	names := map[string]bool{}
+	for _, library := range c.Libraries {
+		if names[library.Name] {
+			errs = append(errs, fmt.Sprintf("library: %v is there twice", library.Name))
+		}
+		names[library.Name] = true
+		if info, err := os.Stat(library.Root); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Sprintf("library: root of %v, %v, is not a directory", library.Name, library.Root))
+		}
+	}
+	for _, u := range c.Proxy {
+		if _, err := upstreamClient(u); err != nil {
+			errs = append(errs, fmt.Sprintf("proxy: %v", err))
+		}
+	}
+	if c.Radio != "" {
+		if _, err := os.Stat(c.Radio); err != nil {
+			errs = append(errs, fmt.Sprintf("radio: %v", err))
+		}
+	}
+	if len(c.Libraries) == 0 && len(c.Proxy) == 0 && c.Radio == "" {
+		errs = append(errs, "nothing to serve: set library, proxy or radio")
+	}
+	return errs
+}
+
+// share is the part of the configuration handlers need.
+func (c Config) share() shareSettings {
+	return shareSettings{
+		name:              c.Name,
+		sessionTimeout:    c.SessionTimeout,
+		password:          c.Password,
+		adminPassword:     c.AdminPassword,
+		gzip:              c.Gzip,
+		requireValidation: c.RequireValid,
+		sortArticles:      c.SortArticles,
+		sortLanguage:      c.SortLanguage,
+		writeTags:         c.WriteTags,
+		profiles:          c.profiles(),
+	}
+}
+
+// profiles are the DAAP versions spoken, which daap_version was checked to
+// allow when it was set.
+func (c Config) profiles() []ProtocolProfile {
+	profiles, err := profilesUpTo(c.DAAPVersion)
+	if err != nil {
+		return protocolProfiles
+	}
+	return profiles
+}
+
+func (c Config) playlistsPath() string {
+	return filepath.Join(c.DataDir, "playlists.json")
+}
+
+func (c Config) pairingsPath() string {
+	return filepath.Join(c.DataDir, "pairings.json")
+}
+
+func (c Config) indexPath() string {
+	return filepath.Join(c.DataDir, "library.json")
+}
+
+// readConfigFile reads the subset of TOML the config needs: key = value
+// settings, where a value is a quoted string, number, boolean or array of
+// those, and [[library]] tables with name, root, formats and kind.
+func readConfigFile(r io.Reader, config *Config) error {
+	var library *LibraryConfig
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if line == "[[library]]" {
+			config.Libraries = append(config.Libraries, LibraryConfig{})
+			library = &config.Libraries[len(config.Libraries)-1]
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return fmt.Errorf("line %v: unknown table %v", lineNum, line)
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return fmt.Errorf("line %v: expected key = value", lineNum)
+		}
+		key := strings.TrimSpace(line[:eq])
+		values, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return fmt.Errorf("line %v: %v", lineNum, err)
+		}
+
+		if library != nil {
+			if err := setLibraryKey(library, key, values); err != nil {
+				return fmt.Errorf("line %v: %v", lineNum, err)
+			}
+			continue
+		}
+		s, ok := findSetting(key)
+		if !ok || s.flagOnly || key == "library" {
+			return fmt.Errorf("line %v: unknown setting %v", lineNum, key)
+		}
+		if err := s.set(config, strings.Join(values, ",")); err != nil {
+			return fmt.Errorf("line %v: %v: %v", lineNum, key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for i, library := range config.Libraries {
+		if library.Name == "" || library.Root == "" {
+			return fmt.Errorf("library %v needs a name and root", i+1)
+		}
+	}
+	return nil
+}
+
+func setLibraryKey(library *LibraryConfig, key string, values []string) error {
+	switch key {
+	case "name":
+		library.Name = strings.Join(values, ",")
+	case "root":
+		library.Root = strings.Join(values, ",")
+	case "formats":
+		for _, format := range values {
+			library.Formats = append(library.Formats, strings.ToLower(strings.TrimPrefix(format, ".")))
+		}
+	case "kind":
+		kind, err := parseMediaKind(strings.Join(values, ","))
+		if err != nil {
+			return err
+		}
+		library.Kind = kind
+	default:
+		return fmt.Errorf("unknown library setting %v", key)
+	}
+	return nil
+}
+
+func findSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// stripComment removes a # comment that isn't inside a string.
+func stripComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"' && (i == 0 || line[i-1] != '\\'):
+			quoted = !quoted
+		case c == '#' && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseTOMLValue turns a value into strings, one for each element of an
+// array.
+func parseTOMLValue(s string) ([]string, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated array %v", s)
+		}
+		values := []string{}
+		for _, element := range splitTOMLArray(s[1 : len(s)-1]) {
+			element = strings.TrimSpace(element)
+			if element == "" {
+				continue
+			}
+			value, err := parseTOMLScalar(element)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	value, err := parseTOMLScalar(s)
+	return []string{value}, err
+}
+
+func splitTOMLArray(s string) []string {
+	elements := []string{}
+	quoted := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"' && (i == 0 || s[i-1] != '\\'):
+			quoted = !quoted
+		case c == ',' && !quoted:
+			elements = append(elements, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(elements, s[start:])
+}
+
+func parseTOMLScalar(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		value, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad string %v", s)
+		}
+		return value, nil
+	}
+	if s == "true" || s == "false" {
+		return s, nil
+	}
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return s, nil
+	}
+	return "", fmt.Errorf("unsupported value %v", s)
+}
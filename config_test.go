@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	music := filepath.Join(dir, "music")
+	podcasts := filepath.Join(dir, "podcasts")
+	for _, root := range []string{music, podcasts} {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configPath := filepath.Join(dir, "audioserve.toml")
+	file := `# shared settings
+name = "Living Room"
+port = 4000
+password = "from file"
+data_dir = "` + dir + `"
+sort_articles = ["The", "Le", "La"]
+sort_language = "sv"
+
+[[library]]
+name = "Music"
+root = "` + music + `"
+formats = ["mp3", ".FLAC"] # no m4a
+`
+	if err := ioutil.WriteFile(configPath, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"AUDIOSERVE_CONFIG":       configPath,
+		"AUDIOSERVE_PORT":         "5000",
+		"AUDIOSERVE_PASSWORD":     "from env",
+		"AUDIOSERVE_GZIP":         "false",
+		"AUDIOSERVE_DAAP_VERSION": "2.0",
+	}
+
+	config, err := loadConfig([]string{"-port", "6000"}, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "Living Room" {
+		t.Errorf("name should come from the file: %v", config.Name)
+	}
+	if config.Password != "from env" || config.Gzip {
+		t.Errorf("env should override the file: %+v", config)
+	}
+	if !reflect.DeepEqual(config.SortArticles, []string{"the", "le", "la"}) {
+		t.Errorf("wrong sort articles: %q", config.SortArticles)
+	}
+	if config.SortLanguage.String() != "sv" {
+		t.Errorf("wrong sort language: %v", config.SortLanguage)
+	}
+	if profiles := config.share().profiles; config.DAAPVersion != (Version{2, 0, 0}) || len(profiles) != 2 {
+		t.Errorf("wrong DAAP version %+v, profiles %+v", config.DAAPVersion, profiles)
+	}
+	if config.Port != 6000 {
+		t.Errorf("flags should override env: %v", config.Port)
+	}
+	if config.SessionTimeout != 1800*time.Second || config.CacheSize != 64 {
+		t.Errorf("unset settings should keep their defaults: %+v", config)
+	}
+	if len(config.Libraries) != 1 || config.Libraries[0].Name != "Music" || config.Libraries[0].Root != music {
+		t.Fatalf("wrong libraries: %+v", config.Libraries)
+	}
+	if formats := config.Libraries[0].Formats; len(formats) != 2 || formats[1] != "flac" {
+		t.Errorf("wrong formats: %v", formats)
+	}
+
+	args := []string{"-library", "Music=" + music, "-library", "Podcasts=" + podcasts + ";kind=podcast"}
+	config, err = loadConfig(args, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Libraries) != 2 || config.Libraries[1].Kind != MediaKindPodcast {
+		t.Errorf("-library flags should replace the file's libraries: %+v", config.Libraries)
+	}
+}
+
+func TestLoadConfigReportsEveryError(t *testing.T) {
+	env := map[string]string{
+		"AUDIOSERVE_PORT":        "70000",
+		"AUDIOSERVE_RADIO_RELAY": "sideways",
+		"AUDIOSERVE_DATA_DIR":    "/does/not/exist",
+		"AUDIOSERVE_PASSWORD":    "secret",
+	}
+	_, err := loadConfig([]string{"-cache-size", "lots", "-admin-password", "secret"}, func(name string) string { return env[name] })
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"AUDIOSERVE_RADIO_RELAY", "-cache-size", "port: 70000", "data_dir", "nothing to serve", "admin_password"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	for _, file := range []string{
+		"colour = \"blue\"",
+		"port = 3689.5",
+		"name = \"unterminated",
+		"pin = \"1234\"",
+		"daap_version = \"4.0\"",
+		"[server]",
+		"[[library]]\nname = \"Music\"",
+		"[[library]]\nname = \"Music\"\nroot = \"/srv\"\nkind = \"opera\"",
+	} {
+		config := defaultConfig()
+		if err := readConfigFile(strings.NewReader(file), &config); err == nil {
+			t.Errorf("expected an error for %q", file)
+		}
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "testdb", password: "secret"})
+
+	router := routes(nil, newLibrary([]Database{{name: "testdb"}}), nil, nil, nil)
+	tests := []struct {
+		path     string
+		password string
+		status   int
+	}{
+		{"/server-info", "", http.StatusOK},
+		{"/login", "", http.StatusUnauthorized},
+		{"/login", "wrong", http.StatusUnauthorized},
+		{"/login", "secret", http.StatusOK},
+		{"/databases", "secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.password != "" {
+			req.SetBasicAuth("", test.password)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%v with password %q: wrong status %v, want %v", test.path, test.password, rr.Code, test.status)
+		}
+	}
+}
@@ -96,18 +96,16 @@ func contentCodeToData(contentCode ContentCode) []byte {
 	return data
 }
 
-func databaseToData(database Database) []byte {
+func databaseToData(id int, database Database) []byte {
 	headerData := []byte("mlit")
 
 	data := []byte{}
 
-	// assume only one database
 	data = append(data, "miid"...)
-	data = append(data, intToData(1)...)
+	data = append(data, intToData(id)...)
 
-	// assume only one database
 	data = append(data, "mper"...)
-	data = append(data, longToData(1)...)
+	data = append(data, longToData(int64(id))...)
 
 	data = append(data, "minm"...)
 	data = append(data, stringToData(database.name)...)
@@ -115,9 +113,11 @@ func databaseToData(database Database) []byte {
 	data = append(data, "mimc"...)
 	data = append(data, intToData(len(database.songs))...)
 
-	// no playlist support
 	data = append(data, "mctc"...)
-	data = append(data, intToData(0)...)
+	data = append(data, intToData(len(database.containers()))...)
+
+	data = append(data, "mdbk"...)
+	data = append(data, intToData(database.kind.mdbk())...)
 
 	headerData = append(headerData, intToByteArray(len(data))...)
 	data = append(headerData, data...)
@@ -125,39 +125,14 @@ func databaseToData(database Database) []byte {
 	return data
 }
 
-func songToData(fields []string, song Song) []byte {
+// songToData encodes a song by appending each field, the way listings were
+// built before they were streamed.
+func songToData(fields []string, id int, song Song) []byte {
 	headerData := []byte("mlit")
 
 	data := []byte{}
-
-	kindInd := index(fields, "dmap.itemkind")
-	if kindInd > -1 {
-		data = append(data, "mikd"...)
-		data = append(data, charToData(2)...)
-
-		fields = append(fields[:kindInd], fields[kindInd+1:]...)
-	}
-
-	for _, field := range fields {
-		switch field {
-		case "dmap.itemid":
-			data = append(data, "miid"...)
-			data = append(data, intToData(1)...)
-		case "dmap.itemname":
-			data = append(data, "minm"...)
-			data = append(data, stringToData(song.Title)...)
-		case "dmap.persistentid":
-			data = append(data, "mper"...)
-			data = append(data, longToData(1)...)
-		case "daap.songalbum":
-			data = append(data, "asal"...)
-			data = append(data, stringToData(song.Album)...)
-		case "daap.songartist":
-			data = append(data, "asar"...)
-			data = append(data, stringToData(song.Artist)...)
-		default:
-			log.Printf("unexpected field: %s", field)
-		}
+	for _, field := range orderSongFields(fields) {
+		data = append(data, songFieldToData(field, id, song)...)
 	}
 
 	headerData = append(headerData, intToByteArray(len(data))...)
@@ -166,6 +141,31 @@ func songToData(fields []string, song Song) []byte {
 	return data
 }
 
+func songFieldToData(field string, id int, song Song) []byte {
+	f, ok := songFields[field]
+	if !ok {
+		log.Printf("unexpected field: %s", field)
+		return nil
+	}
+	if f.omit != nil && f.omit(song) {
+		return nil
+	}
+	data := []byte(f.code)
+	switch f.dmapType {
+	case DmapChar:
+		data = append(data, charToData(byte(f.number(song, id)))...)
+	case DmapShort:
+		data = append(data, shortToData(int16(f.number(song, id)))...)
+	case DmapLong, DmapDate:
+		data = append(data, intToData(int(f.number(song, id)))...)
+	case DmapLongLong:
+		data = append(data, longToData(f.number(song, id))...)
+	default:
+		data = append(data, stringToData(f.text(song))...)
+	}
+	return data
+}
+
 func index(s []string, e string) int {
 	for i, a := range s {
 		if a == e {
@@ -174,3 +174,31 @@ func index(s []string, e string) int {
 	}
 	return -1
 }
+
+func containerToData(id int, c container) []byte {
+	headerData := []byte("mlit")
+
+	data := []byte{}
+
+	data = append(data, "miid"...)
+	data = append(data, intToData(id)...)
+
+	data = append(data, "mper"...)
+	data = append(data, longToData(int64(id))...)
+
+	data = append(data, "minm"...)
+	data = append(data, stringToData(c.name)...)
+
+	data = append(data, "mimc"...)
+	data = append(data, intToData(len(c.ids))...)
+
+	if c.special != 0 {
+		data = append(data, "aePS"...)
+		data = append(data, charToData(c.special)...)
+	}
+
+	headerData = append(headerData, intToByteArray(len(data))...)
+	data = append(headerData, data...)
+
+	return data
+}
@@ -75,14 +75,31 @@ func TestContentCodeToData(t *testing.T) {
 }
 
 func TestDataseToData(t *testing.T) {
-	data := databaseToData(Database{"testdb", []Song{{"", "", ""}}})
+	data := databaseToData(1, Database{name: "testdb", songs: []Song{{}}})
 	expectedData := []byte{
-		109, 108, 105, 116, 0, 0, 0, 66, // mlit
+		109, 108, 105, 116, 0, 0, 0, 78, // mlit
 		109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 0, 1, // miid
 		109, 112, 101, 114, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 1, // mper
 		109, 105, 110, 109, 0, 0, 0, 6, 116, 101, 115, 116, 100, 98, // minm
 		109, 105, 109, 99, 0, 0, 0, 4, 0, 0, 0, 1, // mimc
 		109, 99, 116, 99, 0, 0, 0, 4, 0, 0, 0, 0, // mctc
+		109, 100, 98, 107, 0, 0, 0, 4, 0, 0, 0, 1, // mdbk
+	}
+	if !bytes.Equal(data, expectedData) {
+		t.Errorf("wrong byte array value for listing item structure: %v", data)
+	}
+}
+
+func TestRadioDatabaseToData(t *testing.T) {
+	data := databaseToData(2, radioDatabase("radio", []Song{{Title: "a", Genre: "Jazz"}}, RelayOff))
+	expectedData := []byte{
+		109, 108, 105, 116, 0, 0, 0, 77, // mlit
+		109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 0, 2, // miid
+		109, 112, 101, 114, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 2, // mper
+		109, 105, 110, 109, 0, 0, 0, 5, 114, 97, 100, 105, 111, // minm
+		109, 105, 109, 99, 0, 0, 0, 4, 0, 0, 0, 1, // mimc
+		109, 99, 116, 99, 0, 0, 0, 4, 0, 0, 0, 1, // mctc
+		109, 100, 98, 107, 0, 0, 0, 4, 0, 0, 0, 0x64, // mdbk
 	}
 	if !bytes.Equal(data, expectedData) {
 		t.Errorf("wrong byte array value for listing item structure: %v", data)
@@ -91,7 +108,7 @@ func TestDataseToData(t *testing.T) {
 
 func TestSongToData(t *testing.T) {
 	fields := []string{"dmap.itemid", "dmap.itemname", "dmap.itemkind", "dmap.persistentid", "daap.songalbum", "daap.songartist"}
-	data := songToData(fields, Song{"a name", "an album", "an artist"})
+	data := songToData(fields, 1, Song{Title: "a name", Album: "an album", Artist: "an artist"})
 	expectedData := []byte{
 		109, 108, 105, 116, 0, 0, 0, 84, // mlit
 		109, 105, 107, 100, 0, 0, 0, 1, 2, // mikd
@@ -102,7 +119,7 @@ func TestSongToData(t *testing.T) {
 		97, 115, 97, 114, 0, 0, 0, 9, 97, 110, 32, 97, 114, 116, 105, 115, 116, // asar
 	}
 	if !bytes.Equal(data, expectedData) {
-		t.Errorf("wrong byte array value for listing item structure: %v", data, expectedData)
+		t.Errorf("wrong byte array value for listing item structure: %v\nwant: %v", data, expectedData)
 	}
 }
 
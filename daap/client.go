@@ -0,0 +1,460 @@
+// Package daap is a client for DAAP servers such as iTunes, forked-daapd and
+// this one.
+package daap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/carlgreen/audioserve/daaphash"
+)
+
+// ErrUnauthorized is returned when the server wants a (different) password.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// DefaultMeta is the set of song fields requested when none are given.
+var DefaultMeta = []string{
+	"dmap.itemid",
+	"dmap.itemname",
+	"dmap.itemkind",
+	"dmap.persistentid",
+	"daap.songalbum",
+	"daap.songartist",
+	"daap.songformat",
+	"daap.songtracknumber",
+	"daap.songtime",
+}
+
+type Version struct {
+	Major uint16
+	Minor uint8
+	Patch uint8
+}
+
+type ServerInfo struct {
+	Name            string
+	DMAPVersion     Version
+	DAAPVersion     Version
+	LoginRequired   bool
+	TimeoutInterval int
+	DatabasesCount  int
+}
+
+type ContentCode struct {
+	Number string
+	Name   string
+	Type   int16
+}
+
+type Database struct {
+	ID             int
+	PersistentID   int64
+	Name           string
+	ItemCount      int
+	ContainerCount int
+}
+
+type Song struct {
+	ID           int
+	PersistentID int64
+	Kind         int
+	Title        string
+	Album        string
+	Artist       string
+	Format       string
+	TrackNumber  int
+	Duration     int // milliseconds
+	// Tags holds every field the server sent, including ones not decoded
+	// above.
+	Tags []Tag
+}
+
+type Playlist struct {
+	ID           int
+	PersistentID int64
+	Name         string
+	ItemCount    int
+}
+
+// RangeError is returned by Stream when the server can't start from the
+// offset asked for, usually because it's the end of the song.
+type RangeError struct {
+	// Size is the full size of the song, -1 if the server didn't say.
+	Size int64
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("range not satisfiable, the song is %v bytes", e.Size)
+}
+
+// Stream is an open song download.
+type Stream struct {
+	io.ReadCloser
+	// Offset is where the data starts, non-zero when the server honoured a
+	// request to resume.
+	Offset int64
+	// Size is the full size of the song, -1 if the server didn't say.
+	Size int64
+}
+
+// Client talks to one DAAP server. Log in before asking for anything but
+// server info and content codes.
+type Client struct {
+	// URL is the server's base URL, e.g. http://host:3689.
+	URL string
+	// Password is sent with basic auth when logging in, if set.
+	Password string
+	// DAAPVersion is sent as Client-DAAP-Version.
+	DAAPVersion string
+	// HTTPClient makes the requests. Its default adds Client-DAAP-Validation
+	// headers.
+	HTTPClient *http.Client
+
+	// mu guards the rest, as a song can be streamed while the library is
+	// being updated.
+	mu         sync.Mutex
+	sessionID  int
+	revision   int
+	requestID  int
+	containers map[string]bool
+	updated    bool
+}
+
+func NewClient(url string) *Client {
+	containers := map[string]bool{}
+	for _, code := range defaultContainers {
+		containers[code] = true
+	}
+	return &Client{
+		URL:         strings.TrimSuffix(url, "/"),
+		DAAPVersion: "3.0",
+		HTTPClient:  &http.Client{Transport: &daaphash.Transport{}},
+		revision:    1,
+		containers:  containers,
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, path string, params url.Values) (*http.Request, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	if sessionID := c.SessionID(); sessionID != 0 {
+		params.Set("session-id", strconv.Itoa(sessionID))
+	}
+	uri := c.URL + path
+	if len(params) > 0 {
+		uri += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.requestID++
+	requestID := c.requestID
+	c.mu.Unlock()
+
+	req.Header.Set("Client-DAAP-Version", c.DAAPVersion)
+	req.Header.Set("Client-DAAP-Request-ID", strconv.Itoa(requestID))
+	if c.Password != "" {
+		req.SetBasicAuth("", c.Password)
+	}
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNoContent:
+		return resp, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		resp.Body.Close()
+		return nil, ErrUnauthorized
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return nil, &RangeError{Size: parseUnsatisfiedRange(resp.Header.Get("Content-Range"))}
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("%v: %v", req.URL.Path, resp.Status)
+}
+
+// get fetches a DMAP response and returns its single top level tag.
+func (c *Client) get(ctx context.Context, path string, params url.Values, code string) (Tag, error) {
+	req, err := c.newRequest(ctx, path, params)
+	if err != nil {
+		return Tag{}, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return Tag{}, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Tag{}, err
+	}
+
+	c.mu.Lock()
+	tags, err := Decode(data, c.containers)
+	c.mu.Unlock()
+	if err != nil {
+		return Tag{}, fmt.Errorf("%v: %v", path, err)
+	}
+	if len(tags) != 1 || tags[0].Code != code {
+		return Tag{}, fmt.Errorf("%v: expected a single %v", path, code)
+	}
+	if status := tags[0].findInt("mstt"); status != 0 && status != 200 {
+		return Tag{}, fmt.Errorf("%v: status %v", path, status)
+	}
+	return tags[0], nil
+}
+
+func (c *Client) ServerInfo(ctx context.Context) (ServerInfo, error) {
+	tag, err := c.get(ctx, "/server-info", nil, "msrv")
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	mpro, _ := tag.Find("mpro")
+	apro, _ := tag.Find("apro")
+	return ServerInfo{
+		Name:            tag.findText("minm"),
+		DMAPVersion:     mpro.Version(),
+		DAAPVersion:     apro.Version(),
+		LoginRequired:   tag.findInt("mslr") != 0,
+		TimeoutInterval: int(tag.findInt("mstm")),
+		DatabasesCount:  int(tag.findInt("msdc")),
+	}, nil
+}
+
+// ContentCodes fetches the server's content codes and remembers which of them
+// are containers for decoding later responses.
+func (c *Client) ContentCodes(ctx context.Context) ([]ContentCode, error) {
+	tag, err := c.get(ctx, "/content-codes", nil, "mccr")
+	if err != nil {
+		return nil, err
+	}
+	codes := []ContentCode{}
+	for _, dictionary := range tag.All("mdcl") {
+		codes = append(codes, ContentCode{
+			Number: dictionary.findText("mcnm"),
+			Name:   dictionary.findText("mcna"),
+			Type:   int16(dictionary.findInt("mcty")),
+		})
+	}
+
+	c.mu.Lock()
+	for _, code := range codes {
+		if code.Type == DmapContainer {
+			c.containers[code.Number] = true
+		}
+	}
+	c.mu.Unlock()
+
+	return codes, nil
+}
+
+func (c *Client) Login(ctx context.Context) error {
+	tag, err := c.get(ctx, "/login", nil, "mlog")
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.sessionID = int(tag.findInt("mlid"))
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) Logout(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "/logout", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	c.mu.Lock()
+	c.sessionID = 0
+	c.mu.Unlock()
+	return nil
+}
+
+// SessionID is the session the client logged in to, 0 if it hasn't.
+func (c *Client) SessionID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionID
+}
+
+// Revision is the library revision the client last saw.
+func (c *Client) Revision() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.revision
+}
+
+// Update waits for the library revision to move past the one the client last
+// saw and returns the new one. The first call returns straight away.
+func (c *Client) Update(ctx context.Context) (int, error) {
+	c.mu.Lock()
+	revision, updated := c.revision, c.updated
+	c.mu.Unlock()
+	params := url.Values{}
+	params.Set("revision-number", strconv.Itoa(revision))
+	if updated {
+		params.Set("delta", strconv.Itoa(revision))
+	}
+	tag, err := c.get(ctx, "/update", params, "mupd")
+	if err != nil {
+		return 0, err
+	}
+	revision = int(tag.findInt("musr"))
+	c.mu.Lock()
+	c.revision, c.updated = revision, true
+	c.mu.Unlock()
+	return revision, nil
+}
+
+func (c *Client) revisionParams() url.Values {
+	params := url.Values{}
+	params.Set("revision-number", strconv.Itoa(c.Revision()))
+	return params
+}
+
+func (c *Client) Databases(ctx context.Context) ([]Database, error) {
+	tag, err := c.get(ctx, "/databases", c.revisionParams(), "avdb")
+	if err != nil {
+		return nil, err
+	}
+	listing, _ := tag.Find("mlcl")
+	databases := []Database{}
+	for _, item := range listing.All("mlit") {
+		databases = append(databases, Database{
+			ID:             int(item.findInt("miid")),
+			PersistentID:   item.findInt("mper"),
+			Name:           item.findText("minm"),
+			ItemCount:      int(item.findInt("mimc")),
+			ContainerCount: int(item.findInt("mctc")),
+		})
+	}
+	return databases, nil
+}
+
+// Items lists the songs in a database with the given fields, DefaultMeta if
+// none are given.
+func (c *Client) Items(ctx context.Context, databaseID int, meta []string) ([]Song, error) {
+	return c.QueryItems(ctx, databaseID, meta, "")
+}
+
+// QueryItems lists the songs in a database matching a DAAP query such as
+// 'daap.songartist:Some Artist'. An empty query matches everything.
+func (c *Client) QueryItems(ctx context.Context, databaseID int, meta []string, query string) ([]Song, error) {
+	if len(meta) == 0 {
+		meta = DefaultMeta
+	}
+	params := c.revisionParams()
+	params.Set("meta", strings.Join(meta, ","))
+	if query != "" {
+		params.Set("query", query)
+	}
+	tag, err := c.get(ctx, fmt.Sprintf("/databases/%d/items", databaseID), params, "adbs")
+	if err != nil {
+		return nil, err
+	}
+	listing, _ := tag.Find("mlcl")
+	songs := []Song{}
+	for _, item := range listing.All("mlit") {
+		songs = append(songs, Song{
+			ID:           int(item.findInt("miid")),
+			PersistentID: item.findInt("mper"),
+			Kind:         int(item.findInt("mikd")),
+			Title:        item.findText("minm"),
+			Album:        item.findText("asal"),
+			Artist:       item.findText("asar"),
+			Format:       item.findText("asfm"),
+			TrackNumber:  int(item.findInt("astn")),
+			Duration:     int(item.findInt("astm")),
+			Tags:         item.Children,
+		})
+	}
+	return songs, nil
+}
+
+func (c *Client) Containers(ctx context.Context, databaseID int) ([]Playlist, error) {
+	params := c.revisionParams()
+	params.Set("meta", "dmap.itemid,dmap.itemname,dmap.persistentid,dmap.itemcount")
+	tag, err := c.get(ctx, fmt.Sprintf("/databases/%d/containers", databaseID), params, "aply")
+	if err != nil {
+		return nil, err
+	}
+	listing, _ := tag.Find("mlcl")
+	playlists := []Playlist{}
+	for _, item := range listing.All("mlit") {
+		playlists = append(playlists, Playlist{
+			ID:           int(item.findInt("miid")),
+			PersistentID: item.findInt("mper"),
+			Name:         item.findText("minm"),
+			ItemCount:    int(item.findInt("mimc")),
+		})
+	}
+	return playlists, nil
+}
+
+// Stream starts downloading a song, from offset bytes in if the server
+// supports ranges. The caller must close it.
+func (c *Client) Stream(ctx context.Context, databaseID int, song Song, offset int64) (*Stream, error) {
+	format := song.Format
+	if format == "" {
+		format = "mp3"
+	}
+	req, err := c.newRequest(ctx, fmt.Sprintf("/databases/%d/items/%d.%s", databaseID, song.ID, format), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &Stream{ReadCloser: resp.Body, Size: resp.ContentLength}
+	if resp.StatusCode == http.StatusPartialContent {
+		stream.Offset, stream.Size = parseContentRange(resp.Header.Get("Content-Range"))
+	}
+	return stream, nil
+}
+
+// parseContentRange gets the start and full size from a header like
+// "bytes 100-199/200".
+func parseContentRange(contentRange string) (int64, int64) {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return start, -1
+	}
+	return start, size
+}
+
+// parseUnsatisfiedRange gets the full size from the header of a 416
+// response, like "bytes */200", or -1 if there isn't one.
+func parseUnsatisfiedRange(contentRange string) int64 {
+	var size int64
+	if _, err := fmt.Sscanf(contentRange, "bytes */%d", &size); err != nil {
+		return -1
+	}
+	return size
+}
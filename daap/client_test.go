@@ -0,0 +1,36 @@
+package daap
+
+import "testing"
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header string
+		start  int64
+		size   int64
+	}{
+		{"bytes 100-199/200", 100, 200},
+		{"bytes 0-0/1", 0, 1},
+		{"bytes 100-199/*", 100, -1},
+		{"", 0, -1},
+	}
+	for _, test := range tests {
+		start, size := parseContentRange(test.header)
+		if start != test.start || size != test.size {
+			t.Errorf("wrong range for '%v', want %v/%v, got %v/%v", test.header, test.start, test.size, start, size)
+		}
+	}
+}
+
+func TestParseUnsatisfiedRange(t *testing.T) {
+	tests := map[string]int64{
+		"bytes */200": 200,
+		"bytes */0":   0,
+		"bytes */*":   -1,
+		"":            -1,
+	}
+	for header, want := range tests {
+		if got := parseUnsatisfiedRange(header); got != want {
+			t.Errorf("wrong size for '%v', want %v, got %v", header, want, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package daap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Tag is one decoded DMAP element. Containers have their contents decoded into
+// Children, everything else keeps its raw Data.
+type Tag struct {
+	Code     string
+	Data     []byte
+	Children []Tag
+}
+
+// DmapContainer is the content code type of container tags.
+const DmapContainer int16 = 12
+
+// defaultContainers are the container tags known without asking the server
+// for its content codes.
+var defaultContainers = []string{
+	"msrv", "mccr", "mdcl", "mlog", "mupd", "mlcl", "mlit", "msml",
+	"avdb", "adbs", "aply", "apso", "abro", "abal", "abar", "agal",
+	"arsv", "casp", "cmst", "cmgt",
+}
+
+// Decode splits tagged DMAP data into tags, descending into any tag whose code
+// is in containers.
+func Decode(data []byte, containers map[string]bool) ([]Tag, error) {
+	tags := []Tag{}
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated tag header: %v bytes left", len(data))
+		}
+		code := string(data[:4])
+		length := binary.BigEndian.Uint32(data[4:8])
+		if uint64(len(data)-8) < uint64(length) {
+			return nil, fmt.Errorf("tag %v wants %v bytes, only %v left", code, length, len(data)-8)
+		}
+		tag := Tag{Code: code}
+		payload := data[8 : 8+length]
+		if containers[code] {
+			children, err := Decode(payload, containers)
+			if err != nil {
+				return nil, fmt.Errorf("in %v: %v", code, err)
+			}
+			tag.Children = children
+		} else {
+			tag.Data = payload
+		}
+		tags = append(tags, tag)
+		data = data[8+length:]
+	}
+	return tags, nil
+}
+
+// Find returns the first child tag with the given code.
+func (t Tag) Find(code string) (Tag, bool) {
+	for _, child := range t.Children {
+		if child.Code == code {
+			return child, true
+		}
+	}
+	return Tag{}, false
+}
+
+// All returns every child tag with the given code.
+func (t Tag) All(code string) []Tag {
+	tags := []Tag{}
+	for _, child := range t.Children {
+		if child.Code == code {
+			tags = append(tags, child)
+		}
+	}
+	return tags
+}
+
+// Int decodes a char, short, int or long value. Missing or oddly sized data
+// decodes as 0.
+func (t Tag) Int() int64 {
+	switch len(t.Data) {
+	case 1:
+		return int64(int8(t.Data[0]))
+	case 2:
+		return int64(int16(binary.BigEndian.Uint16(t.Data)))
+	case 4:
+		return int64(int32(binary.BigEndian.Uint32(t.Data)))
+	case 8:
+		return int64(binary.BigEndian.Uint64(t.Data))
+	}
+	return 0
+}
+
+// Text decodes a string value.
+func (t Tag) Text() string {
+	return string(t.Data)
+}
+
+// Version decodes a version value.
+func (t Tag) Version() Version {
+	if len(t.Data) != 4 {
+		return Version{}
+	}
+	return Version{binary.BigEndian.Uint16(t.Data), t.Data[2], t.Data[3]}
+}
+
+func (t Tag) findInt(code string) int64 {
+	child, _ := t.Find(code)
+	return child.Int()
+}
+
+func (t Tag) findText(code string) string {
+	child, _ := t.Find(code)
+	return child.Text()
+}
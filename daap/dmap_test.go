@@ -0,0 +1,76 @@
+package daap
+
+import "testing"
+
+func TestDecode(t *testing.T) {
+	data := []byte{
+		109, 108, 111, 103, 0, 0, 0, 24, // mlog
+		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
+		109, 108, 105, 100, 0, 0, 0, 4, 0, 0, 0, 113, // mlid
+		109, 105, 110, 109, 0, 0, 0, 2, 104, 105, // minm
+	}
+	tags, err := Decode(data, map[string]bool{"mlog": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags[0].Code != "mlog" || tags[1].Code != "minm" {
+		t.Fatalf("wrong tags: %+v", tags)
+	}
+	if len(tags[0].Children) != 2 {
+		t.Fatalf("wrong children: %+v", tags[0].Children)
+	}
+	if got := tags[0].findInt("mlid"); got != 113 {
+		t.Errorf("wrong mlid: %v", got)
+	}
+	if got := tags[1].Text(); got != "hi" {
+		t.Errorf("wrong minm: %v", got)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, data := range [][]byte{
+		{109, 108, 111},
+		{109, 108, 111, 103, 0, 0, 0, 24, 0},
+		{109, 108, 111, 103, 0, 0, 0, 9, 109, 115, 116, 116, 0, 0, 0, 4, 0},
+	} {
+		if _, err := Decode(data, map[string]bool{"mlog": true}); err == nil {
+			t.Errorf("expected error decoding %v", data)
+		}
+	}
+}
+
+func TestTagInt(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want int64
+	}{
+		{[]byte{2}, 2},
+		{[]byte{0xFF}, -1},
+		{[]byte{0, 12}, 12},
+		{[]byte{0, 0, 7, 8}, 1800},
+		{[]byte{0, 0, 0, 0, 0, 8, 0, 0}, 0x80000},
+		{[]byte{1, 2, 3}, 0},
+	}
+	for _, test := range tests {
+		if got := (Tag{Data: test.data}).Int(); got != test.want {
+			t.Errorf("wrong value for %v, want %v, got %v", test.data, test.want, got)
+		}
+	}
+}
+
+func TestTagVersion(t *testing.T) {
+	got := Tag{Data: []byte{0, 3, 0, 12}}.Version()
+	if got != (Version{3, 0, 12}) {
+		t.Errorf("wrong version: %v", got)
+	}
+}
+
+func TestTagAll(t *testing.T) {
+	tag := Tag{Children: []Tag{{Code: "mlit"}, {Code: "mstt"}, {Code: "mlit"}}}
+	if got := tag.All("mlit"); len(got) != 2 {
+		t.Errorf("wrong number of tags: %v", got)
+	}
+	if _, ok := tag.Find("abcd"); ok {
+		t.Error("found missing tag")
+	}
+}
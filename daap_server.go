@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/carlgreen/audioserve/daap"
 	"github.com/husobee/vestigo"
+	"golang.org/x/text/language"
 )
 
 var contentCodes = []ContentCode{
@@ -22,6 +33,7 @@ var contentCodes = []ContentCode{
 	{"mdcl", "dmap.dictionary", DmapContainer},
 	{"msrv", "dmap.serverinforesponse", DmapContainer},
 	{"mslr", "dmap.loginrequired", DmapChar},
+	{"msau", "dmap.authenticationmethod", DmapChar},
 	{"mpro", "dmap.protocolversion", DmapVersion},
 	{"msal", "dmap.supportsautologout", DmapChar},
 	{"msup", "dmap.supportsupdate", DmapChar},
@@ -47,33 +59,317 @@ var contentCodes = []ContentCode{
 	{"adbs", "daap.databasesongs", DmapContainer},
 	{"asal", "daap.songalbum", DmapString},
 	{"asar", "daap.songartist", DmapString},
+	{"asfm", "daap.songformat", DmapString},
+	{"astn", "daap.songtracknumber", DmapShort},
+	{"astm", "daap.songtime", DmapLong},
+	{"aspc", "daap.songuserplaycount", DmapLong},
+	{"askp", "daap.songuserskipcount", DmapLong},
+	{"aspl", "daap.songdateplayed", DmapDate},
+	{"askd", "daap.songlastskipdate", DmapDate},
+	{"asur", "daap.songuserrating", DmapChar},
+	{"asgn", "daap.songgenre", DmapString},
+	{"ascp", "daap.songcomposer", DmapString},
+	{"asaa", "daap.songalbumartist", DmapString},
+	{"assa", "daap.sortartist", DmapString},
+	{"assu", "daap.sortalbum", DmapString},
+	{"assn", "daap.sortname", DmapString},
+	{"assl", "daap.sortalbumartist", DmapString},
+	{"asco", "daap.songcompilation", DmapChar},
+	{"asdn", "daap.songdiscnumber", DmapShort},
+	{"asai", "daap.songalbumid", DmapLongLong},
+	{"agal", "daap.albumgrouping", DmapContainer},
+	{"agar", "daap.artistgrouping", DmapContainer},
+	{"agac", "daap.groupalbumcount", DmapLong},
+	{"abro", "daap.databasebrowse", DmapContainer},
+	{"abar", "daap.browseartistlisting", DmapContainer},
+	{"abal", "daap.browsealbumlisting", DmapContainer},
+	{"abgn", "daap.browsegenrelisting", DmapContainer},
+	{"abcp", "daap.browsecomposerlisting", DmapContainer},
+	{"mshl", "dmap.sortingheaderlisting", DmapContainer},
+	{"mshc", "dmap.sortingheaderchar", DmapShort},
+	{"mshi", "dmap.sortingheaderindex", DmapLong},
+	{"mshn", "dmap.sortingheadernumber", DmapLong},
+	{"aeMK", "com.apple.itunes.mediakind", DmapChar},
+	{"asct", "daap.songcategory", DmapString},
+	{"asdt", "daap.songdescription", DmapString},
+	{"asdr", "daap.songdatereleased", DmapDate},
+	{"aePS", "com.apple.itunes.special-playlist", DmapChar},
+	{"asul", "daap.songdataurl", DmapString},
+	{"mdbk", "dmap.databasekind", DmapLong},
+	{"apso", "daap.playlistsongs", DmapContainer},
 	{"aply", "daap.databaseplaylists", DmapContainer},
+	{"aeSV", "com.apple.itunes.music-sharing-version", DmapLong},
+	{"ated", "daap.supportsextradata", DmapShort},
+	{"asgr", "daap.supportsgroups", DmapShort},
+	{"asse", "com.apple.itunes.unknown-asse", DmapLongLong},
+	{"msed", "dmap.supportsedit", DmapChar},
+	{"msml", "dmap.speakermachinelist", DmapContainer},
+	{"cmst", "dmcp.playstatus", DmapContainer},
+	{"cmsr", "dmcp.serverrevision", DmapLong},
+	{"caps", "dacp.playerstate", DmapChar},
+	{"cash", "dacp.shufflestate", DmapChar},
+	{"carp", "dacp.repeatstate", DmapChar},
+	{"cavc", "dacp.volumecontrollable", DmapChar},
+	{"caas", "dacp.albumshuffle", DmapLong},
+	{"caar", "dacp.albumrepeat", DmapLong},
+	{"canp", "dacp.nowplaying", DmapString},
+	{"cann", "daap.nowplayingtrack", DmapString},
+	{"cana", "daap.nowplayingartist", DmapString},
+	{"canl", "daap.nowplayingalbum", DmapString},
+	{"cant", "dacp.remainingtime", DmapLong},
+	{"cast", "dacp.tracklength", DmapLong},
+	{"cmgt", "dmcp.getpropertyresponse", DmapContainer},
+	{"cmvo", "dmcp.volume", DmapLong},
+	{"cacr", "dacp.cueresponse", DmapContainer},
+	{"ceQR", "com.apple.itunes.playqueue-contents-response", DmapContainer},
+	{"cmpa", "dacp.pairinganswer", DmapContainer},
+	{"cmpg", "dacp.pairingguid", DmapLongLong},
+	{"cmnm", "dacp.devicename", DmapString},
+	{"cmty", "dacp.devicetype", DmapString},
 }
 
-var databases = []Database{
-	{
-		"testdb",
-		[]Song{
-			{"some item", "some artist", "some album"},
-		},
-	},
+// shareSettings are the parts of the configuration read on every request.
+// They are swapped as a whole when the configuration is reloaded.
+type shareSettings struct {
+	// name is the share name clients show.
+	name string
+	// sessionTimeout is how long clients are told they can be idle before
+	// logging in again.
+	sessionTimeout time.Duration
+	// password, if set, must be sent with basic auth to get at the library.
+	password string
+	// adminPassword must be sent with basic auth to use the admin API, which
+	// is off without one.
+	adminPassword string
+	// gzip compresses responses for clients that accept it.
+	gzip bool
+	// requireValidation rejects DAAP 2 and later clients that don't send a
+	// correct Client-DAAP-Validation header, as iTunes does for its own
+	// shares.
+	requireValidation bool
+	// sortArticles are left off the start of names without a sort tag.
+	sortArticles []string
+	// sortLanguage gives the collation rules names are sorted by.
+	sortLanguage language.Tag
+	// writeTags writes ratings and play counts back into song files.
+	writeTags bool
+	// profiles are the DAAP versions spoken, see negotiate.
+	profiles []ProtocolProfile
 }
 
-func routes(contentCodes []ContentCode, databases []Database) http.Handler {
+var (
+	shareMu sync.RWMutex
+	share   = shareSettings{name: "daap-server", sessionTimeout: 1800 * time.Second, gzip: true, sortArticles: defaultSortArticles, sortLanguage: defaultSortLanguage, profiles: protocolProfiles}
+)
+
+func currentShare() shareSettings {
+	shareMu.RLock()
+	defer shareMu.RUnlock()
+	return share
+}
+
+func setShare(settings shareSettings) {
+	shareMu.Lock()
+	defer shareMu.Unlock()
+	share = settings
+}
+
+// routes sets up the DAAP server, DACP remote control if there's a player and
+// the admin API if there's an admin.
+func routes(contentCodes []ContentCode, library *Library, player Player, pairings *Pairings, admin *Admin) http.Handler {
+	cache := newResponseCache(responseCacheSize)
+
 	router := vestigo.NewRouter()
-	router.Get("/server-info", headers(serverInfoHandler))
-	router.Get("/content-codes", headers(contentCodesHandler(contentCodes)))
-	router.Get("/databases", headers(databasesHandler(databases)))
-	router.Get("/databases/:itemId/items", headers(databaseItemsHandler(databases)))
-	router.Get("/databases/:itemId/containers", headers(databaseContainersHandler(databases)))
-	router.Get("/login", headers(loginHandler))
-	router.Get("/logout", headers(logoutHandler))
-	router.Get("/update", headers(updateHandler))
-	vestigo.CustomNotFoundHandlerFunc(headers(defaultHandler))
-	return router
+	sessions := newSessions()
+	serverMetrics.watch(library, cache, sessions)
+	wrap := func(route string, handler http.HandlerFunc) http.HandlerFunc {
+		return serverMetrics.instrument(route, accessLog.wrap(headers(sessions, sessions.track(http.Error, handler))))
+	}
+	get := func(route string, handler http.HandlerFunc) {
+		router.Get(route, wrap(route, handler))
+	}
+	get("/server-info", serverInfoHandler(library))
+	get("/content-codes", contentCodesHandler(contentCodes))
+	get("/databases", databasesHandler(library))
+	get("/databases/:itemId/items", databaseItemsHandler(library, cache))
+	song := "/databases/:itemId/items/:songId"
+	router.Get(song, serverMetrics.instrumentStream(song, accessLog.wrap(streamHeaders(sessions, sessions.track(http.Error, songStreamHandler(library))))))
+	router.Post(song+"/rating", wrap(song+"/rating", songRatingHandler(library)))
+	get("/databases/:itemId/groups", requireField("daap.supportsgroups", groupsHandler(library)))
+	get("/databases/:itemId/browse/:category", requireField("dmap.supportsbrowse", browseHandler(library)))
+	get("/databases/:itemId/containers", databaseContainersHandler(library))
+	get("/databases/:itemId/containers/:containerId/items", containerItemsHandler(library))
+	get("/login", loginHandler(pairings, sessions))
+	get("/logout", logoutHandler(sessions))
+	get("/update", updateHandler(library))
+	api := func(route string, handler http.HandlerFunc) {
+		router.Get("/api/v1"+route, serverMetrics.instrument("/api/v1"+route, accessLog.wrap(serve("application/json", true, apiError, shareAccess(sessions), sessions.track(apiError, handler)))))
+	}
+	api("/databases", apiDatabasesHandler(library))
+	api("/databases/:databaseId/songs", apiSongsHandler(library))
+	api("/databases/:databaseId/songs/:songId", apiSongHandler(library))
+	api("/databases/:databaseId/playlists", apiPlaylistsHandler(library))
+	api("/databases/:databaseId/playlists/:playlistId/songs", apiPlaylistSongsHandler(library))
+	api("/databases/:databaseId/artists", apiArtistsHandler(library))
+	api("/databases/:databaseId/albums", apiAlbumsHandler(library))
+	api("/stats", apiStatsHandler(library))
+	api("/openapi.json", apiOpenAPIHandler)
+	web := func(route string, handler http.HandlerFunc) {
+		router.Get(route, serverMetrics.instrument(route, accessLog.wrap(serve("", true, http.Error, adminAccess, handler))))
+	}
+	web("/admin/web", webIndexHandler)
+	web("/admin/web/static/*", webStaticHandler)
+	if admin != nil {
+		adminAPI := func(method, route string, handler http.HandlerFunc) {
+			router.Add(method, "/admin/v1"+route, serverMetrics.instrument("/admin/v1"+route, accessLog.wrap(serve("application/json", true, apiError, adminAccess, handler))))
+		}
+		adminAPI("GET", "/rescan", rescanStatusHandler(admin))
+		adminAPI("POST", "/rescan", rescanHandler(admin))
+		adminAPI("GET", "/sessions", sessionsHandler(sessions))
+		adminAPI("DELETE", "/sessions/:sessionId", expireSessionHandler(sessions))
+		adminAPI("GET", "/playlists", smartPlaylistsHandler(admin))
+		adminAPI("PUT", "/playlists/:name", putSmartPlaylistHandler(admin, library))
+		adminAPI("DELETE", "/playlists/:name", deleteSmartPlaylistHandler(admin, library))
+	}
+	if player != nil {
+		control := newPlayerControl(player, library)
+		get("/ctrl-int/1/playstatusupdate", playStatusHandler(control))
+		get("/ctrl-int/1/playpause", playerCommandHandler(control, Player.PlayPause))
+		get("/ctrl-int/1/nextitem", playerCommandHandler(control, control.nextItem))
+		get("/ctrl-int/1/previtem", playerCommandHandler(control, Player.Previous))
+		get("/ctrl-int/1/setproperty", setPropertyHandler(control))
+		get("/ctrl-int/1/getproperty", getPropertyHandler(control))
+		get("/ctrl-int/1/cue", cueHandler(control, library))
+		get("/ctrl-int/1/playqueue-contents", playQueueHandler(control))
+		get("/ctrl-int/1/nowplayingartwork", nowPlayingArtworkHandler(control))
+	}
+	// vestigo keeps the first not found handler it's given for good, so it
+	// finds this server's sessions in the request rather than keeping them
+	vestigo.CustomNotFoundHandlerFunc(notFoundHandler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), serverSessionsKey{}, sessions)))
+	})
+}
+
+type serverSessionsKey struct{}
+
+// notFoundHandler refuses or 404s requests for routes the server doesn't
+// have, using the sessions of the server that got the request.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, _ := r.Context().Value(serverSessionsKey{}).(*Sessions)
+	accessLog.wrap(headers(sessions, defaultHandler))(w, r)
 }
 
 func main() {
-	router := routes(contentCodes, databases)
-	log.Fatal(http.ListenAndServe(":3689", router))
+	config, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	setShare(config.share())
+	responseCacheSize = config.CacheSize << 20
+	accessLog.format = config.LogFormat
+	accessLog.level = config.LogLevel
+	if config.AccessLog != "" {
+		f, err := openRotatingFile(config.AccessLog, int64(config.AccessLogMaxSize)<<20, config.AccessLogBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		accessLog.w = f
+	}
+
+	pairings, err := loadPairings(config.pairingsPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.PairRemote != "" {
+		device, err := pairings.pair(context.Background(), http.DefaultClient, config.PairRemote, config.PairCode, config.PIN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("paired with %v (%v)", device.Name, device.Type)
+	}
+
+	playlists, err := loadSmartPlaylists(config.playlistsPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clients := []*daap.Client{}
+	var proxied *Database
+	if len(config.Proxy) > 0 {
+		for _, rawURL := range config.Proxy {
+			client, err := upstreamClient(rawURL)
+			if err != nil {
+				log.Fatal(err)
+			}
+			clients = append(clients, client)
+		}
+		// filled in by the proxy once it has heard from the upstreams
+		proxied = &Database{name: config.Name}
+	}
+	served, err := servedDatabases(config, proxied)
+	if err != nil {
+		log.Fatal(err)
+	}
+	library := newLibrary(served)
+	if err := library.useIndex(config.indexPath()); err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := library.saveIndex(); err != nil {
+			log.Printf("cannot save the library index: %v", err)
+		}
+	}()
+	library.useSmartPlaylists(playlists.list())
+	rescannable := config.Libraries
+	if len(clients) > 0 {
+		// the libraries aren't served when proxying
+		rescannable = nil
+	}
+	scanner := newScanner(library, rescannable)
+	admin := &Admin{scanner: scanner, playlists: playlists}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if len(clients) > 0 {
+		go newProxy(config.Name, library, clients).run(ctx)
+	}
+
+	// remotes can only browse without something to play on
+	var player Player
+	if len(config.Player) > 0 {
+		commandPlayer := newCommandPlayer(config.Player)
+		defer commandPlayer.close()
+		player = commandPlayer
+	}
+
+	server := &http.Server{
+		Addr:        fmt.Sprintf(":%d", config.Port),
+		Handler:     routes(contentCodes, library, player, pairings, admin),
+		IdleTimeout: config.IdleTimeout,
+	}
+	server.RegisterOnShutdown(cancel)
+	server.RegisterOnShutdown(library.close)
+	if config.AdminPort != 0 {
+		admin := &http.Server{Addr: fmt.Sprintf(":%d", config.AdminPort), Handler: adminRoutes(serverMetrics)}
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		server.RegisterOnShutdown(func() { admin.Close() })
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	reloader := &reloader{args: os.Args[1:], getenv: os.Getenv, config: config, library: library, scanner: scanner}
+	if err := run(server, listener, signals, reloader.reload, config.ShutdownTimeout); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
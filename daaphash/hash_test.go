@@ -0,0 +1,142 @@
+package daaphash
+
+import (
+	"crypto/md5"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDigestMatchesMD5(t *testing.T) {
+	inputs := []string{
+		"",
+		"abc",
+		"/server-info",
+		strings.Repeat("a", 55),
+		strings.Repeat("a", 56),
+		strings.Repeat("a", 64),
+		strings.Repeat("0123456789", 30),
+	}
+	for _, input := range inputs {
+		d := newDigest(false)
+		d.WriteString(input)
+		got := d.Sum()
+		want := md5.Sum([]byte(input))
+		if got != want {
+			t.Errorf("wrong digest for %q, want %x, got %x", input, want, got)
+		}
+	}
+}
+
+func TestAppleDigestDiffers(t *testing.T) {
+	d := newDigest(true)
+	d.WriteString("abc")
+	got := d.Sum()
+	if got == md5.Sum([]byte("abc")) {
+		t.Error("apple variant should not match standard MD5")
+	}
+}
+
+func TestVersion2Table(t *testing.T) {
+	// version 2 uses standard MD5 so the table can be checked independently
+	want := md5.Sum([]byte("user-agentAuthorizationAccept-Encodingdaap.songartistdaap.songdatemodifieddaap.songdisabledrevision-numbercontent-codes"))
+	if version2Table[0] != digestToString(want) {
+		t.Errorf("wrong first table entry: %v", version2Table[0])
+	}
+	want = md5.Sum([]byte("Accept-Languagemax-ageClient-DAAP-Versiondaap.protocolversiondaap.songcomposerdaap.songdiscnumberplaylist-item-specsession-id"))
+	if version2Table[255] != digestToString(want) {
+		t.Errorf("wrong last table entry: %v", version2Table[255])
+	}
+}
+
+func TestGenerateVersion2(t *testing.T) {
+	want := md5.Sum([]byte("/server-info" + copyright + version2Table[2]))
+	got := Generate(2, "/server-info", 2, 0)
+	if got != digestToString(want) {
+		t.Errorf("wrong hash, want %v, got %v", digestToString(want), got)
+	}
+	if len(got) != 32 || strings.ToUpper(got) != got {
+		t.Errorf("hash should be 32 upper case hex characters: %v", got)
+	}
+}
+
+func TestGenerateVersion3(t *testing.T) {
+	noID := Generate(3, "/databases", 2, 0)
+	withID := Generate(3, "/databases", 2, 7)
+	if noID == withID {
+		t.Error("request id should change the version 3 hash")
+	}
+	if Generate(2, "/databases", 2, 0) != Generate(2, "/databases", 2, 7) {
+		t.Error("request id should not change the version 2 hash")
+	}
+	if noID == Generate(2, "/databases", 2, 0) {
+		t.Error("version 3 hash should differ from version 2")
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		version    string
+		validation string
+		requestID  string
+		want       bool
+	}{
+		{"", "", "", true},
+		{"1.0", "", "", true},
+		{"2.0", "", "", false},
+		{"2.0", Generate(2, "/login?a=b", 2, 0), "", true},
+		{"2.0", strings.ToLower(Generate(2, "/login?a=b", 2, 0)), "", true},
+		{"3.0", Generate(3, "/login?a=b", 2, 0), "5", false},
+		{"3.0", Generate(3, "/login?a=b", 2, 5), "5", true},
+		{"3.0", Generate(3, "/login?a=b", 2, 5), "x", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/login?a=b", nil)
+		req.Header.Set("Client-DAAP-Version", test.version)
+		req.Header.Set("Client-DAAP-Validation", test.validation)
+		req.Header.Set("Client-DAAP-Request-ID", test.requestID)
+		if got := Valid(req); got != test.want {
+			t.Errorf("wrong validity for %+v, want %v, got %v", test, test.want, got)
+		}
+	}
+}
+
+func TestValidUsesSentURI(t *testing.T) {
+	uri := "/databases/1/items?meta=dmap.itemid"
+	req := httptest.NewRequest("GET", uri, nil)
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	req.Header.Set("Client-DAAP-Validation", Generate(3, uri, 2, 0))
+	// as a router adding a path parameter does
+	req.URL.RawQuery = ":itemId=1&" + req.URL.RawQuery
+	if !Valid(req) {
+		t.Error("hash checked against the rewritten URI")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var valid bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		valid = r.Header.Get("Client-DAAP-Validation") != "" && Valid(r)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &Transport{}}
+	req, err := http.NewRequest("GET", server.URL+"/databases/1/items?meta=dmap.itemid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	req.Header.Set("Client-DAAP-Request-ID", "3")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !valid {
+		t.Error("server did not receive a valid hash")
+	}
+	if req.Header.Get("Client-DAAP-Validation") != "" {
+		t.Error("transport modified the caller's request")
+	}
+}
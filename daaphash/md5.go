@@ -0,0 +1,122 @@
+package daaphash
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// digest is a plain MD5 implementation with one twist: DAAP version 3 hashes
+// use a different constant in the twelfth step of the second round, so the
+// standard library's crypto/md5 can't be used for them.
+type digest struct {
+	s     [4]uint32
+	buf   [64]byte
+	nbuf  int
+	len   uint64
+	apple bool
+}
+
+var md5Shifts = [64]uint{
+	7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22,
+	5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20,
+	4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23,
+	6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21,
+}
+
+var md5Table = [64]uint32{
+	0xd76aa478, 0xe8c7b756, 0x242070db, 0xc1bdceee, 0xf57c0faf, 0x4787c62a, 0xa8304613, 0xfd469501,
+	0x698098d8, 0x8b44f7af, 0xffff5bb1, 0x895cd7be, 0x6b901122, 0xfd987193, 0xa679438e, 0x49b40821,
+	0xf61e2562, 0xc040b340, 0x265e5a51, 0xe9b6c7aa, 0xd62f105d, 0x02441453, 0xd8a1e681, 0xe7d3fbc8,
+	0x21e1cde6, 0xc33707d6, 0xf4d50d87, 0x455a14ed, 0xa9e3e905, 0xfcefa3f8, 0x676f02d9, 0x8d2a4c8a,
+	0xfffa3942, 0x8771f681, 0x6d9d6122, 0xfde5380c, 0xa4beea44, 0x4bdecfa9, 0xf6bb4b60, 0xbebfbc70,
+	0x289b7ec6, 0xeaa127fa, 0xd4ef3085, 0x04881d05, 0xd9d4d039, 0xe6db99e5, 0x1fa27cf8, 0xc4ac5665,
+	0xf4292244, 0x432aff97, 0xab9423a7, 0xfc93a039, 0x655b59c3, 0x8f0ccc92, 0xffeff47d, 0x85845dd1,
+	0x6fa87e4f, 0xfe2ce6e0, 0xa3014314, 0x4e0811a1, 0xf7537e82, 0xbd3af235, 0x2ad7d2bb, 0xeb86d391,
+}
+
+// appleConstant replaces md5Table[27], 0x455a14ed, in the version 3 variant.
+const appleConstant = 0x445a14ed
+
+func newDigest(apple bool) *digest {
+	return &digest{
+		s:     [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476},
+		apple: apple,
+	}
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.len += uint64(n)
+	if d.nbuf > 0 {
+		c := copy(d.buf[d.nbuf:], p)
+		d.nbuf += c
+		p = p[c:]
+		if d.nbuf == 64 {
+			d.block(d.buf[:])
+			d.nbuf = 0
+		}
+	}
+	for len(p) >= 64 {
+		d.block(p[:64])
+		p = p[64:]
+	}
+	d.nbuf += copy(d.buf[:], p)
+	return n, nil
+}
+
+func (d *digest) WriteString(s string) {
+	d.Write([]byte(s))
+}
+
+func (d *digest) Sum() [16]byte {
+	length := d.len
+	padding := make([]byte, 64+8)
+	padding[0] = 0x80
+	padLen := 56 - int(length%64)
+	if padLen <= 0 {
+		padLen += 64
+	}
+	binary.LittleEndian.PutUint64(padding[padLen:], length<<3)
+	d.Write(padding[:padLen+8])
+
+	var out [16]byte
+	for i, s := range d.s {
+		binary.LittleEndian.PutUint32(out[i*4:], s)
+	}
+	return out
+}
+
+func (d *digest) block(p []byte) {
+	var x [16]uint32
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(p[i*4:])
+	}
+	a, b, c, dd := d.s[0], d.s[1], d.s[2], d.s[3]
+	for i := 0; i < 64; i++ {
+		var f uint32
+		var g int
+		switch {
+		case i < 16:
+			f = dd ^ (b & (c ^ dd))
+			g = i
+		case i < 32:
+			f = c ^ (dd & (b ^ c))
+			g = (5*i + 1) % 16
+		case i < 48:
+			f = b ^ c ^ dd
+			g = (3*i + 5) % 16
+		default:
+			f = c ^ (b | ^dd)
+			g = (7 * i) % 16
+		}
+		k := md5Table[i]
+		if i == 27 && d.apple {
+			k = appleConstant
+		}
+		a, b, c, dd = dd, b+bits.RotateLeft32(a+f+k+x[g], int(md5Shifts[i])), b, c
+	}
+	d.s[0] += a
+	d.s[1] += b
+	d.s[2] += c
+	d.s[3] += dd
+}
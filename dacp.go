@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// playerControl tracks the play status revision that DACP remotes long-poll
+// on, bumping it whenever a command or the player itself changes something.
+type playerControl struct {
+	player  Player
+	library *Library
+
+	mu       sync.Mutex
+	revision int
+	changed  chan struct{}
+}
+
+func newPlayerControl(player Player, library *Library) *playerControl {
+	// start at 2 so the first status request, which asks for revision 1,
+	// returns straight away and later ones wait
+	c := &playerControl{player: player, library: library, revision: 2, changed: make(chan struct{})}
+	player.Notify(c.bump, c.finished)
+	return c
+}
+
+// finished counts a song the player played through.
+func (c *playerControl) finished(item QueueItem) {
+	c.library.recordPlay(item.databaseID, item.song, false, time.Now())
+}
+
+// nextItem moves on to the next song, counting a skip against the one that
+// was playing.
+func (c *playerControl) nextItem(player Player) error {
+	status := player.Status()
+	queue := player.Queue()
+	if err := player.Next(); err != nil {
+		return err
+	}
+	if status.state == PlayStatePlaying && status.current >= 0 && status.current < len(queue) {
+		item := queue[status.current]
+		c.library.recordPlay(item.databaseID, item.song, true, time.Now())
+	}
+	return nil
+}
+
+func (c *playerControl) bump() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revision++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *playerControl) current() (int, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.revision, c.changed
+}
+
+func playStatusHandler(control *playerControl) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revNumParam := r.Form.Get("revision-number")
+		revNum, err := strconv.Atoi(revNumParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", revNumParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		revision, changed := control.current()
+		if revNum >= revision {
+			select {
+			case <-changed:
+				revision, _ = control.current()
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		status := control.player.Status()
+		queue := control.player.Queue()
+
+		headerData := []byte("cmst")
+
+		data := []byte{}
+
+		data = append(data, "mstt"...)
+		data = append(data, intToData(200)...)
+
+		data = append(data, "cmsr"...)
+		data = append(data, intToData(revision)...)
+
+		data = append(data, "caps"...)
+		data = append(data, charToData(byte(status.state))...)
+
+		data = append(data, "cash"...)
+		data = append(data, charToData(boolToByte(status.shuffle))...)
+
+		data = append(data, "carp"...)
+		data = append(data, charToData(status.repeat)...)
+
+		data = append(data, "cavc"...)
+		data = append(data, charToData(1)...)
+
+		data = append(data, "caas"...)
+		data = append(data, intToData(2)...)
+
+		data = append(data, "caar"...)
+		data = append(data, intToData(6)...)
+
+		if status.current >= 0 && status.current < len(queue) {
+			item := queue[status.current]
+
+			// database, container, container item and item ids
+			data = append(data, "canp"...)
+			data = append(data, intToByteArray(16)...)
+			data = append(data, intToByteArray(item.databaseID)...)
+			data = append(data, intToByteArray(1)...)
+			data = append(data, intToByteArray(item.itemID)...)
+			data = append(data, intToByteArray(item.itemID)...)
+
+			data = append(data, "cann"...)
+			data = append(data, stringToData(item.song.Title)...)
+
+			data = append(data, "cana"...)
+			data = append(data, stringToData(item.song.Artist)...)
+
+			data = append(data, "canl"...)
+			data = append(data, stringToData(item.song.Album)...)
+
+			if item.song.Duration > 0 {
+				data = append(data, "cant"...)
+				data = append(data, intToData(item.song.Duration-status.position)...)
+
+				data = append(data, "cast"...)
+				data = append(data, intToData(item.song.Duration)...)
+			}
+		}
+
+		headerData = append(headerData, intToByteArray(len(data))...)
+		data = append(headerData, data...)
+
+		w.Write(data)
+	})
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// playerCommandHandler runs a command that takes no arguments, like
+// playpause or nextitem.
+func playerCommandHandler(control *playerControl, command func(Player) error) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := command(control.player); err != nil {
+			log.Printf("player command failed: %v", err)
+			http.Error(w, "player command failed", http.StatusInternalServerError)
+			return
+		}
+		control.bump()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func setPropertyHandler(control *playerControl) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if volumeParam := r.Form.Get("dmcp.volume"); volumeParam != "" {
+			volume, err := strconv.ParseFloat(volumeParam, 64)
+			if err != nil || volume < 0 || volume > 100 {
+				msg := fmt.Sprintf("Invalid volume '%v'", volumeParam)
+				log.Print(msg)
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if err := control.player.SetVolume(int(volume)); err != nil {
+				log.Printf("cannot set volume: %v", err)
+				http.Error(w, "cannot set volume", http.StatusInternalServerError)
+				return
+			}
+			control.bump()
+		}
+		if ratingParam := r.Form.Get("dacp.userrating"); ratingParam != "" {
+			rating, err := strconv.Atoi(ratingParam)
+			if err != nil {
+				msg := fmt.Sprintf("Cannot convert '%v' to int", ratingParam)
+				log.Print(msg)
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			databaseID, song, err := control.specifiedSong(r.Form.Get("database-spec"), r.Form.Get("item-spec"))
+			if err != nil {
+				log.Print(err)
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err := control.library.setRating(databaseID, song, rating); err != nil {
+				log.Print(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// specifiedSong finds the song a remote means by a database-spec and
+// item-spec, such as 'dmap.persistentid:0x1' and 'dmap.itemid:0x2a', or the
+// song playing if there is no item-spec.
+func (c *playerControl) specifiedSong(databaseSpec string, itemSpec string) (int, Song, error) {
+	if itemSpec == "" {
+		status := c.player.Status()
+		queue := c.player.Queue()
+		if status.current < 0 || status.current >= len(queue) {
+			return 0, Song{}, fmt.Errorf("no song playing")
+		}
+		item := queue[status.current]
+		return item.databaseID, item.song, nil
+	}
+
+	databaseID := 1
+	if databaseSpec != "" {
+		id, err := parseSpec(databaseSpec, "dmap.persistentid")
+		if err != nil {
+			return 0, Song{}, err
+		}
+		databaseID = id
+	}
+	itemID, err := parseSpec(itemSpec, "dmap.itemid")
+	if err != nil {
+		return 0, Song{}, err
+	}
+	database, ok := c.library.database(databaseID)
+	if !ok {
+		return 0, Song{}, fmt.Errorf("no database %v", databaseID)
+	}
+	_, song, ok := database.item(itemID)
+	if !ok {
+		return 0, Song{}, fmt.Errorf("no item %v in database %v", itemID, databaseID)
+	}
+	return databaseID, song, nil
+}
+
+// parseSpec reads the id out of a spec like 'dmap.itemid:0x2a'.
+func parseSpec(spec string, field string) (int, error) {
+	parts := strings.SplitN(strings.Trim(spec, "'"), ":", 2)
+	if len(parts) != 2 || parts[0] != field {
+		return 0, fmt.Errorf("cannot read %v from '%v'", field, spec)
+	}
+	id, err := strconv.ParseInt(parts[1], 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot convert '%v' to int", parts[1])
+	}
+	return int(id), nil
+}
+
+func getPropertyHandler(control *playerControl) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := control.player.Status()
+
+		headerData := []byte("cmgt")
+
+		data := []byte{}
+
+		data = append(data, "mstt"...)
+		data = append(data, intToData(200)...)
+
+		for _, property := range strings.Split(r.Form.Get("properties"), ",") {
+			switch property {
+			case "dmcp.volume":
+				data = append(data, "cmvo"...)
+				data = append(data, intToData(status.volume)...)
+			}
+		}
+
+		headerData = append(headerData, intToByteArray(len(data))...)
+		data = append(headerData, data...)
+
+		w.Write(data)
+	})
+}
+
+// cueHandler replaces the play queue with the songs matching a query, or
+// clears it.
+func cueHandler(control *playerControl, library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items := []QueueItem{}
+		index := 0
+
+		switch command := r.Form.Get("command"); command {
+		case "clear":
+		case "play":
+			query, err := parseQuery(r.Form.Get("query"))
+			if err != nil {
+				log.Print(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for dbIndex, database := range library.databases() {
+				for _, id := range database.find(query) {
+					song := database.songs[id-1]
+					items = append(items, QueueItem{dbIndex + 1, song.itemIDAt(id), song})
+				}
+			}
+			if indexParam := r.Form.Get("index"); indexParam != "" {
+				index, err = strconv.Atoi(indexParam)
+				if err != nil || index < 0 || index >= len(items) {
+					msg := fmt.Sprintf("Invalid index '%v'", indexParam)
+					log.Print(msg)
+					http.Error(w, msg, http.StatusBadRequest)
+					return
+				}
+			}
+		default:
+			msg := fmt.Sprintf("Unknown cue command '%v'", command)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		if err := control.player.Cue(items, index); err != nil {
+			log.Printf("cannot cue songs: %v", err)
+			http.Error(w, "cannot cue songs", http.StatusInternalServerError)
+			return
+		}
+		control.bump()
+
+		headerData := []byte("cacr")
+
+		data := []byte{}
+
+		data = append(data, "mstt"...)
+		data = append(data, intToData(200)...)
+
+		data = append(data, "miid"...)
+		data = append(data, intToData(len(items))...)
+
+		headerData = append(headerData, intToByteArray(len(data))...)
+		data = append(headerData, data...)
+
+		w.Write(data)
+	})
+}
+
+func playQueueHandler(control *playerControl) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queue := control.player.Queue()
+
+		headerData := []byte("ceQR")
+
+		data := []byte{}
+
+		data = append(data, "mstt"...)
+		data = append(data, intToData(200)...)
+
+		data = append(data, "mtco"...)
+		data = append(data, intToData(len(queue))...)
+
+		data = append(data, "mrco"...)
+		data = append(data, intToData(len(queue))...)
+
+		listing := []byte{}
+		for _, item := range queue {
+			listing = append(listing, songToData([]string{"dmap.itemid", "dmap.itemname", "daap.songartist", "daap.songalbum", "daap.songtime"}, item.itemID, item.song)...)
+		}
+
+		data = append(data, "mlcl"...)
+		data = append(data, intToByteArray(len(listing))...)
+		data = append(data, listing...)
+
+		headerData = append(headerData, intToByteArray(len(data))...)
+		data = append(headerData, data...)
+
+		w.Write(data)
+	})
+}
+
+func nowPlayingArtworkHandler(control *playerControl) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		artwork, contentType, err := control.player.Artwork()
+		if err != nil {
+			log.Printf("cannot get artwork: %v", err)
+			http.Error(w, "cannot get artwork", http.StatusInternalServerError)
+			return
+		}
+		if len(artwork) == 0 {
+			http.Error(w, r.RequestURI+" not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(artwork)
+	})
+}
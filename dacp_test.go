@@ -0,0 +1,471 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+// fakePlayer keeps its state in memory and never makes a sound.
+type fakePlayer struct {
+	mu       sync.Mutex
+	status   PlayerStatus
+	queue    []QueueItem
+	changed  func()
+	finished func(QueueItem)
+}
+
+func newFakePlayer() *fakePlayer {
+	return &fakePlayer{status: PlayerStatus{state: PlayStateStopped, volume: 50, current: -1}}
+}
+
+func (p *fakePlayer) Cue(items []QueueItem, index int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = items
+	p.status.position = 0
+	if len(items) == 0 {
+		p.status.state = PlayStateStopped
+		p.status.current = -1
+		return nil
+	}
+	p.status.state = PlayStatePlaying
+	p.status.current = index
+	return nil
+}
+
+func (p *fakePlayer) PlayPause() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.status.state {
+	case PlayStatePlaying:
+		p.status.state = PlayStatePaused
+	case PlayStatePaused:
+		p.status.state = PlayStatePlaying
+	case PlayStateStopped:
+		if len(p.queue) > 0 {
+			p.status.state = PlayStatePlaying
+			p.status.current = 0
+		}
+	}
+	return nil
+}
+
+func (p *fakePlayer) skip(by int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		return nil
+	}
+	p.status.current = (p.status.current + by + len(p.queue)) % len(p.queue)
+	p.status.position = 0
+	return nil
+}
+
+func (p *fakePlayer) Next() error     { return p.skip(1) }
+func (p *fakePlayer) Previous() error { return p.skip(-1) }
+
+func (p *fakePlayer) SetVolume(volume int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.volume = volume
+	return nil
+}
+
+func (p *fakePlayer) Status() PlayerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *fakePlayer) Queue() []QueueItem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queue
+}
+
+func (p *fakePlayer) Artwork() ([]byte, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status.current < 0 {
+		return nil, "", nil
+	}
+	return []byte("png data"), "image/png", nil
+}
+
+func (p *fakePlayer) Notify(changed func(), finished func(QueueItem)) {
+	p.changed = changed
+	p.finished = finished
+}
+
+// finishSong pretends the current song ended and the player moved on.
+func (p *fakePlayer) finishSong() {
+	p.finished(p.queue[p.status.current])
+	p.skip(1)
+	p.changed()
+}
+
+var dacpContainers = map[string]bool{"cmst": true, "cmgt": true, "cacr": true, "ceQR": true, "mlcl": true, "mlit": true}
+
+func dacpRequest(t *testing.T, router http.Handler, uri string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func dacpResponse(t *testing.T, router http.Handler, uri string, code string) daap.Tag {
+	resp := dacpRequest(t, router, uri)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("wrong http status for %v, want %v, got %v", uri, http.StatusOK, resp.Code)
+	}
+	tags, err := daap.Decode(resp.Body.Bytes(), dacpContainers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Code != code {
+		t.Fatalf("wrong response for %v: %+v", uri, tags)
+	}
+	return tags[0]
+}
+
+func findTag(t *testing.T, tag daap.Tag, code string) daap.Tag {
+	child, ok := tag.Find(code)
+	if !ok {
+		t.Fatalf("no %v in %v", code, tag.Code)
+	}
+	return child
+}
+
+// remoteRouter sets up the routes with a paired remote logged in, sending its
+// session with every request as remotes do.
+func remoteRouter(t *testing.T, library *Library, player Player) http.Handler {
+	pairings, err := loadPairings(filepath.Join(t.TempDir(), "pairings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pairings.add(PairedDevice{GUID: 1, Name: "remote"}); err != nil {
+		t.Fatal(err)
+	}
+	router := routes(nil, library, player, pairings, nil)
+	sessionID := loginID(t, router, "/login?pairing-guid=0x0000000000000001")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		query.Set("session-id", strconv.Itoa(sessionID))
+		r.URL.RawQuery = query.Encode()
+		router.ServeHTTP(w, r)
+	})
+}
+
+func loginID(t *testing.T, router http.Handler, uri string) int {
+	resp := dacpRequest(t, router, uri)
+	tags, err := daap.Decode(resp.Body.Bytes(), map[string]bool{"mlog": true})
+	if resp.Code != http.StatusOK || err != nil || len(tags) != 1 {
+		t.Fatalf("cannot log in with %v: %v %v", uri, resp.Code, err)
+	}
+	return int(findTag(t, tags[0], "mlid").Int())
+}
+
+func dacpTestRouter(t *testing.T) (http.Handler, *fakePlayer) {
+	var databases = []Database{
+		{name: "testdb", songs: []Song{
+			{Title: "one", Artist: "artist", Album: "album", Duration: 60000},
+			{Title: "two", Artist: "artist", Album: "album", Duration: 120000},
+			{Title: "three", Artist: "someone else", Album: "other"},
+		}},
+	}
+	player := newFakePlayer()
+	return remoteRouter(t, newLibrary(databases), player), player
+}
+
+func TestPlayStatusStopped(t *testing.T) {
+	router, _ := dacpTestRouter(t)
+	status := dacpResponse(t, router, "/ctrl-int/1/playstatusupdate?revision-number=1", "cmst")
+	if got := findTag(t, status, "cmsr").Int(); got != 2 {
+		t.Errorf("wrong revision: %v", got)
+	}
+	if got := findTag(t, status, "caps").Int(); got != int64(PlayStateStopped) {
+		t.Errorf("wrong play state: %v", got)
+	}
+	if _, ok := status.Find("canp"); ok {
+		t.Error("now playing sent while stopped")
+	}
+}
+
+func TestCueAndPlayStatus(t *testing.T) {
+	router, player := dacpTestRouter(t)
+
+	cue := dacpResponse(t, router, "/ctrl-int/1/cue?command=play&query='daap.songartist:artist'&index=1", "cacr")
+	if got := findTag(t, cue, "miid").Int(); got != 2 {
+		t.Errorf("wrong number of songs cued: %v", got)
+	}
+	if len(player.queue) != 2 || player.status.current != 1 {
+		t.Fatalf("wrong queue: %+v", player.queue)
+	}
+
+	status := dacpResponse(t, router, "/ctrl-int/1/playstatusupdate?revision-number=1", "cmst")
+	if got := findTag(t, status, "caps").Int(); got != int64(PlayStatePlaying) {
+		t.Errorf("wrong play state: %v", got)
+	}
+	if got := findTag(t, status, "cann").Text(); got != "two" {
+		t.Errorf("wrong now playing: %v", got)
+	}
+	if got := findTag(t, status, "cast").Int(); got != 120000 {
+		t.Errorf("wrong track length: %v", got)
+	}
+	canp := findTag(t, status, "canp").Data
+	if len(canp) != 16 || canp[3] != 1 || canp[15] != 2 {
+		t.Errorf("wrong now playing ids: %v", canp)
+	}
+
+	queue := dacpResponse(t, router, "/ctrl-int/1/playqueue-contents", "ceQR")
+	listing := findTag(t, queue, "mlcl")
+	items := listing.All("mlit")
+	if len(items) != 2 || findTag(t, items[0], "minm").Text() != "one" {
+		t.Errorf("wrong queue contents: %+v", items)
+	}
+
+	if resp := dacpRequest(t, router, "/ctrl-int/1/cue?command=clear"); resp.Code != http.StatusOK {
+		t.Errorf("wrong http status for clear: %v", resp.Code)
+	}
+	if len(player.queue) != 0 || player.status.state != PlayStateStopped {
+		t.Errorf("queue not cleared: %+v", player.queue)
+	}
+}
+
+func TestCueInvalid(t *testing.T) {
+	router, _ := dacpTestRouter(t)
+	for _, uri := range []string{
+		"/ctrl-int/1/cue?command=dance",
+		"/ctrl-int/1/cue?command=play&query='dmap.itemid:1'&index=1",
+		"/ctrl-int/1/cue?command=play&query='unterminated",
+	} {
+		if resp := dacpRequest(t, router, uri); resp.Code != http.StatusBadRequest {
+			t.Errorf("wrong http status for %v, want %v, got %v", uri, http.StatusBadRequest, resp.Code)
+		}
+	}
+}
+
+func TestPlayerCommands(t *testing.T) {
+	router, player := dacpTestRouter(t)
+	dacpRequest(t, router, "/ctrl-int/1/cue?command=play")
+
+	tests := []struct {
+		uri     string
+		state   PlayState
+		current int
+	}{
+		{"/ctrl-int/1/playpause", PlayStatePaused, 0},
+		{"/ctrl-int/1/playpause", PlayStatePlaying, 0},
+		{"/ctrl-int/1/nextitem", PlayStatePlaying, 1},
+		{"/ctrl-int/1/previtem", PlayStatePlaying, 0},
+		{"/ctrl-int/1/previtem", PlayStatePlaying, 2},
+	}
+	for _, test := range tests {
+		resp := dacpRequest(t, router, test.uri)
+		if resp.Code != http.StatusNoContent {
+			t.Errorf("wrong http status for %v, want %v, got %v", test.uri, http.StatusNoContent, resp.Code)
+		}
+		if player.status.state != test.state || player.status.current != test.current {
+			t.Errorf("wrong status after %v: %+v", test.uri, player.status)
+		}
+	}
+}
+
+func TestVolume(t *testing.T) {
+	router, player := dacpTestRouter(t)
+	if resp := dacpRequest(t, router, "/ctrl-int/1/setproperty?dmcp.volume=72.5"); resp.Code != http.StatusNoContent {
+		t.Errorf("wrong http status, want %v, got %v", http.StatusNoContent, resp.Code)
+	}
+	if player.status.volume != 72 {
+		t.Errorf("wrong volume: %v", player.status.volume)
+	}
+	if resp := dacpRequest(t, router, "/ctrl-int/1/setproperty?dmcp.volume=101"); resp.Code != http.StatusBadRequest {
+		t.Errorf("wrong http status, want %v, got %v", http.StatusBadRequest, resp.Code)
+	}
+
+	property := dacpResponse(t, router, "/ctrl-int/1/getproperty?properties=dmcp.volume", "cmgt")
+	if got := findTag(t, property, "cmvo").Int(); got != 72 {
+		t.Errorf("wrong volume: %v", got)
+	}
+}
+
+func TestNowPlayingArtwork(t *testing.T) {
+	router, _ := dacpTestRouter(t)
+	if resp := dacpRequest(t, router, "/ctrl-int/1/nowplayingartwork?mw=320&mh=320"); resp.Code != http.StatusNotFound {
+		t.Errorf("wrong http status with nothing playing: %v", resp.Code)
+	}
+	dacpRequest(t, router, "/ctrl-int/1/cue?command=play")
+	resp := dacpRequest(t, router, "/ctrl-int/1/nowplayingartwork?mw=320&mh=320")
+	if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("wrong artwork response: %v %v", resp.Code, resp.Header())
+	}
+	p, _ := ioutil.ReadAll(resp.Body)
+	if string(p) != "png data" {
+		t.Errorf("wrong artwork: %q", p)
+	}
+}
+
+func TestPlayStatusLongPoll(t *testing.T) {
+	router, player := dacpTestRouter(t)
+	dacpRequest(t, router, "/ctrl-int/1/cue?command=play")
+	status := dacpResponse(t, router, "/ctrl-int/1/playstatusupdate?revision-number=1", "cmst")
+	revision := findTag(t, status, "cmsr").Int()
+
+	done := make(chan daap.Tag)
+	go func() {
+		req := httptest.NewRequest("GET", "/ctrl-int/1/playstatusupdate?revision-number="+strconv.FormatInt(revision, 10), nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		tags, err := daap.Decode(resp.Body.Bytes(), dacpContainers)
+		if err != nil || len(tags) != 1 {
+			t.Errorf("bad response: %v %v", tags, err)
+			done <- daap.Tag{}
+			return
+		}
+		done <- tags[0]
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("status returned before anything changed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// the player moving on by itself wakes up the remote
+	player.finishSong()
+	select {
+	case status := <-done:
+		if got := findTag(t, status, "cmsr").Int(); got != revision+1 {
+			t.Errorf("wrong revision, want %v, got %v", revision+1, got)
+		}
+		if got := findTag(t, status, "cann").Text(); got != "two" {
+			t.Errorf("wrong now playing: %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("status did not return after the player changed")
+	}
+}
+
+func TestDACPOverHTTP(t *testing.T) {
+	router, player := dacpTestRouter(t)
+	// a real server, so requests are parsed by net/http as a remote's are
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	get := func(uri string) *http.Response {
+		resp, err := http.Get(server.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get("/ctrl-int/1/cue?command=play&query=%27daap.songartist:someone%20else%27&index=0"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong http status for cue: %v", resp.StatusCode)
+	}
+	if len(player.queue) != 1 || player.queue[0].song.Title != "three" {
+		t.Errorf("query not applied to cue: %+v", player.queue)
+	}
+	if resp := get("/ctrl-int/1/setproperty?dmcp.volume=30"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("wrong http status for setproperty: %v", resp.StatusCode)
+	}
+	if player.status.volume != 30 {
+		t.Errorf("volume not set: %v", player.status.volume)
+	}
+}
+
+func TestNoPlayerNoControl(t *testing.T) {
+	router := remoteRouter(t, nil, nil)
+	if resp := dacpRequest(t, router, "/ctrl-int/1/playpause"); resp.Code != http.StatusNotFound {
+		t.Errorf("wrong http status without a player: %v", resp.Code)
+	}
+}
+
+func TestSetRatingProperty(t *testing.T) {
+	library := newLibrary([]Database{
+		{name: "testdb", songs: []Song{{Title: "one"}, {Title: "two"}}},
+	})
+	player := newFakePlayer()
+	router := remoteRouter(t, library, player)
+
+	if resp := dacpRequest(t, router, "/ctrl-int/1/setproperty?dacp.userrating=60"); resp.Code != http.StatusNotFound {
+		t.Errorf("wrong http status rating with nothing playing: %v", resp.Code)
+	}
+
+	dacpRequest(t, router, "/ctrl-int/1/cue?command=play")
+	tests := []struct {
+		uri    string
+		want   int
+		song   int
+		rating int
+	}{
+		{"/ctrl-int/1/setproperty?dacp.userrating=60", http.StatusNoContent, 0, 60},
+		{"/ctrl-int/1/setproperty?dacp.userrating=100&database-spec='dmap.persistentid:0x1'&item-spec='dmap.itemid:0x2'", http.StatusNoContent, 1, 100},
+		{"/ctrl-int/1/setproperty?dacp.userrating=20&item-spec='dmap.itemid:0x9'", http.StatusNotFound, 0, 60},
+		{"/ctrl-int/1/setproperty?dacp.userrating=120", http.StatusBadRequest, 0, 60},
+		{"/ctrl-int/1/setproperty?dacp.userrating=lots", http.StatusBadRequest, 0, 60},
+	}
+	for _, test := range tests {
+		resp := dacpRequest(t, router, test.uri)
+		if resp.Code != test.want {
+			t.Errorf("wrong http status for %v, want %v, got %v", test.uri, test.want, resp.Code)
+		}
+		if got := library.databases()[0].songs[test.song].stats().Rating; got != test.rating {
+			t.Errorf("wrong rating after %v, want %v, got %v", test.uri, test.rating, got)
+		}
+	}
+}
+
+func TestRemoteSessionRequired(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "testdb", password: "secret", sessionTimeout: 1800e9})
+
+	pairings, err := loadPairings(filepath.Join(t.TempDir(), "pairings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pairings.add(PairedDevice{GUID: 1, Name: "remote"}); err != nil {
+		t.Fatal(err)
+	}
+	router := routes(nil, newLibrary([]Database{{name: "testdb"}}), newFakePlayer(), pairings, nil)
+	remote := strconv.Itoa(loginID(t, router, "/login?pairing-guid=0x0000000000000001"))
+
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.SetBasicAuth("", "secret")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	tags, _ := daap.Decode(resp.Body.Bytes(), map[string]bool{"mlog": true})
+	client := strconv.Itoa(int(findTag(t, tags[0], "mlid").Int()))
+
+	tests := []struct {
+		uri  string
+		want int
+	}{
+		// remotes browse with the session from their pairing, not the password
+		{"/databases?session-id=" + remote, http.StatusOK},
+		{"/databases?session-id=" + client, http.StatusUnauthorized},
+		{"/databases?session-id=12345", http.StatusUnauthorized},
+		{"/databases", http.StatusUnauthorized},
+		{"/ctrl-int/1/playpause?session-id=" + remote, http.StatusNoContent},
+		{"/ctrl-int/1/playpause?session-id=" + client, http.StatusForbidden},
+		{"/ctrl-int/1/playpause?session-id=12345", http.StatusForbidden},
+		{"/ctrl-int/1/playpause", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if resp := dacpRequest(t, router, test.uri); resp.Code != test.want {
+			t.Errorf("wrong http status for %v, want %v, got %v", test.uri, test.want, resp.Code)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type ContentCode struct {
 	number   string
 	name     string
@@ -13,20 +15,70 @@ type Version struct {
 }
 
 type Song struct {
-	Title  string
-	Album  string
-	Artist string
+	Title       string
+	Album       string
+	Artist      string
+	TrackNumber int
+	Duration    int // milliseconds
+	Genre       string
+	Composer    string
+	Path        string
+	// live are the song's stats, shared by its copies, see stats.
+	live *songStats
+
+	// AlbumArtist is who the album is by, if that's not Artist. Songs on
+	// a compilation are on the same album whoever they're by, see
+	// albumID. The sort names come from tags; without them names are
+	// sorted without a leading article, see deriveSortName.
+	AlbumArtist     string
+	Compilation     bool
+	DiscNumber      int
+	SortArtist      string
+	SortAlbum       string
+	SortName        string
+	SortAlbumArtist string
+
+	MediaKind    MediaKind
+	Category     string
+	Description  string
+	DateReleased time.Time
+
+	// StreamURL is set for radio stations, which are streamed from the
+	// station rather than a file. relay is how the server passes the stream
+	// on, if clients aren't sent to the station directly.
+	StreamURL string
+	relay     RelayMode
+
+	// remote is set for songs that are streamed from another server, which
+	// also have ids of their own that stay the same as other songs come
+	// and go, see itemIDAt.
+	remote       *remoteSong
+	itemID       int
+	persistentID int64
 }
 
 type Database struct {
-	name  string
-	songs []Song
+	name   string
+	songs  []Song
+	kind   DatabaseKind
+	smart  []SmartPlaylist
+	index  *searchIndex
+	albums []Album
+	// items maps item ids to positions, for databases whose songs have
+	// ids of their own
+	items map[int]int
 }
 
+type DatabaseKind int
+
+const LibraryDatabase DatabaseKind = 0
+const RadioDatabase DatabaseKind = 1
+
 const DmapChar int16 = 1
 const DmapShort int16 = 3
 const DmapLong int16 = 5
 const DmapLongLong int16 = 7
 const DmapString int16 = 9
+const DmapDate int16 = 10
 const DmapVersion int16 = 11
 const DmapContainer int16 = 12
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"time"
+)
+
+type byteWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// dmapWriter writes tagged DMAP data straight to an io.Writer. Container sizes
+// have to be known up front, so callers work them out with the matching size
+// functions before writing.
+type dmapWriter struct {
+	w       byteWriter
+	scratch [8]byte
+}
+
+func newDmapWriter(w io.Writer) *dmapWriter {
+	if bw, ok := w.(byteWriter); ok {
+		return &dmapWriter{w: bw}
+	}
+	return &dmapWriter{w: bufio.NewWriterSize(w, 32*1024)}
+}
+
+// flush returns the first error encountered while writing, if any.
+func (e *dmapWriter) flush() error {
+	if bw, ok := e.w.(*bufio.Writer); ok {
+		return bw.Flush()
+	}
+	return nil
+}
+
+func (e *dmapWriter) tag(code string, length int) {
+	e.w.WriteString(code)
+	e.putInt(length)
+}
+
+func (e *dmapWriter) putInt(i int) {
+	e.scratch[0] = byte((i >> 24) & 0xFF)
+	e.scratch[1] = byte((i >> 16) & 0xFF)
+	e.scratch[2] = byte((i >> 8) & 0xFF)
+	e.scratch[3] = byte(i & 0xFF)
+	e.w.Write(e.scratch[:4])
+}
+
+func (e *dmapWriter) charField(code string, b byte) {
+	e.tag(code, 1)
+	e.w.WriteByte(b)
+}
+
+func (e *dmapWriter) shortField(code string, i int16) {
+	e.tag(code, 2)
+	e.w.WriteByte(byte((i >> 8) & 0xFF))
+	e.w.WriteByte(byte(i & 0xFF))
+}
+
+func (e *dmapWriter) intField(code string, i int) {
+	e.tag(code, 4)
+	e.putInt(i)
+}
+
+func (e *dmapWriter) longField(code string, l int64) {
+	e.tag(code, 8)
+	for i := 0; i < 8; i++ {
+		e.scratch[i] = byte((l >> uint(56-8*i)) & 0xFF)
+	}
+	e.w.Write(e.scratch[:8])
+}
+
+func (e *dmapWriter) stringField(code string, s string) {
+	e.tag(code, len(s))
+	e.w.WriteString(s)
+}
+
+// songField is how a song field is encoded: its tag, its type and where its
+// value comes from. number gives the value of numeric fields and text that of
+// strings.
+type songField struct {
+	code     string
+	dmapType int16
+	number   func(song Song, id int) int64
+	text     func(song Song) string
+	// omit leaves the field out for songs that don't have it.
+	omit func(song Song) bool
+}
+
+var songFields = map[string]songField{
+	"dmap.itemkind": {code: "mikd", dmapType: DmapChar, number: func(song Song, id int) int64 {
+		return 2
+	}},
+	"dmap.itemid": {code: "miid", dmapType: DmapLong, number: func(song Song, id int) int64 {
+		return int64(song.itemIDAt(id))
+	}},
+	"dmap.itemname": {code: "minm", dmapType: DmapString, text: func(song Song) string {
+		return song.Title
+	}},
+	"dmap.persistentid": {code: "mper", dmapType: DmapLongLong, number: func(song Song, id int) int64 {
+		return song.persistentIDAt(id)
+	}},
+	"daap.songformat": {code: "asfm", dmapType: DmapString, text: Song.format},
+	"daap.songtracknumber": {code: "astn", dmapType: DmapShort, number: func(song Song, id int) int64 {
+		return int64(song.TrackNumber)
+	}},
+	"daap.songtime": {code: "astm", dmapType: DmapLong, number: func(song Song, id int) int64 {
+		return int64(song.Duration)
+	}},
+	"daap.songalbum": {code: "asal", dmapType: DmapString, text: func(song Song) string {
+		return song.Album
+	}},
+	"daap.songartist": {code: "asar", dmapType: DmapString, text: func(song Song) string {
+		return song.Artist
+	}},
+	"daap.songplaycount":     {code: "aspc", dmapType: DmapLong, number: playCount},
+	"daap.songuserplaycount": {code: "aspc", dmapType: DmapLong, number: playCount},
+	"daap.songuserskipcount": {code: "askp", dmapType: DmapLong, number: func(song Song, id int) int64 {
+		return int64(song.stats().SkipCount)
+	}},
+	"daap.songdateplayed": {code: "aspl", dmapType: DmapDate, number: func(song Song, id int) int64 {
+		return int64(dmapDate(song.stats().LastPlayed))
+	}},
+	"daap.songlastskipdate": {code: "askd", dmapType: DmapDate, number: func(song Song, id int) int64 {
+		return int64(dmapDate(song.stats().LastSkipped))
+	}},
+	"daap.songuserrating": {code: "asur", dmapType: DmapChar, number: func(song Song, id int) int64 {
+		return int64(song.stats().Rating)
+	}},
+	"daap.songgenre": {code: "asgn", dmapType: DmapString, text: func(song Song) string {
+		return song.Genre
+	}},
+	"daap.songcomposer": {code: "ascp", dmapType: DmapString, text: func(song Song) string {
+		return song.Composer
+	}},
+	"daap.songalbumartist": {code: "asaa", dmapType: DmapString, text: Song.albumArtist},
+	"daap.songcompilation": {code: "asco", dmapType: DmapChar, number: func(song Song, id int) int64 {
+		if song.Compilation {
+			return 1
+		}
+		return 0
+	}},
+	"daap.songdiscnumber": {code: "asdn", dmapType: DmapShort, number: func(song Song, id int) int64 {
+		return int64(song.DiscNumber)
+	}},
+	// songs that aren't on an album don't have one
+	"daap.songalbumid": {code: "asai", dmapType: DmapLongLong, number: func(song Song, id int) int64 {
+		return song.albumID()
+	}, omit: func(song Song) bool {
+		return song.albumID() == 0
+	}},
+	"daap.sortartist":      {code: "assa", dmapType: DmapString, text: Song.sortArtist},
+	"daap.sortalbum":       {code: "assu", dmapType: DmapString, text: Song.sortAlbum},
+	"daap.sortname":        {code: "assn", dmapType: DmapString, text: Song.sortTitle},
+	"daap.sortalbumartist": {code: "assl", dmapType: DmapString, text: Song.sortAlbumArtist},
+	"com.apple.itunes.mediakind": {code: "aeMK", dmapType: DmapChar, number: func(song Song, id int) int64 {
+		return int64(song.kind())
+	}},
+	"daap.songcategory": {code: "asct", dmapType: DmapString, text: func(song Song) string {
+		return song.Category
+	}},
+	"daap.songdescription": {code: "asdt", dmapType: DmapString, text: func(song Song) string {
+		return song.Description
+	}},
+	"daap.songdatereleased": {code: "asdr", dmapType: DmapDate, number: func(song Song, id int) int64 {
+		return int64(dmapDate(song.DateReleased))
+	}},
+	// only radio stations have one
+	"daap.songdataurl": {code: "asul", dmapType: DmapString, text: Song.dataURL, omit: func(song Song) bool {
+		return song.dataURL() == ""
+	}},
+}
+
+func playCount(song Song, id int) int64 {
+	return int64(song.stats().PlayCount)
+}
+
+// songFieldSize is the encoded size of a field including its tag and length,
+// or 0 for fields that aren't supported.
+func songFieldSize(field string, song Song) int {
+	f, ok := songFields[field]
+	if !ok || (f.omit != nil && f.omit(song)) {
+		return 0
+	}
+	switch f.dmapType {
+	case DmapChar:
+		return 8 + 1
+	case DmapShort:
+		return 8 + 2
+	case DmapLong, DmapDate:
+		return 8 + 4
+	case DmapLongLong:
+		return 8 + 8
+	}
+	return 8 + len(f.text(song))
+}
+
+func writeSongField(e *dmapWriter, field string, id int, song Song) {
+	f, ok := songFields[field]
+	if !ok {
+		log.Printf("unexpected field: %s", field)
+		return
+	}
+	if f.omit != nil && f.omit(song) {
+		return
+	}
+	switch f.dmapType {
+	case DmapChar:
+		e.charField(f.code, byte(f.number(song, id)))
+	case DmapShort:
+		e.shortField(f.code, int16(f.number(song, id)))
+	case DmapLong, DmapDate:
+		e.intField(f.code, int(f.number(song, id)))
+	case DmapLongLong:
+		e.longField(f.code, f.number(song, id))
+	default:
+		e.stringField(f.code, f.text(song))
+	}
+}
+
+// dmapDate is a time as seconds since the epoch, or 0 if it was never set.
+func dmapDate(t time.Time) int {
+	if t.IsZero() {
+		return 0
+	}
+	return int(t.Unix())
+}
+
+// orderSongFields puts dmap.itemkind first, where clients expect it.
+func orderSongFields(fields []string) []string {
+	kindInd := index(fields, "dmap.itemkind")
+	if kindInd < 0 {
+		return fields
+	}
+	ordered := make([]string, 0, len(fields))
+	ordered = append(ordered, "dmap.itemkind")
+	ordered = append(ordered, fields[:kindInd]...)
+	ordered = append(ordered, fields[kindInd+1:]...)
+	return ordered
+}
+
+func songContentSize(fields []string, song Song) int {
+	size := 0
+	for _, field := range fields {
+		size += songFieldSize(field, song)
+	}
+	return size
+}
+
+func writeSong(e *dmapWriter, fields []string, id int, song Song) {
+	e.tag("mlit", songContentSize(fields, song))
+	for _, field := range fields {
+		writeSongField(e, field, id, song)
+	}
+}
+
+func databaseListingSize(fields []string, database Database) int {
+	size := 0
+	for _, song := range database.songs {
+		size += 8 + songContentSize(fields, song)
+	}
+	return size
+}
+
+// databaseItemsSize is the size of the whole adbs response, so that it can be
+// allocated in one go.
+func databaseItemsSize(fields []string, database Database) int {
+	return 8 + 12 + 9 + 12 + 12 + 8 + databaseListingSize(orderSongFields(fields), database)
+}
+
+func writeDatabaseItems(w io.Writer, fields []string, database Database) error {
+	fields = orderSongFields(fields)
+	listingSize := databaseListingSize(fields, database)
+
+	e := newDmapWriter(w)
+	e.tag("adbs", 12+9+12+12+8+listingSize)
+	e.intField("mstt", 200)
+	e.charField("muty", 0)
+	e.intField("mtco", len(database.songs))
+	e.intField("mrco", len(database.songs))
+	e.tag("mlcl", listingSize)
+	for i, song := range database.songs {
+		writeSong(e, fields, i+1, song)
+	}
+	return e.flush()
+}
+
+// writeContainerItems writes the songs in a container, which keep their item
+// ids from the database. total is how many songs there are in all, if only
+// some of them were asked for.
+func writeContainerItems(w io.Writer, fields []string, database Database, ids []int, total int, headers []sortHeader) error {
+	return writeSongListing(w, "apso", fields, database, ids, total, headers)
+}
+
+// foundItemsSize is the size of the adbs response for some of the songs in a
+// database, see databaseItemsSize.
+func foundItemsSize(fields []string, database Database, ids []int, headers []sortHeader) int {
+	return 8 + 12 + 9 + 12 + 12 + 8 + songListingSize(orderSongFields(fields), database, ids) + sortHeadersSize(headers)
+}
+
+// writeFoundItems writes the songs in a database found by a query, or put in
+// order, with an index of them if there are headers. total is how many songs
+// were found, if only some of them were asked for.
+func writeFoundItems(w io.Writer, fields []string, database Database, ids []int, total int, headers []sortHeader) error {
+	return writeSongListing(w, "adbs", fields, database, ids, total, headers)
+}
+
+// sortHeadersSize is the size of the mshl index of a listing, if it has one.
+func sortHeadersSize(headers []sortHeader) int {
+	if len(headers) == 0 {
+		return 0
+	}
+	return 8 + len(headers)*(8+10+12+12)
+}
+
+func songListingSize(fields []string, database Database, ids []int) int {
+	size := 0
+	for _, id := range ids {
+		song, _ := database.song(id)
+		size += 8 + songContentSize(fields, song)
+	}
+	return size
+}
+
+// writeSongListing writes the songs with the given ids in a tag like adbs.
+func writeSongListing(w io.Writer, tag string, fields []string, database Database, ids []int, total int, headers []sortHeader) error {
+	fields = orderSongFields(fields)
+	listingSize := songListingSize(fields, database, ids)
+
+	e := newDmapWriter(w)
+	e.tag(tag, 12+9+12+12+8+listingSize+sortHeadersSize(headers))
+	e.intField("mstt", 200)
+	e.charField("muty", 0)
+	e.intField("mtco", total)
+	e.intField("mrco", len(ids))
+	e.tag("mlcl", listingSize)
+	for _, id := range ids {
+		song, _ := database.song(id)
+		writeSong(e, fields, id, song)
+	}
+	writeSortHeaders(e, headers)
+	return e.flush()
+}
+
+// writeSortHeaders writes the mshl index that follows a sorted listing, if
+// there is one.
+func writeSortHeaders(e *dmapWriter, headers []sortHeader) {
+	if len(headers) == 0 {
+		return
+	}
+	e.tag("mshl", sortHeadersSize(headers)-8)
+	for _, header := range headers {
+		e.tag("mlit", 10+12+12)
+		e.shortField("mshc", int16(header.char))
+		e.intField("mshi", header.index)
+		e.intField("mshn", header.count)
+	}
+}
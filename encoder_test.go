@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"testing"
+)
+
+var allSongFields = []string{"dmap.itemid", "dmap.itemname", "dmap.itemkind", "dmap.persistentid", "daap.songalbum", "daap.songartist"}
+
+func TestOrderSongFields(t *testing.T) {
+	fields := []string{"dmap.itemid", "dmap.itemkind", "dmap.itemname"}
+	got := orderSongFields(fields)
+	if len(got) != 3 || got[0] != "dmap.itemkind" || got[1] != "dmap.itemid" || got[2] != "dmap.itemname" {
+		t.Errorf("wrong field order: %v", got)
+	}
+	if fields[1] != "dmap.itemkind" {
+		t.Errorf("original fields were modified: %v", fields)
+	}
+}
+
+func TestWriteDatabaseItems(t *testing.T) {
+	database := Database{name: "testdb", songs: []Song{{Title: "aname", Album: "aalbum", Artist: "aartist"}}}
+	var buf bytes.Buffer
+	if err := writeDatabaseItems(&buf, allSongFields, database); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedData := []byte{
+		97, 100, 98, 115, 0, 0, 0, 21 + 24 + 8 + 87, // adbs
+		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
+		109, 117, 116, 121, 0, 0, 0, 1, 0, // muty
+		109, 116, 99, 111, 0, 0, 0, 4, 0, 0, 0, 1, // mtco
+		109, 114, 99, 111, 0, 0, 0, 4, 0, 0, 0, 1, // mrco
+		109, 108, 99, 108, 0, 0, 0, 8 + 79, // mlcl
+		109, 108, 105, 116, 0, 0, 0, 79, // mlit
+		109, 105, 107, 100, 0, 0, 0, 1, 2, // mikd
+		109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 0, 1, // miid
+		109, 105, 110, 109, 0, 0, 0, 5, 97, 110, 97, 109, 101, // minm
+		109, 112, 101, 114, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 1, // mper
+		97, 115, 97, 108, 0, 0, 0, 6, 97, 97, 108, 98, 117, 109, // asal
+		97, 115, 97, 114, 0, 0, 0, 7, 97, 97, 114, 116, 105, 115, 116, // asar
+	}
+	if !bytes.Equal(buf.Bytes(), expectedData) {
+		t.Errorf("wrong byte array value for items:\n%v\nwant:\n%v", buf.Bytes(), expectedData)
+	}
+	if size := databaseItemsSize(allSongFields, database); size != len(expectedData) {
+		t.Errorf("wrong precomputed size, want %v, got %v", len(expectedData), size)
+	}
+}
+
+func TestWriteDatabaseItemsUnbuffered(t *testing.T) {
+	// a writer without WriteByte/WriteString gets wrapped in a bufio.Writer
+	database := syntheticDatabase(1000)
+	var buf bytes.Buffer
+	if err := writeDatabaseItems(struct{ *bytes.Buffer }{&buf}, allSongFields, database); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != databaseItemsSize(allSongFields, database) {
+		t.Errorf("wrong size, want %v, got %v", databaseItemsSize(allSongFields, database), buf.Len())
+	}
+}
+
+// bufferedDatabaseItems builds a listing the way the handlers used to, by
+// appending every song and then prepending the container headers. It is the
+// baseline the streamed listings are checked and benchmarked against.
+func bufferedDatabaseItems(fields []string, database Database) []byte {
+	data := []byte{}
+	data = append(data, "mstt"...)
+	data = append(data, intToData(200)...)
+	data = append(data, "muty"...)
+	data = append(data, charToData(0)...)
+	data = append(data, "mtco"...)
+	data = append(data, intToData(len(database.songs))...)
+	data = append(data, "mrco"...)
+	data = append(data, intToData(len(database.songs))...)
+
+	listing := []byte{}
+	for i, song := range database.songs {
+		listing = append(listing, songToData(fields, i+1, song)...)
+	}
+	data = append(data, "mlcl"...)
+	data = append(data, intToByteArray(len(listing))...)
+	data = append(data, listing...)
+
+	headerData := append([]byte("adbs"), intToByteArray(len(data))...)
+	return append(headerData, data...)
+}
+
+func TestWriteAlbumFields(t *testing.T) {
+	fields := []string{"daap.songalbumartist", "daap.songcompilation", "daap.songdiscnumber", "daap.songalbumid"}
+	for _, song := range []Song{
+		{Title: "Hit", Album: "Now 42", Artist: "Blur", Compilation: true, DiscNumber: 2},
+		{Title: "Loose", Artist: "Zed"},
+	} {
+		var buf bytes.Buffer
+		e := newDmapWriter(&buf)
+		writeSong(e, fields, 1, song)
+		e.flush()
+		if buf.Len() != 8+songContentSize(fields, song) {
+			t.Errorf("%v: wrong size, wrote %v bytes for %v", song.Title, buf.Len(), 8+songContentSize(fields, song))
+		}
+		albumID := bytes.Index(buf.Bytes(), []byte("asai"))
+		if (albumID >= 0) != (song.Album != "") {
+			t.Errorf("%v: album id written %v", song.Title, albumID >= 0)
+		}
+	}
+}
+
+func TestSongFieldsMatchBuffered(t *testing.T) {
+	fields := []string{}
+	for field := range songFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, song := range []Song{
+		{Title: "Hit", Album: "Now 42", Artist: "Blur", Genre: "Pop", Compilation: true, DiscNumber: 2, TrackNumber: 7, Duration: 1000},
+		{Title: "Loose", Artist: "Zed"},
+		{Title: "Station", StreamURL: "http://radio.example.com/stream"},
+	} {
+		var buf bytes.Buffer
+		e := newDmapWriter(&buf)
+		writeSong(e, orderSongFields(fields), 3, song)
+		e.flush()
+		if want := songToData(fields, 3, song); !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%v: streamed and buffered songs differ\ngot:  %v\nwant: %v", song.Title, buf.Bytes(), want)
+		}
+		if buf.Len() != 8+songContentSize(fields, song) {
+			t.Errorf("%v: wrong size, wrote %v bytes for %v", song.Title, buf.Len(), 8+songContentSize(fields, song))
+		}
+	}
+}
+
+func TestBufferedMatchesStreamed(t *testing.T) {
+	database := syntheticDatabase(100)
+	var buf bytes.Buffer
+	writeDatabaseItems(&buf, allSongFields, database)
+	if !bytes.Equal(buf.Bytes(), bufferedDatabaseItems(allSongFields, database)) {
+		t.Error("streamed and buffered listings differ")
+	}
+}
+
+func BenchmarkBufferedDatabaseItems(b *testing.B) {
+	database := syntheticDatabase(50000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ioutil.Discard.Write(bufferedDatabaseItems(allSongFields, database))
+	}
+}
+
+func BenchmarkWriteDatabaseItems(b *testing.B) {
+	database := syntheticDatabase(50000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writeDatabaseItems(ioutil.Discard, allSongFields, database)
+	}
+}
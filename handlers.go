@@ -1,88 +1,233 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/carlgreen/audioserve/daaphash"
 	"github.com/husobee/vestigo"
 )
 
-func headers(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+// errorWriter writes an error response in the format of the routes it's
+// for, like http.Error.
+type errorWriter func(w http.ResponseWriter, msg string, status int)
+
+// refusal is why a request was turned away. A realm asks for a password.
+type refusal struct {
+	status int
+	msg    string
+	realm  string
+}
+
+// accessCheck decides whether a request may go on, returning nil if it may.
+type accessCheck func(r *http.Request, share shareSettings) *refusal
+
+// serve is what every route shares: the server header and content type,
+// parsing the query string into r.Form, refusing requests check turns away
+// with errors from writeError, and, if compress is set, compression for
+// clients that accept it.
+func serve(contentType string, compress bool, writeError errorWriter, check accessCheck, inner http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s\t%s", r.Method, r.RequestURI)
+		share := currentShare()
+		r.ParseForm()
 
-		w.Header().Add(`DAAP-Server`, `daap-server: 1.0`)
-		w.Header().Add(`Content-Type`, `application/x-dmap-tagged`)
+		w.Header().Add(`DAAP-Server`, share.name+`: 1.0`)
+		if contentType != "" {
+			w.Header().Add(`Content-Type`, contentType)
+		}
+
+		if refused := check(r, share); refused != nil {
+			if refused.realm != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+refused.realm+`"`)
+			} else {
+				log.Printf("%v for %s", refused.msg, r.RequestURI)
+			}
+			writeError(w, refused.msg, refused.status)
+			return
+		}
+
+		if compress && acceptsGzip(r) {
+			gw := newGzipResponseWriter(w)
+			defer gw.Close()
+			w = gw
+		}
 
 		inner(w, r)
 	})
 }
 
+func headers(sessions *Sessions, inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return serve(`application/x-dmap-tagged`, true, http.Error, daapAccess(sessions), inner)
+}
+
+// streamHeaders is headers for the route songs are streamed from, which is
+// never compressed: audio doesn't shrink, clients seek in it, and relayed and
+// proxied streams don't always say what they are.
+func streamHeaders(sessions *Sessions, inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return serve(`application/x-dmap-tagged`, false, http.Error, daapAccess(sessions), inner)
+}
+
+// daapAccess checks DAAP and DACP requests: their validation header if it's
+// required, a remote's session for remote control, and the share password.
+func daapAccess(sessions *Sessions) accessCheck {
+	return func(r *http.Request, share shareSettings) *refusal {
+		if share.requireValidation && !daaphash.Valid(r) {
+			return &refusal{status: http.StatusForbidden, msg: "invalid Client-DAAP-Validation"}
+		}
+		if strings.HasPrefix(r.URL.Path, "/ctrl-int/") && !sessions.remote(r) {
+			return &refusal{status: http.StatusForbidden, msg: "remote not logged in"}
+		}
+		return shareAccess(sessions)(r, share)
+	}
+}
+
+// shareAccess checks the share password.
+func shareAccess(sessions *Sessions) accessCheck {
+	return func(r *http.Request, share shareSettings) *refusal {
+		if !authorized(r, share.password, sessions) {
+			return &refusal{status: http.StatusUnauthorized, msg: "password required", realm: share.name}
+		}
+		return nil
+	}
+}
+
+// authorized checks the share password, if there is one. Server info and
+// content codes are needed to find out a password is wanted, and remotes log
+// in with their pairing instead, then send the session they got rather than
+// the password.
+func authorized(r *http.Request, sharePassword string, sessions *Sessions) bool {
+	if sharePassword == "" {
+		return true
+	}
+	switch {
+	case r.URL.Path == "/server-info", r.URL.Path == "/content-codes":
+		return true
+	case r.URL.Path == "/login" && r.URL.Query().Get("pairing-guid") != "":
+		return true
+	case sessions.remote(r):
+		return true
+	}
+	_, password, ok := r.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(sharePassword)) == 1
+}
+
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, r.RequestURI+" not found", http.StatusNotFound)
 }
 
-func serverInfoHandler(w http.ResponseWriter, r *http.Request) {
-	headerData := []byte("msrv")
+func serverInfoHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		share := currentShare()
+		profile := negotiate(share.profiles, r.Header.Get("Client-DAAP-Version"))
 
-	data := []byte{}
+		headerData := []byte("msrv")
 
-	data = append(data, "mstt"...)
-	data = append(data, intToData(200)...)
+		data := []byte{}
 
-	data = append(data, "mpro"...)
-	data = append(data, versionToData(Version{1, 0, 0})...)
+		data = append(data, "mstt"...)
+		data = append(data, intToData(200)...)
 
-	data = append(data, "apro"...)
-	data = append(data, versionToData(Version{1, 0, 0})...)
+		data = append(data, "mpro"...)
+		data = append(data, versionToData(profile.dmap)...)
 
-	data = append(data, "minm"...)
-	data = append(data, stringToData("daap-server")...)
+		data = append(data, "apro"...)
+		data = append(data, versionToData(profile.daap)...)
 
-	data = append(data, "mslr"...)
-	data = append(data, charToData(1)...)
+		if profile.musicSharingVersion != 0 {
+			data = append(data, "aeSV"...)
+			data = append(data, intToData(profile.musicSharingVersion)...)
+		}
 
-	data = append(data, "mstm"...)
-	data = append(data, intToData(1800)...)
+		if profile.supportsExtraData != 0 {
+			data = append(data, "ated"...)
+			data = append(data, shortToData(profile.supportsExtraData)...)
+		}
 
-	data = append(data, "msal"...)
-	data = append(data, charToData(1)...)
+		if profile.supportsGroups != 0 {
+			data = append(data, "asgr"...)
+			data = append(data, shortToData(profile.supportsGroups)...)
+		}
 
-	data = append(data, "msup"...)
-	data = append(data, charToData(1)...)
+		if profile.supportsField("com.apple.itunes.unknown-asse") {
+			data = append(data, "asse"...)
+			data = append(data, longToData(0x80000)...)
+		}
 
-	data = append(data, "mspi"...)
-	data = append(data, charToData(1)...)
+		data = append(data, "minm"...)
+		data = append(data, stringToData(share.name)...)
 
-	data = append(data, "msex"...)
-	data = append(data, charToData(1)...)
+		data = append(data, "mslr"...)
+		data = append(data, charToData(1)...)
 
-	data = append(data, "msbr"...)
-	data = append(data, charToData(1)...)
+		if share.password != "" {
+			data = append(data, "msau"...)
+			data = append(data, charToData(2)...)
+		}
 
-	data = append(data, "msqy"...)
-	data = append(data, charToData(1)...)
+		data = append(data, "mstm"...)
+		data = append(data, intToData(int(share.sessionTimeout/time.Second))...)
 
-	data = append(data, "msix"...)
-	data = append(data, charToData(1)...)
+		data = append(data, "msal"...)
+		data = append(data, charToData(1)...)
 
-	data = append(data, "msrs"...)
-	data = append(data, charToData(1)...)
+		data = append(data, "msup"...)
+		data = append(data, charToData(1)...)
 
-	data = append(data, "msdc"...)
-	data = append(data, intToData(1)...)
+		data = append(data, "mspi"...)
+		data = append(data, charToData(1)...)
 
-	headerData = append(headerData, intToByteArray(len(data))...)
-	data = append(headerData, data...)
+		data = append(data, "msex"...)
+		data = append(data, charToData(1)...)
 
-	w.Write(data)
+		if profile.supportsField("dmap.supportsbrowse") {
+			data = append(data, "msbr"...)
+			data = append(data, charToData(1)...)
+		}
+
+		data = append(data, "msqy"...)
+		data = append(data, charToData(1)...)
+
+		data = append(data, "msix"...)
+		data = append(data, charToData(1)...)
+
+		data = append(data, "msrs"...)
+		data = append(data, charToData(1)...)
+
+		// playlists can't be edited, and there are no speakers to play to
+		// besides the server's own
+		if profile.supportsField("dmap.supportsedit") {
+			data = append(data, "msed"...)
+			data = append(data, charToData(0)...)
+		}
+
+		if profile.supportsField("dmap.speakermachinelist") {
+			data = append(data, "msml"...)
+			data = append(data, intToByteArray(0)...)
+		}
+
+		data = append(data, "msdc"...)
+		data = append(data, intToData(len(library.databases()))...)
+
+		headerData = append(headerData, intToByteArray(len(data))...)
+		data = append(headerData, data...)
+
+		w.Write(data)
+	})
 }
 
 func contentCodesHandler(contentCodes []ContentCode) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		profile := negotiate(currentShare().profiles, r.Header.Get("Client-DAAP-Version"))
+
 		headerData := []byte("mccr")
 
 		data := []byte{}
@@ -91,6 +236,9 @@ func contentCodesHandler(contentCodes []ContentCode) http.HandlerFunc {
 		data = append(data, intToData(200)...)
 
 		for _, contentCode := range contentCodes {
+			if !profile.supportsField(contentCode.name) {
+				continue
+			}
 			data = append(data, contentCodeToData(contentCode)...)
 		}
 
@@ -101,8 +249,27 @@ func contentCodesHandler(contentCodes []ContentCode) http.HandlerFunc {
 	})
 }
 
-func databasesHandler(databases []Database) http.HandlerFunc {
+// dmapError responds with a container holding only an error status, which
+// DAAP clients read from mstt as well as the HTTP status.
+func dmapError(w http.ResponseWriter, code string, status int) {
+	headerData := []byte(code)
+
+	data := []byte{}
+
+	data = append(data, "mstt"...)
+	data = append(data, intToData(status)...)
+
+	headerData = append(headerData, intToByteArray(len(data))...)
+	data = append(headerData, data...)
+
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func databasesHandler(library *Library) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		databases := library.databases()
+
 		headerData := []byte("avdb")
 
 		data := []byte{}
@@ -120,8 +287,8 @@ func databasesHandler(databases []Database) http.HandlerFunc {
 		data = append(data, intToData(len(databases))...)
 
 		listing := []byte{}
-		for _, database := range databases {
-			listing = append(listing, databaseToData(database)...)
+		for i, database := range databases {
+			listing = append(listing, databaseToData(i+1, database)...)
 		}
 
 		data = append(data, "mlcl"...)
@@ -135,7 +302,7 @@ func databasesHandler(databases []Database) http.HandlerFunc {
 	})
 }
 
-func databaseItemsHandler(databases []Database) http.HandlerFunc {
+func databaseItemsHandler(library *Library, cache *responseCache) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		itemIdParam := vestigo.Param(r, "itemId")
 		dbId, err := strconv.Atoi(itemIdParam)
@@ -146,12 +313,239 @@ func databaseItemsHandler(databases []Database) http.HandlerFunc {
 			return
 		}
 
-		fields := strings.Split(r.Form["meta"][0], ",")
+		profile := negotiate(currentShare().profiles, r.Header.Get("Client-DAAP-Version"))
+		fields := normalizeMeta(profile.filterFields(strings.Split(r.Form.Get("meta"), ",")))
+		query, err := parseQuery(r.Form.Get("query"))
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		index, err := parseIndexRange(r.Form.Get("index"))
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// the revision in the key, and so the ETag, is the one the database
+		// listed belongs to
+		database, revision, ok := library.databaseAt(dbId)
+		if !ok {
+			dmapError(w, "adbs", http.StatusNotFound)
+			return
+		}
+		key := cacheKey{
+			database: dbId,
+			revision: revision,
+			plays:    library.playsRecorded(),
+			meta:     strings.Join(fields, ","),
+			query:    r.Form.Get("query"),
+			sort:     r.Form.Get("sort"),
+			headers:  r.Form.Get("include-sort-headers") == "1",
+			index:    r.Form.Get("index"),
+			gzip:     acceptsGzip(r),
+		}
+		entry, cached := cache.get(key)
+		if matchesETag(r.Header.Get("If-None-Match"), key.etag()) {
+			w.Header().Set("ETag", key.etag())
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if cached {
+			w.Header().Set("ETag", entry.etag)
+			if entry.gzipped {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Add("Vary", "Accept-Encoding")
+			}
+			w.Write(entry.body)
+			return
+		}
 
-		// TODO error check this
-		database := databases[dbId-1]
+		size := databaseItemsSize(fields, database)
+		write := func(w io.Writer) error {
+			return writeDatabaseItems(w, fields, database)
+		}
+		if key.query != "" || key.sort != "" || key.index != "" {
+			ids := database.find(query)
+			var headers []sortHeader
+			if key.sort != "" {
+				ids, headers, err = sortSongIDs(database, ids, key.sort)
+				if err != nil {
+					log.Print(err)
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if !key.headers {
+				headers = nil
+			}
+			total := len(ids)
+			ids = index.apply(ids)
+			size = foundItemsSize(fields, database, ids, headers)
+			write = func(w io.Writer) error {
+				return writeFoundItems(w, fields, database, ids, total, headers)
+			}
+		}
 
-		headerData := []byte("adbs")
+		w.Header().Set("ETag", key.etag())
+		if size > cache.maxBytes {
+			// too big to cache, don't hold it in memory at all
+			if err := write(w); err != nil {
+				log.Printf("error writing items: %v", err)
+			}
+			return
+		}
+		// the client gets the listing as it's written, the cache a copy once
+		// it's all there
+		buf := bytes.NewBuffer(make([]byte, 0, size))
+		if err := write(io.MultiWriter(w, buf)); err != nil {
+			log.Printf("error writing items: %v", err)
+			return
+		}
+		cache.put(key, buf.Bytes())
+	})
+}
+
+func songStreamHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		itemIdParam := vestigo.Param(r, "itemId")
+		dbId, err := strconv.Atoi(itemIdParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", itemIdParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		// the song id comes with the format as an extension, e.g. 12.mp3
+		songIdParam := vestigo.Param(r, "songId")
+		songIdParam = strings.TrimSuffix(songIdParam, path.Ext(songIdParam))
+		songId, err := strconv.Atoi(songIdParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", songIdParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		database, ok := library.database(dbId)
+		if !ok {
+			http.Error(w, r.RequestURI+" not found", http.StatusNotFound)
+			return
+		}
+		_, song, ok := database.item(songId)
+		if !ok {
+			http.Error(w, r.RequestURI+" not found", http.StatusNotFound)
+			return
+		}
+		noteItem(r, song)
+		defer doneItem(r, song)
+
+		if song.StreamURL != "" {
+			if song.relay == RelayOff {
+				http.Redirect(w, r, song.StreamURL, http.StatusFound)
+				return
+			}
+			relayStream(w, r, song)
+			return
+		}
+
+		if song.remote != nil {
+			proxyStream(w, r, song, func() {
+				library.recordPlay(dbId, song, false, time.Now())
+			})
+			return
+		}
+
+		f, err := os.Open(song.Path)
+		if err != nil {
+			log.Printf("cannot open song: %v", err)
+			http.Error(w, r.RequestURI+" not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			log.Printf("cannot stat song: %v", err)
+			http.Error(w, "cannot read song", http.StatusInternalServerError)
+			return
+		}
+
+		tracker := &playTracker{ReadSeeker: f, size: fi.Size(), played: func() {
+			library.recordPlay(dbId, song, false, time.Now())
+		}}
+		w.Header().Set("Content-Type", song.contentType())
+		http.ServeContent(w, r, "", fi.ModTime(), tracker)
+	})
+}
+
+// songRatingHandler sets a song's user rating from the rating form value, for
+// clients that edit the library rather than controlling a player.
+func songRatingHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		itemIdParam := vestigo.Param(r, "itemId")
+		dbId, err := strconv.Atoi(itemIdParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", itemIdParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		songIdParam := vestigo.Param(r, "songId")
+		songId, err := strconv.Atoi(songIdParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", songIdParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		ratingParam := r.FormValue("rating")
+		rating, err := strconv.Atoi(ratingParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", ratingParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		database, ok := library.database(dbId)
+		if !ok {
+			http.Error(w, r.RequestURI+" not found", http.StatusNotFound)
+			return
+		}
+		_, song, ok := database.item(songId)
+		if !ok {
+			http.Error(w, r.RequestURI+" not found", http.StatusNotFound)
+			return
+		}
+		if err := library.setRating(dbId, song, rating); err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func databaseContainersHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		itemIdParam := vestigo.Param(r, "itemId")
+		dbId, err := strconv.Atoi(itemIdParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", itemIdParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		database, ok := library.database(dbId)
+		if !ok {
+			dmapError(w, "aply", http.StatusNotFound)
+			return
+		}
+		containers := database.containers()
+
+		headerData := []byte("aply")
 
 		data := []byte{}
 
@@ -162,14 +556,14 @@ func databaseItemsHandler(databases []Database) http.HandlerFunc {
 		data = append(data, charToData(0)...)
 
 		data = append(data, "mtco"...)
-		data = append(data, intToData(len(database.songs))...)
+		data = append(data, intToData(len(containers))...)
 
 		data = append(data, "mrco"...)
-		data = append(data, intToData(len(database.songs))...)
+		data = append(data, intToData(len(containers))...)
 
 		listing := []byte{}
-		for _, song := range database.songs {
-			listing = append(listing, songToData(fields, song)...)
+		for i, c := range containers {
+			listing = append(listing, containerToData(i+1, c)...)
 		}
 
 		data = append(data, "mlcl"...)
@@ -183,32 +577,100 @@ func databaseItemsHandler(databases []Database) http.HandlerFunc {
 	})
 }
 
-func databaseContainersHandler(databases []Database) http.HandlerFunc {
+func containerItemsHandler(library *Library) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		headerData := []byte("aply")
-
-		data := []byte{}
+		itemIdParam := vestigo.Param(r, "itemId")
+		dbId, err := strconv.Atoi(itemIdParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", itemIdParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		containerIdParam := vestigo.Param(r, "containerId")
+		containerId, err := strconv.Atoi(containerIdParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", containerIdParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
 
-		data = append(data, "mstt"...)
-		data = append(data, intToData(200)...)
+		database, ok := library.database(dbId)
+		if !ok {
+			dmapError(w, "apso", http.StatusNotFound)
+			return
+		}
+		containers := database.containers()
+		if containerId < 1 || containerId > len(containers) {
+			dmapError(w, "apso", http.StatusNotFound)
+			return
+		}
 
-		data = append(data, "muty"...)
-		data = append(data, charToData(0)...)
+		ids := containers[containerId-1].ids
+		if param := r.Form.Get("query"); param != "" {
+			query, err := parseQuery(param)
+			if err != nil {
+				log.Print(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ids = keepIDs(ids, database.find(query))
+		}
+		var headers []sortHeader
+		if by := r.Form.Get("sort"); by != "" {
+			ids, headers, err = sortSongIDs(database, ids, by)
+			if err != nil {
+				log.Print(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if r.Form.Get("include-sort-headers") != "1" {
+				headers = nil
+			}
+		}
 
-		data = append(data, "mtco"...)
-		data = append(data, intToData(0)...)
+		index, err := parseIndexRange(r.Form.Get("index"))
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		total := len(ids)
+		ids = index.apply(ids)
 
-		data = append(data, "mrco"...)
-		data = append(data, intToData(0)...)
+		profile := negotiate(currentShare().profiles, r.Header.Get("Client-DAAP-Version"))
+		fields := normalizeMeta(profile.filterFields(strings.Split(r.Form.Get("meta"), ",")))
+		if err := writeContainerItems(w, fields, database, ids, total, headers); err != nil {
+			log.Printf("error writing items: %v", err)
+		}
+	})
+}
 
-		headerData = append(headerData, intToByteArray(len(data))...)
-		data = append(headerData, data...)
+func loginHandler(pairings *Pairings, sessions *Sessions) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// remotes log in with the GUID they were given when they paired
+		if guidParam := r.URL.Query().Get("pairing-guid"); guidParam != "" {
+			guid, err := parsePairingGUID(guidParam)
+			if err != nil {
+				msg := fmt.Sprintf("Cannot convert '%v' to a pairing guid", guidParam)
+				log.Print(msg)
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if _, ok := pairings.paired(guid); !ok {
+				log.Printf("login from unpaired remote %v", guidParam)
+				http.Error(w, errNotPaired.Error(), http.StatusForbidden)
+				return
+			}
+		}
 
-		w.Write(data)
+		session := sessions.login(r, r.URL.Query().Get("pairing-guid") != "")
+		writeLogin(w, session.ID)
 	})
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
+func writeLogin(w http.ResponseWriter, sessionID int) {
 	headerData := []byte("mlog")
 
 	data := []byte{}
@@ -217,8 +679,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	data = append(data, intToData(200)...)
 
 	data = append(data, "mlid"...)
-	// TODO generate a real session ID
-	data = append(data, intToData(113)...)
+	data = append(data, intToData(sessionID)...)
 
 	headerData = append(headerData, intToByteArray(len(data))...)
 	data = append(headerData, data...)
@@ -226,33 +687,57 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO end session r.URL.Query().Get("session-id")
+func logoutHandler(sessions *Sessions) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, err := strconv.Atoi(r.URL.Query().Get("session-id")); err == nil {
+			sessions.logout(id)
+		}
+	})
 }
 
-func updateHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	revNumParam := r.Form.Get("revision-number")
-	revNum, err := strconv.Atoi(revNumParam)
-	if err != nil {
-		msg := fmt.Sprintf("Cannot convert '%v' to int", revNumParam)
-		log.Print(msg)
-		http.Error(w, msg, http.StatusBadRequest)
-		return
-	}
+func updateHandler(library *Library) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		revNumParam := r.Form.Get("revision-number")
+		revNum, err := strconv.Atoi(revNumParam)
+		if err != nil {
+			msg := fmt.Sprintf("Cannot convert '%v' to int", revNumParam)
+			log.Print(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
 
-	headerData := []byte("mupd")
+		// clients poll with the revision they already have and expect us to hold
+		// the request until there's a newer one, except on their first request
+		// which has no delta and usually asks for revision 1
+		waiter := library.revisionWaiter()
+		revision := library.revision()
+		polling := revNum > 1 || r.Form.Get("delta") != ""
+		if polling && revNum >= revision {
+			select {
+			case <-waiter:
+				revision = library.revision()
+			case <-library.closing():
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
 
-	data := []byte{}
+		headerData := []byte("mupd")
 
-	data = append(data, "musr"...)
-	data = append(data, intToData(revNum)...)
+		data := []byte{}
 
-	data = append(data, "mstt"...)
-	data = append(data, intToData(200)...)
+		data = append(data, "musr"...)
+		data = append(data, intToData(revision)...)
 
-	headerData = append(headerData, intToByteArray(len(data))...)
-	data = append(headerData, data...)
+		data = append(data, "mstt"...)
+		data = append(data, intToData(200)...)
 
-	w.Write(data)
+		headerData = append(headerData, intToByteArray(len(data))...)
+		data = append(headerData, data...)
+
+		w.Write(data)
+	})
 }
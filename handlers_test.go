@@ -2,15 +2,24 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/carlgreen/audioserve/daap"
+	"github.com/carlgreen/audioserve/daaphash"
 )
 
 func TestGetServerInfo(t *testing.T) {
-	router := routes(nil, nil)
+	router := routes(nil, newLibrary([]Database{{name: "testdb"}}), nil, nil, nil)
 	req, err := http.NewRequest("GET", "/server-info", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -26,7 +35,7 @@ func TestGetServerInfo(t *testing.T) {
 	}
 
 	expectedData := []byte{
-		109, 115, 114, 118, 0, 0, 0, 160, // msrv
+		109, 115, 114, 118, 0, 0, 0, 151, // msrv
 		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
 		109, 112, 114, 111, 0, 0, 0, 4, 0, 1, 0, 0, // mpro
 		97, 112, 114, 111, 0, 0, 0, 4, 0, 1, 0, 0, // apro
@@ -37,7 +46,6 @@ func TestGetServerInfo(t *testing.T) {
 		109, 115, 117, 112, 0, 0, 0, 1, 1, // msup
 		109, 115, 112, 105, 0, 0, 0, 1, 1, // mspi
 		109, 115, 101, 120, 0, 0, 0, 1, 1, // msex
-		109, 115, 98, 114, 0, 0, 0, 1, 1, // msbr
 		109, 115, 113, 121, 0, 0, 0, 1, 1, // msqy
 		109, 115, 105, 120, 0, 0, 0, 1, 1, // msix
 		109, 115, 114, 115, 0, 0, 0, 1, 1, // msrs
@@ -48,16 +56,136 @@ func TestGetServerInfo(t *testing.T) {
 	}
 }
 
+func TestGetServerInfoDaap2(t *testing.T) {
+	router := routes(nil, newLibrary([]Database{{name: "testdb"}}), nil, nil, nil)
+	req, err := http.NewRequest("GET", "/server-info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Client-DAAP-Version", "2.0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Errorf("wrong http status, want %v, got %v", http.StatusOK, resp.Code)
+	}
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedData := []byte{
+		109, 115, 114, 118, 0, 0, 0, 151, // msrv
+		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
+		109, 112, 114, 111, 0, 0, 0, 4, 0, 2, 0, 0, // mpro
+		97, 112, 114, 111, 0, 0, 0, 4, 0, 2, 0, 0, // apro
+		109, 105, 110, 109, 0, 0, 0, 11, 100, 97, 97, 112, 45, 115, 101, 114, 118, 101, 114, // minm
+		109, 115, 108, 114, 0, 0, 0, 1, 1, // mslr
+		109, 115, 116, 109, 0, 0, 0, 4, 0, 0, 7, 8, // mstm
+		109, 115, 97, 108, 0, 0, 0, 1, 1, // msal
+		109, 115, 117, 112, 0, 0, 0, 1, 1, // msup
+		109, 115, 112, 105, 0, 0, 0, 1, 1, // mspi
+		109, 115, 101, 120, 0, 0, 0, 1, 1, // msex
+		109, 115, 113, 121, 0, 0, 0, 1, 1, // msqy
+		109, 115, 105, 120, 0, 0, 0, 1, 1, // msix
+		109, 115, 114, 115, 0, 0, 0, 1, 1, // msrs
+		109, 115, 100, 99, 0, 0, 0, 4, 0, 0, 0, 1, // msdc
+	}
+	if !bytes.Equal(p, expectedData) {
+		t.Errorf("response body doesn't match:\n%v", p)
+	}
+}
+
+func TestGetServerInfoDaap3(t *testing.T) {
+	router := routes(nil, newLibrary([]Database{{name: "testdb"}}), nil, nil, nil)
+	req, err := http.NewRequest("GET", "/server-info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Errorf("wrong http status, want %v, got %v", http.StatusOK, resp.Code)
+	}
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedData := []byte{
+		109, 115, 114, 118, 0, 0, 0, 225, // msrv
+		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
+		109, 112, 114, 111, 0, 0, 0, 4, 0, 2, 0, 10, // mpro
+		97, 112, 114, 111, 0, 0, 0, 4, 0, 3, 0, 12, // apro
+		97, 101, 83, 86, 0, 0, 0, 4, 0, 3, 0, 0, // aeSV
+		97, 116, 101, 100, 0, 0, 0, 2, 0, 7, // ated
+		97, 115, 103, 114, 0, 0, 0, 2, 0, 3, // asgr
+		97, 115, 115, 101, 0, 0, 0, 8, 0, 0, 0, 0, 0, 8, 0, 0, // asse
+		109, 105, 110, 109, 0, 0, 0, 11, 100, 97, 97, 112, 45, 115, 101, 114, 118, 101, 114, // minm
+		109, 115, 108, 114, 0, 0, 0, 1, 1, // mslr
+		109, 115, 116, 109, 0, 0, 0, 4, 0, 0, 7, 8, // mstm
+		109, 115, 97, 108, 0, 0, 0, 1, 1, // msal
+		109, 115, 117, 112, 0, 0, 0, 1, 1, // msup
+		109, 115, 112, 105, 0, 0, 0, 1, 1, // mspi
+		109, 115, 101, 120, 0, 0, 0, 1, 1, // msex
+		109, 115, 98, 114, 0, 0, 0, 1, 1, // msbr
+		109, 115, 113, 121, 0, 0, 0, 1, 1, // msqy
+		109, 115, 105, 120, 0, 0, 0, 1, 1, // msix
+		109, 115, 114, 115, 0, 0, 0, 1, 1, // msrs
+		109, 115, 101, 100, 0, 0, 0, 1, 0, // msed
+		109, 115, 109, 108, 0, 0, 0, 0, // msml
+		109, 115, 100, 99, 0, 0, 0, 4, 0, 0, 0, 1, // msdc
+	}
+	if !bytes.Equal(p, expectedData) {
+		t.Errorf("response body doesn't match:\n%v\nwant:\n%v", p, expectedData)
+	}
+}
+
+func TestGetServerInfoDAAPVersion(t *testing.T) {
+	defer setShare(currentShare())
+	share := currentShare()
+	share.profiles, _ = profilesUpTo(Version{2, 0, 1})
+	setShare(share)
+
+	router := routes(nil, newLibrary([]Database{{name: "testdb"}}), nil, nil, nil)
+	req := httptest.NewRequest("GET", "/server-info", nil)
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	tags, err := daap.Decode(resp.Body.Bytes(), map[string]bool{"msrv": true})
+	if err != nil || len(tags) != 1 {
+		t.Fatalf("bad response %v %v", tags, err)
+	}
+	if apro, _ := tags[0].Find("apro"); !bytes.Equal(apro.Data, []byte{0, 2, 0, 1}) {
+		t.Errorf("wrong apro %v", apro.Data)
+	}
+	for _, code := range []string{"aeSV", "msed", "msml"} {
+		if _, ok := tags[0].Find(code); ok {
+			t.Errorf("%v advertised above daap_version", code)
+		}
+	}
+}
+
+func TestGetDatabaseItemsWithoutMeta(t *testing.T) {
+	router := routes(nil, newLibrary([]Database{{name: "testdb", songs: []Song{{Title: "aname"}}}}), nil, nil, nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest("GET", "/databases/1/items", nil))
+	if resp.Code != http.StatusOK {
+		t.Errorf("wrong http status, want %v, got %v", http.StatusOK, resp.Code)
+	}
+}
+
 func TestGetContentCodes(t *testing.T) {
 	var contentCodes = []ContentCode{
 		{"abal", "daap.browsealbumlisting", DmapContainer},
 		{"msrv", "dmap.serverinforesponse", DmapContainer},
 	}
-	router := routes(contentCodes, nil)
+	router := routes(contentCodes, nil, nil, nil, nil)
 	req, err := http.NewRequest("GET", "/content-codes", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Client-DAAP-Version", "3.0")
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 	if resp.Code != http.StatusOK {
@@ -85,8 +213,44 @@ func TestGetContentCodes(t *testing.T) {
 	}
 }
 
+func TestGetContentCodesByVersion(t *testing.T) {
+	var contentCodes = []ContentCode{
+		{"mstt", "dmap.status", DmapLong},
+		{"msed", "dmap.supportsedit", DmapChar},
+	}
+	router := routes(contentCodes, nil, nil, nil, nil)
+
+	tests := []struct {
+		clientVersion string
+		want          int
+	}{
+		{"", 12 + 49},
+		{"2.0", 12 + 49},
+		{"3.0", 12 + 49 + 55},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/content-codes", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Client-DAAP-Version", test.clientVersion)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Errorf("wrong http status, want %v, got %v", http.StatusOK, resp.Code)
+		}
+		p, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) != 8+test.want {
+			t.Errorf("wrong response length for '%v', want %v, got %v", test.clientVersion, 8+test.want, len(p))
+		}
+	}
+}
+
 func TestGetLogin(t *testing.T) {
-	router := routes(nil, nil)
+	router := routes(nil, nil, nil, nil, nil)
 	req, err := http.NewRequest("GET", "/login", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -104,15 +268,18 @@ func TestGetLogin(t *testing.T) {
 	expectedData := []byte{
 		109, 108, 111, 103, 0, 0, 0, 24, // mlog
 		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
-		109, 108, 105, 100, 0, 0, 0, 4, 0, 0, 0, 113, // mlid
+		109, 108, 105, 100, 0, 0, 0, 4, // mlid, then a random session id
 	}
-	if !bytes.Equal(p, expectedData) {
+	if len(p) != 32 || !bytes.Equal(p[:28], expectedData) {
 		t.Errorf("response body doesn't match:\n%v", p)
 	}
+	if sessionID := binary.BigEndian.Uint32(p[28:]); sessionID == 0 || sessionID > 0x7fffffff {
+		t.Errorf("bad session id %v", sessionID)
+	}
 }
 
 func TestGetLogout(t *testing.T) {
-	router := routes(nil, nil)
+	router := routes(nil, nil, nil, nil, nil)
 	req, err := http.NewRequest("GET", "/logout?session-id=113", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -134,9 +301,9 @@ func TestGetLogout(t *testing.T) {
 
 func TestGetDatabases(t *testing.T) {
 	var databases = []Database{
-		{"testdb", []Song{{"", "", ""}}},
+		{name: "testdb", songs: []Song{{}}},
 	}
-	router := routes(nil, databases)
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
 
 	req, err := http.NewRequest("GET", "/databases", nil)
 	if err != nil {
@@ -153,18 +320,19 @@ func TestGetDatabases(t *testing.T) {
 	}
 
 	expectedData := []byte{
-		97, 118, 100, 98, 0, 0, 0, 127, // avdb
+		97, 118, 100, 98, 0, 0, 0, 139, // avdb
 		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
 		109, 117, 116, 121, 0, 0, 0, 1, 0, // muty
 		109, 116, 99, 111, 0, 0, 0, 4, 0, 0, 0, 1, // mtco
 		109, 114, 99, 111, 0, 0, 0, 4, 0, 0, 0, 1, // mrco
-		109, 108, 99, 108, 0, 0, 0, 74, // mlcl
-		109, 108, 105, 116, 0, 0, 0, 66, // mlit
+		109, 108, 99, 108, 0, 0, 0, 86, // mlcl
+		109, 108, 105, 116, 0, 0, 0, 78, // mlit
 		109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 0, 1, // miid
 		109, 112, 101, 114, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 1, // mper
 		109, 105, 110, 109, 0, 0, 0, 6, 116, 101, 115, 116, 100, 98, // minm
 		109, 105, 109, 99, 0, 0, 0, 4, 0, 0, 0, 1, // mimc
 		109, 99, 116, 99, 0, 0, 0, 4, 0, 0, 0, 0, // mctc
+		109, 100, 98, 107, 0, 0, 0, 4, 0, 0, 0, 1, // mdbk
 	}
 	if !bytes.Equal(p, expectedData) {
 		t.Errorf("response body doesn't match:\n%v", p)
@@ -174,14 +342,14 @@ func TestGetDatabases(t *testing.T) {
 func TestGetDatabaseItems(t *testing.T) {
 	var databases = []Database{
 		{
-			"testdb",
-			[]Song{
-				{"aname", "aalbum", "aartist"},
+			name: "testdb",
+			songs: []Song{
+				{Title: "aname", Album: "aalbum", Artist: "aartist"},
 			},
 		},
 	}
 
-	router := routes(nil, databases)
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
 	req, err := http.NewRequest("GET", "/databases/1/items?session-id=113&meta=dmap.itemid,dmap.itemname,dmap.itemkind,dmap.persistentid,daap.songalbum,daap.songartist", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -212,18 +380,331 @@ func TestGetDatabaseItems(t *testing.T) {
 		97, 115, 97, 114, 0, 0, 0, 7, 97, 97, 114, 116, 105, 115, 116, // asar
 	}
 	if !bytes.Equal(p, expectedData) {
-		t.Errorf("response body doesn't match:\n%v", p, expectedData)
+		t.Errorf("response body doesn't match:\n%v\nwant:\n%v", p, expectedData)
+	}
+}
+
+func TestGetDatabaseItemsQuery(t *testing.T) {
+	var databases = []Database{
+		{
+			name: "testdb",
+			songs: []Song{
+				{Title: "Airbag", Album: "OK Computer", Artist: "Radiohead"},
+				{Title: "Déjà Vu", Album: "B'Day", Artist: "Beyoncé"},
+				{Title: "Lucky", Album: "OK Computer", Artist: "Radiohead"},
+			},
+		},
+	}
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
+
+	tests := []struct {
+		query  string
+		status int
+		titles []string
+	}{
+		{"'daap.songartist:radiohead'", http.StatusOK, []string{"Airbag", "Lucky"}},
+		{"'daap.songartist:beyonce'", http.StatusOK, []string{"Déjà Vu"}},
+		{"'dmap.itemname:*uck*','daap.songalbum:b*'", http.StatusOK, []string{"Déjà Vu", "Lucky"}},
+		{"'daap.songartist:Nobody'", http.StatusOK, []string{}},
+		{"'daap.songartist", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/databases/1/items?meta=dmap.itemid,dmap.itemname&query="+url.QueryEscape(test.query), nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != test.status {
+			t.Errorf("%v: wrong http status, want %v, got %v", test.query, test.status, resp.Code)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		body := resp.Body.Bytes()
+		if count := bytes.Count(body, []byte("mlit")); count != len(test.titles) {
+			t.Errorf("%v: wrong number of items, want %v, got %v", test.query, len(test.titles), count)
+		}
+		if mrco := binary.BigEndian.Uint32(body[49:53]); int(mrco) != len(test.titles) {
+			t.Errorf("%v: wrong mrco %v", test.query, mrco)
+		}
+		for _, title := range test.titles {
+			if !bytes.Contains(body, []byte(title)) {
+				t.Errorf("%v: %v missing", test.query, title)
+			}
+		}
+	}
+}
+
+func TestGetDatabaseItemsSorted(t *testing.T) {
+	var databases = []Database{
+		{
+			name: "testdb",
+			songs: []Song{
+				{Title: "Airbag", Album: "OK Computer", Artist: "Radiohead"},
+				{Title: "Help!", Album: "Help!", Artist: "The Beatles"},
+				{Title: "Déjà Vu", Album: "B'Day", Artist: "Beyoncé"},
+			},
+		},
+	}
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
+
+	req := httptest.NewRequest("GET", "/databases/1/items?meta=dmap.itemid,dmap.itemname&sort=artist&include-sort-headers=1", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("wrong http status, want %v, got %v", http.StatusOK, resp.Code)
+	}
+	body := resp.Body.Bytes()
+	if size := binary.BigEndian.Uint32(body[4:8]); int(size) != len(body)-8 {
+		t.Errorf("wrong adbs size %v for %v bytes", size, len(body))
+	}
+	beatles, beyonce, radiohead := bytes.Index(body, []byte("Help!")), bytes.Index(body, []byte("Déjà Vu")), bytes.Index(body, []byte("Airbag"))
+	if !(beatles < beyonce && beyonce < radiohead) {
+		t.Errorf("songs not sorted by artist: %v %v %v", beatles, beyonce, radiohead)
+	}
+	mshl := bytes.Index(body, []byte("mshl"))
+	if mshl < radiohead {
+		t.Fatalf("no sort headers after the listing")
+	}
+	if count := bytes.Count(body[mshl:], []byte("mlit")); count != 2 {
+		t.Errorf("wrong number of sort headers, want 2, got %v", count)
+	}
+	if char := binary.BigEndian.Uint16(body[mshl+24 : mshl+26]); char != 'B' {
+		t.Errorf("wrong first header %q", rune(char))
+	}
+
+	req = httptest.NewRequest("GET", "/databases/1/items?meta=dmap.itemid&sort=colour", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("wrong http status for an unknown sort, want %v, got %v", http.StatusBadRequest, resp.Code)
+	}
+}
+
+func TestGetDatabaseItemsIndex(t *testing.T) {
+	var databases = []Database{
+		{
+			name: "testdb",
+			songs: []Song{
+				{Title: "Airbag", Album: "OK Computer", Artist: "Radiohead"},
+				{Title: "Help!", Album: "Help!", Artist: "The Beatles"},
+				{Title: "Déjà Vu", Album: "B'Day", Artist: "Beyoncé"},
+			},
+		},
+	}
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
+	containers := map[string]bool{"adbs": true, "mlcl": true, "mlit": true}
+
+	tests := []struct {
+		uri    string
+		titles []string
+	}{
+		{"/databases/1/items?meta=dmap.itemname&sort=artist&index=1-1", []string{"Déjà Vu"}},
+		{"/databases/1/items?meta=dmap.itemname&index=1-5", []string{"Help!", "Déjà Vu"}},
+		{"/databases/1/items?meta=dmap.itemname&index=0-1", []string{"Airbag", "Help!"}},
+		{"/databases/1/items?meta=dmap.itemname&index=2", []string{"Déjà Vu"}},
+		{"/databases/1/items?meta=dmap.itemname&index=5-", []string{}},
+	}
+	for _, test := range tests {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest("GET", test.uri, nil))
+		tags, err := daap.Decode(resp.Body.Bytes(), containers)
+		if resp.Code != http.StatusOK || err != nil || len(tags) != 1 {
+			t.Errorf("%v: bad response %v %v", test.uri, resp.Code, err)
+			continue
+		}
+		if total, _ := tags[0].Find("mtco"); total.Int() != 3 {
+			t.Errorf("%v: wrong total %v", test.uri, total.Int())
+		}
+		listing, _ := tags[0].Find("mlcl")
+		titles := []string{}
+		for _, item := range listing.All("mlit") {
+			title, _ := item.Find("minm")
+			titles = append(titles, title.Text())
+		}
+		if !reflect.DeepEqual(titles, test.titles) {
+			t.Errorf("%v: wrong songs %q, want %q", test.uri, titles, test.titles)
+		}
+		if returned, _ := tags[0].Find("mrco"); int(returned.Int()) != len(test.titles) {
+			t.Errorf("%v: wrong returned count %v", test.uri, returned.Int())
+		}
+	}
+
+	for _, index := range []string{"a-b", "2-1", "-1"} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest("GET", "/databases/1/items?meta=dmap.itemname&index="+index, nil))
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("wrong http status for index %q, want %v, got %v", index, http.StatusBadRequest, resp.Code)
+		}
+	}
+}
+
+func TestGetDatabaseItemsNotModified(t *testing.T) {
+	var databases = []Database{
+		{name: "testdb", songs: []Song{{Title: "aname", Album: "aalbum", Artist: "aartist"}}},
+	}
+	library := newLibrary(databases)
+	router := routes(nil, library, nil, nil, nil)
+
+	req, err := http.NewRequest("GET", "/databases/1/items?meta=dmap.itemid,dmap.itemname", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	etag := resp.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"1-`) {
+		t.Fatalf("wrong ETag in response: %q", etag)
+	}
+
+	req, err = http.NewRequest("GET", "/databases/1/items?meta=dmap.itemid,dmap.itemname", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotModified {
+		t.Errorf("wrong http status, want %v, got %v", http.StatusNotModified, resp.Code)
+	}
+	if resp.Body.Len() != 0 {
+		t.Errorf("unexpected body in not modified response: %v", resp.Body.Bytes())
+	}
+
+	// the listing of the next revision doesn't match
+	library.bumpRevision()
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Errorf("wrong http status after a new revision, want %v, got %v", http.StatusOK, resp.Code)
+	}
+	if got := resp.Header().Get("ETag"); !strings.HasPrefix(got, `"2-`) {
+		t.Errorf("wrong ETag after a new revision: %q", got)
+	}
+}
+
+func TestGetDatabaseItemsCachedMatchesStreamed(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "testdb", gzip: true})
+	router := routes(nil, newLibrary([]Database{syntheticDatabase(100)}), nil, nil, nil)
+
+	for _, encoding := range []string{"", "gzip"} {
+		var bodies [2][]byte
+		var etags [2]string
+		for i := range bodies {
+			req := httptest.NewRequest("GET", "/databases/1/items?meta=dmap.itemid,dmap.itemname&sort=name", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+			if got := resp.Header().Get("Content-Encoding"); got != encoding {
+				t.Fatalf("%q: wrong encoding %q", encoding, got)
+			}
+			bodies[i] = resp.Body.Bytes()
+			if encoding == "gzip" {
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bodies[i], err = ioutil.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			}
+			etags[i] = resp.Header().Get("ETag")
+		}
+		if !bytes.Equal(bodies[0], bodies[1]) || len(bodies[0]) < gzipThreshold {
+			t.Errorf("%q: cached listing differs from the streamed one", encoding)
+		}
+		if etags[0] == "" || etags[0] != etags[1] {
+			t.Errorf("%q: wrong ETags %q", encoding, etags)
+		}
+	}
+}
+
+func TestGetMultipleDatabases(t *testing.T) {
+	var databases = []Database{
+		{name: "Music", songs: []Song{{Title: "a song"}}},
+		{name: "Audiobooks", songs: []Song{{Title: "a book"}, {Title: "another book"}}},
+		{name: "Podcasts"},
+	}
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
+
+	req, err := http.NewRequest("GET", "/databases", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	p := resp.Body.Bytes()
+	for i, database := range databases {
+		if !bytes.Contains(p, databaseToData(i+1, database)) {
+			t.Errorf("database %v missing from listing:\n%v", database.name, p)
+		}
+	}
+
+	req, err = http.NewRequest("GET", "/server-info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	msdc := []byte{109, 115, 100, 99, 0, 0, 0, 4, 0, 0, 0, 3}
+	if !bytes.HasSuffix(resp.Body.Bytes(), msdc) {
+		t.Errorf("wrong database count:\n%v", resp.Body.Bytes())
+	}
+
+	req, err = http.NewRequest("GET", "/databases/2/items?meta=dmap.itemname", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if !bytes.Contains(resp.Body.Bytes(), []byte("another book")) {
+		t.Errorf("wrong database items:\n%q", resp.Body.Bytes())
+	}
+}
+
+func TestGetDatabaseNotFound(t *testing.T) {
+	var databases = []Database{
+		{name: "testdb", songs: []Song{{Title: "aname"}}},
+	}
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
+
+	tests := []struct {
+		uri  string
+		code string
+	}{
+		{"/databases/0/items?meta=dmap.itemname", "adbs"},
+		{"/databases/2/items?meta=dmap.itemname", "adbs"},
+		{"/databases/2/containers", "aply"},
+		{"/databases/2/containers/1/items", "apso"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("wrong http status for %v, want %v, got %v", test.uri, http.StatusNotFound, resp.Code)
+		}
+		expectedData := append([]byte(test.code), []byte{
+			0, 0, 0, 12,
+			109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 1, 148, // mstt
+		}...)
+		if !bytes.Equal(resp.Body.Bytes(), expectedData) {
+			t.Errorf("response body for %v doesn't match:\n%v\nwant:\n%v", test.uri, resp.Body.Bytes(), expectedData)
+		}
 	}
 }
 
 func TestGetDatabaseContainers(t *testing.T) {
 	var databases = []Database{
 		{
-			"testdb",
-			nil,
+			name:  "testdb",
+			songs: nil,
 		},
 	}
-	router := routes(nil, databases)
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
 	req, err := http.NewRequest("GET", "/databases/1/containers?session-id=113&revision-number=1", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -239,19 +720,117 @@ func TestGetDatabaseContainers(t *testing.T) {
 	}
 
 	expectedData := []byte{
-		97, 112, 108, 121, 0, 0, 0, 12 + 9 + 12 + 12, // aply
+		97, 112, 108, 121, 0, 0, 0, 12 + 9 + 12 + 12 + 8, // aply
 		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
 		109, 117, 116, 121, 0, 0, 0, 1, 0, // muty
 		109, 116, 99, 111, 0, 0, 0, 4, 0, 0, 0, 0, // mtco
 		109, 114, 99, 111, 0, 0, 0, 4, 0, 0, 0, 0, // mrco
+		109, 108, 99, 108, 0, 0, 0, 0, // mlcl
 	}
 	if !bytes.Equal(p, expectedData) {
-		t.Errorf("response body doesn't match:\n%v", p, expectedData)
+		t.Errorf("response body doesn't match:\n%v\nwant:\n%v", p, expectedData)
+	}
+}
+
+func TestGetSongStream(t *testing.T) {
+	f, err := ioutil.TempFile("", "song*.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not really an mp3")
+	f.Close()
+
+	var databases = []Database{
+		{name: "testdb", songs: []Song{{Title: "aname", Path: f.Name()}}},
+	}
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
+
+	req, err := http.NewRequest("GET", "/databases/1/items/1.mp3?session-id=113", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=4-")
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusPartialContent {
+		t.Errorf("wrong http status, want %v, got %v", http.StatusPartialContent, resp.Code)
+	}
+	if contentType := resp.Header().Get("Content-Type"); contentType != "audio/mpeg" {
+		t.Errorf("wrong content type: %v", contentType)
+	}
+	if resp.Body.String() != "really an mp3" {
+		t.Errorf("response body doesn't match: %v", resp.Body.String())
+	}
+}
+
+func TestPostSongRating(t *testing.T) {
+	library := newLibrary([]Database{
+		{name: "testdb", songs: []Song{{Title: "aname", Path: "/music/aname.mp3"}}},
+	})
+	router := routes(nil, library, nil, nil, nil)
+
+	tests := []struct {
+		uri    string
+		rating string
+		want   int
+	}{
+		{"/databases/1/items/1/rating", "40", http.StatusNoContent},
+		{"/databases/1/items/2/rating", "40", http.StatusNotFound},
+		{"/databases/2/items/1/rating", "40", http.StatusNotFound},
+		{"/databases/1/items/1/rating", "-1", http.StatusBadRequest},
+		{"/databases/1/items/1/rating", "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", test.uri, strings.NewReader("rating="+test.rating))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != test.want {
+			t.Errorf("wrong http status for %v rating %v, want %v, got %v", test.uri, test.rating, test.want, resp.Code)
+		}
+	}
+	if got := library.databases()[0].songs[0].stats().Rating; got != 40 {
+		t.Errorf("wrong rating: %v", got)
+	}
+
+	req, err := http.NewRequest("GET", "/databases/1/items?meta=daap.songuserrating", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	rating := []byte{97, 115, 117, 114, 0, 0, 0, 1, 40} // asur
+	if !bytes.Contains(resp.Body.Bytes(), rating) {
+		t.Errorf("rating not in listing: %v", resp.Body.Bytes())
+	}
+}
+
+func TestGetSongStreamNotFound(t *testing.T) {
+	var databases = []Database{
+		{name: "testdb", songs: []Song{{Title: "aname", Path: "/does/not/exist.mp3"}}},
+	}
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
+
+	for _, uri := range []string{"/databases/1/items/1.mp3", "/databases/1/items/2.mp3", "/databases/2/items/1.mp3"} {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("wrong http status for %v, want %v, got %v", uri, http.StatusNotFound, resp.Code)
+		}
 	}
 }
 
 func TestGetUpdate(t *testing.T) {
-	router := routes(nil, nil)
+	router := routes(nil, nil, nil, nil, nil)
 	req, err := http.NewRequest("GET", "/update?session-id=113&revision-number=1", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -272,7 +851,7 @@ func TestGetUpdate(t *testing.T) {
 		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
 	}
 	if !bytes.Equal(p, expectedData) {
-		t.Errorf("response body doesn't match:\n%v", p, expectedData)
+		t.Errorf("response body doesn't match:\n%v\nwant:\n%v", p, expectedData)
 	}
 }
 
@@ -286,7 +865,7 @@ func TestHeaders(t *testing.T) {
 	dummyHandler := func(w http.ResponseWriter, r *http.Request) {
 		dummyHandlerCalled = true
 	}
-	headers(dummyHandler)(resp, req)
+	headers(nil, dummyHandler)(resp, req)
 	if resp.Code != http.StatusOK {
 		t.Errorf("wrong http status, want %v, got %v", http.StatusOK, resp.Code)
 	}
@@ -300,3 +879,71 @@ func TestHeaders(t *testing.T) {
 		t.Error("did not call inner handler")
 	}
 }
+
+func TestHeadersValidation(t *testing.T) {
+	defer setShare(currentShare())
+	share := currentShare()
+	share.requireValidation = true
+	setShare(share)
+
+	tests := []struct {
+		validation string
+		want       int
+	}{
+		{"", http.StatusForbidden},
+		{"0123456789ABCDEF0123456789ABCDEF", http.StatusForbidden},
+		{daaphash.Generate(3, "/server-info", daaphash.DefaultAccessIndex, 0), http.StatusOK},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/server-info", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Client-DAAP-Version", "3.0")
+		req.Header.Set("Client-DAAP-Validation", test.validation)
+		resp := httptest.NewRecorder()
+		dummyHandler := func(w http.ResponseWriter, r *http.Request) {}
+		headers(nil, dummyHandler)(resp, req)
+		if resp.Code != test.want {
+			t.Errorf("wrong http status for '%v', want %v, got %v", test.validation, test.want, resp.Code)
+		}
+	}
+}
+
+func TestGetUpdateLongPoll(t *testing.T) {
+	library := newLibrary(nil)
+	router := routes(nil, library, nil, nil, nil)
+	req, err := http.NewRequest("GET", "/update?session-id=113&revision-number=2&delta=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	library.bumpRevision()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		done <- resp
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("update returned before the revision changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	library.bumpRevision()
+	select {
+	case resp := <-done:
+		expectedData := []byte{
+			109, 117, 112, 100, 0, 0, 0, 24, // mupd
+			109, 117, 115, 114, 0, 0, 0, 4, 0, 0, 0, 3, // musr
+			109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
+		}
+		if !bytes.Equal(resp.Body.Bytes(), expectedData) {
+			t.Errorf("response body doesn't match:\n%v\nwant:\n%v", resp.Body.Bytes(), expectedData)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("update did not return after the revision changed")
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Library holds the databases being served. They can be replaced while the
+// server is running, e.g. by a rescan or a proxy refresh.
+type Library struct {
+	mu  sync.RWMutex
+	dbs []Database
+
+	// rev is bumped whenever the contents of any database change, so that
+	// clients and cached responses know to refresh. changed is closed and
+	// replaced at the same time.
+	rev     int64
+	changed chan struct{}
+
+	// indexPath is the library index, where song stats are saved so they
+	// survive rescans and restarts, see useIndex. saved are the stats read
+	// from it and those of songs that have left the library, in case they
+	// come back. pending is the save waiting for statsSaveDelay, if any.
+	indexPath string
+	saved     map[string]SongStats
+	pending   *time.Timer
+	saveMu    sync.Mutex // held while writing the index
+
+	// plays counts the plays and skips recorded, which don't bump the
+	// revision as clients would reload the whole library every time a song
+	// ended.
+	plays int64
+
+	// smart playlists are added to every library database as it is set.
+	smart []SmartPlaylist
+
+	// closed is closed when the server shuts down, to let go of clients
+	// waiting for a new revision.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newLibrary(databases []Database) *Library {
+	l := &Library{rev: 1, saved: map[string]SongStats{}, changed: make(chan struct{}), closed: make(chan struct{})}
+	dbs := make([]Database, len(databases))
+	for i, database := range databases {
+		dbs[i] = l.indexLocked(i+1, database)
+	}
+	l.dbs = dbs
+	return l
+}
+
+// databases returns the current databases. They must not be modified, use
+// setDatabase instead. A nil Library has no databases.
+func (l *Library) databases() []Database {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.dbs
+}
+
+// database looks up a database by its id, counting from 1.
+func (l *Library) database(id int) (Database, bool) {
+	databases := l.databases()
+	if id < 1 || id > len(databases) {
+		return Database{}, false
+	}
+	return databases[id-1], true
+}
+
+// databaseAt looks up a database like database does, along with the library
+// revision it belongs to.
+func (l *Library) databaseAt(id int) (Database, int, bool) {
+	if l == nil {
+		return Database{}, 1, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	revision := l.revision()
+	if id < 1 || id > len(l.dbs) {
+		return Database{}, revision, false
+	}
+	return l.dbs[id-1], revision, true
+}
+
+// setDatabase replaces the database with the given id, counting from 1, or
+// adds it if the id is one past the end. It bumps the library revision.
+func (l *Library) setDatabase(id int, database Database) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	database = l.applySmartPlaylists(l.indexLocked(id, database))
+	databases := make([]Database, len(l.dbs), len(l.dbs)+1)
+	copy(databases, l.dbs)
+	if id == len(databases)+1 {
+		databases = append(databases, database)
+	} else {
+		databases[id-1] = database
+	}
+	l.dbs = databases
+	l.bumpRevisionLocked()
+}
+
+// setDatabases replaces every database, e.g. after the configuration is
+// reloaded. It bumps the library revision.
+func (l *Library) setDatabases(databases []Database) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	dbs := make([]Database, len(databases))
+	for i, database := range databases {
+		dbs[i] = l.applySmartPlaylists(l.indexLocked(i+1, database))
+	}
+	l.dbs = dbs
+	l.bumpRevisionLocked()
+}
+
+// useSmartPlaylists replaces the smart playlists in every library database.
+// It bumps the library revision.
+func (l *Library) useSmartPlaylists(playlists []SmartPlaylist) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.smart = playlists
+	databases := make([]Database, len(l.dbs))
+	for i, database := range l.dbs {
+		databases[i] = l.applySmartPlaylists(database)
+	}
+	l.dbs = databases
+	l.bumpRevisionLocked()
+}
+
+// indexLocked returns database with a search index, updated from the index of
+// the database it replaces if there is one, as rescans mostly find the same
+// songs, its songs grouped into albums and their stats. Callers must hold the
+// lock.
+func (l *Library) indexLocked(id int, database Database) Database {
+	var replaced []Song
+	if id >= 1 && id <= len(l.dbs) {
+		replaced = l.dbs[id-1].songs
+		database.index = l.dbs[id-1].index.update(replaced, database.songs)
+	} else {
+		database.index = newSearchIndex(database.songs)
+	}
+	database.albums = groupAlbums(database.songs)
+	database.songs = l.attachStatsLocked(replaced, database.songs)
+	return database
+}
+
+// attachStatsLocked returns a copy of songs with their stats: those of the
+// same song in replaced, so plays recorded against either are kept, or the
+// saved ones. The stats of replaced songs that have gone are saved in case
+// they come back. Callers must hold the lock.
+func (l *Library) attachStatsLocked(replaced, songs []Song) []Song {
+	live := make(map[string]*songStats, len(replaced))
+	for _, song := range replaced {
+		if song.live != nil {
+			live[song.statsKey()] = song.live
+		}
+	}
+	attached := make([]Song, len(songs))
+	for i, song := range songs {
+		key := song.statsKey()
+		if stats, ok := live[key]; ok {
+			song.live = stats
+			delete(live, key)
+		} else if song.live == nil {
+			song.live = &songStats{SongStats: l.saved[key]}
+		}
+		attached[i] = song
+	}
+	for key, stats := range live {
+		stats.mu.Lock()
+		if stats.SongStats != (SongStats{}) {
+			l.saved[key] = stats.SongStats
+		}
+		stats.mu.Unlock()
+	}
+	return attached
+}
+
+// applySmartPlaylists returns database with the smart playlists, unless it's
+// a radio database.
+func (l *Library) applySmartPlaylists(database Database) Database {
+	if database.kind != RadioDatabase {
+		database.smart = l.smart
+	}
+	return database
+}
+
+// recordPlay counts a song in a database being played through, or skipped,
+// at the given time.
+func (l *Library) recordPlay(databaseID int, song Song, skipped bool, when time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats, ok := l.updateStatsLocked(databaseID, song, func(s *SongStats) {
+		if skipped {
+			s.SkipCount++
+			s.LastSkipped = when
+		} else {
+			s.PlayCount++
+			s.LastPlayed = when
+		}
+	})
+	atomic.AddInt64(&l.plays, 1)
+	if ok && !skipped {
+		queueStatsTags(song, stats)
+	}
+}
+
+// setRating sets a song's user rating, from 0 to 100. Unlike plays, a rating
+// is an edit to the library and bumps the revision.
+func (l *Library) setRating(databaseID int, song Song, rating int) error {
+	if rating < 0 || rating > 100 {
+		return fmt.Errorf("rating %v is not between 0 and 100", rating)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats, ok := l.updateStatsLocked(databaseID, song, func(s *SongStats) { s.Rating = rating })
+	if !ok {
+		return fmt.Errorf("no song '%v' in database %v", song.Title, databaseID)
+	}
+	l.bumpRevisionLocked()
+	queueStatsTags(song, stats)
+	return nil
+}
+
+// updateStatsLocked applies update to the stats of a song in a database, in
+// place, and schedules the library index to be saved. It returns the new
+// stats, or false if the song isn't in the library. Callers must hold the
+// lock.
+func (l *Library) updateStatsLocked(databaseID int, song Song, update func(*SongStats)) (SongStats, bool) {
+	if databaseID < 1 || databaseID > len(l.dbs) || song.live == nil {
+		return SongStats{}, false
+	}
+	song.live.mu.Lock()
+	update(&song.live.SongStats)
+	stats := song.live.SongStats
+	song.live.mu.Unlock()
+	if l.indexPath != "" && l.pending == nil {
+		l.pending = time.AfterFunc(statsSaveDelay, func() {
+			if err := l.saveIndex(); err != nil {
+				log.Printf("cannot save the library index: %v", err)
+			}
+		})
+	}
+	return stats, true
+}
+
+// useIndex reads the library index at path, filling in the stats of the
+// songs in the library and of those added later, and saves stats there as
+// they change. A missing index has no stats yet.
+func (l *Library) useIndex(path string) error {
+	saved := map[string]SongStats{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("cannot read the library index %v: %v", path, err)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.indexPath, l.saved = path, saved
+	for _, database := range l.dbs {
+		for _, song := range database.songs {
+			if stats, ok := saved[song.statsKey()]; ok {
+				song.live.mu.Lock()
+				song.live.SongStats = stats
+				song.live.mu.Unlock()
+			}
+		}
+	}
+	return nil
+}
+
+// saveIndex saves the stats of the songs in the library to the library
+// index, if any have changed since it was last saved.
+func (l *Library) saveIndex() error {
+	if l == nil {
+		return nil
+	}
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	l.mu.Lock()
+	if l.pending == nil {
+		l.mu.Unlock()
+		return nil
+	}
+	l.pending.Stop()
+	l.pending = nil
+	index := make(map[string]SongStats, len(l.saved))
+	for key, stats := range l.saved {
+		index[key] = stats
+	}
+	for _, database := range l.dbs {
+		for _, song := range database.songs {
+			if stats := song.stats(); stats != (SongStats{}) {
+				index[song.statsKey()] = stats
+			}
+		}
+	}
+	path := l.indexPath
+	l.mu.Unlock()
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// playsRecorded is the number of plays and skips recorded, for telling
+// whether song stats have changed.
+func (l *Library) playsRecorded() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.plays)
+}
+
+// revision is the current library revision. A nil Library is always at its
+// first revision.
+func (l *Library) revision() int {
+	if l == nil {
+		return 1
+	}
+	return int(atomic.LoadInt64(&l.rev))
+}
+
+func (l *Library) bumpRevision() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bumpRevisionLocked()
+}
+
+func (l *Library) bumpRevisionLocked() int {
+	revision := int(atomic.AddInt64(&l.rev, 1))
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return revision
+}
+
+// close wakes everything waiting on the library, as the server is shutting
+// down. It can be called more than once.
+func (l *Library) close() {
+	l.closeOnce.Do(func() { close(l.closed) })
+}
+
+// closing is closed once the library is.
+func (l *Library) closing() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.closed
+}
+
+// revisionWaiter returns a channel that is closed the next time the revision
+// changes. Get it before checking the current revision to avoid missing one.
+// A nil Library never changes.
+func (l *Library) revisionWaiter() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.changed
+}
+
+var audioContentTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"m4a":  "audio/mp4",
+	"m4b":  "audio/mp4",
+	"aac":  "audio/aac",
+	"flac": "audio/flac",
+	"ogg":  "audio/ogg",
+	"wav":  "audio/wav",
+	"aif":  "audio/aiff",
+	"aiff": "audio/aiff",
+}
+
+// format is the file extension DAAP clients use when asking for the stream.
+func (s Song) format() string {
+	if s.remote != nil {
+		return s.remote.song.Format
+	}
+	if s.StreamURL != "" {
+		if u, err := url.Parse(s.StreamURL); err == nil {
+			return strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), "."))
+		}
+	}
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(s.Path), "."))
+}
+
+func (s Song) contentType() string {
+	if contentType, ok := audioContentTypes[s.format()]; ok {
+		return contentType
+	}
+	return "audio/" + s.format()
+}
+
+// song looks up a song by its position in the database counting from 1,
+// which is also its item id unless it has an id of its own.
+func (d Database) song(id int) (Song, bool) {
+	if id < 1 || id > len(d.songs) {
+		return Song{}, false
+	}
+	return d.songs[id-1], true
+}
+
+// item looks up a song by the item id clients know it by, returning its
+// position as well.
+func (d Database) item(id int) (int, Song, bool) {
+	if d.items != nil {
+		position, ok := d.items[id]
+		if !ok {
+			return 0, Song{}, false
+		}
+		return position, d.songs[position-1], true
+	}
+	song, ok := d.song(id)
+	return id, song, ok
+}
+
+// itemIDAt is the item id clients know a song at a position by.
+func (s Song) itemIDAt(position int) int {
+	if s.itemID != 0 {
+		return s.itemID
+	}
+	return position
+}
+
+// persistentIDAt is the persistent id clients know a song at a position by.
+func (s Song) persistentIDAt(position int) int64 {
+	if s.persistentID != 0 {
+		return s.persistentID
+	}
+	return int64(position)
+}
+
+// container is a playlist in a database, listing songs by their item ids.
+// special is its com.apple.itunes.special-playlist id, if it is one.
+type container struct {
+	name    string
+	ids     []int
+	special byte
+}
+
+// containers are the playlists in a database. Radio stations are grouped by
+// genre, in the order the genres first appear. Other databases have a special
+// container for each media kind besides music that they have, then the smart
+// playlists.
+func (d Database) containers() []container {
+	if d.kind != RadioDatabase {
+		return append(d.specialContainers(), d.smartContainers()...)
+	}
+	containers := []container{}
+	index := map[string]int{}
+	for i, song := range d.songs {
+		genre := song.Genre
+		if genre == "" {
+			genre = "Other"
+		}
+		c, ok := index[genre]
+		if !ok {
+			c = len(containers)
+			index[genre] = c
+			containers = append(containers, container{name: genre})
+		}
+		containers[c].ids = append(containers[c].ids, i+1)
+	}
+	return containers
+}
+
+func (d Database) specialContainers() []container {
+	containers := []container{}
+	for _, special := range specialContainers {
+		c := container{name: special.name, special: special.special}
+		for i, song := range d.songs {
+			if song.kind() == special.kind {
+				c.ids = append(c.ids, i+1)
+			}
+		}
+		if len(c.ids) > 0 {
+			containers = append(containers, c)
+		}
+	}
+	return containers
+}
+
+// mdbk is the dmap.databasekind clients expect for each kind of database.
+func (k DatabaseKind) mdbk() int {
+	if k == RadioDatabase {
+		return 0x64
+	}
+	return 1
+}
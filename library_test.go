@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBumpRevision(t *testing.T) {
+	library := newLibrary(nil)
+	waiter := library.revisionWaiter()
+	if got := library.bumpRevision(); got != 2 {
+		t.Errorf("wrong revision, want %v, got %v", 2, got)
+	}
+	select {
+	case <-waiter:
+	case <-time.After(time.Second):
+		t.Error("waiter was not notified")
+	}
+}
+
+func TestNilLibrary(t *testing.T) {
+	var library *Library
+	if library.databases() != nil || library.revision() != 1 || library.revisionWaiter() != nil {
+		t.Error("nil library should be empty and never change")
+	}
+}
+
+func TestSetDatabase(t *testing.T) {
+	library := newLibrary([]Database{{name: "one", songs: nil}})
+	before := library.databases()
+
+	library.setDatabase(1, Database{name: "uno", songs: nil})
+	library.setDatabase(2, Database{name: "two", songs: nil})
+
+	databases := library.databases()
+	if len(databases) != 2 || databases[0].name != "uno" || databases[1].name != "two" {
+		t.Errorf("wrong databases: %v", databases)
+	}
+	if before[0].name != "one" {
+		t.Error("earlier snapshot was modified")
+	}
+	if library.revision() != 3 {
+		t.Errorf("wrong revision: %v", library.revision())
+	}
+}
+
+func TestSongFormat(t *testing.T) {
+	tests := []struct {
+		path        string
+		format      string
+		contentType string
+	}{
+		{"/music/a.mp3", "mp3", "audio/mpeg"},
+		{"/music/b.M4A", "m4a", "audio/mp4"},
+		{"/music/c.opus", "opus", "audio/opus"},
+	}
+	for _, test := range tests {
+		song := Song{Path: test.path}
+		if got := song.format(); got != test.format {
+			t.Errorf("wrong format for '%v', want %v, got %v", test.path, test.format, got)
+		}
+		if got := song.contentType(); got != test.contentType {
+			t.Errorf("wrong content type for '%v', want %v, got %v", test.path, test.contentType, got)
+		}
+	}
+}
+
+func TestDatabaseSong(t *testing.T) {
+	database := Database{name: "testdb", songs: []Song{{Title: "one"}, {Title: "two"}}}
+	if song, ok := database.song(2); !ok || song.Title != "two" {
+		t.Errorf("wrong song for id 2: %v", song)
+	}
+	for _, id := range []int{0, 3, -1} {
+		if _, ok := database.song(id); ok {
+			t.Errorf("found song for invalid id %v", id)
+		}
+	}
+}
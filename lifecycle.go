@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// run serves until it gets SIGINT or SIGTERM, then stops accepting
+// connections and gives requests in flight, such as songs being streamed,
+// until the shutdown timeout to finish. SIGHUP calls reload and carries on.
+// Reloads run alongside serving, so a signal to stop isn't held up by a long
+// rescan, and a SIGHUP during a reload is ignored.
+//
+// Pairings are written as they change, and play counts are saved by main once
+// run returns, after the requests are done.
+func run(server *http.Server, listener net.Listener, signals <-chan os.Signal, reload func(), shutdownTimeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	// holds a token while a reload runs
+	reloading := make(chan struct{}, 1)
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				select {
+				case reloading <- struct{}{}:
+					log.Print("reloading configuration")
+					go func() {
+						defer func() { <-reloading }()
+						reload()
+					}()
+				default:
+					log.Print("already reloading, ignoring SIGHUP")
+				}
+				continue
+			}
+			log.Printf("%v, waiting up to %v for streams to finish", sig, shutdownTimeout)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+				return err
+			}
+			log.Print("streams still running, closing them")
+			return server.Close()
+		}
+	}
+}
+
+// reloader rereads the configuration and rescans the library roots on
+// SIGHUP. Clients stay logged in and pick up the changes with their next
+// update.
+type reloader struct {
+	args    []string
+	getenv  func(string) string
+	config  Config
+	library *Library
+	scanner *Scanner
+}
+
+func (r *reloader) reload() {
+	config, err := loadConfig(r.args, r.getenv)
+	if err != nil {
+		log.Printf("not reloading: %v", err)
+		return
+	}
+	for _, key := range restartSettings(r.config, config) {
+		log.Printf("%v has changed but needs a restart to take effect", key)
+	}
+	// whatever the proxy serves is kept, it's only refreshed from upstream
+	var proxied *Database
+	if len(r.config.Proxy) > 0 {
+		database, _ := r.library.database(1)
+		proxied = &database
+	}
+	databases, err := servedDatabases(config, proxied)
+	if err != nil {
+		log.Printf("not reloading: %v", err)
+		return
+	}
+
+	setShare(config.share())
+	r.library.setDatabases(databases)
+	if r.scanner != nil && proxied == nil {
+		r.scanner.setLibraries(config.Libraries)
+	}
+	r.config = config
+}
+
+// restartSettings lists the settings that differ between two configurations
+// but are only read at startup.
+func restartSettings(old, new Config) []string {
+	changed := []string{}
+	if old.Port != new.Port {
+		changed = append(changed, "port")
+	}
+	if old.AdminPort != new.AdminPort {
+		changed = append(changed, "admin_port")
+	}
+	if old.IdleTimeout != new.IdleTimeout {
+		changed = append(changed, "idle_timeout")
+	}
+	if old.ShutdownTimeout != new.ShutdownTimeout {
+		changed = append(changed, "shutdown_timeout")
+	}
+	if old.DataDir != new.DataDir {
+		changed = append(changed, "data_dir")
+	}
+	if old.CacheSize != new.CacheSize {
+		changed = append(changed, "cache_size")
+	}
+	if old.AccessLog != new.AccessLog || old.AccessLogMaxSize != new.AccessLogMaxSize || old.AccessLogBackups != new.AccessLogBackups {
+		changed = append(changed, "access_log")
+	}
+	if old.LogFormat != new.LogFormat || old.LogLevel != new.LogLevel {
+		changed = append(changed, "log_format and log_level")
+	}
+	if !reflect.DeepEqual(old.Proxy, new.Proxy) {
+		changed = append(changed, "proxy")
+	}
+	return changed
+}
+
+// servedDatabases scans the configured library roots and loads the radio
+// stations. When proxying, the proxied database takes the place of the
+// libraries.
+func servedDatabases(config Config, proxied *Database) ([]Database, error) {
+	served := []Database{}
+	if proxied != nil {
+		served = append(served, *proxied)
+	} else {
+		for _, library := range config.Libraries {
+			start := time.Now()
+			database, err := scanLibrary(library)
+			serverMetrics.scanned(library.Name, time.Since(start), err)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("serving %v songs from %v as %v", len(database.songs), library.Root, library.Name)
+			served = append(served, database)
+		}
+	}
+	if config.Radio != "" {
+		stations, err := loadStations(config.Radio)
+		if err != nil {
+			return nil, err
+		}
+		served = append(served, radioDatabase("Radio", stations, config.RadioRelay))
+	}
+	return served, nil
+}
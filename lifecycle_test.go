@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunDrainsStreams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streaming := make(chan struct{})
+	finish := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first half "))
+		w.(http.Flusher).Flush()
+		close(streaming)
+		<-finish
+		w.Write([]byte("second half"))
+	})}
+
+	signals := make(chan os.Signal, 1)
+	reloaded := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(server, listener, signals, func() { reloaded <- struct{}{} }, 5*time.Second)
+	}()
+
+	signals <- syscall.SIGHUP
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("SIGHUP didn't reload")
+	}
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	<-streaming
+
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		t.Fatalf("returned before the stream finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(finish)
+	if got := <-body; got != "first half second half" {
+		t.Errorf("stream was cut short: %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("still accepting connections")
+	}
+}
+
+func TestRunGivesUpOnSlowStreams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streaming := make(chan struct{})
+	finish := make(chan struct{})
+	defer close(finish)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(streaming)
+		<-finish
+	})}
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(server, listener, signals, func() {}, 50*time.Millisecond)
+	}()
+	go http.Get("http://" + listener.Addr().String())
+	<-streaming
+
+	signals <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't give up waiting for the stream")
+	}
+}
+
+func TestRunStopsDuringReload(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	signals := make(chan os.Signal, 1)
+	reloads := make(chan struct{}, 2)
+	finish := make(chan struct{})
+	defer close(finish)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(server, listener, signals, func() {
+			reloads <- struct{}{}
+			<-finish
+		}, time.Second)
+	}()
+
+	signals <- syscall.SIGHUP
+	<-reloads
+	// a second SIGHUP doesn't start another reload while one is running
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM ignored while reloading")
+	}
+	if len(reloads) != 0 {
+		t.Error("reloaded twice at once")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "music")
+	if err := os.MkdirAll(filepath.Join(root, "Artist", "Album"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "Artist", "Album", "01 Song.mp3"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "audioserve.toml")
+	writeConfig := func(name, library string) {
+		file := "name = \"" + name + "\"\ndata_dir = \"" + dir + "\"\n[[library]]\nname = \"" + library + "\"\nroot = \"" + root + "\"\n"
+		if err := ioutil.WriteFile(configPath, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("before", "Music")
+	args := []string{"-config", configPath}
+	getenv := func(string) string { return "" }
+	config, err := loadConfig(args, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := servedDatabases(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	library := newLibrary(served)
+	defer setShare(currentShare())
+	setShare(config.share())
+	r := &reloader{args: args, getenv: getenv, config: config, library: library}
+
+	writeConfig("after", "Songs")
+	r.reload()
+	if currentShare().name != "after" {
+		t.Errorf("share name wasn't reloaded: %v", currentShare().name)
+	}
+	if database, _ := library.database(1); database.name != "Songs" || len(database.songs) != 1 {
+		t.Errorf("library wasn't reloaded: %+v", database)
+	}
+	if library.revision() != 2 {
+		t.Errorf("revision should move on so clients refresh: %v", library.revision())
+	}
+
+	// a broken config is ignored
+	if err := ioutil.WriteFile(configPath, []byte("port = \"http\""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.reload()
+	if currentShare().name != "after" || library.revision() != 2 {
+		t.Error("broken config was applied")
+	}
+}
+
+func TestUpdateReleasedOnShutdown(t *testing.T) {
+	library := newLibrary([]Database{{name: "testdb"}})
+	router := routes(nil, library, nil, nil, nil)
+	server := &http.Server{Handler: router}
+	server.RegisterOnShutdown(library.close)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	go run(server, listener, signals, func() {}, 5*time.Second)
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/update?session-id=113&revision-number=1&delta=1")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	signals <- syscall.SIGTERM
+	select {
+	case got := <-status:
+		if got != http.StatusServiceUnavailable {
+			t.Errorf("wrong status: %v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("update still waiting after shutdown")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MediaKind is com.apple.itunes.mediakind, which iTunes uses to put items in
+// its Music, Podcasts, Audiobooks and video sections.
+type MediaKind byte
+
+const MediaKindMusic MediaKind = 1
+const MediaKindMovie MediaKind = 2
+const MediaKindPodcast MediaKind = 4
+const MediaKindAudiobook MediaKind = 8
+const MediaKindMusicVideo MediaKind = 32
+const MediaKindTVShow MediaKind = 64
+
+var mediaKindNames = map[string]MediaKind{
+	"music":      MediaKindMusic,
+	"movie":      MediaKindMovie,
+	"podcast":    MediaKindPodcast,
+	"audiobook":  MediaKindAudiobook,
+	"musicvideo": MediaKindMusicVideo,
+	"tvshow":     MediaKindTVShow,
+}
+
+func parseMediaKind(s string) (MediaKind, error) {
+	kind, ok := mediaKindNames[strings.ToLower(strings.Replace(s, " ", "", -1))]
+	if !ok {
+		return 0, fmt.Errorf("unknown media kind '%v'", s)
+	}
+	return kind, nil
+}
+
+// specialContainers are the playlists iTunes shows as sections of the
+// library rather than as playlists, with their com.apple.itunes.special-playlist
+// ids. Music isn't one, as it's the library itself.
+var specialContainers = []struct {
+	kind    MediaKind
+	name    string
+	special byte
+}{
+	{MediaKindPodcast, "Podcasts", 1},
+	{MediaKindAudiobook, "Audiobooks", 7},
+	{MediaKindMovie, "Movies", 4},
+	{MediaKindTVShow, "TV Shows", 5},
+}
+
+// folderKinds classify songs by the name of a folder they're in.
+var folderKinds = map[string]MediaKind{
+	"podcasts":     MediaKindPodcast,
+	"audiobooks":   MediaKindAudiobook,
+	"music videos": MediaKindMusicVideo,
+	"movies":       MediaKindMovie,
+	"tv shows":     MediaKindTVShow,
+}
+
+// stikKinds map the stik tag of MP4 files to media kinds.
+var stikKinds = map[byte]MediaKind{
+	1:  MediaKindMusic,
+	2:  MediaKindAudiobook,
+	6:  MediaKindMusicVideo,
+	9:  MediaKindMovie,
+	10: MediaKindTVShow,
+	21: MediaKindPodcast,
+}
+
+// kind is a song's media kind, which is music unless it was classified as
+// something else.
+func (s Song) kind() MediaKind {
+	if s.MediaKind == 0 {
+		return MediaKindMusic
+	}
+	return s.MediaKind
+}
+
+// classify works out a song's media kind. Tags win, then the library's own
+// kind, then the genre, the folders it's in and finally the file format.
+func classify(song Song, tags mp4Tags, libraryKind MediaKind) MediaKind {
+	switch {
+	case tags.podcast:
+		return MediaKindPodcast
+	case stikKinds[tags.stik] != 0:
+		return stikKinds[tags.stik]
+	case libraryKind != 0:
+		return libraryKind
+	}
+	switch strings.ToLower(song.Genre) {
+	case "podcast", "podcasts":
+		return MediaKindPodcast
+	case "audiobook", "audiobooks":
+		return MediaKindAudiobook
+	}
+	for dir := filepath.Dir(song.Path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if kind, ok := folderKinds[strings.ToLower(filepath.Base(dir))]; ok {
+			return kind
+		}
+	}
+	if song.format() == "m4b" {
+		return MediaKindAudiobook
+	}
+	return MediaKindMusic
+}
+
+// mp4Tags are the iTunes tags in an MP4 file that matter for media kinds,
+// albums, searching and sorting.
+type mp4Tags struct {
+	stik        byte
+	podcast     bool
+	genre       string
+	composer    string
+	category    string
+	description string
+	released    time.Time
+	albumTags
+}
+
+// mp4AlbumAtoms are where MP4 files keep the album artist and sort names.
+// The compilation flag and disc number are binary, see readMP4Tags.
+var mp4AlbumAtoms = map[string]func(t *albumTags, value string){
+	"aART": func(t *albumTags, v string) { t.albumArtist = v },
+	"soar": func(t *albumTags, v string) { t.sortArtist = v },
+	"soal": func(t *albumTags, v string) { t.sortAlbum = v },
+	"sonm": func(t *albumTags, v string) { t.sortName = v },
+	"soaa": func(t *albumTags, v string) { t.sortAlbumArtist = v },
+}
+
+// readMP4Tags reads the moov.udta.meta.ilst atoms of an MP4 file, ignoring
+// everything but the tags in mp4Tags.
+func readMP4Tags(r io.ReadSeeker) (mp4Tags, error) {
+	tags := mp4Tags{}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return tags, err
+	}
+	ilst, ilstEnd, err := findAtom(r, 0, end, "moov", "udta", "meta", "ilst")
+	if err != nil {
+		return tags, err
+	}
+	for offset := ilst; offset+8 <= ilstEnd; {
+		name, size, err := readAtomHeader(r, offset)
+		if err != nil {
+			return tags, err
+		}
+		if size < 8 || offset+size > ilstEnd {
+			return tags, fmt.Errorf("bad %q atom size %v", name, size)
+		}
+		// each tag holds a data atom: type and locale, then the value
+		if size > 24 && (name == "stik" || name == "pcst" || name == "\xa9gen" || name == "\xa9wrt" || name == "catg" || name == "desc" || name == "\xa9day" || name == "cpil" || name == "disk" || mp4AlbumAtoms[name] != nil) {
+			value := make([]byte, size-24)
+			if _, err := r.Seek(offset+24, io.SeekStart); err != nil {
+				return tags, err
+			}
+			if _, err := io.ReadFull(r, value); err != nil {
+				return tags, err
+			}
+			switch name {
+			case "stik":
+				tags.stik = value[len(value)-1]
+			case "pcst":
+				tags.podcast = value[len(value)-1] != 0
+			case "\xa9gen":
+				tags.genre = string(value)
+			case "\xa9wrt":
+				tags.composer = string(value)
+			case "catg":
+				tags.category = string(value)
+			case "desc":
+				tags.description = string(value)
+			case "\xa9day":
+				tags.released = parseReleaseDate(string(value))
+			case "cpil":
+				tags.compilation = value[len(value)-1] != 0
+			case "disk":
+				// padding, then the disc number and count
+				if len(value) >= 4 {
+					tags.disc = int(binary.BigEndian.Uint16(value[2:4]))
+				}
+			default:
+				mp4AlbumAtoms[name](&tags.albumTags, string(value))
+			}
+		}
+		offset += size
+	}
+	return tags, nil
+}
+
+// findAtom follows a path of nested atoms, returning where the contents of
+// the last one start and end.
+func findAtom(r io.ReadSeeker, start int64, end int64, path ...string) (int64, int64, error) {
+	for offset := start; offset+8 <= end; {
+		name, size, err := readAtomHeader(r, offset)
+		if err != nil {
+			return 0, 0, err
+		}
+		if size < 8 || offset+size > end {
+			return 0, 0, fmt.Errorf("bad %q atom size %v", name, size)
+		}
+		if name == path[0] {
+			contents := offset + 8
+			if name == "meta" {
+				// meta has a version and flags before its children
+				contents += 4
+			}
+			if len(path) == 1 {
+				return contents, offset + size, nil
+			}
+			return findAtom(r, contents, offset+size, path[1:]...)
+		}
+		offset += size
+	}
+	return 0, 0, fmt.Errorf("no %v atom", path[0])
+}
+
+func readAtomHeader(r io.ReadSeeker, offset int64) (string, int64, error) {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", 0, err
+	}
+	return string(header[4:]), int64(binary.BigEndian.Uint32(header[:4])), nil
+}
+
+// parseReleaseDate reads the dates found in tags, which may be a full
+// timestamp, a day or only a year.
+func parseReleaseDate(s string) time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// mp4Formats are the formats readMP4Tags understands.
+var mp4Formats = map[string]bool{"m4a": true, "m4b": true, "m4v": true, "mp4": true}
+
+// classifyFile fills in the media kind of a scanned song, along with the
+// details, album tags and sort names from its tags.
+func classifyFile(song Song, libraryKind MediaKind) Song {
+	tags := mp4Tags{}
+	if mp4Formats[song.format()] {
+		f, err := os.Open(song.Path)
+		if err == nil {
+			tags, _ = readMP4Tags(f)
+			f.Close()
+		}
+	} else {
+		tags.albumTags = readAlbumTags(song)
+	}
+	song = tags.albumTags.apply(song)
+	if tags.genre != "" {
+		song.Genre = tags.genre
+	}
+	song.Composer = tags.composer
+	song.Category = tags.category
+	song.Description = tags.description
+	song.DateReleased = tags.released
+	song.MediaKind = classify(song, tags, libraryKind)
+	return song
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func atom(name string, contents ...[]byte) []byte {
+	data := bytes.Join(contents, nil)
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(8+len(data)))
+	copy(header[4:], name)
+	return append(header, data...)
+}
+
+// tagAtom is an ilst entry holding a data atom with a value.
+func tagAtom(name string, value []byte) []byte {
+	return atom(name, atom("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, value))
+}
+
+func mp4File(tags ...[]byte) []byte {
+	return bytes.Join([][]byte{
+		atom("ftyp", []byte("M4A \x00\x00\x00\x00")),
+		atom("moov",
+			atom("mvhd", make([]byte, 100)),
+			atom("udta",
+				atom("meta", []byte{0, 0, 0, 0},
+					atom("hdlr", make([]byte, 25)),
+					atom("ilst", tags...),
+				),
+			),
+		),
+		atom("mdat", []byte("audio")),
+	}, nil)
+}
+
+func TestReadMP4Tags(t *testing.T) {
+	data := mp4File(
+		tagAtom("\xa9nam", []byte("Episode 1")),
+		tagAtom("stik", []byte{21}),
+		tagAtom("pcst", []byte{1}),
+		tagAtom("\xa9gen", []byte("Podcast")),
+		tagAtom("catg", []byte("Technology")),
+		tagAtom("desc", []byte("The first one")),
+		tagAtom("\xa9day", []byte("2019-05-06T07:08:09Z")),
+		tagAtom("\xa9wrt", []byte("Some Composer")),
+		tagAtom("aART", []byte("The Hosts")),
+		tagAtom("soar", []byte("Host, The")),
+		tagAtom("soal", []byte("Show")),
+		tagAtom("sonm", []byte("Episode 01")),
+		tagAtom("soaa", []byte("Hosts")),
+		tagAtom("cpil", []byte{1}),
+		tagAtom("disk", []byte{0, 0, 0, 2, 0, 3}),
+	)
+	tags, err := readMP4Tags(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mp4Tags{
+		stik:        21,
+		podcast:     true,
+		genre:       "Podcast",
+		category:    "Technology",
+		description: "The first one",
+		released:    time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC),
+		composer:    "Some Composer",
+		albumTags: albumTags{
+			albumArtist:     "The Hosts",
+			compilation:     true,
+			disc:            2,
+			sortArtist:      "Host, The",
+			sortAlbum:       "Show",
+			sortName:        "Episode 01",
+			sortAlbumArtist: "Hosts",
+		},
+	}
+	if tags != want {
+		t.Errorf("wrong tags, want %+v, got %+v", want, tags)
+	}
+
+	if _, err := readMP4Tags(bytes.NewReader([]byte("ID3 not an mp4 at all"))); err == nil {
+		t.Error("expected an error for a file that isn't MP4")
+	}
+	if _, err := readMP4Tags(bytes.NewReader(atom("moov", atom("udta")))); err == nil {
+		t.Error("expected an error for a file without tags")
+	}
+}
+
+func TestParseReleaseDate(t *testing.T) {
+	tests := map[string]time.Time{
+		"2019-05-06T07:08:09Z": time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC),
+		"2019-05-06":           time.Date(2019, 5, 6, 0, 0, 0, 0, time.UTC),
+		"1997":                 time.Date(1997, 1, 1, 0, 0, 0, 0, time.UTC),
+		"last tuesday":         {},
+	}
+	for in, want := range tests {
+		if got := parseReleaseDate(in); !got.Equal(want) {
+			t.Errorf("wrong date for '%v', want %v, got %v", in, want, got)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		song        Song
+		tags        mp4Tags
+		libraryKind MediaKind
+		want        MediaKind
+	}{
+		{Song{Path: "/music/a.mp3"}, mp4Tags{}, 0, MediaKindMusic},
+		{Song{Path: "/music/a.m4a"}, mp4Tags{podcast: true}, MediaKindMusic, MediaKindPodcast},
+		{Song{Path: "/music/a.m4a"}, mp4Tags{stik: 6}, 0, MediaKindMusicVideo},
+		{Song{Path: "/music/a.mp3"}, mp4Tags{}, MediaKindAudiobook, MediaKindAudiobook},
+		{Song{Path: "/music/a.mp3", Genre: "Podcast"}, mp4Tags{}, 0, MediaKindPodcast},
+		{Song{Path: "/srv/Podcasts/Show/a.mp3"}, mp4Tags{}, 0, MediaKindPodcast},
+		{Song{Path: "/srv/TV Shows/a.m4v"}, mp4Tags{}, 0, MediaKindTVShow},
+		{Song{Path: "/books/a.m4b"}, mp4Tags{}, 0, MediaKindAudiobook},
+	}
+	for _, test := range tests {
+		if got := classify(test.song, test.tags, test.libraryKind); got != test.want {
+			t.Errorf("wrong kind for %+v %+v %v, want %v, got %v", test.song, test.tags, test.libraryKind, test.want, got)
+		}
+	}
+}
+
+func TestScanMediaKinds(t *testing.T) {
+	root := t.TempDir()
+	files := map[string][]byte{
+		"Music/Artist/Album/01 Song.mp3": []byte("audio"),
+		"Podcasts/Show/Episode.m4a": mp4File(
+			tagAtom("pcst", []byte{1}),
+			tagAtom("desc", []byte("about things")),
+		),
+		"Books/A Book.m4b": []byte("audio"),
+	}
+	for file, data := range files {
+		path := filepath.Join(root, file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database, err := scanLibrary(LibraryConfig{Name: "Everything", Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]MediaKind{}
+	for _, song := range database.songs {
+		kinds[song.Title] = song.kind()
+	}
+	want := map[string]MediaKind{"Song": MediaKindMusic, "Episode": MediaKindPodcast, "A Book": MediaKindAudiobook}
+	for title, kind := range want {
+		if kinds[title] != kind {
+			t.Errorf("wrong kind for %v, want %v, got %v", title, kind, kinds[title])
+		}
+	}
+	for _, song := range database.songs {
+		if song.Title == "Episode" && song.Description != "about things" {
+			t.Errorf("description not read: %+v", song)
+		}
+	}
+
+	config, err := parseLibraryConfig(root + "=" + root + ";kind=music video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Kind != MediaKindMusicVideo {
+		t.Errorf("wrong library kind: %v", config.Kind)
+	}
+	if _, err := parseLibraryConfig("Music=/srv/music;kind=opera"); err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+}
+
+func TestSpecialContainers(t *testing.T) {
+	var databases = []Database{
+		{name: "testdb", songs: []Song{
+			{Title: "a song"},
+			{Title: "an episode", MediaKind: MediaKindPodcast, Description: "about things", DateReleased: time.Unix(1000, 0)},
+			{Title: "a book", MediaKind: MediaKindAudiobook},
+			{Title: "another episode", MediaKind: MediaKindPodcast},
+		}},
+	}
+	router := routes(nil, newLibrary(databases), nil, nil, nil)
+
+	req, err := http.NewRequest("GET", "/databases/1/containers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	expectedData := []byte{
+		97, 112, 108, 121, 0, 0, 0, 12 + 9 + 12 + 12 + 8 + 73 + 75, // aply
+		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
+		109, 117, 116, 121, 0, 0, 0, 1, 0, // muty
+		109, 116, 99, 111, 0, 0, 0, 4, 0, 0, 0, 2, // mtco
+		109, 114, 99, 111, 0, 0, 0, 4, 0, 0, 0, 2, // mrco
+		109, 108, 99, 108, 0, 0, 0, 73 + 75, // mlcl
+		109, 108, 105, 116, 0, 0, 0, 65, // mlit
+		109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 0, 1, // miid
+		109, 112, 101, 114, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 1, // mper
+		109, 105, 110, 109, 0, 0, 0, 8, 'P', 'o', 'd', 'c', 'a', 's', 't', 's', // minm
+		109, 105, 109, 99, 0, 0, 0, 4, 0, 0, 0, 2, // mimc
+		97, 101, 80, 83, 0, 0, 0, 1, 1, // aePS
+		109, 108, 105, 116, 0, 0, 0, 67, // mlit
+		109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 0, 2, // miid
+		109, 112, 101, 114, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 2, // mper
+		109, 105, 110, 109, 0, 0, 0, 10, 'A', 'u', 'd', 'i', 'o', 'b', 'o', 'o', 'k', 's', // minm
+		109, 105, 109, 99, 0, 0, 0, 4, 0, 0, 0, 1, // mimc
+		97, 101, 80, 83, 0, 0, 0, 1, 7, // aePS
+	}
+	if !bytes.Equal(resp.Body.Bytes(), expectedData) {
+		t.Errorf("response body doesn't match:\n%v\nwant:\n%v", resp.Body.Bytes(), expectedData)
+	}
+
+	req, err = http.NewRequest("GET", "/databases/1/containers/1/items?meta=dmap.itemid,com.apple.itunes.mediakind,daap.songdescription,daap.songdatereleased", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	episode := []byte{
+		109, 108, 105, 116, 0, 0, 0, 12 + 9 + 20 + 12, // mlit
+		109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 0, 2, // miid
+		97, 101, 77, 75, 0, 0, 0, 1, 4, // aeMK
+		97, 115, 100, 116, 0, 0, 0, 12, 'a', 'b', 'o', 'u', 't', ' ', 't', 'h', 'i', 'n', 'g', 's', // asdt
+		97, 115, 100, 114, 0, 0, 0, 4, 0, 0, 3, 232, // asdr
+	}
+	if !bytes.Contains(resp.Body.Bytes(), episode) {
+		t.Errorf("episode missing from podcasts:\n%v", resp.Body.Bytes())
+	}
+	if bytes.Contains(resp.Body.Bytes(), []byte{109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 0, 1}) {
+		t.Errorf("song in podcasts:\n%v", resp.Body.Bytes())
+	}
+}
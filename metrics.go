@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets.
+var requestBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// serverMetrics counts what the server is doing, for /metrics on the admin
+// port.
+var serverMetrics = newMetrics()
+
+type requestKey struct {
+	route  string
+	status int
+}
+
+type histogram struct {
+	counts []int64 // one per bucket, not cumulative
+	sum    float64
+	count  int64
+}
+
+// Metrics collects request, session, stream and scan metrics and writes
+// them in the Prometheus text format.
+type Metrics struct {
+	mu          sync.Mutex
+	requests    map[requestKey]int64
+	latencies   map[string]*histogram
+	scanSeconds map[string]float64
+	scanErrors  int64
+
+	streamBytes   int64
+	activeStreams int64
+
+	// looked at when scraped
+	library  *Library
+	cache    *responseCache
+	sessions *Sessions
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		requests:    map[requestKey]int64{},
+		latencies:   map[string]*histogram{},
+		scanSeconds: map[string]float64{},
+	}
+}
+
+// watch has the library, cache and sessions reported when metrics are
+// scraped.
+func (m *Metrics) watch(library *Library, cache *responseCache, sessions *Sessions) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.library = library
+	m.cache = cache
+	m.sessions = sessions
+}
+
+// instrument counts requests to a route by status and how long they take.
+// route is the pattern, not the path, so songs don't each get their own
+// series.
+func (m *Metrics) instrument(route string, inner http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		inner(rw, r)
+		m.observe(route, rw.status, time.Since(start))
+	})
+}
+
+// instrumentStream also counts the request as an active stream while it runs
+// and the bytes sent.
+func (m *Metrics) instrumentStream(route string, inner http.HandlerFunc) http.HandlerFunc {
+	return m.instrument(route, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&m.activeStreams, 1)
+		defer atomic.AddInt64(&m.activeStreams, -1)
+		inner(&countingWriter{statusWriter: w.(*statusWriter), bytes: &m.streamBytes}, r)
+	})
+}
+
+func (m *Metrics) observe(route string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route, status}]++
+
+	h, ok := m.latencies[route]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(requestBuckets))}
+		m.latencies[route] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range requestBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// scanned records how long a library took to scan, and whether it failed.
+func (m *Metrics) scanned(name string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scanSeconds[name] = elapsed.Seconds()
+	if err != nil {
+		m.scanErrors++
+	}
+}
+
+// write writes every metric in the Prometheus text exposition format.
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].status < keys[j].status
+	})
+	writeHeader(w, "daap_requests_total", "counter", "Requests handled, by route and status.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "daap_requests_total{route=%q,status=\"%d\"} %d\n", key.route, key.status, m.requests[key])
+	}
+
+	writeHeader(w, "daap_request_duration_seconds", "histogram", "How long requests took, by route.")
+	routes := []string{}
+	for route := range m.latencies {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		h := m.latencies[route]
+		cumulative := int64(0)
+		for i, bound := range requestBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "daap_request_duration_seconds_bucket{route=%q,le=\"%v\"} %d\n", route, bound, cumulative)
+		}
+		fmt.Fprintf(w, "daap_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(w, "daap_request_duration_seconds_sum{route=%q} %v\n", route, h.sum)
+		fmt.Fprintf(w, "daap_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+
+	if m.sessions != nil {
+		writeHeader(w, "daap_active_sessions", "gauge", "Clients seen within the session timeout.")
+		fmt.Fprintf(w, "daap_active_sessions %d\n", len(m.sessions.active()))
+	}
+
+	writeHeader(w, "daap_active_streams", "gauge", "Songs being streamed.")
+	fmt.Fprintf(w, "daap_active_streams %d\n", atomic.LoadInt64(&m.activeStreams))
+	writeHeader(w, "daap_stream_bytes_total", "counter", "Bytes of songs streamed.")
+	fmt.Fprintf(w, "daap_stream_bytes_total %d\n", atomic.LoadInt64(&m.streamBytes))
+
+	writeHeader(w, "daap_library_songs", "gauge", "Songs in each database.")
+	for i, database := range m.library.databases() {
+		fmt.Fprintf(w, "daap_library_songs{database=%q,id=\"%d\"} %d\n", database.name, i+1, len(database.songs))
+	}
+	writeHeader(w, "daap_library_revision", "gauge", "The library revision clients are told about.")
+	if m.library != nil {
+		fmt.Fprintf(w, "daap_library_revision %d\n", m.library.revision())
+	}
+
+	writeHeader(w, "daap_scan_duration_seconds", "gauge", "How long the last scan of each library took.")
+	libraries := []string{}
+	for name := range m.scanSeconds {
+		libraries = append(libraries, name)
+	}
+	sort.Strings(libraries)
+	for _, name := range libraries {
+		fmt.Fprintf(w, "daap_scan_duration_seconds{library=%q} %v\n", name, m.scanSeconds[name])
+	}
+	writeHeader(w, "daap_scan_errors_total", "counter", "Library scans that failed.")
+	fmt.Fprintf(w, "daap_scan_errors_total %d\n", m.scanErrors)
+
+	if m.cache != nil {
+		hits, misses, size := m.cache.stats()
+		writeHeader(w, "daap_cache_hits_total", "counter", "Item listings served from the cache.")
+		fmt.Fprintf(w, "daap_cache_hits_total %d\n", hits)
+		writeHeader(w, "daap_cache_misses_total", "counter", "Item listings that had to be encoded.")
+		fmt.Fprintf(w, "daap_cache_misses_total %d\n", misses)
+		writeHeader(w, "daap_cache_bytes", "gauge", "Memory used by cached item listings.")
+		fmt.Fprintf(w, "daap_cache_bytes %d\n", size)
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// metricsHandler serves /metrics.
+func metricsHandler(m *Metrics) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+}
+
+// adminRoutes serves the admin port, kept apart from the DAAP port so it
+// needn't be exposed to the network clients are on.
+func adminRoutes(m *Metrics) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(m))
+	return mux
+}
+
+// statusWriter remembers the status a handler responds with and how much it
+// wrote.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countingWriter adds the bytes of audio written to a counter as they go, so
+// long streams show up before they finish. Error messages aren't counted.
+type countingWriter struct {
+	*statusWriter
+	bytes *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.statusWriter.Write(p)
+	if w.status < 300 {
+		atomic.AddInt64(w.bytes, int64(n))
+	}
+	return n, err
+}
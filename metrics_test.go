@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	defer func(m *Metrics) { serverMetrics = m }(serverMetrics)
+	serverMetrics = newMetrics()
+
+	dir := t.TempDir()
+	path := dir + "/song.mp3"
+	if err := ioutil.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	library := newLibrary([]Database{{name: "testdb", songs: []Song{{Title: "a", Path: path}}}})
+	router := routes(nil, library, nil, nil, nil)
+	for _, uri := range []string{
+		"/server-info",
+		"/databases?session-id=7",
+		"/databases/1/items?session-id=7&meta=dmap.itemid",
+		"/databases/1/items?session-id=7&meta=dmap.itemid",
+		"/databases/1/items/1.mp3?session-id=7",
+		"/databases/1/items/9.mp3?session-id=8",
+	} {
+		req := httptest.NewRequest("GET", uri, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serverMetrics.scanned("Music", 1500*time.Millisecond, nil)
+
+	var buf bytes.Buffer
+	serverMetrics.write(&buf)
+	got := buf.String()
+	for _, want := range []string{
+		`daap_requests_total{route="/server-info",status="200"} 1`,
+		`daap_requests_total{route="/databases/:itemId/items",status="200"} 2`,
+		`daap_requests_total{route="/databases/:itemId/items/:songId",status="404"} 1`,
+		`daap_request_duration_seconds_count{route="/databases/:itemId/items"} 2`,
+		`daap_request_duration_seconds_bucket{route="/databases",le="+Inf"} 1`,
+		"daap_active_sessions 2\n",
+		"daap_active_streams 0\n",
+		"daap_stream_bytes_total 10\n",
+		`daap_library_songs{database="testdb",id="1"} 1`,
+		`daap_scan_duration_seconds{library="Music"} 1.5`,
+		"daap_scan_errors_total 0\n",
+		"daap_cache_hits_total 1\n",
+		"daap_cache_misses_total 1\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %v in:\n%v", want, got)
+		}
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	rr := httptest.NewRecorder()
+	adminRoutes(newMetrics()).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("wrong response: %v %v", rr.Code, rr.Header())
+	}
+	if !strings.Contains(rr.Body.String(), "# TYPE daap_requests_total counter") {
+		t.Errorf("wrong body:\n%v", rr.Body.String())
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+// openAPIDocument describes the JSON API, served at /api/v1/openapi.json.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "audioserve",
+    "version": "1",
+    "description": "JSON view of the library served over DAAP. If the share has a password it is needed here too, with basic auth."
+  },
+  "servers": [{"url": "/api/v1"}],
+  "components": {
+    "securitySchemes": {
+      "password": {"type": "http", "scheme": "basic"}
+    },
+    "parameters": {
+      "databaseId": {"name": "databaseId", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1}},
+      "songId": {"name": "songId", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1}},
+      "playlistId": {"name": "playlistId", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1}},
+      "query": {"name": "query", "in": "query", "description": "DAAP query, e.g. 'daap.songartist:Radiohead'", "schema": {"type": "string"}},
+      "q": {"name": "q", "in": "query", "description": "songs with words starting with these words in their title, artist, album, composer or genre, ignoring case and accents", "schema": {"type": "string"}},
+      "artist": {"name": "artist", "in": "query", "description": "exact artist, ignoring case and accents", "schema": {"type": "string"}},
+      "album": {"name": "album", "in": "query", "description": "exact album, ignoring case and accents", "schema": {"type": "string"}},
+      "albumId": {"name": "album_id", "in": "query", "description": "songs on the album with this id", "schema": {"type": "string"}},
+      "genre": {"name": "genre", "in": "query", "description": "exact genre, ignoring case and accents", "schema": {"type": "string"}},
+      "kind": {"name": "kind", "in": "query", "description": "media kind", "schema": {"type": "string", "enum": ["music", "movie", "podcast", "audiobook", "musicvideo", "tvshow"]}},
+      "sort": {"name": "sort", "in": "query", "description": "comma separated fields, each descending if it starts with -. Names sort by their sort names, ignoring case and accents", "schema": {"type": "string", "example": "artist,album,track_number"}},
+      "offset": {"name": "offset", "in": "query", "schema": {"type": "integer", "minimum": 0, "default": 0}},
+      "limit": {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}}
+    },
+    "schemas": {
+      "Error": {"type": "object", "properties": {"error": {"type": "string"}}},
+      "Database": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "name": {"type": "string"},
+          "kind": {"type": "string", "enum": ["library", "radio"]},
+          "songs": {"type": "integer"},
+          "playlists": {"type": "integer"}
+        }
+      },
+      "Song": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "title": {"type": "string"},
+          "album": {"type": "string"},
+          "artist": {"type": "string"},
+          "genre": {"type": "string"},
+          "composer": {"type": "string"},
+          "album_artist": {"type": "string", "description": "the artist, or Various Artists on a compilation, unless tagged otherwise"},
+          "album_id": {"type": "string", "description": "the same for every song on the album, across rescans"},
+          "compilation": {"type": "boolean"},
+          "disc_number": {"type": "integer"},
+          "track_number": {"type": "integer"},
+          "duration_ms": {"type": "integer"},
+          "format": {"type": "string"},
+          "media_kind": {"type": "string"},
+          "rating": {"type": "integer", "minimum": 0, "maximum": 100},
+          "play_count": {"type": "integer"},
+          "skip_count": {"type": "integer"},
+          "last_played": {"type": "string", "format": "date-time"},
+          "stream_url": {"type": "string", "description": "path to stream the song from, on this server"}
+        }
+      },
+      "SongPage": {
+        "type": "object",
+        "properties": {
+          "total": {"type": "integer"},
+          "offset": {"type": "integer"},
+          "limit": {"type": "integer"},
+          "songs": {"type": "array", "items": {"$ref": "#/components/schemas/Song"}}
+        }
+      },
+      "Playlist": {
+        "type": "object",
+        "properties": {"id": {"type": "integer"}, "name": {"type": "string"}, "songs": {"type": "integer"}}
+      },
+      "Artist": {
+        "type": "object",
+        "properties": {"name": {"type": "string"}, "sort_name": {"type": "string", "description": "what the artist is sorted by"}, "albums": {"type": "integer"}, "songs": {"type": "integer"}}
+      },
+      "Album": {
+        "type": "object",
+        "description": "songs with the same album name and album artist, or name on a compilation, across all of its discs",
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string", "description": "without any disc number"},
+          "artist": {"type": "string", "description": "the album artist"},
+          "compilation": {"type": "boolean"},
+          "discs": {"type": "integer"},
+          "songs": {"type": "integer"}
+        }
+      },
+      "Stats": {
+        "type": "object",
+        "properties": {
+          "revision": {"type": "integer"},
+          "databases": {"type": "integer"},
+          "songs": {"type": "integer"},
+          "duration_ms": {"type": "integer"},
+          "plays": {"type": "integer"},
+          "skips": {"type": "integer"},
+          "rated": {"type": "integer"}
+        }
+      }
+    },
+    "responses": {
+      "BadRequest": {"description": "bad parameter", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "NotFound": {"description": "no such database, song or playlist", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    }
+  },
+  "security": [{}, {"password": []}],
+  "paths": {
+    "/databases": {
+      "get": {
+        "summary": "List databases",
+        "responses": {"200": {"description": "databases", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Database"}}}}}}
+      }
+    },
+    "/databases/{databaseId}/songs": {
+      "get": {
+        "summary": "List, filter, sort and page songs",
+        "parameters": [
+          {"$ref": "#/components/parameters/databaseId"},
+          {"$ref": "#/components/parameters/query"},
+          {"$ref": "#/components/parameters/q"},
+          {"$ref": "#/components/parameters/artist"},
+          {"$ref": "#/components/parameters/album"},
+          {"$ref": "#/components/parameters/albumId"},
+          {"$ref": "#/components/parameters/genre"},
+          {"$ref": "#/components/parameters/kind"},
+          {"$ref": "#/components/parameters/sort"},
+          {"$ref": "#/components/parameters/offset"},
+          {"$ref": "#/components/parameters/limit"}
+        ],
+        "responses": {
+          "200": {"description": "songs", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SongPage"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/databases/{databaseId}/songs/{songId}": {
+      "get": {
+        "summary": "Get a song",
+        "parameters": [{"$ref": "#/components/parameters/databaseId"}, {"$ref": "#/components/parameters/songId"}],
+        "responses": {
+          "200": {"description": "the song", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Song"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/databases/{databaseId}/playlists": {
+      "get": {
+        "summary": "List playlists",
+        "parameters": [{"$ref": "#/components/parameters/databaseId"}],
+        "responses": {
+          "200": {"description": "playlists", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Playlist"}}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/databases/{databaseId}/playlists/{playlistId}/songs": {
+      "get": {
+        "summary": "List, filter, sort and page the songs in a playlist",
+        "parameters": [
+          {"$ref": "#/components/parameters/databaseId"},
+          {"$ref": "#/components/parameters/playlistId"},
+          {"$ref": "#/components/parameters/query"},
+          {"$ref": "#/components/parameters/q"},
+          {"$ref": "#/components/parameters/artist"},
+          {"$ref": "#/components/parameters/album"},
+          {"$ref": "#/components/parameters/albumId"},
+          {"$ref": "#/components/parameters/genre"},
+          {"$ref": "#/components/parameters/kind"},
+          {"$ref": "#/components/parameters/sort"},
+          {"$ref": "#/components/parameters/offset"},
+          {"$ref": "#/components/parameters/limit"}
+        ],
+        "responses": {
+          "200": {"description": "songs", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SongPage"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/databases/{databaseId}/artists": {
+      "get": {
+        "summary": "List artists",
+        "parameters": [{"$ref": "#/components/parameters/databaseId"}],
+        "responses": {
+          "200": {"description": "artists", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Artist"}}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/databases/{databaseId}/albums": {
+      "get": {
+        "summary": "List albums, by or with songs by an artist",
+        "parameters": [{"$ref": "#/components/parameters/databaseId"}, {"$ref": "#/components/parameters/artist"}],
+        "responses": {
+          "200": {"description": "albums", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Album"}}}}},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/stats": {
+      "get": {
+        "summary": "Library totals",
+        "responses": {"200": {"description": "totals", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Stats"}}}}}
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {"200": {"description": "OpenAPI document"}}
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+var errNotPaired = errors.New("remote is not paired")
+
+// PairedDevice is a remote that has been paired with the server and may log in
+// with its pairing GUID.
+type PairedDevice struct {
+	GUID   uint64    `json:"guid"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Paired time.Time `json:"paired"`
+}
+
+// Pairings keeps the remotes paired with the server, saving them to a file so
+// they stay paired across restarts.
+type Pairings struct {
+	path string
+
+	mu          sync.RWMutex
+	ServiceName string          `json:"service_name"`
+	Devices     []*PairedDevice `json:"devices"`
+}
+
+// loadPairings reads the paired devices from path. A missing file is an empty
+// store, with a new service name that is saved along with the first pairing.
+func loadPairings(path string) (*Pairings, error) {
+	p := &Pairings{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		p.ServiceName, err = newServiceName()
+		return p, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("cannot read pairings from %v: %v", path, err)
+	}
+	if p.ServiceName == "" {
+		p.ServiceName, err = newServiceName()
+	}
+	return p, err
+}
+
+// newServiceName makes the 16 hex digit id the server tells remotes it pairs
+// with.
+func newServiceName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016X", b), nil
+}
+
+// add records a paired device, replacing any earlier pairing with the same
+// GUID, and saves the store.
+func (p *Pairings) add(device PairedDevice) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	devices := []*PairedDevice{}
+	for _, d := range p.Devices {
+		if d.GUID != device.GUID {
+			devices = append(devices, d)
+		}
+	}
+	p.Devices = append(devices, &device)
+	return p.save()
+}
+
+// save writes the store to a temporary file and renames it over the old one so
+// a crash doesn't lose the pairings. Callers must hold the lock.
+func (p *Pairings) save() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// paired finds the device with a pairing GUID. It is safe to call on a nil
+// store, which has no devices.
+func (p *Pairings) paired(guid uint64) (PairedDevice, bool) {
+	if p == nil {
+		return PairedDevice{}, false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, d := range p.Devices {
+		if d.GUID == guid {
+			return *d, true
+		}
+	}
+	return PairedDevice{}, false
+}
+
+// parsePairingGUID reads a pairing GUID as sent in the pairing-guid parameter,
+// e.g. 0x0000000000000001.
+func parsePairingGUID(s string) (uint64, error) {
+	s = strings.ToLower(s)
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+}
+
+// pairingCode is the hash the remote expects to be sent back, proving the PIN
+// it shows was entered. It is the MD5 of the remote's pair code followed by
+// each digit of the PIN as a UTF-16LE character.
+func pairingCode(pairCode string, pin string) string {
+	data := []byte(pairCode)
+	for _, digit := range pin {
+		data = append(data, byte(digit), 0)
+	}
+	return fmt.Sprintf("%X", md5.Sum(data))
+}
+
+// pair completes pairing with a remote, whose address is the host and port it
+// advertises, once the user has entered the PIN shown on the remote.
+func (p *Pairings) pair(ctx context.Context, client *http.Client, remote string, pairCode string, pin string) (PairedDevice, error) {
+	if len(pin) != 4 || strings.Trim(pin, "0123456789") != "" {
+		return PairedDevice{}, fmt.Errorf("pin '%v' must be 4 digits", pin)
+	}
+	p.mu.RLock()
+	serviceName := p.ServiceName
+	p.mu.RUnlock()
+
+	query := url.Values{}
+	query.Set("pairingcode", pairingCode(pairCode, pin))
+	query.Set("servicename", serviceName)
+	req, err := http.NewRequest("GET", "http://"+remote+"/pair?"+query.Encode(), nil)
+	if err != nil {
+		return PairedDevice{}, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return PairedDevice{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// remotes answer a wrong PIN with 404
+		return PairedDevice{}, fmt.Errorf("pairing with %v failed: %v", remote, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return PairedDevice{}, err
+	}
+	tags, err := daap.Decode(data, map[string]bool{"cmpa": true})
+	if err != nil {
+		return PairedDevice{}, err
+	}
+	if len(tags) != 1 || tags[0].Code != "cmpa" {
+		return PairedDevice{}, fmt.Errorf("unexpected pairing response from %v", remote)
+	}
+	guid, ok := tags[0].Find("cmpg")
+	if !ok || len(guid.Data) != 8 {
+		return PairedDevice{}, fmt.Errorf("no pairing guid from %v", remote)
+	}
+	device := PairedDevice{
+		GUID:   binary.BigEndian.Uint64(guid.Data),
+		Paired: time.Now(),
+	}
+	if name, ok := tags[0].Find("cmnm"); ok {
+		device.Name = name.Text()
+	}
+	if kind, ok := tags[0].Find("cmty"); ok {
+		device.Type = kind.Text()
+	}
+	return device, p.add(device)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPairingCode(t *testing.T) {
+	want := fmt.Sprintf("%X", md5.Sum([]byte("0000000000000001"+"1\x002\x003\x004\x00")))
+	if got := pairingCode("0000000000000001", "1234"); got != want {
+		t.Errorf("wrong pairing code, want %v, got %v", want, got)
+	}
+}
+
+func TestParsePairingGUID(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+	}{
+		{"0x0000000000000001", 1},
+		{"0X00000000DEADBEEF", 0xdeadbeef},
+		{"FFFFFFFFFFFFFFFF", 0xffffffffffffffff},
+	}
+	for _, test := range tests {
+		got, err := parsePairingGUID(test.in)
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", test.in, err)
+		}
+		if got != test.want {
+			t.Errorf("wrong guid for %v, want %v, got %v", test.in, test.want, got)
+		}
+	}
+	if _, err := parsePairingGUID("0xnothex"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// standInRemote answers /pair the way a remote app does once the user has
+// entered its PIN on the server.
+func standInRemote(t *testing.T, pairCode string, pin string, serviceName *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pair" || r.URL.Query().Get("pairingcode") != pairingCode(pairCode, pin) {
+			http.NotFound(w, r)
+			return
+		}
+		*serviceName = r.URL.Query().Get("servicename")
+		data := []byte{
+			99, 109, 112, 97, 0, 0, 0, 45, // cmpa
+			99, 109, 112, 103, 0, 0, 0, 8, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, // cmpg
+			99, 109, 110, 109, 0, 0, 0, 6, 'i', 'P', 'h', 'o', 'n', 'e', // cmnm
+			99, 109, 116, 121, 0, 0, 0, 7, 'i', 'P', 'h', 'o', 'n', 'e', '9', // cmty
+		}
+		w.Write(data)
+	}))
+}
+
+func TestPair(t *testing.T) {
+	var serviceName string
+	remote := standInRemote(t, "ABCDEF0123456789", "4321", &serviceName)
+	defer remote.Close()
+	host := strings.TrimPrefix(remote.URL, "http://")
+
+	path := filepath.Join(t.TempDir(), "pairings.json")
+	pairings, err := loadPairings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pairings.pair(context.Background(), http.DefaultClient, host, "ABCDEF0123456789", "1111"); err == nil {
+		t.Error("expected pairing with the wrong pin to fail")
+	}
+	if _, err := pairings.pair(context.Background(), http.DefaultClient, host, "ABCDEF0123456789", "12345"); err == nil {
+		t.Error("expected pairing with a 5 digit pin to fail")
+	}
+
+	device, err := pairings.pair(context.Background(), http.DefaultClient, host, "ABCDEF0123456789", "4321")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.GUID != 0x123456789abcdef0 || device.Name != "iPhone" || device.Type != "iPhone9" {
+		t.Errorf("wrong device: %+v", device)
+	}
+	if serviceName != pairings.ServiceName || len(serviceName) != 16 {
+		t.Errorf("wrong service name sent, want %v, got %v", pairings.ServiceName, serviceName)
+	}
+
+	// pairing again replaces the device rather than adding another
+	if _, err := pairings.pair(context.Background(), http.DefaultClient, host, "ABCDEF0123456789", "4321"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadPairings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.ServiceName != pairings.ServiceName {
+		t.Errorf("service name not kept, want %v, got %v", pairings.ServiceName, reloaded.ServiceName)
+	}
+	if len(reloaded.Devices) != 1 {
+		t.Fatalf("wrong number of paired devices: %v", len(reloaded.Devices))
+	}
+	if _, ok := reloaded.paired(0x123456789abcdef0); !ok {
+		t.Error("device not paired after reload")
+	}
+}
+
+func TestLoginPairingGUID(t *testing.T) {
+	pairings, err := loadPairings(filepath.Join(t.TempDir(), "pairings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pairings.add(PairedDevice{GUID: 1, Name: "remote"}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := routes(nil, nil, nil, pairings, nil)
+	tests := []struct {
+		uri  string
+		want int
+	}{
+		{"/login", http.StatusOK},
+		{"/login?pairing-guid=0x0000000000000001", http.StatusOK},
+		{"/login?pairing-guid=0x0000000000000002", http.StatusForbidden},
+		{"/login?pairing-guid=nope", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != test.want {
+			t.Errorf("wrong http status for %v, want %v, got %v", test.uri, test.want, resp.Code)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+// PlayState is the DACP play state, dacp.playerstate.
+type PlayState byte
+
+const PlayStateStopped PlayState = 2
+const PlayStatePaused PlayState = 3
+const PlayStatePlaying PlayState = 4
+
+// QueueItem is a song queued on the player along with the ids clients use to
+// refer to it.
+type QueueItem struct {
+	databaseID int
+	itemID     int
+	song       Song
+}
+
+// PlayerStatus is a snapshot of what a player is doing. current is the index
+// into the queue of the song playing, -1 if there isn't one.
+type PlayerStatus struct {
+	state    PlayState
+	volume   int // 0 to 100
+	shuffle  bool
+	repeat   byte // 0 off, 1 one song, 2 all
+	current  int
+	position int // milliseconds into the current song
+}
+
+// Player plays songs on the machine the server runs on, for DACP remotes to
+// control.
+type Player interface {
+	// Cue replaces the queue and starts playing it from index. An empty queue
+	// stops playback.
+	Cue(items []QueueItem, index int) error
+	PlayPause() error
+	Next() error
+	Previous() error
+	SetVolume(volume int) error
+	Status() PlayerStatus
+	Queue() []QueueItem
+	// Artwork returns the current song's artwork and its content type, or no
+	// data if there isn't any.
+	Artwork() ([]byte, string, error)
+	// Notify registers functions for the player to call whenever it changes
+	// by itself, e.g. moving on at the end of a song, and when it has played
+	// a song through to the end.
+	Notify(changed func(), finished func(QueueItem))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// SmartPlaylist is a playlist of the songs matching a DAAP query, e.g.
+// 'daap.songgenre:Jazz'+'daap.songuserrating:80'.
+type SmartPlaylist struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+// SmartPlaylists are the smart playlists shown in every library, kept in a
+// JSON file.
+type SmartPlaylists struct {
+	path string
+
+	mu        sync.Mutex
+	Playlists []SmartPlaylist `json:"playlists"`
+}
+
+// loadSmartPlaylists reads the playlists from path, if there are any yet.
+func loadSmartPlaylists(path string) (*SmartPlaylists, error) {
+	p := &SmartPlaylists{path: path, Playlists: []SmartPlaylist{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	for _, playlist := range p.Playlists {
+		if err := playlist.validate(); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	return p, nil
+}
+
+func (p SmartPlaylist) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("smart playlist needs a name")
+	}
+	if _, err := parseQuery(p.Query); err != nil {
+		return fmt.Errorf("smart playlist %v: %v", p.Name, err)
+	}
+	return nil
+}
+
+// list returns the playlists. A nil SmartPlaylists has none.
+func (p *SmartPlaylists) list() []SmartPlaylist {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]SmartPlaylist{}, p.Playlists...)
+}
+
+// put adds a playlist, or replaces the one with the same name, and saves.
+func (p *SmartPlaylists) put(playlist SmartPlaylist) error {
+	if err := playlist.validate(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	playlists := append([]SmartPlaylist{}, p.Playlists...)
+	replaced := false
+	for i := range playlists {
+		if playlists[i].Name == playlist.Name {
+			playlists[i] = playlist
+			replaced = true
+		}
+	}
+	if !replaced {
+		playlists = append(playlists, playlist)
+	}
+	return p.saveLocked(playlists)
+}
+
+// remove deletes a playlist by name and saves. It returns false if there
+// wasn't one.
+func (p *SmartPlaylists) remove(name string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	playlists := []SmartPlaylist{}
+	for _, playlist := range p.Playlists {
+		if playlist.Name != name {
+			playlists = append(playlists, playlist)
+		}
+	}
+	if len(playlists) == len(p.Playlists) {
+		return false, nil
+	}
+	return true, p.saveLocked(playlists)
+}
+
+// saveLocked writes playlists out, only keeping them if that worked.
+func (p *SmartPlaylists) saveLocked(playlists []SmartPlaylist) error {
+	data, err := json.MarshalIndent(struct {
+		Playlists []SmartPlaylist `json:"playlists"`
+	}{playlists}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		return err
+	}
+	p.Playlists = playlists
+	return nil
+}
+
+// smartContainers are a database's smart playlists, with the songs that
+// match them now.
+func (d Database) smartContainers() []container {
+	containers := []container{}
+	for _, playlist := range d.smart {
+		query, err := parseQuery(playlist.Query)
+		if err != nil {
+			continue
+		}
+		containers = append(containers, container{name: playlist.Name, ids: d.find(query)})
+	}
+	return containers
+}
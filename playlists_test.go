@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSmartPlaylists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playlists.json")
+	playlists, err := loadSmartPlaylists(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists.list()) != 0 {
+		t.Errorf("expected no playlists: %+v", playlists.list())
+	}
+
+	if err := playlists.put(SmartPlaylist{Name: "Radiohead", Query: "'daap.songartist:Radiohead'"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := playlists.put(SmartPlaylist{Name: "Jazz", Query: "'daap.songgenre:Jazz'"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := playlists.put(SmartPlaylist{Name: "Radiohead", Query: "'daap.songalbum:OK*'"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := playlists.put(SmartPlaylist{Name: "Broken", Query: "'daap.songgenre:Jazz"}); err == nil {
+		t.Error("expected an error for a bad query")
+	}
+	if err := playlists.put(SmartPlaylist{Query: "'daap.songgenre:Jazz'"}); err == nil {
+		t.Error("expected an error for a missing name")
+	}
+
+	reloaded, err := loadSmartPlaylists(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := reloaded.list()
+	if len(list) != 2 || list[0] != (SmartPlaylist{Name: "Radiohead", Query: "'daap.songalbum:OK*'"}) || list[1].Name != "Jazz" {
+		t.Errorf("wrong playlists after reloading: %+v", list)
+	}
+
+	if removed, err := reloaded.remove("Jazz"); !removed || err != nil {
+		t.Errorf("expected to remove Jazz, got %v %v", removed, err)
+	}
+	if removed, err := reloaded.remove("Jazz"); removed || err != nil {
+		t.Errorf("expected Jazz to be gone, got %v %v", removed, err)
+	}
+	if list := reloaded.list(); len(list) != 1 {
+		t.Errorf("wrong playlists after removing: %+v", list)
+	}
+}
+
+func TestLoadSmartPlaylistsErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"bad.json":   "{",
+		"query.json": `{"playlists": [{"name": "Broken", "query": "'daap.songgenre"}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSmartPlaylists(path); err == nil {
+			t.Errorf("expected an error for %v", name)
+		}
+	}
+}
+
+func TestSmartPlaylistContainers(t *testing.T) {
+	library := newLibrary([]Database{{
+		name: "Music",
+		songs: []Song{
+			{Title: "Airbag", Artist: "Radiohead"},
+			{Title: "So What", Artist: "Miles Davis", Genre: "Jazz"},
+			{Title: "Lucky", Artist: "Radiohead"},
+		},
+	}})
+	library.useSmartPlaylists([]SmartPlaylist{{Name: "Radiohead", Query: "'daap.songartist:Radiohead'"}})
+
+	database, _ := library.database(1)
+	containers := database.containers()
+	last := containers[len(containers)-1]
+	if last.name != "Radiohead" || len(last.ids) != 2 || last.ids[0] != 1 || last.ids[1] != 3 {
+		t.Errorf("wrong smart playlist: %+v", last)
+	}
+
+	// databases set later get them too
+	library.setDatabase(1, Database{name: "Music", songs: []Song{{Title: "Creep", Artist: "Radiohead"}}})
+	database, _ = library.database(1)
+	containers = database.containers()
+	if last := containers[len(containers)-1]; last.name != "Radiohead" || len(last.ids) != 1 {
+		t.Errorf("wrong smart playlist after setting the database: %+v", containers)
+	}
+
+	library.useSmartPlaylists(nil)
+	database, _ = library.database(1)
+	for _, c := range database.containers() {
+		if c.name == "Radiohead" {
+			t.Errorf("smart playlist not removed: %+v", database.containers())
+		}
+	}
+}
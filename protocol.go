@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProtocolProfile describes what the server advertises to clients speaking a
+// particular major version of DAAP.
+type ProtocolProfile struct {
+	daap                Version
+	dmap                Version
+	musicSharingVersion int   // aeSV, not sent when zero
+	supportsExtraData   int16 // ated, not sent when zero
+	supportsGroups      int16 // asgr, not sent when zero
+}
+
+// protocolProfiles must be sorted by ascending DAAP version. The first entry is
+// used for clients that don't send a Client-DAAP-Version header. The server
+// only speaks the ones up to the daap_version setting, see profilesUpTo.
+var protocolProfiles = []ProtocolProfile{
+	{daap: Version{1, 0, 0}, dmap: Version{1, 0, 0}},
+	{daap: Version{2, 0, 0}, dmap: Version{2, 0, 0}},
+	{
+		daap:                Version{3, 0, 12},
+		dmap:                Version{2, 0, 10},
+		musicSharingVersion: 0x00030000,
+		supportsExtraData:   7,
+		supportsGroups:      3,
+	},
+}
+
+// newestDAAPVersion is the newest version in protocolProfiles, the default
+// daap_version.
+var newestDAAPVersion = protocolProfiles[len(protocolProfiles)-1].daap
+
+// contentCodeVersions holds the minimum major DAAP version for fields that
+// older clients don't know about. Anything not listed is available to all.
+// They are left out of server-info, content-codes and item listings for
+// older clients, and the groups and browse routes aren't served to clients
+// without daap.supportsgroups and dmap.supportsbrowse.
+var contentCodeVersions = map[string]uint16{
+	"com.apple.itunes.music-sharing-version": 3,
+	"daap.supportsextradata":                 3,
+	"daap.supportsgroups":                    3,
+	"com.apple.itunes.unknown-asse":          3,
+	"dmap.supportsedit":                      3,
+	"dmap.speakermachinelist":                3,
+	"dmap.supportsbrowse":                    3,
+
+	// item fields
+	"daap.songuserskipcount":     3,
+	"daap.songlastskipdate":      3,
+	"daap.songalbumartist":       3,
+	"daap.sortartist":            3,
+	"daap.sortalbum":             3,
+	"daap.sortname":              3,
+	"daap.sortalbumartist":       3,
+	"daap.songalbumid":           3,
+	"com.apple.itunes.mediakind": 3,
+	"daap.songcategory":          3,
+	"daap.songdescription":       3,
+	"daap.songdatereleased":      3,
+	"daap.songdataurl":           3,
+
+	// groups and browse listings
+	"daap.albumgrouping":         3,
+	"daap.artistgrouping":        3,
+	"daap.groupalbumcount":       3,
+	"daap.databasebrowse":        3,
+	"daap.browseartistlisting":   3,
+	"daap.browsealbumlisting":    3,
+	"daap.browsegenrelisting":    3,
+	"daap.browsecomposerlisting": 3,
+}
+
+// profilesUpTo returns the profiles for DAAP versions up to version, with
+// version advertised in place of the profile of the same major version.
+func profilesUpTo(version Version) ([]ProtocolProfile, error) {
+	profiles := []ProtocolProfile{}
+	for _, profile := range protocolProfiles {
+		if profile.daap.major > version.major {
+			break
+		}
+		if profile.daap.major == version.major {
+			profile.daap = version
+		}
+		profiles = append(profiles, profile)
+	}
+	if len(profiles) == 0 || profiles[len(profiles)-1].daap != version {
+		return nil, fmt.Errorf("unsupported DAAP version %v.%v.%v, expected 1 to %v", version.major, version.minor, version.patch, newestDAAPVersion.major)
+	}
+	return profiles, nil
+}
+
+func parseVersion(s string) (Version, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) > 3 {
+		return Version{}, fmt.Errorf("too many parts in version '%v'", s)
+	}
+	var nums [3]uint64
+	bitSizes := [3]int{16, 8, 8}
+	for i, part := range parts {
+		num, err := strconv.ParseUint(part, 10, bitSizes[i])
+		if err != nil {
+			return Version{}, fmt.Errorf("cannot parse version '%v': %v", s, err)
+		}
+		nums[i] = num
+	}
+	return Version{uint16(nums[0]), uint8(nums[1]), uint8(nums[2])}, nil
+}
+
+// negotiate picks the newest profile with a major DAAP version no newer than
+// the one the client says it speaks.
+func negotiate(profiles []ProtocolProfile, clientVersion string) ProtocolProfile {
+	if len(profiles) == 0 {
+		return ProtocolProfile{daap: Version{1, 0, 0}, dmap: Version{1, 0, 0}}
+	}
+	selected := profiles[0]
+	if clientVersion == "" {
+		return selected
+	}
+	version, err := parseVersion(clientVersion)
+	if err != nil {
+		return selected
+	}
+	for _, profile := range profiles {
+		if profile.daap.major <= version.major {
+			selected = profile
+		}
+	}
+	return selected
+}
+
+// requireField serves inner only to clients whose profile supports field,
+// others get the not found response of a route that doesn't exist.
+func requireField(field string, inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		profile := negotiate(currentShare().profiles, r.Header.Get("Client-DAAP-Version"))
+		if !profile.supportsField(field) {
+			defaultHandler(w, r)
+			return
+		}
+		inner(w, r)
+	}
+}
+
+func (p ProtocolProfile) supportsField(field string) bool {
+	return p.daap.major >= contentCodeVersions[field]
+}
+
+func (p ProtocolProfile) filterFields(fields []string) []string {
+	supported := []string{}
+	for _, field := range fields {
+		if p.supportsField(field) {
+			supported = append(supported, field)
+		}
+	}
+	return supported
+}
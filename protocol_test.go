@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Version
+	}{
+		{"1", Version{1, 0, 0}},
+		{"2.0", Version{2, 0, 0}},
+		{"3.10", Version{3, 10, 0}},
+		{" 3.0.2 ", Version{3, 0, 2}},
+	}
+	for _, test := range tests {
+		got, err := parseVersion(test.in)
+		if err != nil {
+			t.Errorf("unexpected error parsing '%v': %v", test.in, err)
+		} else if got != test.want {
+			t.Errorf("wrong version for '%v', want %v, got %v", test.in, test.want, got)
+		}
+	}
+}
+
+func TestParseVersionInvalid(t *testing.T) {
+	for _, in := range []string{"", "a.b", "1.2.3.4", "3.256"} {
+		if _, err := parseVersion(in); err == nil {
+			t.Errorf("expected error parsing '%v'", in)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		clientVersion string
+		want          Version
+	}{
+		{"", Version{1, 0, 0}},
+		{"garbage", Version{1, 0, 0}},
+		{"0.5", Version{1, 0, 0}},
+		{"1.0", Version{1, 0, 0}},
+		{"2.0", Version{2, 0, 0}},
+		{"3.0", Version{3, 0, 12}},
+		{"3.10", Version{3, 0, 12}},
+		{"4.0", Version{3, 0, 12}},
+	}
+	for _, test := range tests {
+		got := negotiate(protocolProfiles, test.clientVersion)
+		if got.daap != test.want {
+			t.Errorf("wrong profile for '%v', want %v, got %v", test.clientVersion, test.want, got.daap)
+		}
+	}
+}
+
+func TestNegotiateNoProfiles(t *testing.T) {
+	got := negotiate(nil, "3.0")
+	if got.daap != (Version{1, 0, 0}) || got.dmap != (Version{1, 0, 0}) {
+		t.Errorf("wrong fallback profile: %v", got)
+	}
+}
+
+func TestFilterFields(t *testing.T) {
+	fields := []string{"dmap.itemid", "dmap.supportsedit", "dmap.itemname"}
+
+	got := negotiate(protocolProfiles, "2.0").filterFields(fields)
+	if len(got) != 2 || got[0] != "dmap.itemid" || got[1] != "dmap.itemname" {
+		t.Errorf("wrong fields for DAAP 2: %v", got)
+	}
+
+	got = negotiate(protocolProfiles, "3.0").filterFields(fields)
+	if len(got) != 3 {
+		t.Errorf("wrong fields for DAAP 3: %v", got)
+	}
+}
+
+func TestItemFieldsByVersion(t *testing.T) {
+	router := routes(nil, newLibrary([]Database{{name: "testdb", songs: []Song{{Title: "Teardrop", AlbumArtist: "Massive Attack"}}}}), nil, nil, nil)
+	tests := []struct {
+		clientVersion string
+		want          bool
+	}{
+		{"2.0", false},
+		{"3.0", true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/databases/1/items?meta=dmap.itemname,daap.songalbumartist,daap.sortname", nil)
+		req.Header.Set("Client-DAAP-Version", test.clientVersion)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		tags, err := daap.Decode(resp.Body.Bytes(), map[string]bool{"adbs": true, "mlcl": true, "mlit": true})
+		if err != nil || len(tags) != 1 {
+			t.Fatalf("%v: bad response %+v %v", test.clientVersion, tags, err)
+		}
+		listing, _ := tags[0].Find("mlcl")
+		items := listing.All("mlit")
+		if len(items) != 1 {
+			t.Fatalf("%v: wrong items %+v", test.clientVersion, items)
+		}
+		if _, ok := items[0].Find("minm"); !ok {
+			t.Errorf("%v: dmap.itemname missing", test.clientVersion)
+		}
+		_, asaa := items[0].Find("asaa")
+		_, assn := items[0].Find("assn")
+		if asaa != test.want || assn != test.want {
+			t.Errorf("%v: daap.songalbumartist sent %v and daap.sortname sent %v, want %v", test.clientVersion, asaa, assn, test.want)
+		}
+	}
+}
+
+func TestGroupsAndBrowseByVersion(t *testing.T) {
+	router := routes(nil, newLibrary([]Database{{name: "testdb", songs: albumTestSongs}}), nil, nil, nil)
+	tests := []struct {
+		clientVersion string
+		want          int
+	}{
+		{"", http.StatusNotFound},
+		{"2.0", http.StatusNotFound},
+		{"3.0", http.StatusOK},
+	}
+	for _, test := range tests {
+		for _, uri := range []string{"/databases/1/groups?group-type=albums", "/databases/1/browse/artists"} {
+			req := httptest.NewRequest("GET", uri, nil)
+			if test.clientVersion != "" {
+				req.Header.Set("Client-DAAP-Version", test.clientVersion)
+			}
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+			if resp.Code != test.want {
+				t.Errorf("%v for DAAP '%v': wrong http status, want %v, got %v", uri, test.clientVersion, test.want, resp.Code)
+			}
+		}
+	}
+}
+
+func TestProfilesUpTo(t *testing.T) {
+	profiles, err := profilesUpTo(Version{2, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles[1].daap != (Version{2, 0, 1}) || profiles[1].dmap != (Version{2, 0, 0}) {
+		t.Errorf("wrong profiles up to 2.0.1: %+v", profiles)
+	}
+	if got := negotiate(profiles, "3.0"); got.daap != (Version{2, 0, 1}) || got.supportsField("dmap.supportsedit") {
+		t.Errorf("wrong profile for a DAAP 3 client: %+v", got)
+	}
+
+	profiles, err = profilesUpTo(newestDAAPVersion)
+	if err != nil || len(profiles) != len(protocolProfiles) {
+		t.Errorf("wrong profiles up to the newest version: %+v %v", profiles, err)
+	}
+	for _, version := range []Version{{0, 9, 0}, {4, 0, 0}} {
+		if _, err := profilesUpTo(version); err == nil {
+			t.Errorf("expected an error for %+v", version)
+		}
+	}
+}
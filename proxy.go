@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+// proxyRetryInterval is how long to wait before reconnecting to an upstream
+// server that failed.
+var proxyRetryInterval = 30 * time.Second
+
+// remoteSong is where a proxied song really lives.
+type remoteSong struct {
+	client     *daap.Client
+	databaseID int
+	song       daap.Song
+}
+
+type upstream struct {
+	client *daap.Client
+	songs  []remoteSong
+}
+
+// Proxy merges the songs of several upstream DAAP servers into a single
+// database, keeping it up to date as the upstream libraries change.
+type Proxy struct {
+	name      string
+	library   *Library
+	upstreams []*upstream
+
+	mu sync.Mutex
+}
+
+func newProxy(name string, library *Library, clients []*daap.Client) *Proxy {
+	p := &Proxy{name: name, library: library}
+	for _, client := range clients {
+		p.upstreams = append(p.upstreams, &upstream{client: client})
+	}
+	return p
+}
+
+// upstreamClient makes a client for a server URL, taking a password from the
+// URL's user info if there is one, e.g. http://:secret@host:3689.
+func upstreamClient(rawURL string) (*daap.Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported upstream URL '%v'", rawURL)
+	}
+	password, _ := u.User.Password()
+	u.User = nil
+	client := daap.NewClient(u.String())
+	client.Password = password
+	return client, nil
+}
+
+// run follows every upstream until ctx is done.
+func (p *Proxy) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			p.watch(ctx, u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+func (p *Proxy) watch(ctx context.Context, u *upstream) {
+	for {
+		err := p.follow(ctx, u)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("upstream %v: %v", u.client.URL, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(proxyRetryInterval):
+		}
+	}
+}
+
+// follow logs in to an upstream and reloads its songs every time its revision
+// changes. It only returns on error.
+func (p *Proxy) follow(ctx context.Context, u *upstream) error {
+	if err := u.client.Login(ctx); err != nil {
+		return err
+	}
+	for {
+		revision := u.client.Revision()
+		songs, err := fetchSongs(ctx, u.client)
+		if err != nil {
+			return err
+		}
+		// merged and published under one lock, so an older merge can't
+		// replace a newer one
+		p.mu.Lock()
+		u.songs = songs
+		p.library.setDatabase(1, p.mergeLocked())
+		p.mu.Unlock()
+
+		// the first update returns straight away, often with the revision we
+		// just fetched
+		for u.client.Revision() == revision {
+			if _, err := u.client.Update(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// proxyMeta are the song fields asked of upstream servers, so songs are put
+// on the same albums as they are upstream.
+var proxyMeta = append(append([]string{}, daap.DefaultMeta...), "daap.songalbumartist", "daap.songcompilation", "daap.songdiscnumber")
+
+func fetchSongs(ctx context.Context, client *daap.Client) ([]remoteSong, error) {
+	databases, err := client.Databases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	songs := []remoteSong{}
+	for _, database := range databases {
+		items, err := client.Items(ctx, database.ID, proxyMeta)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			songs = append(songs, remoteSong{client, database.ID, item})
+		}
+	}
+	return songs, nil
+}
+
+type songKey struct {
+	artist   string
+	album    string
+	title    string
+	duration int
+}
+
+func newSongKey(song daap.Song) songKey {
+	return songKey{
+		strings.ToLower(strings.TrimSpace(song.Artist)),
+		strings.ToLower(strings.TrimSpace(song.Album)),
+		strings.ToLower(strings.TrimSpace(song.Title)),
+		// different encodings of the same track rarely agree to the millisecond
+		(song.Duration + 500) / 1000,
+	}
+}
+
+// mergeLocked builds the combined database. Songs found on more than one
+// upstream are only listed once, from whichever upstream was configured first.
+// Callers must hold the lock.
+//
+// Songs keep their ids as upstream songs come and go: the persistent id is a
+// hash of where the song lives upstream, and the item id is taken from it,
+// moving on to the next free id in the rare case two songs' ids collide.
+func (p *Proxy) mergeLocked() Database {
+	seen := map[songKey]bool{}
+	items := map[int]int{}
+	songs := []Song{}
+	for _, u := range p.upstreams {
+		for i := range u.songs {
+			remote := &u.songs[i]
+			key := newSongKey(remote.song)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			tags := daap.Tag{Children: remote.song.Tags}
+			albumArtist, _ := tags.Find("asaa")
+			compilation, _ := tags.Find("asco")
+			disc, _ := tags.Find("asdn")
+			song := Song{
+				Title:       remote.song.Title,
+				Album:       remote.song.Album,
+				Artist:      remote.song.Artist,
+				TrackNumber: remote.song.TrackNumber,
+				Duration:    remote.song.Duration,
+				Compilation: compilation.Int() != 0,
+				DiscNumber:  int(disc.Int()),
+				remote:      remote,
+			}
+			song.persistentID = remote.persistentID()
+			song.itemID = freeItemID(items, int(song.persistentID&0x7fffffff))
+			items[song.itemID] = len(songs) + 1
+			if artist := albumArtist.Text(); artist != song.Artist && !(song.Compilation && artist == variousArtists) {
+				// upstream sends the artist when there's no album artist
+				song.AlbumArtist = artist
+			}
+			songs = append(songs, song)
+		}
+	}
+	return Database{name: p.name, songs: songs, items: items}
+}
+
+// persistentID identifies a proxied song by the upstream server and database
+// it lives in and its persistent id there, or its item id if the upstream
+// doesn't send persistent ids.
+func (r *remoteSong) persistentID() int64 {
+	id := r.song.PersistentID
+	if id == 0 {
+		id = int64(r.song.ID)
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v\x00%d\x00%d", r.client.URL, r.databaseID, id)
+	// mper is signed, keep it positive
+	return int64(h.Sum64() & 0x7fffffffffffffff)
+}
+
+// freeItemID is id, or the first id after it that isn't taken.
+func freeItemID(items map[int]int, id int) int {
+	for {
+		if _, taken := items[id]; !taken && id != 0 {
+			return id
+		}
+		id = (id + 1) & 0x7fffffff
+	}
+}
+
+// remoteReader reads a song from upstream as if it were a file, so ranges
+// are served by http.ServeContent just as they are for local songs. A read
+// from anywhere but where the current stream is up to opens another one.
+type remoteReader struct {
+	ctx    context.Context
+	remote *remoteSong
+	stream *daap.Stream
+	// streamOffset is how far into the song the stream is.
+	streamOffset int64
+	size         int64
+	offset       int64
+	// start is where reading began, -1 until the first read.
+	start int64
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	if r.start < 0 {
+		r.start = r.offset
+	}
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.streamOffset != r.offset {
+		r.Close()
+	}
+	if r.stream == nil {
+		stream, err := r.remote.client.Stream(r.ctx, r.remote.databaseID, r.remote.song, r.offset)
+		if err != nil {
+			log.Printf("upstream stream failed: %v", err)
+			return 0, err
+		}
+		r.stream, r.streamOffset = stream, r.offset
+		// not every server honours the range asked for
+		if _, err := io.CopyN(ioutil.Discard, stream, r.offset-stream.Offset); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.stream.Read(p)
+	r.offset += int64(n)
+	r.streamOffset = r.offset
+	if err != nil && err != io.EOF {
+		log.Printf("upstream stream interrupted: %v", err)
+	}
+	return n, err
+}
+
+func (r *remoteReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *remoteReader) Close() error {
+	if r.stream == nil {
+		return nil
+	}
+	err := r.stream.Close()
+	r.stream = nil
+	return err
+}
+
+// proxyStream relays a song from the upstream server it lives on, calling
+// played if it was streamed from the start to the end.
+func proxyStream(w http.ResponseWriter, r *http.Request, song Song, played func()) {
+	// the size comes from opening the stream, which a request from the start
+	// goes on to use
+	stream, err := song.remote.client.Stream(r.Context(), song.remote.databaseID, song.remote.song, 0)
+	if err != nil {
+		log.Printf("upstream stream failed: %v", err)
+		http.Error(w, "upstream stream failed", http.StatusBadGateway)
+		return
+	}
+	reader := &remoteReader{ctx: r.Context(), remote: song.remote, stream: stream, size: stream.Size, start: -1}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", song.contentType())
+	if stream.Size < 0 {
+		// without a size there's nothing to serve ranges from
+		if _, err := io.Copy(w, stream); err == nil && r.Header.Get("Range") == "" {
+			played()
+		}
+		return
+	}
+	tracker := &playTracker{ReadSeeker: reader, size: reader.size, played: func() {
+		if reader.start == 0 {
+			played()
+		}
+	}}
+	http.ServeContent(w, r, "", time.Time{}, tracker)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/carlgreen/audioserve/daap"
+)
+
+func TestUpstreamClient(t *testing.T) {
+	client, err := upstreamClient("http://:secret@localhost:3689")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.URL != "http://localhost:3689" || client.Password != "secret" {
+		t.Errorf("wrong client: %v %v", client.URL, client.Password)
+	}
+	if _, err := upstreamClient("localhost:3689"); err == nil {
+		t.Error("expected error for URL without scheme")
+	}
+}
+
+func TestProxyMerge(t *testing.T) {
+	p := newProxy("merged", newLibrary(nil), []*daap.Client{daap.NewClient("http://a"), daap.NewClient("http://b")})
+	p.upstreams[0].songs = []remoteSong{
+		{p.upstreams[0].client, 1, daap.Song{ID: 1, Title: "Song", Artist: "Artist", Album: "Album", Duration: 199600}},
+	}
+	p.upstreams[1].songs = []remoteSong{
+		{p.upstreams[1].client, 1, daap.Song{ID: 1, Title: "song ", Artist: "ARTIST", Album: "Album", Duration: 200400}},
+		{p.upstreams[1].client, 1, daap.Song{ID: 2, Title: "Other", Artist: "Artist", Album: "Album", Duration: 100000}},
+		{p.upstreams[1].client, 1, daap.Song{ID: 3, Title: "Hit", Artist: "Someone", Album: "Hits", Tags: []daap.Tag{
+			{Code: "asaa", Data: []byte("Various Artists")},
+			{Code: "asco", Data: []byte{1}},
+			{Code: "asdn", Data: []byte{0, 2}},
+		}}},
+		{p.upstreams[1].client, 1, daap.Song{ID: 4, Title: "Tune", Artist: "Band", Album: "Tunes", Tags: []daap.Tag{
+			{Code: "asaa", Data: []byte("Band")},
+			{Code: "asco", Data: []byte{0}},
+		}}},
+	}
+
+	database := p.mergeLocked()
+	if database.name != "merged" || len(database.songs) != 4 {
+		t.Fatalf("wrong merged database: %+v", database)
+	}
+	if database.songs[0].remote.client.URL != "http://a" {
+		t.Error("duplicate not taken from the first upstream")
+	}
+	if database.songs[1].Title != "Other" || database.songs[1].remote.song.ID != 2 {
+		t.Errorf("wrong second song: %+v", database.songs[1])
+	}
+	if song := database.songs[2]; !song.Compilation || song.DiscNumber != 2 || song.AlbumArtist != "" || song.albumArtist() != variousArtists {
+		t.Errorf("album tags not taken from upstream: %+v", song)
+	}
+	if song := database.songs[3]; song.Compilation || song.AlbumArtist != "" {
+		t.Errorf("album artist should be left to the artist: %+v", song)
+	}
+
+	// ids stay the same when songs before them go away upstream
+	other := database.songs[1]
+	if position, song, ok := database.item(other.itemID); !ok || position != 2 || song.Title != "Other" {
+		t.Errorf("wrong song for item id %v: %v %+v", other.itemID, position, song)
+	}
+	p.upstreams[0].songs = nil
+	p.upstreams[1].songs = p.upstreams[1].songs[1:]
+	database = p.mergeLocked()
+	if song := database.songs[0]; song.Title != "Other" || song.itemID != other.itemID || song.persistentID != other.persistentID {
+		t.Errorf("ids changed from %v and %v: %+v", other.itemID, other.persistentID, song)
+	}
+	if _, song, ok := database.item(other.itemID); !ok || song.Title != "Other" {
+		t.Errorf("wrong song for item id %v after a change: %+v", other.itemID, song)
+	}
+}
+
+func TestFreeItemID(t *testing.T) {
+	items := map[int]int{5: 1, 6: 2, 0x7fffffff: 3}
+	tests := map[int]int{4: 4, 5: 7, 0x7fffffff: 1, 0: 1}
+	for id, want := range tests {
+		if got := freeItemID(items, id); got != want {
+			t.Errorf("freeItemID(%v) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func waitForRevision(t *testing.T, library *Library, revision int) {
+	deadline := time.After(5 * time.Second)
+	for library.revision() < revision {
+		select {
+		case <-library.revisionWaiter():
+		case <-deadline:
+			t.Fatalf("library did not reach revision %v", revision)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	f, err := ioutil.TempFile("", "song*.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not really an mp3")
+	f.Close()
+
+	libraryA := newLibrary([]Database{{name: "a", songs: []Song{
+		{Title: "shared", Artist: "artist", Duration: 1000, Path: "/nowhere.mp3"},
+	}}})
+	libraryB := newLibrary([]Database{{name: "b", songs: []Song{
+		{Title: "shared", Artist: "artist", Duration: 1000, Path: "/nowhere.mp3"},
+		{Title: "only b", Artist: "artist", Duration: 2000, Path: f.Name()},
+	}}})
+	serverA := httptest.NewServer(routes(contentCodes, libraryA, nil, nil, nil))
+	defer serverA.Close()
+	serverB := httptest.NewServer(routes(contentCodes, libraryB, nil, nil, nil))
+	defer serverB.Close()
+
+	library := newLibrary(nil)
+	p := newProxy("merged", library, []*daap.Client{daap.NewClient(serverA.URL), daap.NewClient(serverB.URL)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.run(ctx)
+
+	// one revision per upstream loaded
+	waitForRevision(t, library, 3)
+
+	proxyServer := httptest.NewServer(routes(contentCodes, library, nil, nil, nil))
+	defer proxyServer.Close()
+	client := daap.NewClient(proxyServer.URL)
+	if err := client.Login(ctx); err != nil {
+		t.Fatal(err)
+	}
+	songs, err := client.Items(ctx, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 2 || songs[1].Title != "only b" || songs[1].Format != "mp3" {
+		t.Fatalf("wrong merged songs: %+v", songs)
+	}
+
+	stream, err := client.Stream(ctx, 1, songs[1], 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := ioutil.ReadAll(stream)
+	stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p2) != "really an mp3" || stream.Offset != 4 || stream.Size != 17 {
+		t.Errorf("wrong stream: %q from %v of %v", p2, stream.Offset, stream.Size)
+	}
+
+	// ranges are served like they are for local songs, and only a stream
+	// from the start counts as a play
+	plays := func() int {
+		for _, song := range library.databases()[0].songs {
+			if song.Title == "only b" {
+				return song.stats().PlayCount
+			}
+		}
+		return -1
+	}
+	ranged := func(rangeHeader string) string {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%v/databases/1/items/%d.mp3?session-id=%d", proxyServer.URL, songs[1].ID, client.SessionID()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", rangeHeader)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Errorf("wrong status for '%v': %v", rangeHeader, resp.Status)
+		}
+		p, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(p)
+	}
+	if got := ranged("bytes=4-9"); got != "really" {
+		t.Errorf("wrong range: %q", got)
+	}
+	if got := ranged("bytes=-3"); got != "mp3" {
+		t.Errorf("wrong suffix range: %q", got)
+	}
+	if got := ranged("bytes=0-"); got != "not really an mp3" {
+		t.Errorf("wrong open range: %q", got)
+	}
+	if got := plays(); got != 1 {
+		t.Errorf("wrong play count after ranges: %v", got)
+	}
+	stream, err = client.Stream(ctx, 1, songs[1], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(stream)
+	stream.Close()
+	if got := plays(); got != 2 {
+		t.Errorf("wrong play count after full stream: %v", got)
+	}
+
+	// a change upstream is picked up
+	libraryA.setDatabase(1, Database{name: "a", songs: []Song{
+		{Title: "new", Artist: "artist", Duration: 3000, Path: "/nowhere.mp3"},
+	}})
+	waitForRevision(t, library, 4)
+	if got := len(library.databases()[0].songs); got != 3 {
+		t.Errorf("wrong number of songs after upstream change: %v", got)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// songQuery is a parsed DAAP query filter like
+// ('daap.songartist:Some Artist'+'daap.songalbum:Some*'),'dmap.itemid:3'
+// where + (or a space) means and, and a comma means or. Text is compared
+// folded, see foldText, so case and accents don't matter.
+type songQuery interface {
+	matches(id int, song Song) bool
+}
+
+type andQuery []songQuery
+type orQuery []songQuery
+
+type termQuery struct {
+	field    string
+	value    string
+	negate   bool
+	prefix   bool // value ended with *
+	suffix   bool // value started with *
+	contains bool // both
+}
+
+func (q andQuery) matches(id int, song Song) bool {
+	for _, sub := range q {
+		if !sub.matches(id, song) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q orQuery) matches(id int, song Song) bool {
+	for _, sub := range q {
+		if sub.matches(id, song) {
+			return true
+		}
+	}
+	return false
+}
+
+// songFieldText is the value of a field as text, for matching queries. ok is
+// false for fields that can't be queried.
+func songFieldText(field string, id int, song Song) (string, bool) {
+	switch field {
+	case "dmap.itemid":
+		return strconv.Itoa(song.itemIDAt(id)), true
+	case "dmap.persistentid":
+		return strconv.FormatInt(song.persistentIDAt(id), 10), true
+	case "dmap.itemname":
+		return song.Title, true
+	case "daap.songalbum":
+		return song.Album, true
+	case "daap.songartist":
+		return song.Artist, true
+	case "daap.songformat":
+		return song.format(), true
+	case "daap.songgenre":
+		return song.Genre, true
+	case "daap.songcomposer":
+		return song.Composer, true
+	case "daap.songtracknumber":
+		return strconv.Itoa(song.TrackNumber), true
+	case "daap.songplaycount", "daap.songuserplaycount":
+		return strconv.Itoa(song.stats().PlayCount), true
+	case "daap.songuserskipcount":
+		return strconv.Itoa(song.stats().SkipCount), true
+	case "daap.songdateplayed":
+		return strconv.Itoa(dmapDate(song.stats().LastPlayed)), true
+	case "daap.songlastskipdate":
+		return strconv.Itoa(dmapDate(song.stats().LastSkipped)), true
+	case "daap.songuserrating":
+		return strconv.Itoa(song.stats().Rating), true
+	case "com.apple.itunes.mediakind":
+		return strconv.Itoa(int(song.kind())), true
+	case "dmap.itemkind":
+		return "2", true
+	case "daap.songcategory":
+		return song.Category, true
+	}
+	return "", false
+}
+
+func (q termQuery) matches(id int, song Song) bool {
+	text, ok := songFieldText(q.field, id, song)
+	if !ok {
+		// unknown fields don't exclude anything
+		return true
+	}
+	text = foldText(text)
+	var matched bool
+	switch {
+	case q.contains:
+		matched = strings.Contains(text, q.value)
+	case q.prefix:
+		matched = strings.HasPrefix(text, q.value)
+	case q.suffix:
+		matched = strings.HasSuffix(text, q.value)
+	default:
+		matched = text == q.value
+	}
+	return matched != q.negate
+}
+
+// parseQuery parses a query filter. An empty query matches everything.
+func parseQuery(s string) (songQuery, error) {
+	p := &queryParser{s: strings.TrimSpace(s)}
+	if p.s == "" {
+		return andQuery{}, nil
+	}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected '%c' at %v in query", p.s[p.pos], p.pos)
+	}
+	return q, nil
+}
+
+type queryParser struct {
+	s   string
+	pos int
+}
+
+func (p *queryParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *queryParser) parseOr() (songQuery, error) {
+	q := orQuery{}
+	for {
+		sub, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		q = append(q, sub)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if len(q) == 1 {
+		return q[0], nil
+	}
+	return q, nil
+}
+
+func (p *queryParser) parseAnd() (songQuery, error) {
+	q := andQuery{}
+	for {
+		sub, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		q = append(q, sub)
+		if c := p.peek(); c != '+' && c != ' ' {
+			break
+		}
+		p.pos++
+	}
+	if len(q) == 1 {
+		return q[0], nil
+	}
+	return q, nil
+}
+
+func (p *queryParser) parseTerm() (songQuery, error) {
+	switch p.peek() {
+	case '(':
+		p.pos++
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at %v in query", p.pos)
+		}
+		p.pos++
+		return q, nil
+	case '\'':
+		p.pos++
+		var term strings.Builder
+		for {
+			c := p.peek()
+			switch {
+			case c == 0:
+				return nil, fmt.Errorf("unterminated term in query")
+			case c == '\\' && p.pos+1 < len(p.s):
+				term.WriteByte(p.s[p.pos+1])
+				p.pos += 2
+				continue
+			case c == '\'':
+				p.pos++
+				return newTermQuery(term.String())
+			}
+			term.WriteByte(c)
+			p.pos++
+		}
+	}
+	return nil, fmt.Errorf("expected a term at %v in query", p.pos)
+}
+
+func newTermQuery(term string) (termQuery, error) {
+	i := strings.Index(term, ":")
+	if i < 0 {
+		return termQuery{}, fmt.Errorf("no ':' in query term '%v'", term)
+	}
+	q := termQuery{field: term[:i], value: foldText(term[i+1:])}
+	if strings.HasSuffix(q.field, "!") {
+		q.field = strings.TrimSuffix(q.field, "!")
+		q.negate = true
+	}
+	q.prefix = strings.HasSuffix(q.value, "*")
+	q.suffix = strings.HasPrefix(q.value, "*")
+	q.contains = q.prefix && q.suffix
+	q.value = strings.Trim(q.value, "*")
+	return q, nil
+}
+
+// indexRange is the part of a listing a client asks for with index=a-b,
+// counting from 0 with both ends included, or index=a for one item.
+type indexRange struct {
+	start int
+	end   int // exclusive, -1 for the rest of the listing
+}
+
+// parseIndexRange parses an index parameter. An empty one is the whole
+// listing.
+func parseIndexRange(s string) (indexRange, error) {
+	if s == "" {
+		return indexRange{0, -1}, nil
+	}
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return indexRange{}, fmt.Errorf("bad index '%v'", s)
+	}
+	if last == "" {
+		return indexRange{start, -1}, nil
+	}
+	end, err := strconv.Atoi(last)
+	if err != nil || end < start {
+		return indexRange{}, fmt.Errorf("bad index '%v'", s)
+	}
+	return indexRange{start, end + 1}, nil
+}
+
+// apply returns the ids in the range.
+func (r indexRange) apply(ids []int) []int {
+	start, end := r.start, r.end
+	if end < 0 || end > len(ids) {
+		end = len(ids)
+	}
+	if start > end {
+		start = end
+	}
+	return ids[start:end]
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestParseQuery(t *testing.T) {
+	songs := []Song{
+		{Title: "Come Together", Artist: "The Beatles", Album: "Abbey Road"},
+		{Title: "Something", Artist: "The Beatles", Album: "Abbey Road"},
+		{Title: "Paranoid Android", Artist: "Radiohead", Album: "OK Computer"},
+	}
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"", []int{1, 2, 3}},
+		{"'dmap.itemid:2'", []int{2}},
+		{"'daap.songartist:the beatles'", []int{1, 2}},
+		{"'daap.songartist!:The Beatles'", []int{3}},
+		{"'dmap.itemname:Some*'", []int{2}},
+		{"'dmap.itemname:*android'", []int{3}},
+		{"'dmap.itemname:*o*'", []int{1, 2, 3}},
+		{"'daap.songartist:The Beatles'+'dmap.itemname:Something'", []int{2}},
+		{"'daap.songartist:The Beatles' 'dmap.itemname:Something'", []int{2}},
+		{"'dmap.itemid:1','dmap.itemid:3'", []int{1, 3}},
+		{"('dmap.itemid:1','dmap.itemid:3')+'daap.songalbum:OK*'", []int{3}},
+		{"'dmap.itemname:It\\'s'", []int{}},
+		{"'com.apple.itunes.extended-media-kind:1'", []int{1, 2, 3}},
+	}
+	for _, test := range tests {
+		q, err := parseQuery(test.query)
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", test.query, err)
+			continue
+		}
+		got := []int{}
+		for i, song := range songs {
+			if q.matches(i+1, song) {
+				got = append(got, i+1)
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("wrong matches for %v, want %v, got %v", test.query, test.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("wrong matches for %v, want %v, got %v", test.query, test.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestParseQueryInvalid(t *testing.T) {
+	for _, query := range []string{"'unterminated", "'nocolon'", "('dmap.itemid:1'", "dmap.itemid:1", "'dmap.itemid:1')"} {
+		if _, err := parseQuery(query); err == nil {
+			t.Errorf("expected error for %v", query)
+		}
+	}
+}
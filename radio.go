@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RelayMode is how radio streams reach clients.
+type RelayMode int
+
+// RelayOff sends clients to the station's own URL. RelayStrip streams through
+// the server without the ICY metadata (the now playing titles interleaved
+// with the audio) and RelayForward streams through it with the metadata, for
+// clients that ask for it.
+const RelayOff RelayMode = 0
+const RelayStrip RelayMode = 1
+const RelayForward RelayMode = 2
+
+func parseRelayMode(s string) (RelayMode, error) {
+	switch s {
+	case "", "off":
+		return RelayOff, nil
+	case "strip":
+		return RelayStrip, nil
+	case "forward":
+		return RelayForward, nil
+	}
+	return RelayOff, fmt.Errorf("unknown radio relay '%v', want off, strip or forward", s)
+}
+
+// loadStations reads radio stations from a PLS or M3U playlist, or a JSON list
+// of {"title", "url", "genre"} objects, going by the file extension.
+func loadStations(path string) ([]Song, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pls":
+		return parsePLS(f)
+	case ".m3u", ".m3u8":
+		return parseM3U(f)
+	case ".json":
+		stations := []struct {
+			Title string `json:"title"`
+			URL   string `json:"url"`
+			Genre string `json:"genre"`
+		}{}
+		if err := json.NewDecoder(f).Decode(&stations); err != nil {
+			return nil, fmt.Errorf("cannot read stations from %v: %v", path, err)
+		}
+		songs := []Song{}
+		for _, station := range stations {
+			songs = append(songs, Song{Title: station.Title, StreamURL: station.URL, Genre: station.Genre})
+		}
+		return songs, nil
+	}
+	return nil, fmt.Errorf("unknown station list format '%v'", path)
+}
+
+// parsePLS reads the File, Title pairs of a PLS playlist.
+func parsePLS(r io.Reader) ([]Song, error) {
+	entries := map[int]*Song{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			continue
+		}
+		key, value := strings.ToLower(line[:eq]), strings.TrimSpace(line[eq+1:])
+		var field string
+		switch {
+		case strings.HasPrefix(key, "file"):
+			field = "file"
+		case strings.HasPrefix(key, "title"):
+			field = "title"
+		default:
+			continue
+		}
+		n, err := strconv.Atoi(key[len(field):])
+		if err != nil {
+			continue
+		}
+		if entries[n] == nil {
+			entries[n] = &Song{}
+		}
+		if field == "file" {
+			entries[n].StreamURL = value
+		} else {
+			entries[n].Title = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	numbers := []int{}
+	for n := range entries {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	songs := []Song{}
+	for _, n := range numbers {
+		song := entries[n]
+		if song.StreamURL == "" {
+			continue
+		}
+		if song.Title == "" {
+			song.Title = song.StreamURL
+		}
+		songs = append(songs, *song)
+	}
+	return songs, nil
+}
+
+// parseM3U reads an extended M3U playlist. The genre comes from an #EXTGRP
+// line or a group-title attribute on #EXTINF.
+func parseM3U(r io.Reader) ([]Song, error) {
+	songs := []Song{}
+	next := Song{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := strings.TrimPrefix(line, "#EXTINF:")
+			if comma := strings.Index(info, ","); comma >= 0 {
+				next.Title = strings.TrimSpace(info[comma+1:])
+				info = info[:comma]
+			}
+			if i := strings.Index(info, `group-title="`); i >= 0 {
+				genre := info[i+len(`group-title="`):]
+				if end := strings.Index(genre, `"`); end >= 0 {
+					next.Genre = genre[:end]
+				}
+			}
+		case strings.HasPrefix(line, "#EXTGRP:"):
+			next.Genre = strings.TrimSpace(strings.TrimPrefix(line, "#EXTGRP:"))
+		case strings.HasPrefix(line, "#"):
+		default:
+			next.StreamURL = line
+			if next.Title == "" {
+				next.Title = line
+			}
+			songs = append(songs, next)
+			next = Song{}
+		}
+	}
+	return songs, scanner.Err()
+}
+
+func radioDatabase(name string, stations []Song, relay RelayMode) Database {
+	songs := make([]Song, len(stations))
+	for i, station := range stations {
+		station.relay = relay
+		songs[i] = station
+	}
+	return Database{name: name, songs: songs, kind: RadioDatabase}
+}
+
+// dataURL is where clients should stream a song from themselves, only set for
+// radio stations that aren't relayed.
+func (s Song) dataURL() string {
+	if s.relay != RelayOff {
+		return ""
+	}
+	return s.StreamURL
+}
+
+// relayStream passes a radio stream on to the client, with or without the
+// station's ICY metadata.
+func relayStream(w http.ResponseWriter, r *http.Request, song Song) {
+	req, err := http.NewRequest("GET", song.StreamURL, nil)
+	if err != nil {
+		log.Printf("bad station URL: %v", err)
+		http.Error(w, "bad station URL", http.StatusBadGateway)
+		return
+	}
+	forward := song.relay == RelayForward && r.Header.Get("Icy-MetaData") == "1"
+	if forward {
+		req.Header.Set("Icy-MetaData", "1")
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(r.Context()))
+	if err != nil {
+		log.Printf("station stream failed: %v", err)
+		http.Error(w, "station stream failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("station stream failed: %v", resp.Status)
+		http.Error(w, "station stream failed", http.StatusBadGateway)
+		return
+	}
+
+	var body io.Reader = resp.Body
+	metaint, _ := strconv.Atoi(resp.Header.Get("Icy-Metaint"))
+	for name, values := range resp.Header {
+		if !strings.HasPrefix(strings.ToLower(name), "icy-") {
+			continue
+		}
+		if !forward && strings.EqualFold(name, "Icy-Metaint") {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	if !forward && metaint > 0 {
+		// the station sent metadata the client didn't ask for
+		body = &icyStripper{r: resp.Body, metaint: metaint, audioLeft: metaint}
+	}
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("station stream interrupted: %v", err)
+	}
+}
+
+// icyStripper removes the metadata blocks an ICY stream puts after every
+// metaint bytes of audio. Each block is a length byte, counting 16 byte units,
+// followed by that much metadata.
+type icyStripper struct {
+	r         io.Reader
+	metaint   int
+	audioLeft int
+}
+
+func (s *icyStripper) Read(p []byte) (int, error) {
+	if s.audioLeft == 0 {
+		var length [1]byte
+		if _, err := io.ReadFull(s.r, length[:]); err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, s.r, int64(length[0])*16); err != nil {
+			return 0, err
+		}
+		s.audioLeft = s.metaint
+	}
+	if len(p) > s.audioLeft {
+		p = p[:s.audioLeft]
+	}
+	n, err := s.r.Read(p)
+	s.audioLeft -= n
+	return n, err
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePLS(t *testing.T) {
+	pls := `[playlist]
+NumberOfEntries=3
+File1=http://one.example.com/stream
+Title1=Station One
+Length1=-1
+File2=http://two.example.com/stream.mp3
+Length2=-1
+title3=Station Three
+Version=2
+`
+	songs, err := parsePLS(strings.NewReader(pls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Song{
+		{Title: "Station One", StreamURL: "http://one.example.com/stream"},
+		{Title: "http://two.example.com/stream.mp3", StreamURL: "http://two.example.com/stream.mp3"},
+	}
+	if len(songs) != len(want) {
+		t.Fatalf("wrong number of stations, want %v, got %v", len(want), len(songs))
+	}
+	for i := range want {
+		if songs[i] != want[i] {
+			t.Errorf("wrong station %v, want %+v, got %+v", i, want[i], songs[i])
+		}
+	}
+}
+
+func TestParseM3U(t *testing.T) {
+	m3u := `#EXTM3U
+#EXTINF:-1 group-title="Jazz",Jazz Station
+http://jazz.example.com/live.aac
+
+#EXTINF:-1,News Station
+#EXTGRP:News
+http://news.example.com/live
+http://bare.example.com/live
+`
+	songs, err := parseM3U(strings.NewReader(m3u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Song{
+		{Title: "Jazz Station", Genre: "Jazz", StreamURL: "http://jazz.example.com/live.aac"},
+		{Title: "News Station", Genre: "News", StreamURL: "http://news.example.com/live"},
+		{Title: "http://bare.example.com/live", StreamURL: "http://bare.example.com/live"},
+	}
+	if len(songs) != len(want) {
+		t.Fatalf("wrong number of stations, want %v, got %v", len(want), len(songs))
+	}
+	for i := range want {
+		if songs[i] != want[i] {
+			t.Errorf("wrong station %v, want %+v, got %+v", i, want[i], songs[i])
+		}
+	}
+	if format := songs[0].format(); format != "aac" {
+		t.Errorf("wrong format: %v", format)
+	}
+}
+
+func TestLoadStationsJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stations.json")
+	ioutil.WriteFile(path, []byte(`[{"title": "one", "url": "http://one.example.com/", "genre": "Rock"}]`), 0644)
+	songs, err := loadStations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 1 || songs[0].Title != "one" || songs[0].Genre != "Rock" || songs[0].StreamURL != "http://one.example.com/" {
+		t.Errorf("wrong stations: %+v", songs)
+	}
+
+	if _, err := loadStations(filepath.Join(t.TempDir(), "stations.txt")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestRadioContainers(t *testing.T) {
+	database := radioDatabase("Radio", []Song{
+		{Title: "a", Genre: "Jazz"},
+		{Title: "b", Genre: "News"},
+		{Title: "c", Genre: "Jazz"},
+		{Title: "d"},
+	}, RelayOff)
+	containers := database.containers()
+	want := []container{
+		{name: "Jazz", ids: []int{1, 3}},
+		{name: "News", ids: []int{2}},
+		{name: "Other", ids: []int{4}},
+	}
+	if len(containers) != len(want) {
+		t.Fatalf("wrong containers: %+v", containers)
+	}
+	for i := range want {
+		if containers[i].name != want[i].name || len(containers[i].ids) != len(want[i].ids) {
+			t.Errorf("wrong container %v, want %+v, got %+v", i, want[i], containers[i])
+			continue
+		}
+		for j := range want[i].ids {
+			if containers[i].ids[j] != want[i].ids[j] {
+				t.Errorf("wrong container %v, want %+v, got %+v", i, want[i], containers[i])
+			}
+		}
+	}
+
+	if containers := (Database{name: "music", songs: []Song{{Genre: "Jazz"}}}).containers(); len(containers) != 0 {
+		t.Errorf("unexpected containers for a library: %+v", containers)
+	}
+}
+
+func radioTestRouter(relay RelayMode, station string) http.Handler {
+	databases := []Database{
+		{name: "testdb", songs: []Song{{Title: "a song"}}},
+		radioDatabase("Radio", []Song{
+			{Title: "Jazz Station", Genre: "Jazz", StreamURL: station + "/jazz"},
+			{Title: "News Station", Genre: "News", StreamURL: station + "/news"},
+		}, relay),
+	}
+	return routes(nil, newLibrary(databases), nil, nil, nil)
+}
+
+func TestGetRadioContainerItems(t *testing.T) {
+	router := radioTestRouter(RelayOff, "http://radio.example.com")
+
+	req, err := http.NewRequest("GET", "/databases/2/containers/2/items?meta=dmap.itemid,dmap.itemname,daap.songdataurl", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Errorf("wrong http status, want %v, got %v", http.StatusOK, resp.Code)
+	}
+	expectedData := []byte{
+		97, 112, 115, 111, 0, 0, 0, 12 + 9 + 12 + 12 + 8 + 8 + 12 + 20 + 37, // apso
+		109, 115, 116, 116, 0, 0, 0, 4, 0, 0, 0, 200, // mstt
+		109, 117, 116, 121, 0, 0, 0, 1, 0, // muty
+		109, 116, 99, 111, 0, 0, 0, 4, 0, 0, 0, 1, // mtco
+		109, 114, 99, 111, 0, 0, 0, 4, 0, 0, 0, 1, // mrco
+		109, 108, 99, 108, 0, 0, 0, 8 + 12 + 20 + 37, // mlcl
+		109, 108, 105, 116, 0, 0, 0, 12 + 20 + 37, // mlit
+		109, 105, 105, 100, 0, 0, 0, 4, 0, 0, 0, 2, // miid
+		109, 105, 110, 109, 0, 0, 0, 12, 'N', 'e', 'w', 's', ' ', 'S', 't', 'a', 't', 'i', 'o', 'n', // minm
+		97, 115, 117, 108, 0, 0, 0, 29, // asul
+	}
+	expectedData = append(expectedData, "http://radio.example.com/news"...)
+	if !bytes.Equal(resp.Body.Bytes(), expectedData) {
+		t.Errorf("response body doesn't match:\n%v\nwant:\n%v", resp.Body.Bytes(), expectedData)
+	}
+
+	for _, uri := range []string{"/databases/2/containers/3/items", "/databases/3/containers/1/items", "/databases/1/containers/1/items"} {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("wrong http status for %v, want %v, got %v", uri, http.StatusNotFound, resp.Code)
+		}
+	}
+}
+
+func TestGetRadioContainers(t *testing.T) {
+	router := radioTestRouter(RelayOff, "http://radio.example.com")
+	req, err := http.NewRequest("GET", "/databases/2/containers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	p := resp.Body.Bytes()
+	if !bytes.Contains(p, containerToData(1, container{name: "Jazz", ids: []int{1}})) || !bytes.Contains(p, containerToData(2, container{name: "News", ids: []int{2}})) {
+		t.Errorf("genres missing from containers:\n%v", p)
+	}
+}
+
+// icyStation streams audio with a metadata block after every 4 bytes, when
+// asked for it.
+func icyStation() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Header().Set("Icy-Name", "Test Station")
+		if r.Header.Get("Icy-MetaData") != "1" {
+			w.Write([]byte("audioaudio"))
+			return
+		}
+		w.Header().Set("Icy-Metaint", "4")
+		meta := append([]byte{1}, []byte("StreamTitle='x';")...)
+		w.Write([]byte("audi"))
+		w.Write(meta)
+		w.Write([]byte("oaud"))
+		w.Write([]byte{0})
+		w.Write([]byte("io"))
+	}))
+}
+
+func TestRelayStream(t *testing.T) {
+	station := icyStation()
+	defer station.Close()
+
+	tests := []struct {
+		relay    RelayMode
+		metadata string
+		want     string
+		metaint  string
+	}{
+		{RelayStrip, "1", "audioaudio", ""},
+		{RelayForward, "", "audioaudio", ""},
+		{RelayForward, "1", "audi\x01StreamTitle='x';oaud\x00io", "4"},
+	}
+	for _, test := range tests {
+		router := radioTestRouter(test.relay, station.URL)
+		req, err := http.NewRequest("GET", "/databases/2/items/1.mp3", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.metadata != "" {
+			req.Header.Set("Icy-MetaData", test.metadata)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Errorf("wrong http status, want %v, got %v", http.StatusOK, resp.Code)
+		}
+		if got := resp.Body.String(); got != test.want {
+			t.Errorf("wrong stream for relay %v metadata %q, want %q, got %q", test.relay, test.metadata, test.want, got)
+		}
+		if got := resp.Header().Get("Icy-Metaint"); got != test.metaint {
+			t.Errorf("wrong icy-metaint for relay %v metadata %q: %q", test.relay, test.metadata, got)
+		}
+		if got := resp.Header().Get("Icy-Name"); got != "Test Station" {
+			t.Errorf("icy headers not passed on: %v", resp.Header())
+		}
+	}
+}
+
+func TestIcyStripper(t *testing.T) {
+	stream := "audi\x01StreamTitle='x';oaud\x00io"
+	stripped, err := ioutil.ReadAll(&icyStripper{r: strings.NewReader(stream), metaint: 4, audioLeft: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stripped) != "audioaudio" {
+		t.Errorf("wrong stripped stream: %q", stripped)
+	}
+}
+
+func TestRadioRedirect(t *testing.T) {
+	router := radioTestRouter(RelayOff, "http://radio.example.com")
+	req, err := http.NewRequest("GET", "/databases/2/items/1.mp3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusFound || resp.Header().Get("Location") != "http://radio.example.com/jazz" {
+		t.Errorf("wrong redirect: %v %v", resp.Code, resp.Header())
+	}
+}
+
+func TestParseRelayMode(t *testing.T) {
+	for in, want := range map[string]RelayMode{"": RelayOff, "off": RelayOff, "strip": RelayStrip, "forward": RelayForward} {
+		if got, err := parseRelayMode(in); err != nil || got != want {
+			t.Errorf("wrong relay mode for %q: %v %v", in, got, err)
+		}
+	}
+	if _, err := parseRelayMode("sideways"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var errScanRunning = errors.New("a scan is already running")
+
+// ScanStatus is how the last rescan went, or how the current one is going.
+type ScanStatus struct {
+	Running   bool       `json:"running"`
+	Libraries []string   `json:"libraries"`
+	Current   string     `json:"current,omitempty"`
+	Songs     int        `json:"songs"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Errors    []string   `json:"errors"`
+}
+
+// Scanner rescans library roots in the background, replacing each database
+// in the library once its scan is done. One scan runs at a time.
+type Scanner struct {
+	library *Library
+
+	mu        sync.Mutex
+	libraries []LibraryConfig
+	status    ScanStatus
+	done      chan struct{}
+}
+
+func newScanner(library *Library, libraries []LibraryConfig) *Scanner {
+	done := make(chan struct{})
+	close(done)
+	return &Scanner{library: library, libraries: libraries, status: ScanStatus{Libraries: []string{}, Errors: []string{}}, done: done}
+}
+
+// setLibraries changes what can be scanned, e.g. after a reload.
+func (s *Scanner) setLibraries(libraries []LibraryConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.libraries = libraries
+}
+
+// start rescans the named libraries, or all of them if there are no names.
+func (s *Scanner) start(names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.Running {
+		return errScanRunning
+	}
+	configs := []LibraryConfig{}
+	if len(names) == 0 {
+		configs = append(configs, s.libraries...)
+	}
+	for _, name := range names {
+		found := false
+		for _, config := range s.libraries {
+			if config.Name == name {
+				configs = append(configs, config)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no library called '%v'", name)
+		}
+	}
+
+	now := time.Now()
+	s.status = ScanStatus{Running: true, Libraries: []string{}, Started: &now, Errors: []string{}}
+	for _, config := range configs {
+		s.status.Libraries = append(s.status.Libraries, config.Name)
+	}
+	s.done = make(chan struct{})
+	go s.run(configs, s.done)
+	return nil
+}
+
+func (s *Scanner) run(configs []LibraryConfig, done chan struct{}) {
+	defer close(done)
+	for _, config := range configs {
+		s.mu.Lock()
+		s.status.Current = config.Name
+		s.mu.Unlock()
+
+		start := time.Now()
+		database, err := scanLibraryProgress(config, func() {
+			s.mu.Lock()
+			s.status.Songs++
+			s.mu.Unlock()
+		})
+		serverMetrics.scanned(config.Name, time.Since(start), err)
+		if err == nil {
+			err = s.replace(database)
+		}
+		if err != nil {
+			log.Print(err)
+			s.mu.Lock()
+			s.status.Errors = append(s.status.Errors, err.Error())
+			s.mu.Unlock()
+			continue
+		}
+		log.Printf("rescanned %v songs from %v as %v", len(database.songs), config.Root, config.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.status.Running = false
+	s.status.Current = ""
+	s.status.Finished = &now
+}
+
+// replace swaps a rescanned database for the one with the same name.
+func (s *Scanner) replace(database Database) error {
+	for i, existing := range s.library.databases() {
+		if existing.name == database.name && existing.kind == LibraryDatabase {
+			s.library.setDatabase(i+1, database)
+			return nil
+		}
+	}
+	return fmt.Errorf("library %v isn't being served, reload to add it", database.name)
+}
+
+// progress returns the status of the current or last scan.
+func (s *Scanner) progress() ScanStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Libraries = append([]string{}, status.Libraries...)
+	status.Errors = append([]string{}, status.Errors...)
+	return status
+}
+
+// wait blocks until the current scan, if any, is done.
+func (s *Scanner) wait() {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	<-done
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeSongs(t *testing.T, root string, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("audio"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScanner(t *testing.T) {
+	music, podcasts := t.TempDir(), t.TempDir()
+	writeSongs(t, music, "Radiohead/OK Computer/01 Airbag.mp3")
+	writeSongs(t, podcasts, "Show/Episode 1.mp3")
+	configs := []LibraryConfig{{Name: "Music", Root: music}, {Name: "Podcasts", Root: podcasts}}
+	library := newLibrary([]Database{{name: "Music"}, {name: "Podcasts"}})
+	scanner := newScanner(library, configs)
+
+	if err := scanner.start([]string{"Films"}); err == nil {
+		t.Error("expected an error for an unknown library")
+	}
+
+	writeSongs(t, music, "Radiohead/OK Computer/02 Paranoid Android.mp3")
+	if err := scanner.start([]string{"Music"}); err != nil {
+		t.Fatal(err)
+	}
+	scanner.wait()
+	status := scanner.progress()
+	if status.Running || status.Songs != 2 || len(status.Libraries) != 1 || status.Libraries[0] != "Music" || len(status.Errors) != 0 || status.Finished == nil {
+		t.Errorf("wrong status: %+v", status)
+	}
+	if database, _ := library.database(1); len(database.songs) != 2 {
+		t.Errorf("music not rescanned: %+v", database.songs)
+	}
+	if database, _ := library.database(2); len(database.songs) != 0 {
+		t.Errorf("podcasts rescanned: %+v", database.songs)
+	}
+
+	os.RemoveAll(music)
+	if err := scanner.start(nil); err != nil {
+		t.Fatal(err)
+	}
+	scanner.wait()
+	status = scanner.progress()
+	if status.Songs != 1 || len(status.Libraries) != 2 || len(status.Errors) != 1 {
+		t.Errorf("wrong status: %+v", status)
+	}
+	if database, _ := library.database(1); len(database.songs) != 2 {
+		t.Errorf("music replaced after failing to scan: %+v", database.songs)
+	}
+	if database, _ := library.database(2); len(database.songs) != 1 {
+		t.Errorf("podcasts not rescanned: %+v", database.songs)
+	}
+}
+
+func TestScannerNotServed(t *testing.T) {
+	root := t.TempDir()
+	writeSongs(t, root, "01 Airbag.mp3")
+	library := newLibrary([]Database{{name: "Music"}})
+	scanner := newScanner(library, nil)
+	scanner.setLibraries([]LibraryConfig{{Name: "Audiobooks", Root: root}})
+
+	if err := scanner.start(nil); err != nil {
+		t.Fatal(err)
+	}
+	scanner.wait()
+	if status := scanner.progress(); len(status.Errors) != 1 {
+		t.Errorf("expected an error for a library that isn't served: %+v", status)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LibraryConfig says where a database's songs come from.
+type LibraryConfig struct {
+	Name string
+	Root string
+	// Formats are the file extensions to include, without the dot. Empty
+	// means every format the server knows a content type for.
+	Formats []string
+	// Kind is the media kind of everything in the library, unless a song's
+	// tags say otherwise. Zero means working it out song by song.
+	Kind MediaKind
+}
+
+// parseLibraryConfig reads a -library flag, e.g. Music=/srv/music or
+// Audiobooks=/srv/books;formats=m4b,mp3;kind=audiobook.
+func parseLibraryConfig(s string) (LibraryConfig, error) {
+	settings := strings.Split(s, ";")
+	eq := strings.Index(settings[0], "=")
+	if eq < 1 || eq == len(settings[0])-1 {
+		return LibraryConfig{}, fmt.Errorf("library '%v' should be name=root", s)
+	}
+	config := LibraryConfig{Name: settings[0][:eq], Root: settings[0][eq+1:]}
+	for _, setting := range settings[1:] {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return LibraryConfig{}, fmt.Errorf("library setting '%v' should be key=value", setting)
+		}
+		switch kv[0] {
+		case "formats":
+			for _, format := range strings.Split(kv[1], ",") {
+				config.Formats = append(config.Formats, strings.ToLower(strings.TrimPrefix(format, ".")))
+			}
+		case "kind":
+			kind, err := parseMediaKind(kv[1])
+			if err != nil {
+				return LibraryConfig{}, err
+			}
+			config.Kind = kind
+		default:
+			return LibraryConfig{}, fmt.Errorf("unknown library setting '%v'", kv[0])
+		}
+	}
+	return config, nil
+}
+
+func (c LibraryConfig) includes(format string) bool {
+	if len(c.Formats) == 0 {
+		_, ok := audioContentTypes[format]
+		return ok
+	}
+	return index(c.Formats, format) >= 0
+}
+
+// scanLibrary makes a database of the songs under a library's root. The
+// details come from the file's tags where it has them, see classifyFile, and
+// otherwise from where the file is, laid out as Artist/Album/NN Title.ext,
+// with the discs of a set in folders like Artist/Album/Disc 2. The tags read
+// don't include the artist, album, track or title, so those always come from
+// the path.
+func scanLibrary(config LibraryConfig) (Database, error) {
+	return scanLibraryProgress(config, func() {})
+}
+
+// scanLibraryProgress is scanLibrary, calling found for each song.
+func scanLibraryProgress(config LibraryConfig, found func()) (Database, error) {
+	songs := []Song{}
+	err := filepath.Walk(config.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != config.Root {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		song := Song{Path: path}
+		if !config.includes(song.format()) {
+			return nil
+		}
+		rel, err := filepath.Rel(config.Root, path)
+		if err != nil {
+			return err
+		}
+		dirs := strings.Split(filepath.ToSlash(filepath.Dir(rel)), "/")
+		if disc, ok := parseDiscName(dirs[len(dirs)-1]); ok && len(dirs) >= 2 {
+			// Artist/Album/Disc 2/NN Title.ext
+			song.DiscNumber = disc
+			dirs = dirs[:len(dirs)-1]
+		}
+		if len(dirs) >= 2 {
+			song.Artist = dirs[len(dirs)-2]
+		}
+		if dirs[len(dirs)-1] != "." {
+			song.Album = dirs[len(dirs)-1]
+		}
+		song.TrackNumber, song.Title = parseTrackName(strings.TrimSuffix(info.Name(), filepath.Ext(path)))
+		songs = append(songs, classifyFile(song, config.Kind))
+		found()
+		return nil
+	})
+	if err != nil {
+		return Database{}, fmt.Errorf("cannot scan library %v: %v", config.Name, err)
+	}
+	return Database{name: config.Name, songs: songs}, nil
+}
+
+// parseTrackName splits a file name like "03 Title" or "03 - Title" into its
+// track number and title.
+func parseTrackName(name string) (int, string) {
+	digits := 0
+	for digits < len(name) && name[digits] >= '0' && name[digits] <= '9' {
+		digits++
+	}
+	if digits == 0 || digits == len(name) || name[digits] != ' ' {
+		return 0, name
+	}
+	track, _ := strconv.Atoi(name[:digits])
+	title := strings.TrimPrefix(strings.TrimSpace(name[digits:]), "- ")
+	return track, title
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLibraryConfig(t *testing.T) {
+	config, err := parseLibraryConfig("Audiobooks=/srv/books;formats=m4b,.MP3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "Audiobooks" || config.Root != "/srv/books" {
+		t.Errorf("wrong config: %+v", config)
+	}
+	if len(config.Formats) != 2 || config.Formats[0] != "m4b" || config.Formats[1] != "mp3" {
+		t.Errorf("wrong formats: %v", config.Formats)
+	}
+
+	for _, bad := range []string{"", "Music", "=/srv/music", "Music=", "Music=/srv;formats", "Music=/srv;colour=blue"} {
+		if _, err := parseLibraryConfig(bad); err == nil {
+			t.Errorf("expected an error for '%v'", bad)
+		}
+	}
+}
+
+func TestParseTrackName(t *testing.T) {
+	tests := []struct {
+		name  string
+		track int
+		title string
+	}{
+		{"03 Airbag", 3, "Airbag"},
+		{"12 - Lucky", 12, "Lucky"},
+		{"Airbag", 0, "Airbag"},
+		{"1979", 0, "1979"},
+		{"99problems", 0, "99problems"},
+	}
+	for _, test := range tests {
+		track, title := parseTrackName(test.name)
+		if track != test.track || title != test.title {
+			t.Errorf("wrong parse of '%v', want %v %q, got %v %q", test.name, test.track, test.title, track, title)
+		}
+	}
+}
+
+func TestScanLibrary(t *testing.T) {
+	root := t.TempDir()
+	files := []string{
+		"Radiohead/OK Computer/01 Airbag.mp3",
+		"Radiohead/OK Computer/02 Paranoid Android.MP3",
+		"Radiohead/OK Computer/cover.jpg",
+		"The Beatles/The White Album/CD 2/01 Birthday.mp3",
+		"Loose/Track.m4a",
+		"single.flac",
+		".hidden/01 Secret.mp3",
+	}
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("audio"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	database, err := scanLibrary(LibraryConfig{Name: "Music", Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if database.name != "Music" {
+		t.Errorf("wrong name: %v", database.name)
+	}
+	want := []Song{
+		{Title: "Track", Album: "Loose", Path: filepath.Join(root, "Loose/Track.m4a"), MediaKind: MediaKindMusic},
+		{Title: "Airbag", Album: "OK Computer", Artist: "Radiohead", TrackNumber: 1, Path: filepath.Join(root, "Radiohead/OK Computer/01 Airbag.mp3"), MediaKind: MediaKindMusic},
+		{Title: "Paranoid Android", Album: "OK Computer", Artist: "Radiohead", TrackNumber: 2, Path: filepath.Join(root, "Radiohead/OK Computer/02 Paranoid Android.MP3"), MediaKind: MediaKindMusic},
+		{Title: "Birthday", Album: "The White Album", Artist: "The Beatles", TrackNumber: 1, DiscNumber: 2, Path: filepath.Join(root, "The Beatles/The White Album/CD 2/01 Birthday.mp3"), MediaKind: MediaKindMusic},
+		{Title: "single", Path: filepath.Join(root, "single.flac"), MediaKind: MediaKindMusic},
+	}
+	if len(database.songs) != len(want) {
+		t.Fatalf("wrong songs: %+v", database.songs)
+	}
+	for i := range want {
+		if database.songs[i] != want[i] {
+			t.Errorf("wrong song %v, want %+v, got %+v", i, want[i], database.songs[i])
+		}
+	}
+
+	database, err = scanLibrary(LibraryConfig{Name: "Music", Root: root, Formats: []string{"flac"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(database.songs) != 1 || database.songs[0].Title != "single" {
+		t.Errorf("formats not applied: %+v", database.songs)
+	}
+
+	if _, err := scanLibrary(LibraryConfig{Name: "Missing", Root: filepath.Join(root, "missing")}); err == nil {
+		t.Error("expected an error for a missing root")
+	}
+}
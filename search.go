@@ -0,0 +1,538 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// foldText normalizes text for searching: it is decomposed with NFKD, case
+// is folded and combining marks are dropped, so "Beyoncé", "BEYONCE" and
+// "ｂｅｙｏｎｃｅ" all become "beyonce". Letters that don't decompose, like ø
+// and ß, are folded by unfoldedRunes.
+func foldText(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return strings.ToLower(s)
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range norm.NFKD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if folded, ok := unfoldedRunes[r]; ok {
+			b.WriteString(folded)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// unfoldedRunes are the lower case letters that NFKD leaves alone but are
+// searched as other letters, mostly ones whose diacritic is part of the
+// letter.
+var unfoldedRunes = map[rune]string{
+	'æ': "ae",
+	'œ': "oe",
+	'ß': "ss",
+	'þ': "th",
+	'ð': "d",
+	'đ': "d",
+	'ħ': "h",
+	'ı': "i",
+	'ł': "l",
+	'ŀ': "l",
+	'ø': "o",
+	'ŧ': "t",
+	'ς': "σ",
+}
+
+// searchWords splits text into folded words. Apostrophes are dropped rather
+// than splitting, so "Don't" is the word "dont".
+func searchWords(s string) []string {
+	return foldedWords(foldText(s))
+}
+
+func foldedWords(folded string) []string {
+	words := strings.FieldsFunc(folded, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\'' && r != '’'
+	})
+	kept := words[:0]
+	for _, word := range words {
+		if strings.ContainsAny(word, "'’") {
+			word = strings.NewReplacer("'", "", "’", "").Replace(word)
+		}
+		if word != "" {
+			kept = append(kept, word)
+		}
+	}
+	return kept
+}
+
+// indexedFields are the query fields with text worth indexing.
+var indexedFields = map[string]func(Song) string{
+	"dmap.itemname":     func(s Song) string { return s.Title },
+	"daap.songartist":   func(s Song) string { return s.Artist },
+	"daap.songalbum":    func(s Song) string { return s.Album },
+	"daap.songcomposer": func(s Song) string { return s.Composer },
+	"daap.songgenre":    func(s Song) string { return s.Genre },
+}
+
+// searchIndex finds songs by the text of their titles, artists, albums,
+// composers and genres without looking at every song. Indexes are never
+// modified, update returns a new one sharing what hasn't changed, so they can
+// be used without locking.
+type searchIndex struct {
+	fields map[string]*fieldIndex
+	songs  int
+}
+
+// fieldIndex maps the folded values of one field, and the words in them, to
+// the ids of the songs that have them, in order.
+type fieldIndex struct {
+	values postings
+	words  postings
+}
+
+// postings map keys to sorted song ids, keeping the keys sorted too for
+// prefix lookups. owned are the keys whose ids were copied while updating,
+// which can be changed in place rather than copied again.
+type postings struct {
+	ids   map[string][]int
+	keys  []string
+	owned map[string]bool
+}
+
+func newSearchIndex(songs []Song) *searchIndex {
+	x := &searchIndex{fields: map[string]*fieldIndex{}, songs: len(songs)}
+	for field, text := range indexedFields {
+		f := &fieldIndex{values: postings{ids: map[string][]int{}}, words: postings{ids: map[string][]int{}}}
+		// artists, albums and genres repeat, so only fold each one once
+		folded := map[string]string{}
+		words := map[string][]string{}
+		for i, song := range songs {
+			value := text(song)
+			if value == "" {
+				continue
+			}
+			key, ok := folded[value]
+			if !ok {
+				key = foldText(value)
+				folded[value] = key
+				words[value] = foldedWords(key)
+			}
+			// ids only go up, so they stay sorted
+			id := i + 1
+			f.values.ids[key] = append(f.values.ids[key], id)
+			for _, word := range words[value] {
+				if ids := f.words.ids[word]; len(ids) == 0 || ids[len(ids)-1] != id {
+					f.words.ids[word] = append(ids, id)
+				}
+			}
+		}
+		f.values.sortKeys()
+		f.words.sortKeys()
+		x.fields[field] = f
+	}
+	return x
+}
+
+// change reindexes a song whose value for the field has changed, leaving
+// the words it still has alone.
+func (f *fieldIndex) change(id int, old, new string) {
+	oldKey, newKey := foldText(old), foldText(new)
+	if oldKey == newKey {
+		return
+	}
+	oldWords, newWords := map[string]bool{}, map[string]bool{}
+	for _, word := range foldedWords(oldKey) {
+		oldWords[word] = true
+	}
+	for _, word := range foldedWords(newKey) {
+		newWords[word] = true
+	}
+	if old != "" {
+		f.values.remove(oldKey, id)
+	}
+	if new != "" {
+		f.values.add(newKey, id)
+	}
+	for word := range oldWords {
+		if !newWords[word] {
+			f.words.remove(word, id)
+		}
+	}
+	for word := range newWords {
+		if !oldWords[word] {
+			f.words.add(word, id)
+		}
+	}
+}
+
+// add puts id in a key's postings. The first change to a key copies its ids,
+// as an older index might share them.
+func (p *postings) add(key string, id int) {
+	ids := p.ids[key]
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return
+	}
+	if !p.owned[key] {
+		ids = append(make([]int, 0, len(ids)+1), ids...)
+		p.owned[key] = true
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	p.ids[key] = ids
+}
+
+func (p *postings) remove(key string, id int) {
+	ids := p.ids[key]
+	i := sort.SearchInts(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return
+	}
+	if len(ids) == 1 {
+		delete(p.ids, key)
+		delete(p.owned, key)
+		return
+	}
+	if !p.owned[key] {
+		ids = append([]int{}, ids...)
+		p.owned[key] = true
+	}
+	p.ids[key] = append(ids[:i], ids[i+1:]...)
+}
+
+func (p *postings) sortKeys() {
+	p.keys = make([]string, 0, len(p.ids))
+	for key := range p.ids {
+		p.keys = append(p.keys, key)
+	}
+	sort.Strings(p.keys)
+}
+
+func (p postings) clone() postings {
+	ids := make(map[string][]int, len(p.ids))
+	for key, list := range p.ids {
+		ids[key] = list
+	}
+	return postings{ids: ids, owned: map[string]bool{}}
+}
+
+// prefixed returns the ids of every key starting with prefix.
+func (p postings) prefixed(prefix string) []int {
+	var lists [][]int
+	for i := sort.SearchStrings(p.keys, prefix); i < len(p.keys) && strings.HasPrefix(p.keys[i], prefix); i++ {
+		lists = append(lists, p.ids[p.keys[i]])
+	}
+	return unionIDs(lists...)
+}
+
+// matching returns the ids of every key match accepts.
+func (p postings) matching(match func(string) bool) []int {
+	var lists [][]int
+	for _, key := range p.keys {
+		if match(key) {
+			lists = append(lists, p.ids[key])
+		}
+	}
+	return unionIDs(lists...)
+}
+
+// update returns an index for songs, which replace old. Only the songs whose
+// text has changed are reindexed. A nil index is built from scratch.
+func (x *searchIndex) update(old []Song, songs []Song) *searchIndex {
+	if x == nil {
+		return newSearchIndex(songs)
+	}
+	type change struct {
+		id       int
+		old, new string
+	}
+	changed := map[string][]change{}
+	count := 0
+	for i := 0; i < len(old) || i < len(songs); i++ {
+		for field, text := range indexedFields {
+			var before, after string
+			if i < len(old) {
+				before = text(old[i])
+			}
+			if i < len(songs) {
+				after = text(songs[i])
+			}
+			if before != after {
+				changed[field] = append(changed[field], change{i + 1, before, after})
+				count++
+			}
+		}
+	}
+	if count > len(songs) {
+		// it's quicker to start again
+		return newSearchIndex(songs)
+	}
+
+	updated := &searchIndex{fields: map[string]*fieldIndex{}, songs: len(songs)}
+	for field, f := range x.fields {
+		changes := changed[field]
+		if len(changes) == 0 {
+			updated.fields[field] = f
+			continue
+		}
+		u := &fieldIndex{values: f.values.clone(), words: f.words.clone()}
+		for _, c := range changes {
+			u.change(c.id, c.old, c.new)
+		}
+		u.values.sortKeys()
+		u.words.sortKeys()
+		u.values.owned, u.words.owned = nil, nil
+		updated.fields[field] = u
+	}
+	return updated
+}
+
+// find returns the ids of the songs matching a query, in order. Terms on
+// indexed fields are looked up in the index and the rest are checked song by
+// song. A nil index checks everything song by song. The ids may be shared
+// with the index, so they must not be modified.
+func (x *searchIndex) find(q songQuery, songs []Song) []int {
+	if x == nil || x.songs != len(songs) {
+		return filterIDs(allIDs(len(songs)), q, songs)
+	}
+	switch q := q.(type) {
+	case andQuery:
+		var ids []int
+		var rest andQuery
+		for _, sub := range q {
+			if !x.indexed(sub) {
+				rest = append(rest, sub)
+				continue
+			}
+			if ids == nil {
+				ids = x.find(sub, songs)
+			} else {
+				ids = intersectIDs(ids, x.find(sub, songs))
+			}
+		}
+		if ids == nil {
+			ids = allIDs(len(songs))
+		}
+		return filterIDs(ids, rest, songs)
+	case orQuery:
+		lists := make([][]int, len(q))
+		for i, sub := range q {
+			lists[i] = x.find(sub, songs)
+		}
+		return unionIDs(lists...)
+	case termQuery:
+		f, ok := x.fields[q.field]
+		if !ok {
+			return filterIDs(allIDs(len(songs)), q, songs)
+		}
+		var ids []int
+		switch {
+		case q.value == "" && (q.prefix || q.suffix):
+			// a lone * matches even empty values
+			ids = allIDs(len(songs))
+		case q.contains:
+			ids = f.values.matching(func(value string) bool { return strings.Contains(value, q.value) })
+		case q.prefix:
+			ids = f.values.prefixed(q.value)
+		case q.suffix:
+			ids = f.values.matching(func(value string) bool { return strings.HasSuffix(value, q.value) })
+		case q.value == "":
+			// empty values aren't indexed
+			ids = filterIDs(allIDs(len(songs)), termQuery{field: q.field}, songs)
+		default:
+			ids = f.values.ids[q.value]
+		}
+		if q.negate {
+			return exceptIDs(len(songs), ids)
+		}
+		return ids
+	}
+	return filterIDs(allIDs(len(songs)), q, songs)
+}
+
+// indexed tells whether a query can be answered from the index alone.
+func (x *searchIndex) indexed(q songQuery) bool {
+	switch q := q.(type) {
+	case andQuery:
+		for _, sub := range q {
+			if !x.indexed(sub) {
+				return false
+			}
+		}
+		return len(q) > 0
+	case orQuery:
+		for _, sub := range q {
+			if !x.indexed(sub) {
+				return false
+			}
+		}
+		return true
+	case termQuery:
+		_, ok := x.fields[q.field]
+		return ok
+	}
+	return false
+}
+
+// search returns the ids of the songs with a word starting with each word in
+// text, in any indexed field. It's for finding songs as someone types, so
+// "radio ok" finds OK Computer by Radiohead. Text without any words matches
+// everything.
+func (x *searchIndex) search(text string, songs []Song) []int {
+	if x == nil || x.songs != len(songs) {
+		x = newSearchIndex(songs)
+	}
+	ids := allIDs(len(songs))
+	for i, word := range searchWords(text) {
+		var lists [][]int
+		for _, f := range x.fields {
+			lists = append(lists, f.words.prefixed(word))
+		}
+		if i == 0 {
+			ids = unionIDs(lists...)
+		} else {
+			ids = intersectIDs(ids, unionIDs(lists...))
+		}
+	}
+	return ids
+}
+
+func allIDs(n int) []int {
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	return ids
+}
+
+func filterIDs(ids []int, q songQuery, songs []Song) []int {
+	if sub, ok := q.(andQuery); ok && len(sub) == 0 {
+		return ids
+	}
+	filtered := []int{}
+	for _, id := range ids {
+		if q.matches(id, songs[id-1]) {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered
+}
+
+func unionIDs(lists ...[]int) []int {
+	switch len(lists) {
+	case 0:
+		return []int{}
+	case 1:
+		return lists[0]
+	}
+	total, max := 0, 0
+	for _, list := range lists {
+		total += len(list)
+		if len(list) > 0 && list[len(list)-1] > max {
+			max = list[len(list)-1]
+		}
+	}
+	if total > max/16 {
+		// mark them off rather than sorting lots of ids
+		found := make([]bool, max+1)
+		for _, list := range lists {
+			for _, id := range list {
+				found[id] = true
+			}
+		}
+		ids := make([]int, 0, total)
+		for id, ok := range found {
+			if ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	ids := make([]int, 0, total)
+	for _, list := range lists {
+		ids = append(ids, list...)
+	}
+	sort.Ints(ids)
+	unique := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+func intersectIDs(a, b []int) []int {
+	ids := []int{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			ids = append(ids, a[i])
+			i++
+			j++
+		}
+	}
+	return ids
+}
+
+// keepIDs returns the ids, in their order, that are also in found.
+func keepIDs(ids []int, found []int) []int {
+	keep := map[int]bool{}
+	for _, id := range found {
+		keep[id] = true
+	}
+	kept := []int{}
+	for _, id := range ids {
+		if keep[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// exceptIDs returns the ids up to n that aren't in ids.
+func exceptIDs(n int, ids []int) []int {
+	except := make([]int, 0, n-len(ids))
+	next := 0
+	for id := 1; id <= n; id++ {
+		if next < len(ids) && ids[next] == id {
+			next++
+			continue
+		}
+		except = append(except, id)
+	}
+	return except
+}
+
+// find returns the ids of the songs in the database matching a query.
+func (d Database) find(q songQuery) []int {
+	return d.index.find(q, d.songs)
+}
+
+// search returns the ids of the songs in the database with words starting
+// with the words in text.
+func (d Database) search(text string) []int {
+	return d.index.search(text, d.songs)
+}
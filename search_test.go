@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFoldText(t *testing.T) {
+	tests := map[string]string{
+		"Radiohead":         "radiohead",
+		"Beyoncé":           "beyonce",
+		"BEYONCÉ":           "beyonce",
+		"ｂｅｙｏｎｃｅ":           "beyonce",
+		"Beyonce\u0301":     "beyonce",
+		"Sigur Rós":         "sigur ros",
+		"Motörhead":         "motorhead",
+		"Straße":            "strasse",
+		"Æther ﬁre":         "aether fire",
+		"Mø":                "mo",
+		"Łódź":              "lodz",
+		"Σίγουρα":           "σιγουρα",
+		"坂本龍一":              "坂本龍一",
+		"MC²":               "mc2",
+		"Don't Stop Me Now": "don't stop me now",
+		"Muḥammad Ṣāliḥ":    "muhammad salih",
+		"Ḱ":                 "k",
+		"Ёлка":              "елка",
+		"½ Life™":           "1⁄2 lifetm",
+		"Ǻ Ǖ Ṩ":             "a u s",
+	}
+	for text, want := range tests {
+		if got := foldText(text); got != want {
+			t.Errorf("foldText(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestFoldDecomposed(t *testing.T) {
+	// e followed by a combining acute accent, as macOS file names have it
+	decomposed := "Beyonce\u0301 Cafe\u0301"
+	if got := foldText(decomposed); got != "beyonce cafe" {
+		t.Errorf("foldText(%q) = %q", decomposed, got)
+	}
+	if foldText(decomposed) != foldText("Beyoncé Café") {
+		t.Error("decomposed and precomposed text should fold the same")
+	}
+	if got := searchWords(decomposed); !reflect.DeepEqual(got, []string{"beyonce", "cafe"}) {
+		t.Errorf("wrong words %q", got)
+	}
+}
+
+func TestSearchWords(t *testing.T) {
+	got := searchWords("Don’t Stop — Me Now (Remastered 2011), Café!")
+	want := []string{"dont", "stop", "me", "now", "remastered", "2011", "cafe"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong words %q, want %q", got, want)
+	}
+}
+
+var searchTestSongs = []Song{
+	{Title: "Airbag", Album: "OK Computer", Artist: "Radiohead", Genre: "Rock"},
+	{Title: "Hoppípolla", Album: "Takk...", Artist: "Sigur Rós", Genre: "Post-Rock"},
+	{Title: "Lucky", Album: "OK Computer", Artist: "Radiohead", Genre: "Rock", TrackNumber: 11},
+	{Title: "Gnossienne No. 1", Album: "Gnossiennes", Artist: "Pascal Rogé", Composer: "Erik Satie", Genre: "Classical"},
+	{Title: "Déjà Vu", Album: "B'Day", Artist: "Beyoncé", Composer: "Beyoncé Knowles"},
+	{Title: "Untitled"},
+}
+
+// The index must find exactly what checking every song finds.
+func TestSearchIndexFind(t *testing.T) {
+	index := newSearchIndex(searchTestSongs)
+	for _, query := range []string{
+		"",
+		"'daap.songartist:radiohead'",
+		"'daap.songartist:Sigur Ros'",
+		"'daap.songartist!:Radiohead'",
+		"'daap.songalbum:ok*'",
+		"'daap.songalbum:*es'",
+		"'dmap.itemname:*o*'",
+		"'daap.songcomposer:*satie*'",
+		"'daap.songgenre:'",
+		"'daap.songgenre!:'",
+		"'daap.songgenre:*'",
+		"'daap.songartist:Radiohead'+'daap.songtracknumber:11'",
+		"'daap.songartist:Radiohead','daap.songgenre:Classical'",
+		"('daap.songgenre:*rock'+'dmap.itemname!:Lucky'),'dmap.itemid:5'",
+		"'daap.songtracknumber:11'",
+		"'com.apple.itunes.unknown:1'+'daap.songartist:Beyonce'",
+	} {
+		q, err := parseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := filterIDs(allIDs(len(searchTestSongs)), q, searchTestSongs)
+		if got := index.find(q, searchTestSongs); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v: found %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestSearchIndexSearch(t *testing.T) {
+	index := newSearchIndex(searchTestSongs)
+	tests := map[string][]int{
+		"radio":          {1, 3},
+		"radio ok":       {1, 3},
+		"radio lucky":    {3},
+		"ROS":            {2},
+		"hoppipolla":     {2},
+		"satie":          {4},
+		"bday":           {5},
+		"rock":           {1, 2, 3},
+		"nothing at all": {},
+		"!!":             {1, 2, 3, 4, 5, 6},
+	}
+	for text, want := range tests {
+		if got := index.search(text, searchTestSongs); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%v: found %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestSearchIndexUpdate(t *testing.T) {
+	index := newSearchIndex(searchTestSongs)
+	songs := append([]Song{}, searchTestSongs...)
+	songs[0].Title = "Paranoid Android"
+	songs[4].Artist = "Destiny's Child"
+	songs = append(songs, Song{Title: "Creep", Artist: "Radiohead"})
+	updated := index.update(searchTestSongs, songs)
+
+	if !reflect.DeepEqual(updated, newSearchIndex(songs)) {
+		t.Error("updated index doesn't match a new one")
+	}
+	// the old index is left as it was
+	if !reflect.DeepEqual(index, newSearchIndex(searchTestSongs)) {
+		t.Error("old index changed")
+	}
+	if updated.fields["daap.songgenre"] != index.fields["daap.songgenre"] {
+		t.Error("unchanged field was reindexed")
+	}
+	if got := updated.search("radiohead", songs); fmt.Sprint(got) != "[1 3 7]" {
+		t.Errorf("wrong songs after update: %v", got)
+	}
+
+	shorter := index.update(searchTestSongs, searchTestSongs[:2])
+	if !reflect.DeepEqual(shorter, newSearchIndex(searchTestSongs[:2])) {
+		t.Error("index of fewer songs doesn't match a new one")
+	}
+}
+
+func TestLibraryUpdatesIndex(t *testing.T) {
+	library := newLibrary([]Database{{name: "Music", songs: searchTestSongs}})
+	library.setDatabase(1, Database{name: "Music", songs: append([]Song{{Title: "Creep", Artist: "Radiohead"}}, searchTestSongs...)})
+	database, _ := library.database(1)
+	if got := database.search("radiohead"); fmt.Sprint(got) != "[1 2 4]" {
+		t.Errorf("wrong songs after a rescan: %v", got)
+	}
+}
+
+func benchmarkFind(b *testing.B, query string, index *searchIndex, songs []Song) {
+	q, err := parseQuery(query)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.find(q, songs)
+	}
+}
+
+func searchBenchmarkSongs() []Song {
+	songs := syntheticDatabase(80000).songs
+	for i := range songs {
+		songs[i].Genre = []string{"Rock", "Jazz", "Electronic", "Classical"}[i%4]
+	}
+	return songs
+}
+
+func BenchmarkFindPrefixScan(b *testing.B) {
+	benchmarkFind(b, "'daap.songartist:Artist 12*'", nil, searchBenchmarkSongs())
+}
+
+func BenchmarkFindPrefixIndex(b *testing.B) {
+	songs := searchBenchmarkSongs()
+	benchmarkFind(b, "'daap.songartist:Artist 12*'", newSearchIndex(songs), songs)
+}
+
+func BenchmarkFindAndScan(b *testing.B) {
+	benchmarkFind(b, "'daap.songgenre:Jazz'+'daap.songalbum:Album 4*'", nil, searchBenchmarkSongs())
+}
+
+func BenchmarkFindAndIndex(b *testing.B) {
+	songs := searchBenchmarkSongs()
+	benchmarkFind(b, "'daap.songgenre:Jazz'+'daap.songalbum:Album 4*'", newSearchIndex(songs), songs)
+}
+
+func BenchmarkSearchWords(b *testing.B) {
+	songs := searchBenchmarkSongs()
+	index := newSearchIndex(songs)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.search("artist 66 track 1", songs)
+	}
+}
+
+func BenchmarkNewSearchIndex(b *testing.B) {
+	songs := searchBenchmarkSongs()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newSearchIndex(songs)
+	}
+}
+
+func BenchmarkUpdateSearchIndex(b *testing.B) {
+	songs := searchBenchmarkSongs()
+	index := newSearchIndex(songs)
+	changed := append([]Song{}, songs...)
+	for i := 0; i < len(changed); i += 1000 {
+		changed[i].Title = strings.ToUpper(changed[i].Title) + " (Live)"
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.update(songs, changed)
+	}
+}
+
+func BenchmarkFoldText(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		foldText("Sigur Rós - Hoppípolla")
+	}
+}
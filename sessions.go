@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errSessionExpired = errors.New("session has expired")
+
+// Session is a logged in DAAP client.
+type Session struct {
+	ID          int       `json:"id"`
+	ClientIP    string    `json:"client_ip"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	DAAPVersion string    `json:"daap_version,omitempty"`
+	Remote      bool      `json:"remote"`
+	Started     time.Time `json:"started"`
+	LastSeen    time.Time `json:"last_seen"`
+	// Streaming is the song being streamed, if any.
+	Streaming string `json:"streaming,omitempty"`
+}
+
+// Sessions keeps track of logged in clients. Clients don't always log out,
+// so sessions not seen for the session timeout are forgotten.
+type Sessions struct {
+	mu       sync.Mutex
+	sessions map[int]*Session
+	// expired sessions are refused until the client would have timed out
+	// anyway, so it logs in again.
+	expired map[int]time.Time
+	now     func() time.Time
+}
+
+func newSessions() *Sessions {
+	return &Sessions{
+		sessions: map[int]*Session{},
+		expired:  map[int]time.Time{},
+		now:      time.Now,
+	}
+}
+
+// login starts a session with a new random id.
+func (s *Sessions) login(r *http.Request, remote bool) Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.pruneLocked(now)
+	id := s.newIDLocked()
+	session := &Session{
+		ID:          id,
+		ClientIP:    clientIP(r),
+		UserAgent:   r.UserAgent(),
+		DAAPVersion: r.Header.Get("Client-DAAP-Version"),
+		Remote:      remote,
+		Started:     now,
+		LastSeen:    now,
+	}
+	s.sessions[id] = session
+	return *session
+}
+
+func (s *Sessions) newIDLocked() int {
+	for {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		// mlid is a signed int, keep it positive
+		id := int(binary.BigEndian.Uint32(b[:]) & 0x7fffffff)
+		if _, ok := s.sessions[id]; id != 0 && !ok {
+			return id
+		}
+	}
+}
+
+// logout ends a session.
+func (s *Sessions) logout(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// expire ends a session and refuses it from then on, so the client has to
+// log in again. It returns false if there's no such session.
+func (s *Sessions) expire(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		return false
+	}
+	delete(s.sessions, id)
+	s.expired[id] = s.now()
+	return true
+}
+
+// seen notes a request in a session. Sessions that aren't known, e.g. from
+// before a restart, are picked up rather than refused.
+func (s *Sessions) seen(id int, r *http.Request) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.pruneLocked(now)
+	if _, ok := s.expired[id]; ok {
+		return nil, errSessionExpired
+	}
+	session, ok := s.sessions[id]
+	if !ok {
+		session = &Session{
+			ID:          id,
+			ClientIP:    clientIP(r),
+			UserAgent:   r.UserAgent(),
+			DAAPVersion: r.Header.Get("Client-DAAP-Version"),
+			Started:     now,
+		}
+		s.sessions[id] = session
+	}
+	session.LastSeen = now
+	return session, nil
+}
+
+// remote reports whether a request is in a session a paired remote logged in
+// with. It is safe to call on nil Sessions, which have no remotes.
+func (s *Sessions) remote(r *http.Request) bool {
+	if s == nil {
+		return false
+	}
+	id, ok := requestSessionID(r)
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	return ok && session.Remote && s.now().Sub(session.LastSeen) <= currentShare().sessionTimeout
+}
+
+// streaming sets the song a session is streaming.
+func (s *Sessions) streaming(session *Session, item string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.Streaming = item
+}
+
+// doneStreaming clears the song a session is streaming once it's done, if the
+// session hasn't moved on to another song in the meantime.
+func (s *Sessions) doneStreaming(session *Session, item string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session.Streaming == item {
+		session.Streaming = ""
+	}
+}
+
+// pruneLocked forgets sessions and expiries older than the session timeout.
+// Callers must hold the lock.
+func (s *Sessions) pruneLocked(now time.Time) {
+	timeout := currentShare().sessionTimeout
+	for id, expired := range s.expired {
+		if now.Sub(expired) > timeout {
+			delete(s.expired, id)
+		}
+	}
+	for id, session := range s.sessions {
+		if now.Sub(session.LastSeen) > timeout {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// active lists the sessions seen within the session timeout, oldest first.
+func (s *Sessions) active() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(s.now())
+	sessions := []Session{}
+	for _, session := range s.sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].Started.Equal(sessions[j].Started) {
+			return sessions[i].Started.Before(sessions[j].Started)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+type sessionKey struct{}
+
+// sessionContext is what track leaves in a request's context.
+type sessionContext struct {
+	sessions *Sessions
+	session  *Session
+}
+
+// track notes each request in its session, refusing expired ones with errors
+// from writeError. Songs being streamed show up in the session while they
+// play, through noteItem and doneItem.
+func (s *Sessions) track(writeError errorWriter, inner http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := requestSessionID(r)
+		if !ok {
+			inner(w, r)
+			return
+		}
+		session, err := s.seen(id, r)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), sessionKey{}, sessionContext{s, session}))
+		inner(w, r)
+	})
+}
+
+// requestSessionID reads the session-id parameter of a request.
+func requestSessionID(r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.URL.Query().Get("session-id"))
+	return id, err == nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
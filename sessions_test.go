@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	sessions := newSessions()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	sessions.now = func() time.Time { return now }
+
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.Header.Set("User-Agent", "iTunes/12.0")
+	req.Header.Set("Client-DAAP-Version", "3.0")
+	first := sessions.login(req, false)
+	now = now.Add(time.Minute)
+	second := sessions.login(req, true)
+	if first.ID == second.ID || first.ID <= 0 || second.ID <= 0 {
+		t.Errorf("bad session ids %v and %v", first.ID, second.ID)
+	}
+	if first.ClientIP != "192.0.2.1" || first.UserAgent != "iTunes/12.0" || first.DAAPVersion != "3.0" {
+		t.Errorf("wrong client info: %+v", first)
+	}
+
+	active := sessions.active()
+	if len(active) != 2 || active[0].ID != first.ID || active[1].ID != second.ID {
+		t.Fatalf("wrong active sessions: %+v", active)
+	}
+
+	// unknown sessions, e.g. from before a restart, are picked up
+	if _, err := sessions.seen(42, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions.active()) != 3 {
+		t.Errorf("unknown session not picked up: %+v", sessions.active())
+	}
+	sessions.logout(42)
+
+	if !sessions.expire(first.ID) {
+		t.Error("expected to expire the first session")
+	}
+	if sessions.expire(first.ID) {
+		t.Error("expected the first session to be gone")
+	}
+	if _, err := sessions.seen(first.ID, req); err != errSessionExpired {
+		t.Errorf("expected an expired session, got %v", err)
+	}
+
+	// idle sessions time out, and expired ones can be used again after that
+	now = now.Add(currentShare().sessionTimeout + time.Second)
+	if active := sessions.active(); len(active) != 0 {
+		t.Errorf("expected sessions to time out: %+v", active)
+	}
+	if _, err := sessions.seen(first.ID, req); err != nil {
+		t.Errorf("expected the expired session to be forgotten, got %v", err)
+	}
+}
+
+func TestSessionsPrunedWhenSeen(t *testing.T) {
+	sessions := newSessions()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	sessions.now = func() time.Time { return now }
+
+	req := httptest.NewRequest("GET", "/databases", nil)
+	for id := 1; id <= 100; id++ {
+		sessions.seen(id, req)
+	}
+	now = now.Add(currentShare().sessionTimeout + time.Second)
+	sessions.seen(1000, req)
+	sessions.login(req, false)
+	if len(sessions.sessions) != 2 {
+		t.Errorf("idle sessions not pruned, %v left", len(sessions.sessions))
+	}
+}
+
+func TestSessionsTrack(t *testing.T) {
+	sessions := newSessions()
+	session := sessions.login(httptest.NewRequest("GET", "/login", nil), false)
+	var streaming string
+	handler := sessions.track(http.Error, func(w http.ResponseWriter, r *http.Request) {
+		song := Song{Artist: "Radiohead", Album: "OK Computer", Title: "Airbag"}
+		noteItem(r, song)
+		defer doneItem(r, song)
+		streaming = sessions.active()[0].Streaming
+	})
+
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/databases/1/items/1.mp3?session-id="+strconv.Itoa(session.ID), nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("wrong status %v", rr.Code)
+	}
+	if streaming != "Radiohead - OK Computer - Airbag" {
+		t.Errorf("wrong song streaming: %q", streaming)
+	}
+	if active := sessions.active(); active[0].Streaming != "" {
+		t.Errorf("still streaming after the request: %+v", active)
+	}
+
+	// a stream ending doesn't clear the next one, which started while it
+	// finished, and requests that aren't streams leave it alone
+	id := strconv.Itoa(session.ID)
+	next := sessions.track(http.Error, func(w http.ResponseWriter, r *http.Request) {
+		noteItem(r, Song{Artist: "Radiohead", Album: "OK Computer", Title: "Paranoid Android"})
+	})
+	overlapping := sessions.track(http.Error, func(w http.ResponseWriter, r *http.Request) {
+		song := Song{Artist: "Radiohead", Album: "OK Computer", Title: "Airbag"}
+		noteItem(r, song)
+		defer doneItem(r, song)
+		next(httptest.NewRecorder(), httptest.NewRequest("GET", "/databases/1/items/2.mp3?session-id="+id, nil))
+	})
+	overlapping(httptest.NewRecorder(), httptest.NewRequest("GET", "/databases/1/items/1.mp3?session-id="+id, nil))
+	sessions.track(http.Error, func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest("GET", "/update?session-id="+id, nil))
+	if active := sessions.active(); active[0].Streaming != "Radiohead - OK Computer - Paranoid Android" {
+		t.Errorf("wrong song streaming: %+v", active)
+	}
+
+	sessions.expire(session.ID)
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/databases?session-id="+strconv.Itoa(session.ID), nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected an expired session to be refused, got %v", rr.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SongStats is what the server remembers about a song being listened to,
+// including how much the user likes it. They are kept in the library index,
+// see Library.useIndex.
+type SongStats struct {
+	Rating      int       `json:"rating,omitempty"` // 0 to 100
+	PlayCount   int       `json:"play_count,omitempty"`
+	SkipCount   int       `json:"skip_count,omitempty"`
+	LastPlayed  time.Time `json:"last_played"`
+	LastSkipped time.Time `json:"last_skipped"`
+}
+
+// statsSaveDelay is how long changed stats wait before the library index is
+// saved, so a run of plays and ratings is written once.
+var statsSaveDelay = 10 * time.Second
+
+// songStats hold a song's stats where every copy of the song sees them, so a
+// play or rating updates the song in place instead of copying the library.
+type songStats struct {
+	mu sync.Mutex
+	SongStats
+}
+
+// stats are the song's current stats. A song that isn't in a library has
+// none.
+func (s Song) stats() SongStats {
+	if s.live == nil {
+		return SongStats{}
+	}
+	s.live.mu.Lock()
+	defer s.live.mu.Unlock()
+	return s.live.SongStats
+}
+
+// statsKey identifies a song across rescans: its path, or for proxied songs
+// what it is, since they have no path and their ids change.
+func (s Song) statsKey() string {
+	if s.Path != "" {
+		return s.Path
+	}
+	return strings.ToLower(strings.Join([]string{s.Artist, s.Album, s.Title}, "\x00"))
+}
+
+// playTracker calls played once the last byte of a song has been read, which
+// is as close as the server gets to knowing a client listened to it all. At
+// least half the song has to have been read too, so a client fetching just
+// the end of the file, such as for an ID3v1 tag, doesn't count as a play.
+type playTracker struct {
+	io.ReadSeeker
+	size   int64
+	offset int64
+	read   int64
+	played func()
+	done   bool
+}
+
+func (t *playTracker) Read(p []byte) (int, error) {
+	n, err := t.ReadSeeker.Read(p)
+	t.offset += int64(n)
+	t.read += int64(n)
+	if n > 0 && !t.done && t.offset >= t.size && t.read*2 >= t.size {
+		t.done = true
+		t.played()
+	}
+	return n, err
+}
+
+func (t *playTracker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := t.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		t.offset = pos
+	}
+	return pos, err
+}
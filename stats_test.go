@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLibraryIndexPersist(t *testing.T) {
+	defer func(delay time.Duration) { statsSaveDelay = delay }(statsSaveDelay)
+	statsSaveDelay = time.Hour
+
+	path := filepath.Join(t.TempDir(), "library.json")
+	songs := func() []Song { return []Song{{Title: "a", Path: "/music/a.mp3"}, {Title: "b", Path: "/music/b.mp3"}} }
+	library := newLibrary([]Database{{name: "testdb", songs: songs()}})
+	if err := library.useIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	played := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	library.recordPlay(1, library.databases()[0].songs[0], false, played)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("index saved straight away: %v", err)
+	}
+	// a song that leaves the library keeps its stats
+	library.setDatabase(1, Database{name: "testdb", songs: songs()[1:]})
+	if err := library.saveIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newLibrary([]Database{{name: "testdb", songs: songs()}})
+	if err := reloaded.useIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	got := reloaded.databases()[0].songs[0].stats()
+	if got.PlayCount != 1 || !got.LastPlayed.Equal(played) {
+		t.Errorf("wrong stats after reload: %+v", got)
+	}
+	if got := reloaded.databases()[0].songs[1].stats(); got != (SongStats{}) {
+		t.Errorf("unexpected stats for an unplayed song: %+v", got)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "b.mp3") {
+		t.Errorf("unplayed song saved: %s", data)
+	}
+	if !strings.Contains(string(data), `"last_skipped": "0001-01-01T00:00:00Z"`) {
+		t.Errorf("times not saved as they are: %s", data)
+	}
+}
+
+func TestLibraryIndexSaveDelay(t *testing.T) {
+	defer func(delay time.Duration) { statsSaveDelay = delay }(statsSaveDelay)
+	statsSaveDelay = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "library.json")
+	library := newLibrary([]Database{{name: "testdb", songs: []Song{{Title: "a", Path: "/music/a.mp3"}}}})
+	if err := library.useIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	library.recordPlay(1, library.databases()[0].songs[0], true, time.Now())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := ioutil.ReadFile(path)
+		if strings.Contains(string(data), `"skip_count": 1`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("index never saved")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRecordPlay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "library.json")
+	if err := ioutil.WriteFile(path, []byte(`{"/music/b.mp3": {"play_count": 7}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	library := newLibrary([]Database{
+		{name: "testdb", songs: []Song{{Title: "a", Path: "/music/a.mp3"}, {Title: "b", Path: "/music/b.mp3"}}},
+	})
+	if err := library.useIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := library.databases()[0].songs[1].stats().PlayCount; got != 7 {
+		t.Errorf("stats not applied, play count %v", got)
+	}
+
+	before := library.databases()
+	revision := library.revision()
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	library.recordPlay(1, before[0].songs[0], false, when)
+	library.recordPlay(1, before[0].songs[0], true, when)
+
+	stats := library.databases()[0].songs[0].stats()
+	if stats.PlayCount != 1 || stats.SkipCount != 1 || !stats.LastPlayed.Equal(when) || !stats.LastSkipped.Equal(when) {
+		t.Errorf("wrong stats recorded: %+v", stats)
+	}
+	if &library.databases()[0].songs[0] != &before[0].songs[0] {
+		t.Error("recording a play copied the songs")
+	}
+	if library.revision() != revision {
+		t.Error("recording a play bumped the revision")
+	}
+	if library.playsRecorded() != 2 {
+		t.Errorf("wrong plays recorded: %v", library.playsRecorded())
+	}
+
+	// a rescan keeps the stats, and plays counted against songs from
+	// before it
+	library.setDatabase(1, Database{name: "testdb", songs: []Song{{Title: "a", Path: "/music/a.mp3"}}})
+	library.recordPlay(1, before[0].songs[0], false, when)
+	if got := library.databases()[0].songs[0].stats().PlayCount; got != 2 {
+		t.Errorf("stats lost by setDatabase, play count %v", got)
+	}
+}
+
+func TestStreamCountsPlays(t *testing.T) {
+	f, err := ioutil.TempFile("", "song*.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not really an mp3 but long enough")
+	f.Close()
+
+	library := newLibrary([]Database{{name: "testdb", songs: []Song{{Title: "aname", Path: f.Name()}}}})
+	router := routes(nil, library, nil, nil, nil)
+
+	stream := func(rangeHeader string) {
+		req, err := http.NewRequest("GET", "/databases/1/items/1.mp3?session-id=113", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	stream("bytes=0-3")
+	if got := library.databases()[0].songs[0].stats().PlayCount; got != 0 {
+		t.Errorf("partial stream counted as a play: %v", got)
+	}
+	stream("bytes=-4")
+	if got := library.databases()[0].songs[0].stats().PlayCount; got != 0 {
+		t.Errorf("reading the end of the file counted as a play: %v", got)
+	}
+	stream("")
+	if got := library.databases()[0].songs[0].stats().PlayCount; got != 1 {
+		t.Errorf("full stream not counted as a play: %v", got)
+	}
+
+	// the count shows up in listings, and isn't hidden by the cache
+	req, err := http.NewRequest("GET", "/databases/1/items?meta=daap.songplaycount,daap.songdateplayed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	stream("")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	body := resp.Body.Bytes()
+	count := []byte{'a', 's', 'p', 'c', 0, 0, 0, 4, 0, 0, 0, 2}
+	if !strings.Contains(string(body), string(count)) {
+		t.Errorf("play count not in listing: %v", body)
+	}
+	if !strings.Contains(string(body), "aspl") {
+		t.Errorf("date played not in listing: %v", body)
+	}
+}
+
+func TestPlayerCountsPlaysAndSkips(t *testing.T) {
+	library := newLibrary([]Database{
+		{name: "testdb", songs: []Song{{Title: "one"}, {Title: "two"}}},
+	})
+	player := newFakePlayer()
+	router := remoteRouter(t, library, player)
+	dacpRequest(t, router, "/ctrl-int/1/cue?command=play")
+
+	// skipping the first song, then listening to the second
+	dacpRequest(t, router, "/ctrl-int/1/nextitem")
+	player.finishSong()
+
+	songs := library.databases()[0].songs
+	if stats := songs[0].stats(); stats.PlayCount != 0 || stats.SkipCount != 1 {
+		t.Errorf("wrong stats for skipped song: %+v", stats)
+	}
+	if stats := songs[1].stats(); stats.PlayCount != 1 || stats.SkipCount != 0 {
+		t.Errorf("wrong stats for played song: %+v", stats)
+	}
+
+	// smart playlist rules can pick them out
+	tests := []struct {
+		rule string
+		want []bool
+	}{
+		{"'daap.songuserplaycount:1'", []bool{false, true}},
+		{"'daap.songuserskipcount:1'", []bool{true, false}},
+		{"'daap.songdateplayed:0'", []bool{true, false}},
+	}
+	for _, test := range tests {
+		query, err := parseQuery(test.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, song := range songs {
+			if got := query.matches(i+1, song); got != test.want[i] {
+				t.Errorf("%v matching %v, want %v, got %v", test.rule, song.Title, test.want[i], got)
+			}
+		}
+	}
+}
+
+func TestSetRating(t *testing.T) {
+	library := newLibrary([]Database{{name: "testdb", songs: []Song{{Title: "a", Path: "/music/a.mp3"}}}})
+	song := library.databases()[0].songs[0]
+	revision := library.revision()
+
+	if err := library.setRating(1, song, 80); err != nil {
+		t.Fatal(err)
+	}
+	if got := library.databases()[0].songs[0].stats().Rating; got != 80 {
+		t.Errorf("wrong rating: %v", got)
+	}
+	if library.revision() != revision+1 {
+		t.Errorf("revision not bumped, want %v, got %v", revision+1, library.revision())
+	}
+
+	if err := library.setRating(1, song, 101); err == nil {
+		t.Error("expected an error for a rating over 100")
+	}
+	if err := library.setRating(2, song, 20); err == nil {
+		t.Error("expected an error for a missing database")
+	}
+	if err := library.setRating(1, Song{Path: "/music/b.mp3"}, 20); err == nil {
+		t.Error("expected an error for a missing song")
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// albumTags are the tags that place a song on an album, the album artist,
+// compilation flag and disc number, along with its sort names.
+type albumTags struct {
+	albumArtist     string
+	compilation     bool
+	disc            int
+	sortArtist      string
+	sortAlbum       string
+	sortName        string
+	sortAlbumArtist string
+}
+
+// apply sets the tags on song. A disc number found from the song's folder is
+// kept if the file doesn't have one.
+func (t albumTags) apply(song Song) Song {
+	song.AlbumArtist = t.albumArtist
+	song.Compilation = t.compilation
+	if t.disc > 0 {
+		song.DiscNumber = t.disc
+	}
+	song.SortArtist = t.sortArtist
+	song.SortAlbum = t.sortAlbum
+	song.SortName = t.sortName
+	song.SortAlbumArtist = t.sortAlbumArtist
+	return song
+}
+
+// readAlbumTags reads the album tags of an MP3 or FLAC file. MP4 files have
+// theirs read along with their other tags, see readMP4Tags.
+func readAlbumTags(song Song) albumTags {
+	var read func(io.Reader) (albumTags, error)
+	switch song.format() {
+	case "mp3":
+		read = readID3Tags
+	case "flac":
+		read = readFLACTags
+	default:
+		return albumTags{}
+	}
+	f, err := os.Open(song.Path)
+	if err != nil {
+		return albumTags{}
+	}
+	defer f.Close()
+	tags, _ := read(f)
+	return tags
+}
+
+// id3AlbumFrames are where ID3v2.3 and 2.4 keep the album tags. TCMP and
+// TSO2 aren't standard but are what iTunes writes.
+var id3AlbumFrames = map[string]func(t *albumTags, value string){
+	"TPE2": func(t *albumTags, v string) { t.albumArtist = v },
+	"TCMP": func(t *albumTags, v string) { t.compilation = v == "1" },
+	"TPOS": func(t *albumTags, v string) { t.disc = parseDiscNumber(v) },
+	"TSOP": func(t *albumTags, v string) { t.sortArtist = v },
+	"TSOA": func(t *albumTags, v string) { t.sortAlbum = v },
+	"TSOT": func(t *albumTags, v string) { t.sortName = v },
+	"TSO2": func(t *albumTags, v string) { t.sortAlbumArtist = v },
+}
+
+// readID3Tags reads the album tags from an ID3v2.3 or 2.4 tag at the start
+// of r. A file without one has none.
+func readID3Tags(r io.Reader) (albumTags, error) {
+	tags := albumTags{}
+	var header [10]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return tags, err
+	}
+	if string(header[:3]) != "ID3" {
+		return tags, nil
+	}
+	version, flags := header[3], header[5]
+	if version != 3 && version != 4 {
+		return tags, fmt.Errorf("unsupported ID3v2.%v tag", version)
+	}
+	body := make([]byte, syncsafe(header[6:10]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return tags, err
+	}
+	if version == 3 && flags&0x80 != 0 {
+		body = unsynchronise(body)
+	}
+	if flags&0x40 != 0 {
+		// skip the extended header
+		if len(body) < 4 {
+			return tags, fmt.Errorf("short ID3 extended header")
+		}
+		size := int(binary.BigEndian.Uint32(body)) + 4
+		if version == 4 {
+			size = syncsafe(body[:4])
+		}
+		if size > len(body) {
+			return tags, fmt.Errorf("bad ID3 extended header size %v", size)
+		}
+		body = body[size:]
+	}
+
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		size := int(binary.BigEndian.Uint32(body[4:8]))
+		if version == 4 {
+			size = syncsafe(body[4:8])
+		}
+		frameFlags := body[9]
+		if size > len(body)-10 {
+			return tags, fmt.Errorf("bad %q frame size %v", id, size)
+		}
+		data := body[10 : 10+size]
+		body = body[10+size:]
+
+		set, ok := id3AlbumFrames[id]
+		if !ok {
+			continue
+		}
+		if version == 4 && frameFlags&0x02 != 0 {
+			data = unsynchronise(data)
+		}
+		if version == 4 && frameFlags&0x01 != 0 && len(data) >= 4 {
+			// data length indicator
+			data = data[4:]
+		}
+		set(&tags, decodeID3Text(data))
+	}
+	return tags, nil
+}
+
+// parseDiscNumber reads a disc number tag like "2" or "2/3", or 0 if there
+// isn't one.
+func parseDiscNumber(s string) int {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	disc, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || disc < 0 {
+		return 0
+	}
+	return disc
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// unsynchronise undoes ID3 unsynchronisation, which puts a zero after every
+// 0xff.
+func unsynchronise(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xff, 0x00}, []byte{0xff})
+}
+
+// decodeID3Text decodes a text frame, keeping only the first value if there
+// are several.
+func decodeID3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	encoding, text := data[0], data[1:]
+	var s string
+	switch encoding {
+	case 0:
+		// ISO-8859-1 maps straight to the first 256 code points
+		runes := make([]rune, len(text))
+		for i, b := range text {
+			runes[i] = rune(b)
+		}
+		s = string(runes)
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(text) >= 2 && text[0] == 0xff && text[1] == 0xfe {
+			bigEndian, text = false, text[2:]
+		} else if len(text) >= 2 && text[0] == 0xfe && text[1] == 0xff {
+			bigEndian, text = true, text[2:]
+		}
+		units := make([]uint16, len(text)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(text[2*i:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(text[2*i:])
+			}
+		}
+		s = string(utf16.Decode(units))
+	default:
+		s = string(text)
+	}
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// vorbisAlbumComments are the Vorbis comments FLAC files keep album tags in.
+var vorbisAlbumComments = map[string]func(t *albumTags, value string){
+	"ALBUMARTIST":     func(t *albumTags, v string) { t.albumArtist = v },
+	"ALBUM ARTIST":    func(t *albumTags, v string) { t.albumArtist = v },
+	"COMPILATION":     func(t *albumTags, v string) { t.compilation = v == "1" },
+	"DISCNUMBER":      func(t *albumTags, v string) { t.disc = parseDiscNumber(v) },
+	"ARTISTSORT":      func(t *albumTags, v string) { t.sortArtist = v },
+	"ALBUMSORT":       func(t *albumTags, v string) { t.sortAlbum = v },
+	"TITLESORT":       func(t *albumTags, v string) { t.sortName = v },
+	"ALBUMARTISTSORT": func(t *albumTags, v string) { t.sortAlbumArtist = v },
+}
+
+// readFLACTags reads the album tags from the Vorbis comment block of a
+// FLAC file.
+func readFLACTags(r io.Reader) (albumTags, error) {
+	tags := albumTags{}
+	var marker [4]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil {
+		return tags, err
+	}
+	if string(marker[:]) != "fLaC" {
+		return tags, fmt.Errorf("not a FLAC file")
+	}
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return tags, err
+		}
+		last, blockType := header[0]&0x80 != 0, header[0]&0x7f
+		size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		if blockType != 4 {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+				return tags, err
+			}
+			if last {
+				return tags, nil
+			}
+			continue
+		}
+
+		block := make([]byte, size)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return tags, err
+		}
+		next := func() (string, bool) {
+			if len(block) < 4 {
+				return "", false
+			}
+			n := int(binary.LittleEndian.Uint32(block))
+			if n > len(block)-4 {
+				return "", false
+			}
+			s := string(block[4 : 4+n])
+			block = block[4+n:]
+			return s, true
+		}
+		if _, ok := next(); !ok {
+			return tags, fmt.Errorf("bad vendor string in Vorbis comments")
+		}
+		if len(block) < 4 {
+			return tags, fmt.Errorf("short Vorbis comments")
+		}
+		count := int(binary.LittleEndian.Uint32(block))
+		block = block[4:]
+		for i := 0; i < count; i++ {
+			comment, ok := next()
+			if !ok {
+				return tags, fmt.Errorf("bad Vorbis comment %v", i+1)
+			}
+			eq := strings.IndexByte(comment, '=')
+			if eq < 0 {
+				continue
+			}
+			if set, ok := vorbisAlbumComments[strings.ToUpper(comment[:eq])]; ok {
+				set(&tags, strings.TrimSpace(comment[eq+1:]))
+			}
+		}
+		return tags, nil
+	}
+}
+
+// popmEmail identifies the POPM frame the server writes, as each player
+// keeps its own.
+const popmEmail = "audioserve"
+
+// popmRatings are the POPM ratings of 0 to 5 stars, as Windows Media Player
+// and most players since write them.
+var popmRatings = [6]byte{0, 1, 64, 128, 196, 255}
+
+// newTagPadding is left after a tag that has to grow, so the next change can
+// be written in place.
+const newTagPadding = 1024
+
+// statsTagWrites are the stats waiting to be written to each file by
+// queueStatsTags. Writes are done one at a time, and a file changed again
+// before its turn only has its latest stats written.
+var statsTagWrites = struct {
+	sync.Mutex
+	pending map[string]SongStats
+	writing sync.Mutex
+}{pending: map[string]SongStats{}}
+
+// queueStatsTags writes a song's stats back into its file in the background,
+// if the write_tags setting is on, as the file may have to be copied.
+func queueStatsTags(song Song, stats SongStats) {
+	if !currentShare().writeTags || song.Path == "" {
+		return
+	}
+	statsTagWrites.Lock()
+	statsTagWrites.pending[song.Path] = stats
+	statsTagWrites.Unlock()
+	go func() {
+		statsTagWrites.writing.Lock()
+		defer statsTagWrites.writing.Unlock()
+		statsTagWrites.Lock()
+		stats, ok := statsTagWrites.pending[song.Path]
+		delete(statsTagWrites.pending, song.Path)
+		statsTagWrites.Unlock()
+		if !ok {
+			return
+		}
+		if err := writeStatsTags(song, stats); err != nil {
+			log.Printf("cannot write stats to tags: %v", err)
+		}
+	}()
+}
+
+// writeStatsTags writes a song's rating and play count back into its file:
+// the server's POPM frame in an MP3's ID3 tag, or the RATING and PLAYCOUNT
+// Vorbis comments of a FLAC file. Other formats are left alone.
+func writeStatsTags(song Song, stats SongStats) error {
+	var build func(io.Reader, SongStats) ([]byte, int64, error)
+	switch song.format() {
+	case "mp3":
+		build = id3WithStats
+	case "flac":
+		build = flacWithStats
+	default:
+		return nil
+	}
+	f, err := os.Open(song.Path)
+	if err != nil {
+		return err
+	}
+	head, size, err := build(bufio.NewReader(f), stats)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%v: %v", song.Path, err)
+	}
+	return replaceHead(song.Path, size, head)
+}
+
+// replaceHead replaces the first size bytes of the file at path with head.
+// A head the same size is written in place, otherwise the file is copied
+// and renamed over the original.
+func replaceHead(path string, size int64, head []byte) error {
+	if int64(len(head)) == size {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(head, 0); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := in.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if _, err := out.Write(head); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Chmod(info.Mode()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// id3WithStats reads the ID3v2.3 or 2.4 tag at the start of r and returns
+// it with the server's POPM frame replaced, along with the size of the tag
+// it replaces. A file without a tag gets a new ID3v2.3 one. Extended headers
+// are dropped, as their CRC would no longer match.
+func id3WithStats(r io.Reader, stats SongStats) ([]byte, int64, error) {
+	var header [10]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, 0, err
+	}
+	if n < len(header) || string(header[:3]) != "ID3" {
+		return encodeID3Tag(3, 0, popmFrame(3, stats), newTagPadding), 0, nil
+	}
+	version, flags := header[3], header[5]
+	if version != 3 && version != 4 {
+		return nil, 0, fmt.Errorf("unsupported ID3v2.%v tag", version)
+	}
+	if flags&0x80 != 0 || flags&0x10 != 0 {
+		return nil, 0, fmt.Errorf("cannot write to an unsynchronised ID3 tag or one with a footer")
+	}
+	size := syncsafe(header[6:10])
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, err
+	}
+	if flags&0x40 != 0 {
+		if len(body) < 4 {
+			return nil, 0, fmt.Errorf("short ID3 extended header")
+		}
+		extended := int(binary.BigEndian.Uint32(body)) + 4
+		if version == 4 {
+			extended = syncsafe(body[:4])
+		}
+		if extended > len(body) {
+			return nil, 0, fmt.Errorf("bad ID3 extended header size %v", extended)
+		}
+		body = body[extended:]
+	}
+
+	frames := []byte{}
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		frameSize := int(binary.BigEndian.Uint32(body[4:8]))
+		if version == 4 {
+			frameSize = syncsafe(body[4:8])
+		}
+		if frameSize > len(body)-10 {
+			return nil, 0, fmt.Errorf("bad %q frame size %v", id, frameSize)
+		}
+		frame := body[:10+frameSize]
+		body = body[10+frameSize:]
+		if id == "POPM" && bytes.HasPrefix(frame[10:], []byte(popmEmail+"\x00")) {
+			continue
+		}
+		frames = append(frames, frame...)
+	}
+	frames = append(frames, popmFrame(version, stats)...)
+	padding := size - len(frames)
+	if padding < 0 {
+		padding = newTagPadding
+	}
+	return encodeID3Tag(version, flags&^0x40, frames, padding), int64(10 + size), nil
+}
+
+// popmFrame is the server's POPM frame for stats: the rating in stars and
+// the play count.
+func popmFrame(version byte, stats SongStats) []byte {
+	data := append([]byte(popmEmail), 0, popmRatings[(stats.Rating+10)/20])
+	data = append(data, byte(stats.PlayCount>>24), byte(stats.PlayCount>>16), byte(stats.PlayCount>>8), byte(stats.PlayCount))
+	frame := []byte("POPM")
+	if version == 4 {
+		frame = append(frame, syncsafeBytes(len(data))...)
+	} else {
+		frame = append(frame, byte(len(data)>>24), byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+	}
+	frame = append(frame, 0, 0)
+	return append(frame, data...)
+}
+
+func encodeID3Tag(version, flags byte, frames []byte, padding int) []byte {
+	tag := []byte{'I', 'D', '3', version, 0, flags}
+	tag = append(tag, syncsafeBytes(len(frames)+padding)...)
+	tag = append(tag, frames...)
+	return append(tag, make([]byte, padding)...)
+}
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+// flacBlock is a FLAC metadata block.
+type flacBlock struct {
+	kind byte
+	data []byte
+}
+
+// flacWithStats reads the metadata blocks of a FLAC file and returns them
+// with RATING and PLAYCOUNT set in the Vorbis comments, along with the size
+// of the metadata they replace. Padding makes room for the change where
+// there is enough of it, so the file can be written in place.
+func flacWithStats(r io.Reader, stats SongStats) ([]byte, int64, error) {
+	var marker [4]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil {
+		return nil, 0, err
+	}
+	if string(marker[:]) != "fLaC" {
+		return nil, 0, fmt.Errorf("not a FLAC file")
+	}
+	size := int64(len(marker))
+	blocks := []flacBlock{}
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, 0, err
+		}
+		n := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, 0, err
+		}
+		size += int64(len(header) + n)
+		blocks = append(blocks, flacBlock{header[0] & 0x7f, data})
+		if header[0]&0x80 != 0 {
+			break
+		}
+	}
+
+	found := false
+	for i, block := range blocks {
+		if block.kind != 4 {
+			continue
+		}
+		data, err := vorbisWithStats(block.data, stats)
+		if err != nil {
+			return nil, 0, err
+		}
+		blocks[i].data, found = data, true
+	}
+	if !found {
+		// after STREAMINFO, which has to come first
+		data, _ := vorbisWithStats(nil, stats)
+		blocks = append(blocks[:1], append([]flacBlock{{4, data}}, blocks[1:]...)...)
+	}
+
+	grown := int64(len(encodeFLACBlocks(blocks))) - size
+	padded := false
+	for i, block := range blocks {
+		if block.kind == 1 && int64(len(block.data)) >= grown {
+			blocks[i].data = make([]byte, int64(len(block.data))-grown)
+			padded = true
+			break
+		}
+	}
+	if !padded && grown != 0 {
+		blocks = append(blocks, flacBlock{1, make([]byte, newTagPadding)})
+	}
+	return encodeFLACBlocks(blocks), size, nil
+}
+
+func encodeFLACBlocks(blocks []flacBlock) []byte {
+	data := []byte("fLaC")
+	for i, block := range blocks {
+		kind := block.kind
+		if i == len(blocks)-1 {
+			kind |= 0x80
+		}
+		n := len(block.data)
+		data = append(data, kind, byte(n>>16), byte(n>>8), byte(n))
+		data = append(data, block.data...)
+	}
+	return data
+}
+
+// vorbisWithStats returns a Vorbis comment block with its RATING and
+// PLAYCOUNT comments replaced. RATING is from 0 to 100, as DAAP has it; a
+// rating or play count of 0 isn't written. Empty data is a new block.
+func vorbisWithStats(data []byte, stats SongStats) ([]byte, error) {
+	vendor := popmEmail
+	comments := []string{}
+	if len(data) > 0 {
+		next := func() (string, bool) {
+			if len(data) < 4 {
+				return "", false
+			}
+			n := int(binary.LittleEndian.Uint32(data))
+			if n > len(data)-4 {
+				return "", false
+			}
+			s := string(data[4 : 4+n])
+			data = data[4+n:]
+			return s, true
+		}
+		var ok bool
+		if vendor, ok = next(); !ok {
+			return nil, fmt.Errorf("bad vendor string in Vorbis comments")
+		}
+		if len(data) < 4 {
+			return nil, fmt.Errorf("short Vorbis comments")
+		}
+		count := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		for i := 0; i < count; i++ {
+			comment, ok := next()
+			if !ok {
+				return nil, fmt.Errorf("bad Vorbis comment %v", i+1)
+			}
+			name := comment
+			if eq := strings.IndexByte(comment, '='); eq >= 0 {
+				name = comment[:eq]
+			}
+			if name = strings.ToUpper(name); name != "RATING" && name != "PLAYCOUNT" {
+				comments = append(comments, comment)
+			}
+		}
+	}
+	if stats.Rating > 0 {
+		comments = append(comments, "RATING="+strconv.Itoa(stats.Rating))
+	}
+	if stats.PlayCount > 0 {
+		comments = append(comments, "PLAYCOUNT="+strconv.Itoa(stats.PlayCount))
+	}
+
+	block := []byte{}
+	add := func(s string) {
+		block = append(block, byte(len(s)), byte(len(s)>>8), byte(len(s)>>16), byte(len(s)>>24))
+		block = append(block, s...)
+	}
+	add(vendor)
+	block = append(block, byte(len(comments)), byte(len(comments)>>8), byte(len(comments)>>16), byte(len(comments)>>24))
+	for _, comment := range comments {
+		add(comment)
+	}
+	return block, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func id3Frame(version byte, id string, text []byte) []byte {
+	frame := []byte(id)
+	size := make([]byte, 4)
+	if version == 4 {
+		size = []byte{byte(len(text) >> 21 & 0x7f), byte(len(text) >> 14 & 0x7f), byte(len(text) >> 7 & 0x7f), byte(len(text) & 0x7f)}
+	} else {
+		binary.BigEndian.PutUint32(size, uint32(len(text)))
+	}
+	frame = append(frame, size...)
+	frame = append(frame, 0, 0)
+	return append(frame, text...)
+}
+
+func id3Tag(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	body = append(body, make([]byte, 16)...) // padding
+	n := len(body)
+	tag := []byte{'I', 'D', '3', version, 0, 0, byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+	return append(append(tag, body...), "audio"...)
+}
+
+func utf16Text(s string) []byte {
+	text := []byte{1, 0xff, 0xfe}
+	for _, unit := range utf16.Encode([]rune(s)) {
+		text = append(text, byte(unit), byte(unit>>8))
+	}
+	return append(text, 0, 0)
+}
+
+func TestReadID3SortTags(t *testing.T) {
+	want := albumTags{
+		albumArtist:     "Various Artists",
+		compilation:     true,
+		disc:            2,
+		sortArtist:      "Beatles, The",
+		sortAlbum:       "Abbey Road",
+		sortName:        "Éclipse",
+		sortAlbumArtist: "Various",
+	}
+	for _, version := range []byte{3, 4} {
+		data := id3Tag(version,
+			id3Frame(version, "TIT2", append([]byte{0}, "Come Together"...)),
+			id3Frame(version, "TPE2", append([]byte{0}, "Various Artists"...)),
+			id3Frame(version, "TCMP", append([]byte{0}, "1"...)),
+			id3Frame(version, "TPOS", append([]byte{0}, "2/3"...)),
+			id3Frame(version, "TSOP", utf16Text("Beatles, The")),
+			id3Frame(version, "TSOA", append([]byte{3}, "Abbey Road\x00Other"...)),
+			id3Frame(version, "TSOT", []byte{0, 0xc9, 'c', 'l', 'i', 'p', 's', 'e'}),
+			id3Frame(version, "TSO2", append([]byte{3}, "Various"...)),
+		)
+		tags, err := readID3Tags(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tags != want {
+			t.Errorf("ID3v2.%v: wrong tags, want %+v, got %+v", version, want, tags)
+		}
+	}
+
+	if tags, err := readID3Tags(bytes.NewReader([]byte("no tags here"))); err != nil || tags != (albumTags{}) {
+		t.Errorf("expected no tags and no error, got %+v %v", tags, err)
+	}
+	bad := id3Tag(3, id3Frame(3, "TSOP", []byte{0, 'x'}))
+	bad[14] = 0x7f // frame size beyond the tag
+	if _, err := readID3Tags(bytes.NewReader(bad)); err == nil {
+		t.Error("expected an error for a bad frame size")
+	}
+}
+
+func vorbisComments(comments ...string) []byte {
+	block := []byte{}
+	add := func(s string) {
+		n := make([]byte, 4)
+		binary.LittleEndian.PutUint32(n, uint32(len(s)))
+		block = append(block, n...)
+		block = append(block, s...)
+	}
+	add("test vendor")
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, uint32(len(comments)))
+	block = append(block, count...)
+	for _, comment := range comments {
+		add(comment)
+	}
+	return block
+}
+
+func flacFile(comments ...string) []byte {
+	data := []byte("fLaC")
+	streamInfo := make([]byte, 34)
+	data = append(data, 0, 0, 0, byte(len(streamInfo)))
+	data = append(data, streamInfo...)
+	block := vorbisComments(comments...)
+	data = append(data, 0x80|4, byte(len(block)>>16), byte(len(block)>>8), byte(len(block)))
+	data = append(data, block...)
+	return append(data, "audio"...)
+}
+
+func TestReadFLACSortTags(t *testing.T) {
+	data := flacFile("TITLE=Hoppípolla", "artistsort=Sigur Ros", "ALBUMSORT=Takk", "TITLESORT=Hoppipolla", "ALBUMARTIST=Sigur Rós", "ALBUMARTISTSORT=Sigur Ros", "DISCNUMBER=1", "COMPILATION=0", "broken")
+	tags, err := readFLACTags(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := albumTags{albumArtist: "Sigur Rós", disc: 1, sortArtist: "Sigur Ros", sortAlbum: "Takk", sortName: "Hoppipolla", sortAlbumArtist: "Sigur Ros"}
+	if tags != want {
+		t.Errorf("wrong tags, want %+v, got %+v", want, tags)
+	}
+
+	if _, err := readFLACTags(bytes.NewReader([]byte("ID3 not flac"))); err == nil {
+		t.Error("expected an error for a file that isn't FLAC")
+	}
+}
+
+func TestParseDiscNumber(t *testing.T) {
+	for in, want := range map[string]int{"2": 2, "2/3": 2, " 1 / 2 ": 1, "": 0, "two": 0, "-1": 0} {
+		if got := parseDiscNumber(in); got != want {
+			t.Errorf("parseDiscNumber(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestScanSortTags(t *testing.T) {
+	root := t.TempDir()
+	files := map[string][]byte{
+		"The Beatles/Abbey Road/01 Come Together.mp3": id3Tag(4, id3Frame(4, "TSOP", append([]byte{3}, "Beatles"...))),
+		"Sigur Rós/Takk/02 Hoppípolla.flac":           flacFile("ARTISTSORT=Sigur Ros"),
+	}
+	for file, data := range files {
+		path := filepath.Join(root, file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database, err := scanLibrary(LibraryConfig{Name: "Music", Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(database.songs) != 2 || database.songs[0].SortArtist != "Sigur Ros" || database.songs[1].SortArtist != "Beatles" {
+		t.Errorf("sort tags not read: %+v", database.songs)
+	}
+}
+
+// findPOPM finds the POPM frame with email in an ID3 tag written by
+// id3WithStats, returning its rating and play count.
+func findPOPM(t *testing.T, data []byte, email string) (byte, int, bool) {
+	if string(data[:3]) != "ID3" {
+		t.Fatalf("no ID3 tag: %q", data)
+	}
+	version := data[3]
+	body := data[10 : 10+syncsafe(data[6:10])]
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		size := int(binary.BigEndian.Uint32(body[4:8]))
+		if version == 4 {
+			size = syncsafe(body[4:8])
+		}
+		frame := body[10 : 10+size]
+		body = body[10+size:]
+		if id != "POPM" || !bytes.HasPrefix(frame, []byte(email+"\x00")) {
+			continue
+		}
+		frame = frame[len(email)+1:]
+		return frame[0], int(binary.BigEndian.Uint32(frame[1:5])), true
+	}
+	return 0, 0, false
+}
+
+func TestWriteID3Stats(t *testing.T) {
+	for _, version := range []byte{3, 4} {
+		path := filepath.Join(t.TempDir(), "song.mp3")
+		data := id3Tag(version,
+			id3Frame(version, "TPE2", append([]byte{0}, "Various Artists"...)),
+			id3Frame(version, "POPM", append([]byte("other@example.com\x00\x40"), 0, 0, 0, 9)))
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		song := Song{Path: path}
+
+		// too big for the padding, so the file is copied
+		if err := writeStatsTags(song, SongStats{Rating: 80, PlayCount: 3}); err != nil {
+			t.Fatal(err)
+		}
+		written, _ := ioutil.ReadFile(path)
+		if rating, count, ok := findPOPM(t, written, popmEmail); !ok || rating != 196 || count != 3 {
+			t.Errorf("v2.%v: wrong POPM %v %v %v", version, rating, count, ok)
+		}
+		if _, count, ok := findPOPM(t, written, "other@example.com"); !ok || count != 9 {
+			t.Errorf("v2.%v: another player's POPM lost", version)
+		}
+		if tags, err := readID3Tags(bytes.NewReader(written)); err != nil || tags.albumArtist != "Various Artists" {
+			t.Errorf("v2.%v: other tags lost: %+v %v", version, tags, err)
+		}
+		if !bytes.HasSuffix(written, []byte("audio")) {
+			t.Errorf("v2.%v: audio lost", version)
+		}
+
+		// now there's padding, so it's written in place
+		if err := writeStatsTags(song, SongStats{Rating: 100, PlayCount: 4}); err != nil {
+			t.Fatal(err)
+		}
+		rewritten, _ := ioutil.ReadFile(path)
+		if len(rewritten) != len(written) {
+			t.Errorf("v2.%v: file resized from %v to %v", version, len(written), len(rewritten))
+		}
+		if rating, count, ok := findPOPM(t, rewritten, popmEmail); !ok || rating != 255 || count != 4 {
+			t.Errorf("v2.%v: wrong POPM %v %v %v", version, rating, count, ok)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "untagged.mp3")
+	if err := ioutil.WriteFile(path, []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStatsTags(Song{Path: path}, SongStats{Rating: 20}); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := ioutil.ReadFile(path)
+	if rating, _, ok := findPOPM(t, written, popmEmail); !ok || rating != 1 || !bytes.HasSuffix(written, []byte("audio")) {
+		t.Errorf("no tag added: %q", written)
+	}
+}
+
+func TestWriteFLACStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "song.flac")
+	if err := ioutil.WriteFile(path, flacFile("ALBUMARTIST=Sigur Rós", "rating=20"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	comments := func(data []byte) []string {
+		blocks := data[4:]
+		for len(blocks) >= 4 {
+			n := int(blocks[1])<<16 | int(blocks[2])<<8 | int(blocks[3])
+			if blocks[0]&0x7f == 4 {
+				block := blocks[4 : 4+n]
+				block = block[4+binary.LittleEndian.Uint32(block):]
+				count := int(binary.LittleEndian.Uint32(block))
+				block = block[4:]
+				list := []string{}
+				for i := 0; i < count; i++ {
+					size := binary.LittleEndian.Uint32(block)
+					list = append(list, string(block[4:4+size]))
+					block = block[4+size:]
+				}
+				return list
+			}
+			blocks = blocks[4+n:]
+		}
+		return nil
+	}
+
+	song := Song{Path: path}
+	if err := writeStatsTags(song, SongStats{Rating: 80, PlayCount: 3}); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := ioutil.ReadFile(path)
+	want := []string{"ALBUMARTIST=Sigur Rós", "RATING=80", "PLAYCOUNT=3"}
+	if got := comments(written); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong comments %q, want %q", got, want)
+	}
+	if tags, err := readFLACTags(bytes.NewReader(written)); err != nil || tags.albumArtist != "Sigur Rós" {
+		t.Errorf("other tags lost: %+v %v", tags, err)
+	}
+	if !bytes.HasSuffix(written, []byte("audio")) {
+		t.Error("audio lost")
+	}
+
+	// padding was added, so this fits in place
+	if err := writeStatsTags(song, SongStats{PlayCount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, _ := ioutil.ReadFile(path)
+	if len(rewritten) != len(written) {
+		t.Errorf("file resized from %v to %v", len(written), len(rewritten))
+	}
+	want = []string{"ALBUMARTIST=Sigur Rós", "PLAYCOUNT=10"}
+	if got := comments(rewritten); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong comments %q, want %q", got, want)
+	}
+}
+
+func TestRatingWritesTags(t *testing.T) {
+	defer setShare(currentShare())
+	settings := currentShare()
+	settings.writeTags = true
+	setShare(settings)
+
+	path := filepath.Join(t.TempDir(), "song.mp3")
+	if err := ioutil.WriteFile(path, []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	library := newLibrary([]Database{{name: "testdb", songs: []Song{{Title: "song", Path: path}}}})
+	if err := library.setRating(1, library.databases()[0].songs[0], 60); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := ioutil.ReadFile(path)
+		if bytes.HasPrefix(data, []byte("ID3")) {
+			if rating, _, ok := findPOPM(t, data, popmEmail); !ok || rating != 128 {
+				t.Errorf("wrong rating written %v %v", rating, ok)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rating never written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
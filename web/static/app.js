@@ -0,0 +1,190 @@
+// A small player for the JSON API. It lists artists, albums and playlists,
+// shows their songs and plays them one after another with an audio element.
+(function () {
+  "use strict";
+
+  var api = window.apiBase;
+  var pageSize = 100;
+  var state = {database: 1, view: "artists", songs: [], params: null, total: 0, playing: -1};
+
+  var databaseSelect = document.getElementById("database");
+  var search = document.getElementById("search");
+  var list = document.getElementById("list");
+  var songTable = document.getElementById("songs");
+  var songRows = songTable.querySelector("tbody");
+  var more = document.getElementById("more");
+  var player = document.getElementById("player");
+  var playing = document.getElementById("playing");
+
+  function get(path, params) {
+    var query = new URLSearchParams(params || {}).toString();
+    return fetch(api + path + (query ? "?" + query : ""), {credentials: "same-origin"}).then(function (resp) {
+      if (!resp.ok) {
+        throw new Error(path + ": " + resp.status);
+      }
+      return resp.json();
+    });
+  }
+
+  function databasePath(path) {
+    return "/databases/" + state.database + path;
+  }
+
+  function formatTime(ms) {
+    if (!ms) {
+      return "";
+    }
+    var seconds = Math.round(ms / 1000);
+    return Math.floor(seconds / 60) + ":" + ("0" + seconds % 60).slice(-2);
+  }
+
+  function showList(items, label, open) {
+    list.textContent = "";
+    songTable.hidden = true;
+    more.hidden = true;
+    list.hidden = false;
+    items.forEach(function (item) {
+      var li = document.createElement("li");
+      li.textContent = label(item);
+      var count = document.createElement("small");
+      count.textContent = item.songs + (item.songs === 1 ? " song" : " songs");
+      li.appendChild(count);
+      li.addEventListener("click", function () {
+        open(item);
+      });
+      list.appendChild(li);
+    });
+  }
+
+  function showSongs(path, params) {
+    state.songs = [];
+    state.path = path;
+    state.params = params;
+    list.hidden = true;
+    songTable.hidden = false;
+    songRows.textContent = "";
+    loadMore();
+  }
+
+  function loadMore() {
+    var params = Object.assign({offset: state.songs.length, limit: pageSize}, state.params);
+    get(state.path, params).then(function (page) {
+      state.total = page.total;
+      page.songs.forEach(function (song) {
+        var index = state.songs.length;
+        state.songs.push(song);
+        var tr = document.createElement("tr");
+        [song.track_number || "", song.title, song.artist || "", song.album || "", formatTime(song.duration_ms)].forEach(function (text) {
+          var td = document.createElement("td");
+          td.textContent = text;
+          tr.appendChild(td);
+        });
+        tr.addEventListener("click", function () {
+          play(index);
+        });
+        songRows.appendChild(tr);
+      });
+      more.hidden = state.songs.length >= state.total;
+    }).catch(showError);
+  }
+
+  function play(index) {
+    var song = state.songs[index];
+    if (!song) {
+      return;
+    }
+    var rows = songRows.querySelectorAll("tr");
+    if (state.playing >= 0 && rows[state.playing]) {
+      rows[state.playing].classList.remove("playing");
+    }
+    state.playing = index;
+    rows[index].classList.add("playing");
+    playing.textContent = song.title + (song.artist ? " — " + song.artist : "");
+    player.src = song.stream_url;
+    player.play();
+  }
+
+  function showError(err) {
+    playing.textContent = err.message;
+  }
+
+  function showView(view) {
+    state.view = view;
+    document.querySelectorAll("nav button").forEach(function (button) {
+      button.classList.toggle("selected", button.dataset.view === view);
+    });
+    if (search.value) {
+      showSongs(databasePath("/songs"), {q: search.value});
+      return;
+    }
+    switch (view) {
+    case "artists":
+      get(databasePath("/artists")).then(function (artists) {
+        showList(artists, function (artist) {
+          return artist.name || "Unknown Artist";
+        }, function (artist) {
+          showSongs(databasePath("/songs"), {artist: artist.name, sort: "album,track_number"});
+        });
+      }).catch(showError);
+      break;
+    case "albums":
+      get(databasePath("/albums")).then(function (albums) {
+        showList(albums, function (album) {
+          return album.name + (album.artist ? " — " + album.artist : "");
+        }, function (album) {
+          showSongs(databasePath("/songs"), {album: album.name, artist: album.artist, sort: "track_number"});
+        });
+      }).catch(showError);
+      break;
+    case "playlists":
+      get(databasePath("/playlists")).then(function (playlists) {
+        showList(playlists, function (playlist) {
+          return playlist.name;
+        }, function (playlist) {
+          showSongs(databasePath("/playlists/" + playlist.id + "/songs"), {});
+        });
+      }).catch(showError);
+      break;
+    default:
+      showSongs(databasePath("/songs"), {sort: "artist,album,track_number"});
+    }
+  }
+
+  document.querySelectorAll("nav button").forEach(function (button) {
+    button.addEventListener("click", function () {
+      search.value = "";
+      showView(button.dataset.view);
+    });
+  });
+
+  var searchTimer;
+  search.addEventListener("input", function () {
+    clearTimeout(searchTimer);
+    searchTimer = setTimeout(function () {
+      showView(state.view);
+    }, 300);
+  });
+
+  databaseSelect.addEventListener("change", function () {
+    state.database = databaseSelect.value;
+    showView(state.view);
+  });
+
+  more.addEventListener("click", loadMore);
+
+  player.addEventListener("ended", function () {
+    if (state.playing + 1 < state.songs.length) {
+      play(state.playing + 1);
+    }
+  });
+
+  get("/databases").then(function (databases) {
+    databases.forEach(function (database) {
+      var option = document.createElement("option");
+      option.value = database.id;
+      option.textContent = database.name;
+      databaseSelect.appendChild(option);
+    });
+    showView(state.view);
+  }).catch(showError);
+})();
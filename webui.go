@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// The web player is a page at /admin/web that uses the JSON API to browse
+// the library and plays songs from the DAAP stream URLs with an audio element.
+// It takes the admin password, so it's only for the people running the server.
+
+//go:embed web
+var webFiles embed.FS
+
+// webAsset is a static file with the hash used to bust caches when it
+// changes.
+type webAsset struct {
+	data []byte
+	hash string
+}
+
+var webAssets = loadWebAssets()
+
+var webIndex = template.Must(template.New("index.html").Funcs(template.FuncMap{
+	"asset": assetURL,
+}).ParseFS(webFiles, "web/index.html"))
+
+// startTime is given as the modification time of the embedded files, which
+// don't have one.
+var startTime = time.Now()
+
+func loadWebAssets() map[string]webAsset {
+	assets := map[string]webAsset{}
+	err := fs.WalkDir(webFiles, "web/static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := webFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		assets[strings.TrimPrefix(name, "web/static/")] = webAsset{data: data, hash: fmt.Sprintf("%x", sum[:8])}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return assets
+}
+
+// assetURL is where the page loads a static file from. The hash changes with
+// the file, so the file can be cached for good.
+func assetURL(name string) (string, error) {
+	asset, ok := webAssets[name]
+	if !ok {
+		return "", fmt.Errorf("no web asset %v", name)
+	}
+	return "/admin/web/static/" + name + "?v=" + asset.hash, nil
+}
+
+func webIndexHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	err := webIndex.Execute(&buf, struct {
+		Name    string
+		APIBase string
+	}{currentShare().name, "/api/v1"})
+	if err != nil {
+		log.Printf("cannot render web player: %v", err)
+		http.Error(w, "cannot render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the page names the current assets, so always check it's up to date
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+func webStaticHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/web/static/")
+	asset, ok := webAssets[name]
+	if !ok {
+		http.Error(w, r.RequestURI+" not found", http.StatusNotFound)
+		return
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", `"`+asset.hash+`"`)
+	if r.URL.Query().Get("v") == asset.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, startTime, bytes.NewReader(asset.data))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// webRequest is a request for the web player with the admin password.
+func webRequest(uri string) *http.Request {
+	req := httptest.NewRequest("GET", uri, nil)
+	req.SetBasicAuth("", "admin")
+	return req
+}
+
+func TestWebIndex(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "Bob's <Music>", adminPassword: "admin", gzip: true})
+
+	router := routes(nil, newLibrary(nil), nil, nil, nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, webRequest("/admin/web"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status: %v", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("wrong content type: %v", ct)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("wrong cache control: %v", cc)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		"<title>Bob&#39;s &lt;Music&gt;</title>",
+		`src="/admin/web/static/app.js?v=` + webAssets["app.js"].hash + `"`,
+		`href="/admin/web/static/style.css?v=` + webAssets["style.css"].hash + `"`,
+		`window.apiBase = "/api/v1";`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %v in:\n%v", want, body)
+		}
+	}
+}
+
+func TestWebStatic(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "testdb", adminPassword: "admin"})
+
+	router := routes(nil, newLibrary(nil), nil, nil, nil)
+	hash := webAssets["app.js"].hash
+
+	tests := []struct {
+		uri          string
+		ifNoneMatch  string
+		status       int
+		cacheControl string
+	}{
+		{"/admin/web/static/app.js?v=" + hash, "", http.StatusOK, "public, max-age=31536000, immutable"},
+		{"/admin/web/static/app.js", "", http.StatusOK, "no-cache"},
+		{"/admin/web/static/app.js?v=old", "", http.StatusOK, "no-cache"},
+		{"/admin/web/static/app.js?v=" + hash, `"` + hash + `"`, http.StatusNotModified, "public, max-age=31536000, immutable"},
+		{"/admin/web/static/nope.js", "", http.StatusNotFound, ""},
+		{"/admin/web/static/../index.html", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		req := webRequest(test.uri)
+		if test.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%v: wrong status %v, want %v", test.uri, rr.Code, test.status)
+		}
+		if cc := rr.Header().Get("Cache-Control"); cc != test.cacheControl {
+			t.Errorf("%v: wrong cache control %q, want %q", test.uri, cc, test.cacheControl)
+		}
+		if test.status == http.StatusOK {
+			if ct := rr.Header().Get("Content-Type"); !strings.Contains(ct, "javascript") {
+				t.Errorf("%v: wrong content type %v", test.uri, ct)
+			}
+			if rr.Body.String() != string(webAssets["app.js"].data) {
+				t.Errorf("%v: wrong body", test.uri)
+			}
+		}
+	}
+}
+
+func TestWebStaticGzip(t *testing.T) {
+	defer setShare(currentShare())
+	setShare(shareSettings{name: "testdb", adminPassword: "admin", gzip: true})
+
+	router := routes(nil, newLibrary(nil), nil, nil, nil)
+	req := webRequest("/admin/web/static/app.js")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("not compressed: %v", rr.Header())
+	}
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(webAssets["app.js"].data) {
+		t.Error("wrong body")
+	}
+}
+
+func TestWebPassword(t *testing.T) {
+	defer setShare(currentShare())
+	router := routes(nil, newLibrary(nil), nil, nil, nil)
+
+	setShare(shareSettings{name: "testdb", password: "secret"})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/web", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected the web player to be off without an admin password, got %v", rr.Code)
+	}
+
+	setShare(shareSettings{name: "testdb", password: "admin", adminPassword: "letmein"})
+	for _, uri := range []string{"/admin/web", "/admin/web/static/app.js"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, webRequest(uri))
+		if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%v: wrong response %v %v", uri, rr.Code, rr.Header())
+		}
+	}
+}